@@ -0,0 +1,87 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+
+// Conditions and condition Reasons for the TinkerbellMachine object.
+
+const (
+	// BMCReachableCondition reports whether the health of the machine's hardware could be read from its BMC.
+	BMCReachableCondition clusterv1.ConditionType = "BMCReachable"
+
+	// BMCUnreachableReason (Severity=Warning) documents the BMC of the machine's hardware not answering health queries.
+	BMCUnreachableReason = "BMCUnreachable"
+
+	// BMCNotConfiguredReason (Severity=Info) documents the machine's hardware having no usable BMC reference.
+	BMCNotConfiguredReason = "BMCNotConfigured"
+)
+
+const (
+	// PowerSupplyHealthyCondition reports the health of the power supplies as reported by the BMC.
+	PowerSupplyHealthyCondition clusterv1.ConditionType = "PowerSupplyHealthy"
+
+	// PowerSupplyFaultReason documents the BMC reporting a degraded or failed power supply.
+	PowerSupplyFaultReason = "PowerSupplyFault"
+)
+
+const (
+	// MemoryHealthyCondition reports the health of the memory as reported by the BMC, e.g. ECC errors.
+	MemoryHealthyCondition clusterv1.ConditionType = "MemoryHealthy"
+
+	// MemoryFaultReason documents the BMC reporting degraded or failed memory.
+	MemoryFaultReason = "MemoryFault"
+)
+
+const (
+	// ThermalHealthyCondition reports the health of temperature sensors and fans as reported by the BMC.
+	ThermalHealthyCondition clusterv1.ConditionType = "ThermalHealthy"
+
+	// ThermalFaultReason documents the BMC reporting a thermal alarm or a failed fan.
+	ThermalFaultReason = "ThermalFault"
+)
+
+const (
+	// ProvisionedCondition reports whether the machine's Hardware has been provisioned.
+	ProvisionedCondition clusterv1.ConditionType = "Provisioned"
+
+	// AllocationTimeoutReason (Severity=Error) documents no Hardware becoming available for the machine in time.
+	AllocationTimeoutReason = "AllocationTimeout"
+
+	// PowerOnTimeoutReason (Severity=Error) documents the BMC Job powering the Hardware on not completing in time.
+	PowerOnTimeoutReason = "PowerOnTimeout"
+
+	// WorkflowStartTimeoutReason (Severity=Error) documents tink-worker not starting the workflow in time.
+	WorkflowStartTimeoutReason = "WorkflowStartTimeout"
+
+	// WorkflowRunTimeoutReason (Severity=Error) documents the workflow not completing in time.
+	WorkflowRunTimeoutReason = "WorkflowRunTimeout"
+
+	// PXERetriesExhaustedReason (Severity=Error) documents the workflow not being started after all PXE retries.
+	PXERetriesExhaustedReason = "PXERetriesExhausted"
+)
+
+const (
+	// TinkerbellStackAvailableCondition reports whether the Tinkerbell stack of the machine's failure domain
+	// can be reached.
+	TinkerbellStackAvailableCondition clusterv1.ConditionType = "TinkerbellStackAvailable"
+
+	// TinkerbellStackUnavailableReason (Severity=Warning) documents the Tinkerbell stack of a machine being
+	// deleted not being reachable, e.g. because its kubeconfig Secret is gone. The machine is not deleted
+	// until the stack is reachable again, or the AbandonStackObjectsAnnotation is set.
+	TinkerbellStackUnavailableReason = "TinkerbellStackUnavailable"
+)
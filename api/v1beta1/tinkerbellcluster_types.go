@@ -17,6 +17,7 @@ limitations under the License.
 package v1beta1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 )
@@ -68,6 +69,167 @@ type TinkerbellClusterSpec struct {
 	// images. If not set it will default based on ImageLookupOSDistro.
 	// +optional
 	ImageLookupOSVersion string `json:"imageLookupOSVersion,omitempty"`
+
+	// FailureDomains maps failure domains to the Tinkerbell stack serving them. Machines placed in
+	// one of these failure domains get their Hardware, Templates, Workflows and BMC Jobs from the
+	// stack of the failure domain. Machines without a failure domain use the Tinkerbell stack of
+	// the management cluster.
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	FailureDomains []TinkerbellFailureDomain `json:"failureDomains,omitempty"`
+
+	// CloudInitParts are cloud-init parts added to the bootstrap data of all machines of the
+	// cluster, before the parts of the TinkerbellMachine.
+	// +optional
+	CloudInitParts []CloudInitPart `json:"cloudInitParts,omitempty"`
+
+	// RemediationReserve holds Hardware aside for replacing machines of the cluster remediated by
+	// a MachineHealthCheck, so replacements don't wait for Hardware to be freed in a shared pool.
+	// +optional
+	RemediationReserve *RemediationReserve `json:"remediationReserve,omitempty"`
+
+	// ScaleDownPolicy ranks the machines of the MachineSets of the cluster by their Hardware, so
+	// scale-downs delete the machines on the least desirable Hardware first.
+	// +optional
+	ScaleDownPolicy *ScaleDownPolicy `json:"scaleDownPolicy,omitempty"`
+
+	// MetadataTLS makes the machines of the cluster read their metadata, including their bootstrap
+	// data, from the Tinkerbell metadata service over https.
+	// +optional
+	MetadataTLS *MetadataTLS `json:"metadataTLS,omitempty"`
+
+	// Exclusivity gives the cluster exclusive use of the topology domains, e.g. racks, its machines
+	// run in. Hardware in a domain occupied by the cluster is not selected for other clusters, and
+	// the cluster doesn't select Hardware in domains used by other clusters.
+	// +optional
+	Exclusivity *TopologyExclusivity `json:"exclusivity,omitempty"`
+}
+
+// TopologyExclusivity defines the topology domains a cluster uses exclusively.
+type TopologyExclusivity struct {
+	// TopologyLabel is the Hardware label holding the topology domain of the Hardware, e.g. its rack.
+	// +kubebuilder:validation:MinLength=1
+	TopologyLabel string `json:"topologyLabel"`
+}
+
+// MetadataTLS defines how provisioned machines reach and verify the metadata service over https.
+type MetadataTLS struct {
+	// URL is the https URL of the metadata service. If not set, port 50061 of TINKERBELL_IP is used.
+	// The metadataURL of failure domains takes precedence.
+	// +optional
+	URL string `json:"url,omitempty"`
+
+	// CABundle references the PEM encoded CA certificates the certificate of the metadata service
+	// is verified with. The default template adds them to the trust store of provisioned machines
+	// and to their cloud-init ca_certs configuration.
+	CABundle CABundleSource `json:"caBundle"`
+}
+
+// CABundleSource references a key holding a CA bundle in the namespace of the TinkerbellCluster.
+// Exactly one of SecretKeyRef and ConfigMapKeyRef must be set.
+type CABundleSource struct {
+	// SecretKeyRef selects a key of a Secret.
+	// +optional
+	SecretKeyRef *corev1.SecretKeySelector `json:"secretKeyRef,omitempty"`
+
+	// ConfigMapKeyRef selects a key of a ConfigMap.
+	// +optional
+	ConfigMapKeyRef *corev1.ConfigMapKeySelector `json:"configMapKeyRef,omitempty"`
+}
+
+// ScaleDownCriterion is a property of the Hardware of a machine ranking it for deletion.
+// +kubebuilder:validation:Enum=HardwareHealth;HardwareGeneration;AffinityScore;RackSpread
+type ScaleDownCriterion string
+
+const (
+	// ScaleDownHardwareHealth ranks machines whose BMC reports a hardware fault first, as their
+	// Hardware is about to be quarantined.
+	ScaleDownHardwareHealth ScaleDownCriterion = "HardwareHealth"
+
+	// ScaleDownHardwareGeneration ranks machines on the oldest Hardware generation first.
+	ScaleDownHardwareGeneration ScaleDownCriterion = "HardwareGeneration"
+
+	// ScaleDownAffinityScore ranks machines whose Hardware matches the fewest preferred hardware
+	// affinity terms of the TinkerbellMachine first.
+	ScaleDownAffinityScore ScaleDownCriterion = "AffinityScore"
+
+	// ScaleDownRackSpread ranks machines in the racks holding the most machines of the MachineSet first.
+	ScaleDownRackSpread ScaleDownCriterion = "RackSpread"
+)
+
+// ScaleDownPolicy defines how the machine deleted first on scale-down is picked. The machine ranked
+// first is annotated with cluster.x-k8s.io/delete-machine, which MachineSets delete first.
+type ScaleDownPolicy struct {
+	// Criteria rank the machines, each criterion breaking the ties of the previous one.
+	// +kubebuilder:validation:MinItems=1
+	Criteria []ScaleDownCriterion `json:"criteria"`
+
+	// GenerationLabel is the Hardware label holding the generation of the Hardware, required by
+	// the HardwareGeneration criterion. Generations are compared as numbers if they all are, and
+	// as strings otherwise.
+	// +optional
+	GenerationLabel string `json:"generationLabel,omitempty"`
+
+	// RackLabel is the Hardware label holding the rack of the Hardware, required by the RackSpread
+	// criterion.
+	// +optional
+	RackLabel string `json:"rackLabel,omitempty"`
+}
+
+// RemediationReserve defines the Hardware reserved for replacing remediated machines of a cluster.
+// Reserved Hardware is not selected for any other machine. It is refilled once consumed.
+type RemediationReserve struct {
+	// Size is the number of Hardware held in reserve.
+	// +kubebuilder:validation:Minimum=1
+	Size int32 `json:"size"`
+
+	// HardwareAffinity selects the Hardware which may be reserved.
+	// +optional
+	HardwareAffinity *HardwareAffinity `json:"hardwareAffinity,omitempty"`
+}
+
+// TinkerbellFailureDomain describes a failure domain and how to reach the Tinkerbell stack serving it.
+type TinkerbellFailureDomain struct {
+	// Name is the name of the failure domain, as referenced by Machine.Spec.FailureDomain.
+	Name string `json:"name"`
+
+	// ControlPlane determines if the failure domain is suitable for use by control plane machines.
+	// +optional
+	ControlPlane bool `json:"controlPlane,omitempty"`
+
+	// Attributes is a free form map of attributes published with the failure domain.
+	// +optional
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// KubeconfigSecretRef references a Secret in the namespace of the TinkerbellCluster holding,
+	// under the "value" key, a kubeconfig for the cluster running the Tinkerbell stack of the
+	// failure domain. If not set, the Tinkerbell stack runs in the management cluster.
+	// +optional
+	KubeconfigSecretRef *corev1.LocalObjectReference `json:"kubeconfigSecretRef,omitempty"`
+
+	// HardwareNamespace is the namespace holding the Hardware, Templates, Workflows and BMC Jobs
+	// of the failure domain. If not set, the namespace of the TinkerbellMachine is used.
+	// +optional
+	HardwareNamespace string `json:"hardwareNamespace,omitempty"`
+
+	// MetadataURL is the URL of the Tinkerbell metadata service of the failure domain, which
+	// provisioned machines read their metadata from. If not set, the metadata service of the
+	// management cluster stack is used. IPv6 addresses must be enclosed in brackets, e.g.
+	// http://[fd00::1]:50061.
+	// +optional
+	MetadataURL string `json:"metadataURL,omitempty"`
+}
+
+// FailureDomain returns the failure domain with the given name, or nil if there is none.
+func (s *TinkerbellClusterSpec) FailureDomain(name string) *TinkerbellFailureDomain {
+	for i := range s.FailureDomains {
+		if s.FailureDomains[i].Name == name {
+			return &s.FailureDomains[i]
+		}
+	}
+
+	return nil
 }
 
 // TinkerbellClusterStatus defines the observed state of TinkerbellCluster.
@@ -78,6 +240,19 @@ type TinkerbellClusterStatus struct {
 	// Ready denotes that the cluster (infrastructure) is ready.
 	// +optional
 	Ready bool `json:"ready"`
+
+	// FailureDomains lists the failure domains Machines of the cluster can be placed in.
+	// +optional
+	FailureDomains clusterv1.FailureDomains `json:"failureDomains,omitempty"`
+
+	// ReservedHardware lists the Hardware currently held in the remediation reserve.
+	// +optional
+	ReservedHardware []string `json:"reservedHardware,omitempty"`
+
+	// ClaimedTopologyValues lists the values of the exclusivity topology label claimed by the
+	// cluster. They are released when the last machine of the cluster goes away.
+	// +optional
+	ClaimedTopologyValues []string `json:"claimedTopologyValues,omitempty"`
 }
 
 // +kubebuilder:subresource:status
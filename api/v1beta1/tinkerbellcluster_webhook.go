@@ -17,9 +17,11 @@ limitations under the License.
 package v1beta1
 
 import (
+	"net/url"
 	"strings"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	ctrl "sigs.k8s.io/controller-runtime"
 )
 
@@ -38,12 +40,12 @@ func (c *TinkerbellCluster) SetupWebhookWithManager(mgr ctrl.Manager) error {
 
 // ValidateCreate implements webhook.Validator so a webhook will be registered for the type.
 func (c *TinkerbellCluster) ValidateCreate() error {
-	return nil
+	return aggregateObjErrors(c.GroupVersionKind().GroupKind(), c.Name, c.validateSpec())
 }
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type.
 func (c *TinkerbellCluster) ValidateUpdate(oldRaw runtime.Object) error {
-	return nil
+	return aggregateObjErrors(c.GroupVersionKind().GroupKind(), c.Name, c.validateSpec())
 }
 
 // ValidateDelete implements webhook.Validator so a webhook will be registered for the type.
@@ -51,6 +53,95 @@ func (c *TinkerbellCluster) ValidateDelete() error {
 	return nil
 }
 
+func (c *TinkerbellCluster) validateSpec() field.ErrorList {
+	allErrs := validateCloudInitParts(field.NewPath("spec", "cloudInitParts"), c.Spec.CloudInitParts)
+
+	allErrs = append(allErrs, validateScaleDownPolicy(field.NewPath("spec", "scaleDownPolicy"), c.Spec.ScaleDownPolicy)...)
+
+	for i, failureDomain := range c.Spec.FailureDomains {
+		path := field.NewPath("spec", "failureDomains").Index(i).Child("metadataURL")
+
+		allErrs = append(allErrs, validateMetadataURL(path, failureDomain.MetadataURL)...)
+
+		secure := strings.HasPrefix(failureDomain.MetadataURL, "https://")
+		if c.Spec.MetadataTLS != nil && failureDomain.MetadataURL != "" && !secure {
+			allErrs = append(allErrs, field.Invalid(path, failureDomain.MetadataURL, "must be an https URL with metadataTLS"))
+		}
+	}
+
+	allErrs = append(allErrs, validateMetadataTLS(field.NewPath("spec", "metadataTLS"), c.Spec.MetadataTLS)...)
+
+	return allErrs
+}
+
+func validateMetadataTLS(path *field.Path, metadataTLS *MetadataTLS) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if metadataTLS == nil {
+		return allErrs
+	}
+
+	if metadataTLS.URL != "" {
+		allErrs = append(allErrs, validateMetadataURL(path.Child("url"), metadataTLS.URL)...)
+
+		if !strings.HasPrefix(metadataTLS.URL, "https://") {
+			allErrs = append(allErrs, field.Invalid(path.Child("url"), metadataTLS.URL, "must be an https URL"))
+		}
+	}
+
+	caBundle := metadataTLS.CABundle
+	if (caBundle.SecretKeyRef == nil) == (caBundle.ConfigMapKeyRef == nil) {
+		allErrs = append(allErrs, field.Invalid(path.Child("caBundle"), "",
+			"exactly one of secretKeyRef and configMapKeyRef must be set"))
+	}
+
+	return allErrs
+}
+
+// validateMetadataURL checks the metadata URL is an http or https URL. IPv6 hosts must be
+// enclosed in brackets, e.g. http://[fd00::1]:50061.
+func validateMetadataURL(path *field.Path, metadataURL string) field.ErrorList {
+	if metadataURL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(metadataURL)
+	if err != nil {
+		return field.ErrorList{field.Invalid(path, metadataURL, err.Error())}
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return field.ErrorList{field.Invalid(path, metadataURL, "must be an http or https URL")}
+	}
+
+	if strings.Count(u.Host, ":") > 1 && !strings.HasPrefix(u.Host, "[") {
+		return field.ErrorList{field.Invalid(path, metadataURL, "IPv6 addresses must be enclosed in brackets")}
+	}
+
+	return nil
+}
+
+func validateScaleDownPolicy(path *field.Path, policy *ScaleDownPolicy) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if policy == nil {
+		return allErrs
+	}
+
+	for _, criterion := range policy.Criteria {
+		switch {
+		case criterion == ScaleDownHardwareGeneration && policy.GenerationLabel == "":
+			allErrs = append(allErrs, field.Required(path.Child("generationLabel"),
+				"generationLabel is required by the HardwareGeneration criterion"))
+		case criterion == ScaleDownRackSpread && policy.RackLabel == "":
+			allErrs = append(allErrs, field.Required(path.Child("rackLabel"),
+				"rackLabel is required by the RackSpread criterion"))
+		}
+	}
+
+	return allErrs
+}
+
 func defaultVersionForOSDistro(distro string) string {
 	if strings.ToLower(distro) == osUbuntu {
 		return defaultUbuntuVersion
@@ -0,0 +1,91 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+)
+
+func Test_tinkerbell_cluster_failure_domain_metadata_url(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	clusterWithMetadataURL := func(metadataURL string) *v1beta1.TinkerbellCluster {
+		return &v1beta1.TinkerbellCluster{
+			Spec: v1beta1.TinkerbellClusterSpec{
+				FailureDomains: []v1beta1.TinkerbellFailureDomain{{Name: "rack-a", MetadataURL: metadataURL}},
+			},
+		}
+	}
+
+	for _, metadataURL := range []string{
+		"",
+		"http://10.1.0.1:50061",
+		"http://[fd00::1]:50061",
+		"https://metadata.example.com",
+	} {
+		g.Expect(clusterWithMetadataURL(metadataURL).ValidateCreate()).To(Succeed(), metadataURL)
+	}
+
+	for _, metadataURL := range []string{
+		"http://fd00::1:50061",
+		"ftp://10.1.0.1",
+		"10.1.0.1:50061",
+	} {
+		g.Expect(clusterWithMetadataURL(metadataURL).ValidateCreate()).NotTo(Succeed(), metadataURL)
+	}
+}
+
+func Test_tinkerbell_cluster_metadata_tls(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	secretCA := v1beta1.CABundleSource{SecretKeyRef: &corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: "hegel-ca"}, Key: "ca.crt",
+	}}
+	configMapCA := v1beta1.CABundleSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: "hegel-ca"}, Key: "ca.crt",
+	}}
+
+	clusterWithMetadataTLS := func(metadataTLS v1beta1.MetadataTLS, failureDomainURL string) *v1beta1.TinkerbellCluster {
+		return &v1beta1.TinkerbellCluster{
+			Spec: v1beta1.TinkerbellClusterSpec{
+				MetadataTLS:    &metadataTLS,
+				FailureDomains: []v1beta1.TinkerbellFailureDomain{{Name: "rack-a", MetadataURL: failureDomainURL}},
+			},
+		}
+	}
+
+	g.Expect(clusterWithMetadataTLS(v1beta1.MetadataTLS{CABundle: secretCA}, "").ValidateCreate()).To(Succeed())
+	g.Expect(clusterWithMetadataTLS(v1beta1.MetadataTLS{URL: "https://[fd00::1]:50061", CABundle: configMapCA},
+		"https://10.1.0.1:50061").ValidateCreate()).To(Succeed())
+
+	g.Expect(clusterWithMetadataTLS(v1beta1.MetadataTLS{}, "").ValidateCreate()).NotTo(Succeed(),
+		"a CA bundle source is required")
+	g.Expect(clusterWithMetadataTLS(v1beta1.MetadataTLS{
+		CABundle: v1beta1.CABundleSource{SecretKeyRef: secretCA.SecretKeyRef, ConfigMapKeyRef: configMapCA.ConfigMapKeyRef},
+	}, "").ValidateCreate()).NotTo(Succeed(), "only one CA bundle source may be set")
+	g.Expect(clusterWithMetadataTLS(v1beta1.MetadataTLS{URL: "http://10.1.0.1:50061", CABundle: secretCA}, "").
+		ValidateCreate()).NotTo(Succeed(), "the metadata URL must be https")
+	g.Expect(clusterWithMetadataTLS(v1beta1.MetadataTLS{CABundle: secretCA}, "http://10.1.0.1:50061").
+		ValidateCreate()).NotTo(Succeed(), "failure domain metadata URLs must be https")
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TinkerbellFirmwareRolloutSpec defines the machines whose firmware is updated and how.
+type TinkerbellFirmwareRolloutSpec struct {
+	// ClusterName is the name of the cluster whose machines are updated.
+	ClusterName string `json:"clusterName"`
+
+	// Selector selects the TinkerbellMachines of the cluster to update. An empty selector selects
+	// all machines of the cluster.
+	// +optional
+	Selector metav1.LabelSelector `json:"selector,omitempty"`
+
+	// TemplateName is the name of the Tinkerbell Template of the firmware workflow, in the namespace
+	// of the Hardware of the machines. The workflow is run with device_1 set to the Hardware.
+	TemplateName string `json:"templateName"`
+
+	// MaxConcurrent is the number of machines updated at the same time.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=1
+	// +optional
+	MaxConcurrent int32 `json:"maxConcurrent,omitempty"`
+
+	// DrainTimeout limits the time spent draining the Node of a machine. The rollout fails when it
+	// expires. If not set, draining waits forever.
+	// +optional
+	DrainTimeout *metav1.Duration `json:"drainTimeout,omitempty"`
+
+	// PhaseTimeout limits the time a machine spends in each of the Updating, Rebooting and
+	// WaitingForNode phases. The rollout fails when it expires. If not set, each phase times out
+	// after 30 minutes.
+	// +optional
+	PhaseTimeout *metav1.Duration `json:"phaseTimeout,omitempty"`
+}
+
+// FirmwareRolloutPhase is the phase of a TinkerbellFirmwareRollout.
+type FirmwareRolloutPhase string
+
+const (
+	// FirmwareRolloutProgressing means machines are being updated.
+	FirmwareRolloutProgressing FirmwareRolloutPhase = "Progressing"
+
+	// FirmwareRolloutCompleted means all machines have been updated.
+	FirmwareRolloutCompleted FirmwareRolloutPhase = "Completed"
+
+	// FirmwareRolloutFailed means the update of a machine failed. No further machine is updated.
+	FirmwareRolloutFailed FirmwareRolloutPhase = "Failed"
+)
+
+// FirmwareRolloutMachinePhase is the step of the update of a machine.
+type FirmwareRolloutMachinePhase string
+
+const (
+	// FirmwareRolloutMachinePending means the machine waits for its update to start.
+	FirmwareRolloutMachinePending FirmwareRolloutMachinePhase = "Pending"
+
+	// FirmwareRolloutMachineDraining means the Node of the machine is being cordoned and drained.
+	FirmwareRolloutMachineDraining FirmwareRolloutMachinePhase = "Draining"
+
+	// FirmwareRolloutMachineUpdating means the firmware workflow runs on the Hardware.
+	FirmwareRolloutMachineUpdating FirmwareRolloutMachinePhase = "Updating"
+
+	// FirmwareRolloutMachineRebooting means the Hardware is rebooted into its OS.
+	FirmwareRolloutMachineRebooting FirmwareRolloutMachinePhase = "Rebooting"
+
+	// FirmwareRolloutMachineWaitingForNode means the rollout waits for the rebooted Node to be Ready.
+	FirmwareRolloutMachineWaitingForNode FirmwareRolloutMachinePhase = "WaitingForNode"
+
+	// FirmwareRolloutMachineCompleted means the machine has been updated and its Node uncordoned.
+	FirmwareRolloutMachineCompleted FirmwareRolloutMachinePhase = "Completed"
+
+	// FirmwareRolloutMachineFailed means the update of the machine failed. Its Node is left cordoned.
+	FirmwareRolloutMachineFailed FirmwareRolloutMachinePhase = "Failed"
+)
+
+// FirmwareRolloutMachine is the update state of a machine.
+type FirmwareRolloutMachine struct {
+	// Name is the name of the TinkerbellMachine.
+	Name string `json:"name"`
+
+	// Phase is the step of the update the machine is in.
+	Phase FirmwareRolloutMachinePhase `json:"phase"`
+
+	// NodeName is the name of the Node of the machine.
+	// +optional
+	NodeName string `json:"nodeName,omitempty"`
+
+	// BootID is the boot ID of the Node before the update, to tell when it has rebooted.
+	// +optional
+	BootID string `json:"bootID,omitempty"`
+
+	// Message describes why the update failed.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// LastTransitionTime is when the machine entered its phase.
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+}
+
+// TinkerbellFirmwareRolloutStatus defines the observed state of TinkerbellFirmwareRollout.
+type TinkerbellFirmwareRolloutStatus struct {
+	// Phase is the phase of the rollout.
+	// +optional
+	Phase FirmwareRolloutPhase `json:"phase,omitempty"`
+
+	// Machines lists the machines selected when the rollout started, and their update state.
+	// +optional
+	Machines []FirmwareRolloutMachine `json:"machines,omitempty"`
+
+	// UpdatedMachines is the number of machines updated.
+	// +optional
+	UpdatedMachines int32 `json:"updatedMachines,omitempty"`
+}
+
+// +kubebuilder:subresource:status
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:path=tinkerbellfirmwarerollouts,scope=Namespaced,categories=cluster-api
+// +kubebuilder:storageversion
+// +kubebuilder:printcolumn:name="Cluster",type="string",JSONPath=".spec.clusterName",description="Cluster whose machines are updated"
+// +kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase",description="Rollout phase"
+// +kubebuilder:printcolumn:name="Updated",type="integer",JSONPath=".status.updatedMachines",description="Number of machines updated"
+
+// TinkerbellFirmwareRollout updates the firmware of the machines of a cluster, a few machines at a
+// time. Each machine's Node is cordoned and drained, the firmware workflow is run on its Hardware,
+// the Hardware is rebooted, and the rollout waits for the Node to be Ready before moving on.
+type TinkerbellFirmwareRollout struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TinkerbellFirmwareRolloutSpec   `json:"spec,omitempty"`
+	Status TinkerbellFirmwareRolloutStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// TinkerbellFirmwareRolloutList contains a list of TinkerbellFirmwareRollout.
+type TinkerbellFirmwareRolloutList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TinkerbellFirmwareRollout `json:"items"`
+}
+
+//nolint:gochecknoinits
+func init() {
+	SchemeBuilder.Register(&TinkerbellFirmwareRollout{}, &TinkerbellFirmwareRolloutList{})
+}
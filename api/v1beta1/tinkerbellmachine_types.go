@@ -19,6 +19,7 @@ package v1beta1
 import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	capierrors "sigs.k8s.io/cluster-api/errors"
 )
 
@@ -26,6 +27,17 @@ const (
 	// MachineFinalizer allows ReconcileTinkerbellMachine to clean up Tinkerbell resources before
 	// removing it from the apiserver.
 	MachineFinalizer = "tinkerbellmachine.infrastructure.cluster.x-k8s.io"
+
+	// HoldOnFailureAnnotation can be set on a TinkerbellMachine to keep the machine and its Hardware
+	// untouched after a provisioning failure, so the failed host can be investigated. While the hold
+	// is active the controller creates no BMC Jobs and neither releases nor powers off the Hardware,
+	// even if the TinkerbellMachine is deleted. Removing the annotation clears the hold.
+	HoldOnFailureAnnotation = "tinkerbellmachine.infrastructure.cluster.x-k8s.io/hold-on-failure"
+
+	// AbandonStackObjectsAnnotation can be set on a TinkerbellMachine being deleted whose Tinkerbell
+	// stack can't be reached anymore, to remove its finalizer anyway. Its Hardware, Template,
+	// Workflow and BMC Jobs are left behind in the stack and must be cleaned up by hand.
+	AbandonStackObjectsAnnotation = "tinkerbellmachine.infrastructure.cluster.x-k8s.io/abandon-stack-objects"
 )
 
 // TinkerbellMachineSpec defines the desired state of TinkerbellMachine.
@@ -62,6 +74,9 @@ type TinkerbellMachineSpec struct {
 
 	// TemplateOverride overrides the default Tinkerbell template used by CAPT.
 	// You can learn more about Tinkerbell templates here: https://docs.tinkerbell.org/templates/
+	// Values of Secrets in the namespace of the TinkerbellMachine can be referenced with
+	// {{ secret "name" "key" }}. They are resolved when the Template is created, and the Template
+	// is deleted once the workflow completes.
 	// +optional
 	TemplateOverride string `json:"templateOverride,omitempty"`
 
@@ -69,6 +84,37 @@ type TinkerbellMachineSpec struct {
 	// +optional
 	HardwareAffinity *HardwareAffinity `json:"hardwareAffinity,omitempty"`
 
+	// PreservedDisks lists Hardware disks holding data which must survive (re)provisioning.
+	// The OS image is never written to a preserved disk and the filesystems on them are
+	// mounted again by UUID once the new OS boots. When TemplateOverride is set, the
+	// template is rejected if it writes to a preserved disk.
+	// +optional
+	PreservedDisks []PreservedDisk `json:"preservedDisks,omitempty"`
+
+	// ProvisioningTimeouts limit how long each provisioning phase may take. When a phase times out,
+	// provisioning fails with a reason naming the phase, or the machine is held if the
+	// HoldOnFailureAnnotation is set. Phases without a timeout may take forever.
+	// +optional
+	ProvisioningTimeouts *ProvisioningTimeouts `json:"provisioningTimeouts,omitempty"`
+
+	// PXERetry retries powering the Hardware on into PXE with a fresh BMC Job when the workflow is
+	// not started within a window after the previous BMC Job completed. Provisioning fails once all
+	// attempts are used up. Requires the Hardware to have a BMC.
+	// +optional
+	PXERetry *PXERetryPolicy `json:"pxeRetry,omitempty"`
+
+	// CloudInitParts are cloud-init parts added to the bootstrap data of the machine, after the
+	// parts of the TinkerbellCluster.
+	// +optional
+	CloudInitParts []CloudInitPart `json:"cloudInitParts,omitempty"`
+
+	// ReadinessGates list conditions which, next to a completed workflow, must be True before the
+	// machine is marked Ready. The conditions are set on the TinkerbellMachine by external
+	// controllers, e.g. once a security agent registered or a network validation job passed.
+	// Gates are no longer evaluated once the machine is Ready.
+	// +optional
+	ReadinessGates []TinkerbellMachineReadinessGate `json:"readinessGates,omitempty"`
+
 	// Those fields are set programmatically, but they cannot be re-constructed from "state of the world", so
 	// we put them in spec instead of status.
 	HardwareName string `json:"hardwareName,omitempty"`
@@ -104,6 +150,34 @@ type WeightedHardwareAffinityTerm struct {
 	HardwareAffinityTerm HardwareAffinityTerm `json:"hardwareAffinityTerm"`
 }
 
+// TinkerbellMachineReadinessGate names a condition which must be True for the machine to become Ready.
+type TinkerbellMachineReadinessGate struct {
+	// ConditionType is the type of a condition in the TinkerbellMachine status.
+	ConditionType clusterv1.ConditionType `json:"conditionType"`
+}
+
+// PreservedDisk describes a Hardware disk whose data is kept across (re)provisioning.
+type PreservedDisk struct {
+	// Device is the disk device as listed in the Hardware disks, e.g. /dev/sdb.
+	Device string `json:"device"`
+
+	// FilesystemUUID is the UUID of the filesystem on the disk. It is used to mount the
+	// filesystem after the OS has been re-imaged, independent of device naming.
+	FilesystemUUID string `json:"filesystemUUID"`
+
+	// MountPoint is the absolute path the filesystem is mounted at.
+	MountPoint string `json:"mountPoint"`
+
+	// FilesystemType is the type of the filesystem, if not set it will default to auto.
+	// +optional
+	FilesystemType string `json:"filesystemType,omitempty"`
+
+	// MountOptions are the options used to mount the filesystem, if not set it will default
+	// to defaults,nofail.
+	// +optional
+	MountOptions string `json:"mountOptions,omitempty"`
+}
+
 // TinkerbellMachineStatus defines the observed state of TinkerbellMachine.
 type TinkerbellMachineStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
@@ -144,6 +218,94 @@ type TinkerbellMachineStatus struct {
 	// controller's output.
 	// +optional
 	ErrorMessage *string `json:"errorMessage,omitempty"`
+
+	// Hold is set when provisioning failed while the HoldOnFailureAnnotation was present. It is
+	// cleared once the annotation is removed.
+	// +optional
+	Hold *HoldStatus `json:"hold,omitempty"`
+
+	// Conditions defines current service state of the TinkerbellMachine.
+	// +optional
+	Conditions clusterv1.Conditions `json:"conditions,omitempty"`
+
+	// PXEAttempts records the BMC Jobs issued to retry PXE booting the Hardware.
+	// +optional
+	PXEAttempts []PXEAttempt `json:"pxeAttempts,omitempty"`
+
+	// TemplateSecrets records the Secret values referenced by TemplateOverride, for auditing.
+	// +optional
+	TemplateSecrets []TemplateSecretReference `json:"templateSecrets,omitempty"`
+
+	// FailureDomain records the failure domain of the TinkerbellCluster the machine is provisioned
+	// in. It locates the Tinkerbell stack of the machine even after the failure domain or the
+	// TinkerbellCluster are gone.
+	// +optional
+	FailureDomain *TinkerbellFailureDomain `json:"failureDomain,omitempty"`
+}
+
+// ProvisioningTimeouts defines the timeouts of the provisioning phases of a TinkerbellMachine.
+type ProvisioningTimeouts struct {
+	// Allocation limits the time spent waiting for available Hardware, starting when the
+	// TinkerbellMachine is created.
+	// +optional
+	Allocation *metav1.Duration `json:"allocation,omitempty"`
+
+	// PowerOn limits the time the BMC Job powering the Hardware on into PXE takes to complete.
+	// +optional
+	PowerOn *metav1.Duration `json:"powerOn,omitempty"`
+
+	// WorkflowStart limits the time for tink-worker to start the workflow, starting when the workflow
+	// is created or the Hardware is powered on, whichever happens last.
+	// +optional
+	WorkflowStart *metav1.Duration `json:"workflowStart,omitempty"`
+
+	// WorkflowRun limits the time the workflow runs, starting with its first action.
+	// +optional
+	WorkflowRun *metav1.Duration `json:"workflowRun,omitempty"`
+}
+
+// PXERetryPolicy defines how PXE boot is retried when the workflow is never picked up.
+type PXERetryPolicy struct {
+	// Window is the time to wait for the workflow to start after the BMC Job completed.
+	Window metav1.Duration `json:"window"`
+
+	// MaxAttempts is the number of retries before provisioning fails.
+	// +kubebuilder:validation:Minimum=1
+	MaxAttempts int32 `json:"maxAttempts"`
+}
+
+// PXEAttempt records a retry of PXE booting the Hardware.
+type PXEAttempt struct {
+	// JobName is the name of the BMC Job issued for the retry.
+	JobName string `json:"jobName"`
+
+	// Time is when the retry was issued.
+	Time metav1.Time `json:"time"`
+}
+
+// TemplateSecretReference identifies a Secret value resolved into the Template of a machine.
+type TemplateSecretReference struct {
+	// Name is the name of the Secret.
+	Name string `json:"name"`
+
+	// Key is the key of the value in the Secret.
+	Key string `json:"key"`
+
+	// ResolvedAt is when the value was read into the Template.
+	ResolvedAt metav1.Time `json:"resolvedAt"`
+}
+
+// HoldStatus describes a provisioning failure the TinkerbellMachine is being held on.
+type HoldStatus struct {
+	// FailedAction is the name of the workflow action or BMC Job which failed.
+	FailedAction string `json:"failedAction"`
+
+	// Reason is a short description of why the machine is held.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+
+	// Since is the time the hold was placed.
+	Since metav1.Time `json:"since"`
 }
 
 // +kubebuilder:subresource:status
@@ -165,6 +327,16 @@ type TinkerbellMachine struct {
 	Status TinkerbellMachineStatus `json:"status,omitempty"`
 }
 
+// GetConditions returns the list of conditions for a TinkerbellMachine API object.
+func (m *TinkerbellMachine) GetConditions() clusterv1.Conditions {
+	return m.Status.Conditions
+}
+
+// SetConditions will set the given conditions on a TinkerbellMachine object.
+func (m *TinkerbellMachine) SetConditions(conditions clusterv1.Conditions) {
+	m.Status.Conditions = conditions
+}
+
 // +kubebuilder:object:root=true
 
 // TinkerbellMachineList contains a list of TinkerbellMachine.
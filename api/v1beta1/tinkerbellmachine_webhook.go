@@ -17,6 +17,9 @@ limitations under the License.
 package v1beta1
 
 import (
+	"path"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/validation/field"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -75,5 +78,55 @@ func (m *TinkerbellMachine) validateSpec() field.ErrorList {
 		}
 	}
 
+	if timeouts := m.Spec.ProvisioningTimeouts; timeouts != nil {
+		timeoutsPath := fieldBasePath.Child("provisioningTimeouts")
+
+		for _, timeout := range []struct {
+			name     string
+			duration *metav1.Duration
+		}{
+			{"allocation", timeouts.Allocation},
+			{"powerOn", timeouts.PowerOn},
+			{"workflowStart", timeouts.WorkflowStart},
+			{"workflowRun", timeouts.WorkflowRun},
+		} {
+			if timeout.duration != nil && timeout.duration.Duration <= 0 {
+				allErrs = append(allErrs, field.Invalid(timeoutsPath.Child(timeout.name),
+					timeout.duration.Duration.String(), "must be positive"))
+			}
+		}
+	}
+
+	if retry := m.Spec.PXERetry; retry != nil {
+		if retry.Window.Duration <= 0 {
+			allErrs = append(allErrs, field.Invalid(fieldBasePath.Child("pxeRetry", "window"),
+				retry.Window.Duration.String(), "must be positive"))
+		}
+
+		if retry.MaxAttempts < 1 {
+			allErrs = append(allErrs, field.Invalid(fieldBasePath.Child("pxeRetry", "maxAttempts"),
+				retry.MaxAttempts, "must be at least 1"))
+		}
+	}
+
+	allErrs = append(allErrs, validateCloudInitParts(fieldBasePath.Child("cloudInitParts"), m.Spec.CloudInitParts)...)
+
+	for i, disk := range m.Spec.PreservedDisks {
+		diskPath := fieldBasePath.Child("preservedDisks").Index(i)
+
+		if disk.Device == "" {
+			allErrs = append(allErrs, field.Required(diskPath.Child("device"), "device is required"))
+		}
+
+		if disk.FilesystemUUID == "" {
+			allErrs = append(allErrs, field.Required(diskPath.Child("filesystemUUID"), "filesystem UUID is required"))
+		}
+
+		if !path.IsAbs(disk.MountPoint) {
+			allErrs = append(allErrs,
+				field.Invalid(diskPath.Child("mountPoint"), disk.MountPoint, "must be an absolute path"))
+		}
+	}
+
 	return allErrs
 }
@@ -18,8 +18,10 @@ package v1beta1_test
 
 import (
 	"testing"
+	"time"
 
 	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
@@ -81,6 +83,58 @@ func Test_valid_tinkerbell_machine(t *testing.T) {
 				},
 			},
 		},
+		// preserved data disk
+		{
+			Spec: v1beta1.TinkerbellMachineSpec{
+				PreservedDisks: []v1beta1.PreservedDisk{
+					{
+						Device:         "/dev/sdb",
+						FilesystemUUID: "5b6c2a8e-3f1d-4a4e-9d0e-0c6f3c1a2b7d",
+						MountPoint:     "/var/lib/data",
+					},
+				},
+			},
+		},
+		// provisioning timeouts
+		{
+			Spec: v1beta1.TinkerbellMachineSpec{
+				ProvisioningTimeouts: &v1beta1.ProvisioningTimeouts{
+					Allocation:  &metav1.Duration{Duration: time.Hour},
+					WorkflowRun: &metav1.Duration{Duration: 30 * time.Minute},
+				},
+			},
+		},
+		// PXE retry
+		{
+			Spec: v1beta1.TinkerbellMachineSpec{
+				PXERetry: &v1beta1.PXERetryPolicy{
+					Window:      metav1.Duration{Duration: 10 * time.Minute},
+					MaxAttempts: 3,
+				},
+			},
+		},
+		// cloud-init parts
+		{
+			Spec: v1beta1.TinkerbellMachineSpec{
+				CloudInitParts: []v1beta1.CloudInitPart{
+					{
+						Name: "monitoring",
+						ConfigMapRef: &corev1.ConfigMapKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "monitoring"},
+							Key:                  "cloud-config",
+						},
+					},
+					{
+						Name: "packages",
+						SecretRef: &corev1.SecretKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "packages"},
+							Key:                  "cloud-config",
+						},
+						MergeType: "list(append)+dict(no_replace,recurse_list)+str()",
+					},
+				},
+			},
+		},
 	} {
 		g.Expect(machine.ValidateCreate()).ToNot(HaveOccurred())
 		g.Expect(machine.ValidateUpdate(existingValidMachine)).ToNot(HaveOccurred())
@@ -127,6 +181,70 @@ func Test_invalid_tinkerbell_machine(t *testing.T) {
 				},
 			},
 		},
+		// preserved data disk without filesystem UUID
+		{
+			Spec: v1beta1.TinkerbellMachineSpec{
+				PreservedDisks: []v1beta1.PreservedDisk{
+					{
+						Device:     "/dev/sdb",
+						MountPoint: "/var/lib/data",
+					},
+				},
+			},
+		},
+		// preserved data disk with relative mount point
+		{
+			Spec: v1beta1.TinkerbellMachineSpec{
+				PreservedDisks: []v1beta1.PreservedDisk{
+					{
+						Device:         "/dev/sdb",
+						FilesystemUUID: "5b6c2a8e-3f1d-4a4e-9d0e-0c6f3c1a2b7d",
+						MountPoint:     "data",
+					},
+				},
+			},
+		},
+		// non positive provisioning timeout
+		{
+			Spec: v1beta1.TinkerbellMachineSpec{
+				ProvisioningTimeouts: &v1beta1.ProvisioningTimeouts{
+					PowerOn: &metav1.Duration{Duration: 0},
+				},
+			},
+		},
+		// PXE retry without attempts
+		{
+			Spec: v1beta1.TinkerbellMachineSpec{
+				PXERetry: &v1beta1.PXERetryPolicy{
+					Window: metav1.Duration{Duration: 10 * time.Minute},
+				},
+			},
+		},
+		// cloud-init part without source
+		{
+			Spec: v1beta1.TinkerbellMachineSpec{
+				CloudInitParts: []v1beta1.CloudInitPart{{Name: "monitoring"}},
+			},
+		},
+		// cloud-init parts with duplicate names
+		{
+			Spec: v1beta1.TinkerbellMachineSpec{
+				CloudInitParts: []v1beta1.CloudInitPart{
+					{
+						Name: "monitoring",
+						ConfigMapRef: &corev1.ConfigMapKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "monitoring"},
+						},
+					},
+					{
+						Name: "monitoring",
+						ConfigMapRef: &corev1.ConfigMapKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "agent"},
+						},
+					},
+				},
+			},
+		},
 	} {
 		g.Expect(machine.ValidateCreate()).To(HaveOccurred())
 		g.Expect(machine.ValidateUpdate(existingValidMachine)).To(HaveOccurred())
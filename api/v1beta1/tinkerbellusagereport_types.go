@@ -0,0 +1,97 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TinkerbellUsageReportSpec defines the period a TinkerbellUsageReport covers.
+type TinkerbellUsageReportSpec struct {
+	// Start is the beginning of the period, a UTC midnight.
+	Start metav1.Time `json:"start"`
+
+	// End is the end of the period, excluded.
+	End metav1.Time `json:"end"`
+}
+
+// HardwareUsage is the time a Hardware has been allocated to a cluster during the period.
+type HardwareUsage struct {
+	// Hardware is the name of the Hardware.
+	Hardware string `json:"hardware"`
+
+	// HardwareClass is the value of the hardware class label of the Hardware.
+	// +optional
+	HardwareClass string `json:"hardwareClass,omitempty"`
+
+	// Cluster is the name of the cluster the Hardware was allocated to.
+	Cluster string `json:"cluster"`
+
+	// Seconds is the number of seconds the Hardware was allocated to the cluster.
+	Seconds int64 `json:"seconds"`
+
+	// Hours is Seconds in hardware-hours.
+	Hours resource.Quantity `json:"hours"`
+
+	// AccountedUntil is the end of the last interval added to Seconds. Usage before it is not added
+	// again, so an interval accounted twice, e.g. by concurrent accountings, is counted once.
+	// +optional
+	AccountedUntil *metav1.Time `json:"accountedUntil,omitempty"`
+}
+
+// TinkerbellUsageReportStatus defines the usage accounted during the period.
+type TinkerbellUsageReportStatus struct {
+	// Usage lists the usage of each Hardware by each cluster of the namespace.
+	// +optional
+	Usage []HardwareUsage `json:"usage,omitempty"`
+
+	// TotalHours is the sum of the hardware-hours of the period.
+	// +optional
+	TotalHours resource.Quantity `json:"totalHours,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:path=tinkerbellusagereports,scope=Namespaced,categories=cluster-api
+// +kubebuilder:storageversion
+// +kubebuilder:printcolumn:name="Start",type="string",format="date-time",JSONPath=".spec.start",description="Beginning of the period"
+// +kubebuilder:printcolumn:name="Hours",type="string",JSONPath=".status.totalHours",description="Hardware-hours of the period"
+
+// TinkerbellUsageReport records the hardware-hours consumed by the clusters of a namespace during
+// a day, for chargeback. Reports are named hardware-usage-<YYYY-MM-DD> and kept up to date by the
+// manager while the day lasts.
+type TinkerbellUsageReport struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TinkerbellUsageReportSpec   `json:"spec,omitempty"`
+	Status TinkerbellUsageReportStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// TinkerbellUsageReportList contains a list of TinkerbellUsageReport.
+type TinkerbellUsageReportList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TinkerbellUsageReport `json:"items"`
+}
+
+//nolint:gochecknoinits
+func init() {
+	SchemeBuilder.Register(&TinkerbellUsageReport{}, &TinkerbellUsageReportList{})
+}
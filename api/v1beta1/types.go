@@ -16,6 +16,11 @@ limitations under the License.
 
 package v1beta1
 
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
 // TinkerbellResourceStatus describes the status of a Tinkerbell resource.
 type TinkerbellResourceStatus int
 
@@ -33,3 +38,56 @@ type TinkerbellMachineTemplateResource struct {
 	// Spec is the specification of the desired behavior of the machine.
 	Spec TinkerbellMachineSpec `json:"spec"`
 }
+
+// CloudInitPart references a cloud-init part, e.g. a cloud-config, added to the bootstrap data of
+// machines. The bootstrap data and all parts are combined into a MIME multipart document, with the
+// bootstrap data first and the parts in the order they are listed.
+type CloudInitPart struct {
+	// Name identifies the part. It is used as the file name of the part in the multipart document.
+	Name string `json:"name"`
+
+	// SecretRef selects the key of a Secret in the namespace of the machine holding the part.
+	// +optional
+	SecretRef *corev1.SecretKeySelector `json:"secretRef,omitempty"`
+
+	// ConfigMapRef selects the key of a ConfigMap in the namespace of the machine holding the part.
+	// +optional
+	ConfigMapRef *corev1.ConfigMapKeySelector `json:"configMapRef,omitempty"`
+
+	// ContentType is the MIME type of the part.
+	// +optional
+	// +kubebuilder:default=text/cloud-config
+	ContentType string `json:"contentType,omitempty"`
+
+	// MergeType controls how cloud-init merges the part into the preceding parts, e.g.
+	// list(append)+dict(no_replace,recurse_list)+str(). If not set, the default merging of
+	// cloud-init applies.
+	// +optional
+	MergeType string `json:"mergeType,omitempty"`
+}
+
+func validateCloudInitParts(partsPath *field.Path, parts []CloudInitPart) field.ErrorList {
+	var allErrs field.ErrorList
+
+	names := map[string]bool{}
+
+	for i, part := range parts {
+		partPath := partsPath.Index(i)
+
+		switch {
+		case part.Name == "":
+			allErrs = append(allErrs, field.Required(partPath.Child("name"), "name is required"))
+		case names[part.Name]:
+			allErrs = append(allErrs, field.Duplicate(partPath.Child("name"), part.Name))
+		}
+
+		names[part.Name] = true
+
+		if (part.SecretRef == nil) == (part.ConfigMapRef == nil) {
+			allErrs = append(allErrs, field.Invalid(partPath, part.Name,
+				"exactly one of secretRef and configMapRef must be set"))
+		}
+	}
+
+	return allErrs
+}
@@ -23,10 +23,78 @@ package v1beta1
 
 import (
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	apiv1beta1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	"sigs.k8s.io/cluster-api/errors"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CABundleSource) DeepCopyInto(out *CABundleSource) {
+	*out = *in
+	if in.SecretKeyRef != nil {
+		in, out := &in.SecretKeyRef, &out.SecretKeyRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ConfigMapKeyRef != nil {
+		in, out := &in.ConfigMapKeyRef, &out.ConfigMapKeyRef
+		*out = new(v1.ConfigMapKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CABundleSource.
+func (in *CABundleSource) DeepCopy() *CABundleSource {
+	if in == nil {
+		return nil
+	}
+	out := new(CABundleSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudInitPart) DeepCopyInto(out *CloudInitPart) {
+	*out = *in
+	if in.SecretRef != nil {
+		in, out := &in.SecretRef, &out.SecretRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ConfigMapRef != nil {
+		in, out := &in.ConfigMapRef, &out.ConfigMapRef
+		*out = new(v1.ConfigMapKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudInitPart.
+func (in *CloudInitPart) DeepCopy() *CloudInitPart {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudInitPart)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FirmwareRolloutMachine) DeepCopyInto(out *FirmwareRolloutMachine) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FirmwareRolloutMachine.
+func (in *FirmwareRolloutMachine) DeepCopy() *FirmwareRolloutMachine {
+	if in == nil {
+		return nil
+	}
+	out := new(FirmwareRolloutMachine)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *HardwareAffinity) DeepCopyInto(out *HardwareAffinity) {
 	*out = *in
@@ -72,13 +140,203 @@ func (in *HardwareAffinityTerm) DeepCopy() *HardwareAffinityTerm {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HardwareUsage) DeepCopyInto(out *HardwareUsage) {
+	*out = *in
+	out.Hours = in.Hours.DeepCopy()
+	if in.AccountedUntil != nil {
+		in, out := &in.AccountedUntil, &out.AccountedUntil
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HardwareUsage.
+func (in *HardwareUsage) DeepCopy() *HardwareUsage {
+	if in == nil {
+		return nil
+	}
+	out := new(HardwareUsage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HoldStatus) DeepCopyInto(out *HoldStatus) {
+	*out = *in
+	in.Since.DeepCopyInto(&out.Since)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HoldStatus.
+func (in *HoldStatus) DeepCopy() *HoldStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(HoldStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MetadataTLS) DeepCopyInto(out *MetadataTLS) {
+	*out = *in
+	in.CABundle.DeepCopyInto(&out.CABundle)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MetadataTLS.
+func (in *MetadataTLS) DeepCopy() *MetadataTLS {
+	if in == nil {
+		return nil
+	}
+	out := new(MetadataTLS)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PXEAttempt) DeepCopyInto(out *PXEAttempt) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PXEAttempt.
+func (in *PXEAttempt) DeepCopy() *PXEAttempt {
+	if in == nil {
+		return nil
+	}
+	out := new(PXEAttempt)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PXERetryPolicy) DeepCopyInto(out *PXERetryPolicy) {
+	*out = *in
+	out.Window = in.Window
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PXERetryPolicy.
+func (in *PXERetryPolicy) DeepCopy() *PXERetryPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(PXERetryPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PreservedDisk) DeepCopyInto(out *PreservedDisk) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PreservedDisk.
+func (in *PreservedDisk) DeepCopy() *PreservedDisk {
+	if in == nil {
+		return nil
+	}
+	out := new(PreservedDisk)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProvisioningTimeouts) DeepCopyInto(out *ProvisioningTimeouts) {
+	*out = *in
+	if in.Allocation != nil {
+		in, out := &in.Allocation, &out.Allocation
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.PowerOn != nil {
+		in, out := &in.PowerOn, &out.PowerOn
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.WorkflowStart != nil {
+		in, out := &in.WorkflowStart, &out.WorkflowStart
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.WorkflowRun != nil {
+		in, out := &in.WorkflowRun, &out.WorkflowRun
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProvisioningTimeouts.
+func (in *ProvisioningTimeouts) DeepCopy() *ProvisioningTimeouts {
+	if in == nil {
+		return nil
+	}
+	out := new(ProvisioningTimeouts)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RemediationReserve) DeepCopyInto(out *RemediationReserve) {
+	*out = *in
+	if in.HardwareAffinity != nil {
+		in, out := &in.HardwareAffinity, &out.HardwareAffinity
+		*out = new(HardwareAffinity)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RemediationReserve.
+func (in *RemediationReserve) DeepCopy() *RemediationReserve {
+	if in == nil {
+		return nil
+	}
+	out := new(RemediationReserve)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScaleDownPolicy) DeepCopyInto(out *ScaleDownPolicy) {
+	*out = *in
+	if in.Criteria != nil {
+		in, out := &in.Criteria, &out.Criteria
+		*out = make([]ScaleDownCriterion, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScaleDownPolicy.
+func (in *ScaleDownPolicy) DeepCopy() *ScaleDownPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(ScaleDownPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TemplateSecretReference) DeepCopyInto(out *TemplateSecretReference) {
+	*out = *in
+	in.ResolvedAt.DeepCopyInto(&out.ResolvedAt)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TemplateSecretReference.
+func (in *TemplateSecretReference) DeepCopy() *TemplateSecretReference {
+	if in == nil {
+		return nil
+	}
+	out := new(TemplateSecretReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TinkerbellCluster) DeepCopyInto(out *TinkerbellCluster) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TinkerbellCluster.
@@ -135,6 +393,40 @@ func (in *TinkerbellClusterList) DeepCopyObject() runtime.Object {
 func (in *TinkerbellClusterSpec) DeepCopyInto(out *TinkerbellClusterSpec) {
 	*out = *in
 	out.ControlPlaneEndpoint = in.ControlPlaneEndpoint
+	if in.FailureDomains != nil {
+		in, out := &in.FailureDomains, &out.FailureDomains
+		*out = make([]TinkerbellFailureDomain, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.CloudInitParts != nil {
+		in, out := &in.CloudInitParts, &out.CloudInitParts
+		*out = make([]CloudInitPart, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.RemediationReserve != nil {
+		in, out := &in.RemediationReserve, &out.RemediationReserve
+		*out = new(RemediationReserve)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ScaleDownPolicy != nil {
+		in, out := &in.ScaleDownPolicy, &out.ScaleDownPolicy
+		*out = new(ScaleDownPolicy)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.MetadataTLS != nil {
+		in, out := &in.MetadataTLS, &out.MetadataTLS
+		*out = new(MetadataTLS)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Exclusivity != nil {
+		in, out := &in.Exclusivity, &out.Exclusivity
+		*out = new(TopologyExclusivity)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TinkerbellClusterSpec.
@@ -150,6 +442,23 @@ func (in *TinkerbellClusterSpec) DeepCopy() *TinkerbellClusterSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TinkerbellClusterStatus) DeepCopyInto(out *TinkerbellClusterStatus) {
 	*out = *in
+	if in.FailureDomains != nil {
+		in, out := &in.FailureDomains, &out.FailureDomains
+		*out = make(apiv1beta1.FailureDomains, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.ReservedHardware != nil {
+		in, out := &in.ReservedHardware, &out.ReservedHardware
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ClaimedTopologyValues != nil {
+		in, out := &in.ClaimedTopologyValues, &out.ClaimedTopologyValues
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TinkerbellClusterStatus.
@@ -162,6 +471,140 @@ func (in *TinkerbellClusterStatus) DeepCopy() *TinkerbellClusterStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TinkerbellFailureDomain) DeepCopyInto(out *TinkerbellFailureDomain) {
+	*out = *in
+	if in.Attributes != nil {
+		in, out := &in.Attributes, &out.Attributes
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.KubeconfigSecretRef != nil {
+		in, out := &in.KubeconfigSecretRef, &out.KubeconfigSecretRef
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TinkerbellFailureDomain.
+func (in *TinkerbellFailureDomain) DeepCopy() *TinkerbellFailureDomain {
+	if in == nil {
+		return nil
+	}
+	out := new(TinkerbellFailureDomain)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TinkerbellFirmwareRollout) DeepCopyInto(out *TinkerbellFirmwareRollout) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TinkerbellFirmwareRollout.
+func (in *TinkerbellFirmwareRollout) DeepCopy() *TinkerbellFirmwareRollout {
+	if in == nil {
+		return nil
+	}
+	out := new(TinkerbellFirmwareRollout)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *TinkerbellFirmwareRollout) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TinkerbellFirmwareRolloutList) DeepCopyInto(out *TinkerbellFirmwareRolloutList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]TinkerbellFirmwareRollout, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TinkerbellFirmwareRolloutList.
+func (in *TinkerbellFirmwareRolloutList) DeepCopy() *TinkerbellFirmwareRolloutList {
+	if in == nil {
+		return nil
+	}
+	out := new(TinkerbellFirmwareRolloutList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *TinkerbellFirmwareRolloutList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TinkerbellFirmwareRolloutSpec) DeepCopyInto(out *TinkerbellFirmwareRolloutSpec) {
+	*out = *in
+	in.Selector.DeepCopyInto(&out.Selector)
+	if in.DrainTimeout != nil {
+		in, out := &in.DrainTimeout, &out.DrainTimeout
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.PhaseTimeout != nil {
+		in, out := &in.PhaseTimeout, &out.PhaseTimeout
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TinkerbellFirmwareRolloutSpec.
+func (in *TinkerbellFirmwareRolloutSpec) DeepCopy() *TinkerbellFirmwareRolloutSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(TinkerbellFirmwareRolloutSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TinkerbellFirmwareRolloutStatus) DeepCopyInto(out *TinkerbellFirmwareRolloutStatus) {
+	*out = *in
+	if in.Machines != nil {
+		in, out := &in.Machines, &out.Machines
+		*out = make([]FirmwareRolloutMachine, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TinkerbellFirmwareRolloutStatus.
+func (in *TinkerbellFirmwareRolloutStatus) DeepCopy() *TinkerbellFirmwareRolloutStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(TinkerbellFirmwareRolloutStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TinkerbellMachine) DeepCopyInto(out *TinkerbellMachine) {
 	*out = *in
@@ -221,6 +664,21 @@ func (in *TinkerbellMachineList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TinkerbellMachineReadinessGate) DeepCopyInto(out *TinkerbellMachineReadinessGate) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TinkerbellMachineReadinessGate.
+func (in *TinkerbellMachineReadinessGate) DeepCopy() *TinkerbellMachineReadinessGate {
+	if in == nil {
+		return nil
+	}
+	out := new(TinkerbellMachineReadinessGate)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TinkerbellMachineSpec) DeepCopyInto(out *TinkerbellMachineSpec) {
 	*out = *in
@@ -229,6 +687,33 @@ func (in *TinkerbellMachineSpec) DeepCopyInto(out *TinkerbellMachineSpec) {
 		*out = new(HardwareAffinity)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.PreservedDisks != nil {
+		in, out := &in.PreservedDisks, &out.PreservedDisks
+		*out = make([]PreservedDisk, len(*in))
+		copy(*out, *in)
+	}
+	if in.ProvisioningTimeouts != nil {
+		in, out := &in.ProvisioningTimeouts, &out.ProvisioningTimeouts
+		*out = new(ProvisioningTimeouts)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PXERetry != nil {
+		in, out := &in.PXERetry, &out.PXERetry
+		*out = new(PXERetryPolicy)
+		**out = **in
+	}
+	if in.CloudInitParts != nil {
+		in, out := &in.CloudInitParts, &out.CloudInitParts
+		*out = make([]CloudInitPart, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.ReadinessGates != nil {
+		in, out := &in.ReadinessGates, &out.ReadinessGates
+		*out = make([]TinkerbellMachineReadinessGate, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TinkerbellMachineSpec.
@@ -264,6 +749,37 @@ func (in *TinkerbellMachineStatus) DeepCopyInto(out *TinkerbellMachineStatus) {
 		*out = new(string)
 		**out = **in
 	}
+	if in.Hold != nil {
+		in, out := &in.Hold, &out.Hold
+		*out = new(HoldStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make(apiv1beta1.Conditions, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.PXEAttempts != nil {
+		in, out := &in.PXEAttempts, &out.PXEAttempts
+		*out = make([]PXEAttempt, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.TemplateSecrets != nil {
+		in, out := &in.TemplateSecrets, &out.TemplateSecrets
+		*out = make([]TemplateSecretReference, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.FailureDomain != nil {
+		in, out := &in.FailureDomain, &out.FailureDomain
+		*out = new(TinkerbellFailureDomain)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TinkerbellMachineStatus.
@@ -366,6 +882,120 @@ func (in *TinkerbellMachineTemplateSpec) DeepCopy() *TinkerbellMachineTemplateSp
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TinkerbellUsageReport) DeepCopyInto(out *TinkerbellUsageReport) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TinkerbellUsageReport.
+func (in *TinkerbellUsageReport) DeepCopy() *TinkerbellUsageReport {
+	if in == nil {
+		return nil
+	}
+	out := new(TinkerbellUsageReport)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *TinkerbellUsageReport) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TinkerbellUsageReportList) DeepCopyInto(out *TinkerbellUsageReportList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]TinkerbellUsageReport, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TinkerbellUsageReportList.
+func (in *TinkerbellUsageReportList) DeepCopy() *TinkerbellUsageReportList {
+	if in == nil {
+		return nil
+	}
+	out := new(TinkerbellUsageReportList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *TinkerbellUsageReportList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TinkerbellUsageReportSpec) DeepCopyInto(out *TinkerbellUsageReportSpec) {
+	*out = *in
+	in.Start.DeepCopyInto(&out.Start)
+	in.End.DeepCopyInto(&out.End)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TinkerbellUsageReportSpec.
+func (in *TinkerbellUsageReportSpec) DeepCopy() *TinkerbellUsageReportSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(TinkerbellUsageReportSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TinkerbellUsageReportStatus) DeepCopyInto(out *TinkerbellUsageReportStatus) {
+	*out = *in
+	if in.Usage != nil {
+		in, out := &in.Usage, &out.Usage
+		*out = make([]HardwareUsage, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	out.TotalHours = in.TotalHours.DeepCopy()
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TinkerbellUsageReportStatus.
+func (in *TinkerbellUsageReportStatus) DeepCopy() *TinkerbellUsageReportStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(TinkerbellUsageReportStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TopologyExclusivity) DeepCopyInto(out *TopologyExclusivity) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TopologyExclusivity.
+func (in *TopologyExclusivity) DeepCopy() *TopologyExclusivity {
+	if in == nil {
+		return nil
+	}
+	out := new(TopologyExclusivity)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *WeightedHardwareAffinityTerm) DeepCopyInto(out *WeightedHardwareAffinityTerm) {
 	*out = *in
@@ -0,0 +1,304 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+)
+
+func hardwareWithAddresses(addresses ...string) *tinkv1.Hardware {
+	hardware := &tinkv1.Hardware{}
+
+	for _, address := range addresses {
+		hardware.Spec.Interfaces = append(hardware.Spec.Interfaces, tinkv1.Interface{
+			DHCP: &tinkv1.DHCP{IP: &tinkv1.IP{Address: address}},
+		})
+	}
+
+	return hardware
+}
+
+//nolint:funlen
+func Test_hardwareIP(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		hardware      *tinkv1.Hardware
+		expectedIP    string
+		expectedError error
+	}{
+		"fails_when_hardware_is_nil": {
+			expectedError: ErrHardwareIsNil,
+		},
+		"fails_when_hardware_has_no_interfaces": {
+			hardware:      &tinkv1.Hardware{},
+			expectedError: ErrHardwareMissingInterfaces,
+		},
+		"fails_when_first_interface_has_no_dhcp": {
+			hardware: &tinkv1.Hardware{
+				Spec: tinkv1.HardwareSpec{Interfaces: []tinkv1.Interface{{}}},
+			},
+			expectedError: ErrHardwareFirstInterfaceNotDHCP,
+		},
+		"fails_when_first_interface_has_no_ip": {
+			hardware: &tinkv1.Hardware{
+				Spec: tinkv1.HardwareSpec{Interfaces: []tinkv1.Interface{{DHCP: &tinkv1.DHCP{}}}},
+			},
+			expectedError: ErrHardwareFirstInterfaceDHCPMissingIP,
+		},
+		"fails_when_first_interface_has_empty_address": {
+			hardware:      hardwareWithAddresses(""),
+			expectedError: ErrHardwareFirstInterfaceDHCPMissingIP,
+		},
+		"fails_when_address_is_invalid": {
+			hardware:      hardwareWithAddresses("10.0.0.256"),
+			expectedError: ErrHardwareInvalidIP,
+		},
+		"returns_ipv4_address": {
+			hardware:   hardwareWithAddresses("10.0.0.10"),
+			expectedIP: "10.0.0.10",
+		},
+		"returns_ipv6_address_in_canonical_form": {
+			hardware:   hardwareWithAddresses("FD00:0:0:0::10"),
+			expectedIP: "fd00::10",
+		},
+		"returns_bracketed_ipv6_address_without_brackets": {
+			hardware:   hardwareWithAddresses("[fd00::10]"),
+			expectedIP: "fd00::10",
+		},
+		"returns_address_of_first_interface": {
+			hardware:   hardwareWithAddresses("fd00::10", "10.0.0.10"),
+			expectedIP: "fd00::10",
+		},
+	}
+
+	for name, c := range cases {
+		c := c
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			g := NewWithT(t)
+
+			ip, err := hardwareIP(c.hardware)
+			if c.expectedError != nil {
+				g.Expect(err).To(MatchError(c.expectedError))
+
+				return
+			}
+
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(ip).To(Equal(c.expectedIP))
+		})
+	}
+}
+
+func Test_hardwareIPs(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		hardware      *tinkv1.Hardware
+		expectedIPs   []string
+		expectedError error
+	}{
+		"returns_single_stack_ipv4_address": {
+			hardware:    hardwareWithAddresses("10.0.0.10"),
+			expectedIPs: []string{"10.0.0.10"},
+		},
+		"returns_single_stack_ipv6_address": {
+			hardware:    hardwareWithAddresses("fd00::10"),
+			expectedIPs: []string{"fd00::10"},
+		},
+		"returns_dual_stack_addresses_in_interface_order": {
+			hardware:    hardwareWithAddresses("10.0.0.10", "fd00::10"),
+			expectedIPs: []string{"10.0.0.10", "fd00::10"},
+		},
+		"skips_interfaces_without_address_and_duplicates": {
+			hardware:    hardwareWithAddresses("fd00::10", "", "fd00:0::10", "10.0.0.10"),
+			expectedIPs: []string{"fd00::10", "10.0.0.10"},
+		},
+		"fails_when_first_interface_has_no_address": {
+			hardware:      hardwareWithAddresses("", "10.0.0.10"),
+			expectedError: ErrHardwareFirstInterfaceDHCPMissingIP,
+		},
+		"fails_when_another_interface_has_invalid_address": {
+			hardware:      hardwareWithAddresses("10.0.0.10", "fd00::g"),
+			expectedError: ErrHardwareInvalidIP,
+		},
+	}
+
+	for name, c := range cases {
+		c := c
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			g := NewWithT(t)
+
+			ips, err := hardwareIPs(c.hardware)
+			if c.expectedError != nil {
+				g.Expect(err).To(MatchError(c.expectedError))
+
+				return
+			}
+
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(ips).To(Equal(c.expectedIPs))
+		})
+	}
+}
+
+//nolint:funlen
+func Test_controlPlaneEndpoint(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		clusterEndpoint           clusterv1.APIEndpoint
+		tinkerbellClusterEndpoint clusterv1.APIEndpoint
+		expected                  clusterv1.APIEndpoint
+		expectedError             error
+	}{
+		"fails_when_no_host_is_set": {
+			expectedError: ErrControlPlaneEndpointNotSet,
+		},
+		"uses_ipv4_endpoint_of_cluster": {
+			clusterEndpoint: clusterv1.APIEndpoint{Host: "10.0.0.100", Port: 443},
+			expected:        clusterv1.APIEndpoint{Host: "10.0.0.100", Port: 443},
+		},
+		"uses_ipv6_endpoint_of_cluster": {
+			clusterEndpoint: clusterv1.APIEndpoint{Host: "fd00::100", Port: 443},
+			expected:        clusterv1.APIEndpoint{Host: "fd00::100", Port: 443},
+		},
+		"strips_brackets_from_ipv6_endpoint_of_tinkerbell_cluster": {
+			tinkerbellClusterEndpoint: clusterv1.APIEndpoint{Host: "[fd00::100]", Port: 443},
+			expected:                  clusterv1.APIEndpoint{Host: "fd00::100", Port: 443},
+		},
+		"defaults_port_of_ipv6_host": {
+			tinkerbellClusterEndpoint: clusterv1.APIEndpoint{Host: "[FD00:0::100]"},
+			expected:                  clusterv1.APIEndpoint{Host: "fd00::100", Port: KubernetesAPIPort},
+		},
+		"keeps_host_names": {
+			clusterEndpoint: clusterv1.APIEndpoint{Host: "api.example.com", Port: 6443},
+			expected:        clusterv1.APIEndpoint{Host: "api.example.com", Port: 6443},
+		},
+	}
+
+	for name, c := range cases {
+		c := c
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			g := NewWithT(t)
+
+			crc := &clusterReconcileContext{
+				cluster: &clusterv1.Cluster{
+					Spec: clusterv1.ClusterSpec{ControlPlaneEndpoint: c.clusterEndpoint},
+				},
+				tinkerbellCluster: &infrastructurev1.TinkerbellCluster{
+					Spec: infrastructurev1.TinkerbellClusterSpec{ControlPlaneEndpoint: c.tinkerbellClusterEndpoint},
+				},
+			}
+
+			endpoint, err := crc.controlPlaneEndpoint()
+			if c.expectedError != nil {
+				g.Expect(err).To(MatchError(c.expectedError))
+
+				return
+			}
+
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(endpoint).To(Equal(c.expected))
+		})
+	}
+}
+
+//nolint:paralleltest // TINKERBELL_IP is read from the environment.
+func Test_metadataURL(t *testing.T) {
+	cases := map[string]struct {
+		tinkerbellIP  string
+		failureDomain *infrastructurev1.TinkerbellFailureDomain
+		metadataTLS   *infrastructurev1.MetadataTLS
+		expected      string
+		expectedErr   error
+	}{
+		"defaults_tinkerbell_ip": {
+			expected: "http://192.168.1.1:50061",
+		},
+		"uses_ipv4_tinkerbell_ip": {
+			tinkerbellIP: "10.0.0.1",
+			expected:     "http://10.0.0.1:50061",
+		},
+		"brackets_ipv6_tinkerbell_ip": {
+			tinkerbellIP: "fd00::1",
+			expected:     "http://[fd00::1]:50061",
+		},
+		"keeps_bracketed_ipv6_tinkerbell_ip": {
+			tinkerbellIP: "[fd00::1]",
+			expected:     "http://[fd00::1]:50061",
+		},
+		"uses_metadata_url_of_failure_domain": {
+			tinkerbellIP:  "10.0.0.1",
+			failureDomain: &infrastructurev1.TinkerbellFailureDomain{MetadataURL: "http://[fd01::1]:50061"},
+			expected:      "http://[fd01::1]:50061",
+		},
+		"uses_https_with_metadata_tls": {
+			tinkerbellIP: "fd00::1",
+			metadataTLS:  &infrastructurev1.MetadataTLS{},
+			expected:     "https://[fd00::1]:50061",
+		},
+		"uses_metadata_tls_url": {
+			tinkerbellIP: "10.0.0.1",
+			metadataTLS:  &infrastructurev1.MetadataTLS{URL: "https://hegel.example.com"},
+			expected:     "https://hegel.example.com",
+		},
+		"prefers_metadata_url_of_failure_domain_over_metadata_tls_url": {
+			failureDomain: &infrastructurev1.TinkerbellFailureDomain{MetadataURL: "https://10.1.0.1:50061"},
+			metadataTLS:   &infrastructurev1.MetadataTLS{URL: "https://hegel.example.com"},
+			expected:      "https://10.1.0.1:50061",
+		},
+		"refuses_http_metadata_url_of_failure_domain_with_metadata_tls": {
+			failureDomain: &infrastructurev1.TinkerbellFailureDomain{MetadataURL: "http://10.1.0.1:50061"},
+			metadataTLS:   &infrastructurev1.MetadataTLS{URL: "https://hegel.example.com"},
+			expectedErr:   ErrInsecureMetadataURL,
+		},
+	}
+
+	for name, c := range cases {
+		c := c
+
+		t.Run(name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			t.Setenv("TINKERBELL_IP", c.tinkerbellIP)
+
+			bmrc := &baseMachineReconcileContext{failureDomain: c.failureDomain}
+			metadataURL, err := bmrc.metadataURL(c.metadataTLS)
+			if c.expectedErr != nil {
+				g.Expect(err).To(MatchError(c.expectedErr))
+
+				return
+			}
+
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(metadataURL).To(Equal(c.expected))
+		})
+	}
+}
@@ -26,7 +26,9 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/controllers/remote"
 	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/conditions"
 	"sigs.k8s.io/cluster-api/util/patch"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -47,16 +49,33 @@ type ReconcileContext interface {
 // baseMachineReconcileContext contains enough information to decide if given machine should
 // be removed or created.
 type baseMachineReconcileContext struct {
-	log               logr.Logger
-	ctx               context.Context
-	tinkerbellMachine *infrastructurev1.TinkerbellMachine
-	patchHelper       *patch.Helper
-	client            client.Client
+	log                     logr.Logger
+	ctx                     context.Context
+	tinkerbellMachine       *infrastructurev1.TinkerbellMachine
+	patchHelper             *patch.Helper
+	client                  client.Client
+	remoteClientGetter      remote.ClusterClientGetter
+	hardwareFaultConditions []string
+	hardwareFaultLabels     []string
+	stackClientGetter       StackClientGetter
+	imageCacheURL           string
+	usageAccountant         *UsageAccountant
+	ownershipMigrator       *HardwareOwnershipMigrator
+	apiReader               client.Reader
+
+	// tinkClient and tinkNamespace address the Tinkerbell stack serving the failure domain of the
+	// machine, which holds its Hardware, Template, Workflow and BMC Jobs.
+	tinkClient    client.Client
+	tinkNamespace string
+	failureDomain *infrastructurev1.TinkerbellFailureDomain
+	// stackUnavailable is why the Tinkerbell stack of a machine being deleted can't be reached.
+	stackUnavailable error
 }
 
 // BaseMachineReconcileContext is an interface allowing basic machine reconciliation which
 // involves either object removal or further processing using MachineReconcileContext interface.
 type BaseMachineReconcileContext interface {
+	MachineHeld() (bool, error)
 	MachineScheduledForDeletion() bool
 	DeleteMachineWithDependencies() error
 	IntoMachineReconcileContext() (ReconcileContext, error)
@@ -78,6 +97,8 @@ var (
 	ErrBootstrapUserDataEmpty = fmt.Errorf("received bootstrap user data is empty")
 	// errWorkflowFailed is the error returned when the workflow fails.
 	errWorkflowFailed = fmt.Errorf("workflow failed")
+	// errBMCJobFailed is the error returned when a BMC Job fails.
+	errBMCJobFailed = fmt.Errorf("bmc job failed")
 )
 
 // New builds a context for machine reconciliation process, collecting all required
@@ -96,10 +117,26 @@ func (tmr *TinkerbellMachineReconciler) newReconcileContext(ctx context.Context,
 	log := ctrl.LoggerFrom(ctx)
 
 	bmrc := &baseMachineReconcileContext{
-		log:               log.WithValues("TinkerbellMachine", namespacedName),
-		ctx:               ctx,
-		tinkerbellMachine: &infrastructurev1.TinkerbellMachine{},
-		client:            tmr.Client,
+		log:                     log.WithValues("TinkerbellMachine", namespacedName),
+		ctx:                     ctx,
+		tinkerbellMachine:       &infrastructurev1.TinkerbellMachine{},
+		client:                  tmr.Client,
+		remoteClientGetter:      tmr.RemoteClientGetter,
+		hardwareFaultConditions: tmr.HardwareFaultConditions,
+		hardwareFaultLabels:     tmr.HardwareFaultLabels,
+		stackClientGetter:       tmr.StackClientGetter,
+		imageCacheURL:           tmr.ImageCacheURL,
+		usageAccountant:         tmr.UsageAccountant,
+		ownershipMigrator:       tmr.HardwareOwnershipMigrator,
+		apiReader:               tmr.APIReader,
+	}
+
+	if bmrc.remoteClientGetter == nil {
+		bmrc.remoteClientGetter = remote.NewClusterClient
+	}
+
+	if bmrc.apiReader == nil {
+		bmrc.apiReader = tmr.Client
 	}
 
 	if err := bmrc.client.Get(bmrc.ctx, namespacedName, bmrc.tinkerbellMachine); err != nil {
@@ -119,9 +156,62 @@ func (tmr *TinkerbellMachineReconciler) newReconcileContext(ctx context.Context,
 
 	bmrc.patchHelper = patchHelper
 
+	if err := bmrc.resolveTinkerbellStack(); err != nil {
+		return nil, ctrl.Result{}, fmt.Errorf("resolving Tinkerbell stack: %w", err)
+	}
+
 	return bmrc, ctrl.Result{}, nil
 }
 
+// MachineHeld implements BaseMachineReconcileContext interface method. It returns true when the
+// TinkerbellMachine is held after a provisioning failure and must not be touched. If the hold
+// annotation has been removed, the hold status is cleared and false is returned.
+func (bmrc *baseMachineReconcileContext) MachineHeld() (bool, error) {
+	hold := bmrc.tinkerbellMachine.Status.Hold
+	if hold == nil {
+		return false, nil
+	}
+
+	if _, ok := bmrc.tinkerbellMachine.Annotations[infrastructurev1.HoldOnFailureAnnotation]; ok {
+		bmrc.log.Info("TinkerbellMachine is held after provisioning failure; skipping reconciliation",
+			"failedAction", hold.FailedAction, "since", hold.Since)
+
+		return true, nil
+	}
+
+	bmrc.log.Info("Hold annotation removed; resuming reconciliation", "failedAction", hold.FailedAction)
+
+	// A machine being deleted is about to go away, so there is no point in clearing its status.
+	if bmrc.MachineScheduledForDeletion() {
+		return false, nil
+	}
+
+	bmrc.tinkerbellMachine.Status.Hold = nil
+
+	return false, bmrc.patch()
+}
+
+// holdRequested returns true if the TinkerbellMachine asks to be held on provisioning failure.
+func (bmrc *baseMachineReconcileContext) holdRequested() bool {
+	_, ok := bmrc.tinkerbellMachine.Annotations[infrastructurev1.HoldOnFailureAnnotation]
+
+	return ok
+}
+
+// hold records a provisioning failure in the TinkerbellMachine status, which freezes further
+// reconciliation until the hold annotation is removed.
+func (bmrc *baseMachineReconcileContext) hold(failedAction, reason string) error {
+	bmrc.log.Info("Holding TinkerbellMachine after provisioning failure", "failedAction", failedAction, "reason", reason)
+
+	bmrc.tinkerbellMachine.Status.Hold = &infrastructurev1.HoldStatus{
+		FailedAction: failedAction,
+		Reason:       reason,
+		Since:        metav1.Now(),
+	}
+
+	return bmrc.patch()
+}
+
 // MachineScheduledForDeletion implements BaseMachineReconcileContext interface method
 // using TinkerbellMachine deletion timestamp.
 func (bmrc *baseMachineReconcileContext) MachineScheduledForDeletion() bool {
@@ -129,13 +219,31 @@ func (bmrc *baseMachineReconcileContext) MachineScheduledForDeletion() bool {
 }
 
 func (bmrc *baseMachineReconcileContext) releaseHardware(hardware *tinkv1.Hardware) error {
-	patchHelper, err := patch.NewHelper(hardware, bmrc.client)
+	patchHelper, err := patch.NewHelper(hardware, bmrc.tinkClient)
 	if err != nil {
 		return fmt.Errorf("initializing patch helper for selected hardware: %w", err)
 	}
 
+	if err := bmrc.usageAccountant.endAllocation(bmrc.ctx, hardware); err != nil {
+		return fmt.Errorf("accounting hardware usage: %w", err)
+	}
+
+	clearHardwareOwnership(hardware)
+
+	if err := patchHelper.Patch(bmrc.ctx, hardware); err != nil {
+		return fmt.Errorf("patching Hardware object: %w", err)
+	}
+
+	return nil
+}
+
+// clearHardwareOwnership removes the machine ownership labels and finalizer from the hardware.
+func clearHardwareOwnership(hardware *tinkv1.Hardware) {
 	delete(hardware.ObjectMeta.Labels, HardwareOwnerNameLabel)
 	delete(hardware.ObjectMeta.Labels, HardwareOwnerNamespaceLabel)
+	delete(hardware.ObjectMeta.Annotations, HardwareAllocatedClusterAnnotation)
+	delete(hardware.ObjectMeta.Annotations, HardwareUsageAccountedAtAnnotation)
+	delete(hardware.ObjectMeta.Annotations, HardwareFirmwareUpdateAnnotation)
 	// setting these Metadata.State and Metadata.Instance.State = "" indicates to Boots
 	// that this hardware should be allowed to netboot. FYI, this is not authoritative.
 	// Other hardware values can be set to prohibit netbooting of a machine.
@@ -144,21 +252,15 @@ func (bmrc *baseMachineReconcileContext) releaseHardware(hardware *tinkv1.Hardwa
 	hardware.Spec.Metadata.Instance.State = ""
 
 	controllerutil.RemoveFinalizer(hardware, infrastructurev1.MachineFinalizer)
-
-	if err := patchHelper.Patch(bmrc.ctx, hardware); err != nil {
-		return fmt.Errorf("patching Hardware object: %w", err)
-	}
-
-	return nil
 }
 
 func (bmrc *baseMachineReconcileContext) getHardwareForMachine(hardware *tinkv1.Hardware) error {
 	namespacedName := types.NamespacedName{
 		Name:      bmrc.tinkerbellMachine.Spec.HardwareName,
-		Namespace: bmrc.tinkerbellMachine.Namespace,
+		Namespace: bmrc.tinkNamespace,
 	}
 
-	if err := bmrc.client.Get(bmrc.ctx, namespacedName, hardware); err != nil {
+	if err := bmrc.tinkClient.Get(bmrc.ctx, namespacedName, hardware); err != nil {
 		return fmt.Errorf("getting hardware: %w", err)
 	}
 
@@ -171,7 +273,7 @@ func (bmrc *baseMachineReconcileContext) createPowerOffJob(hardware *tinkv1.Hard
 	bmcJob := &rufiov1.Job{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      fmt.Sprintf("%s-poweroff", bmrc.tinkerbellMachine.Name),
-			Namespace: bmrc.tinkerbellMachine.Namespace,
+			Namespace: bmrc.tinkNamespace,
 			OwnerReferences: []metav1.OwnerReference{
 				{
 					APIVersion: "infrastructure.cluster.x-k8s.io/v1beta1",
@@ -185,7 +287,7 @@ func (bmrc *baseMachineReconcileContext) createPowerOffJob(hardware *tinkv1.Hard
 		Spec: rufiov1.JobSpec{
 			MachineRef: rufiov1.MachineRef{
 				Name:      hardware.Spec.BMCRef.Name,
-				Namespace: bmrc.tinkerbellMachine.Namespace,
+				Namespace: bmrc.tinkNamespace,
 			},
 			Tasks: []rufiov1.Action{
 				{
@@ -195,7 +297,11 @@ func (bmrc *baseMachineReconcileContext) createPowerOffJob(hardware *tinkv1.Hard
 		},
 	}
 
-	if err := bmrc.client.Create(bmrc.ctx, bmcJob); err != nil {
+	if !bmrc.stackOwnsObjects() {
+		bmcJob.OwnerReferences = nil
+	}
+
+	if err := bmrc.tinkClient.Create(bmrc.ctx, bmcJob); err != nil {
 		return fmt.Errorf("creating BMCJob: %w", err)
 	}
 
@@ -210,10 +316,10 @@ func (bmrc *baseMachineReconcileContext) createPowerOffJob(hardware *tinkv1.Hard
 func (bmrc *baseMachineReconcileContext) getJob(name string, job *rufiov1.Job) error {
 	namespacedName := types.NamespacedName{
 		Name:      name,
-		Namespace: bmrc.tinkerbellMachine.Namespace,
+		Namespace: bmrc.tinkNamespace,
 	}
 
-	if err := bmrc.client.Get(bmrc.ctx, namespacedName, job); err != nil {
+	if err := bmrc.tinkClient.Get(bmrc.ctx, namespacedName, job); err != nil {
 		return fmt.Errorf("GET BMCJob: %w", err)
 	}
 
@@ -223,6 +329,11 @@ func (bmrc *baseMachineReconcileContext) getJob(name string, job *rufiov1.Job) e
 // DeleteMachineWithDependencies removes template and workflow objects associated with given machine.
 func (bmrc *baseMachineReconcileContext) DeleteMachineWithDependencies() error {
 	bmrc.log.Info("Removing machine", "hardwareName", bmrc.tinkerbellMachine.Spec.HardwareName)
+
+	if bmrc.stackUnavailable != nil {
+		return bmrc.waitForUnavailableStack()
+	}
+
 	// Fetch hardware for the machine.
 	hardware := &tinkv1.Hardware{}
 	if err := bmrc.getHardwareForMachine(hardware); err != nil {
@@ -245,6 +356,35 @@ func (bmrc *baseMachineReconcileContext) DeleteMachineWithDependencies() error {
 	return bmrc.ensureBMCJobCompletionForDelete(hardware)
 }
 
+// waitForUnavailableStack keeps the finalizer of a machine being deleted whose Tinkerbell stack can't
+// be reached, as its Hardware would otherwise stay owned forever, and polls for the stack to come
+// back. With the AbandonStackObjectsAnnotation, the finalizer is removed and the objects of the
+// machine are left behind in the stack.
+func (bmrc *baseMachineReconcileContext) waitForUnavailableStack() error {
+	if _, ok := bmrc.tinkerbellMachine.Annotations[infrastructurev1.AbandonStackObjectsAnnotation]; ok {
+		bmrc.log.Error(bmrc.stackUnavailable, "Tinkerbell stack of machine is unavailable; leaving its Hardware, "+
+			"Template, Workflow and BMC Jobs behind as requested")
+
+		controllerutil.RemoveFinalizer(bmrc.tinkerbellMachine, infrastructurev1.MachineFinalizer)
+
+		return bmrc.patch()
+	}
+
+	bmrc.log.Error(bmrc.stackUnavailable, "Tinkerbell stack of machine is unavailable; waiting for it to release "+
+		"the Hardware of the machine")
+
+	conditions.MarkFalse(bmrc.tinkerbellMachine, infrastructurev1.TinkerbellStackAvailableCondition,
+		infrastructurev1.TinkerbellStackUnavailableReason, clusterv1.ConditionSeverityWarning,
+		"%s; set the %s annotation to delete the machine anyway", bmrc.stackUnavailable.Error(),
+		infrastructurev1.AbandonStackObjectsAnnotation)
+
+	if err := bmrc.patch(); err != nil {
+		return err
+	}
+
+	return &errRequeueAfter{after: unwatchedStackPollInterval}
+}
+
 // removeDependencies removes the Template, Workflow linked to the machine.
 // Deletes the machine hardware labels for the machine.
 func (bmrc *baseMachineReconcileContext) removeDependencies(hardware *tinkv1.Hardware) error {
@@ -256,6 +396,14 @@ func (bmrc *baseMachineReconcileContext) removeDependencies(hardware *tinkv1.Har
 		return fmt.Errorf("removing Workflow: %w", err)
 	}
 
+	if reason := bmrc.hardwareFaultReason(); reason != "" {
+		if err := bmrc.quarantineHardware(hardware, reason); err != nil {
+			return fmt.Errorf("quarantining Hardware: %w", err)
+		}
+
+		return nil
+	}
+
 	if err := bmrc.releaseHardware(hardware); err != nil {
 		return fmt.Errorf("releasing Hardware: %w", err)
 	}
@@ -264,6 +412,10 @@ func (bmrc *baseMachineReconcileContext) removeDependencies(hardware *tinkv1.Har
 }
 
 func (bmrc *baseMachineReconcileContext) removeFinalizer() error {
+	if err := bmrc.removeUnownedJobs(); err != nil {
+		return fmt.Errorf("removing BMCJobs: %w", err)
+	}
+
 	controllerutil.RemoveFinalizer(bmrc.tinkerbellMachine, infrastructurev1.MachineFinalizer)
 
 	bmrc.log.Info("Patching Machine object to remove finalizer")
@@ -293,7 +445,7 @@ func (bmrc *baseMachineReconcileContext) ensureBMCJobCompletionForDelete(hardwar
 	}
 
 	if bmcJob.HasCondition(rufiov1.JobFailed, rufiov1.ConditionTrue) {
-		return fmt.Errorf("bmc job %s/%s failed", bmcJob.Namespace, bmcJob.Name) //nolint:goerr113
+		return fmt.Errorf("%w: %s/%s", errBMCJobFailed, bmcJob.Namespace, bmcJob.Name)
 	}
 
 	return nil
@@ -345,12 +497,12 @@ func (bmrc *baseMachineReconcileContext) Log() logr.Logger {
 func (bmrc *baseMachineReconcileContext) removeTemplate() error {
 	namespacedName := types.NamespacedName{
 		Name:      bmrc.tinkerbellMachine.Name,
-		Namespace: bmrc.tinkerbellMachine.Namespace,
+		Namespace: bmrc.tinkNamespace,
 	}
 
 	template := &tinkv1.Template{}
 
-	err := bmrc.client.Get(bmrc.ctx, namespacedName, template)
+	err := bmrc.tinkClient.Get(bmrc.ctx, namespacedName, template)
 	if err != nil {
 		if apierrors.IsNotFound(err) {
 			bmrc.log.Info("Template already removed", "name", namespacedName)
@@ -363,7 +515,7 @@ func (bmrc *baseMachineReconcileContext) removeTemplate() error {
 
 	bmrc.log.Info("Removing Template", "name", namespacedName)
 
-	if err := bmrc.client.Delete(bmrc.ctx, template); err != nil {
+	if err := bmrc.tinkClient.Delete(bmrc.ctx, template); err != nil {
 		return fmt.Errorf("ensuring template has been removed: %w", err)
 	}
 
@@ -374,12 +526,12 @@ func (bmrc *baseMachineReconcileContext) removeTemplate() error {
 func (bmrc *baseMachineReconcileContext) removeWorkflow() error {
 	namespacedName := types.NamespacedName{
 		Name:      bmrc.tinkerbellMachine.Name,
-		Namespace: bmrc.tinkerbellMachine.Namespace,
+		Namespace: bmrc.tinkNamespace,
 	}
 
 	workflow := &tinkv1.Workflow{}
 
-	err := bmrc.client.Get(bmrc.ctx, namespacedName, workflow)
+	err := bmrc.tinkClient.Get(bmrc.ctx, namespacedName, workflow)
 	if err != nil {
 		if apierrors.IsNotFound(err) {
 			bmrc.log.Info("Workflow already removed", "name", namespacedName)
@@ -392,7 +544,7 @@ func (bmrc *baseMachineReconcileContext) removeWorkflow() error {
 
 	bmrc.log.Info("Removing Workflow", "name", namespacedName)
 
-	if err := bmrc.client.Delete(bmrc.ctx, workflow); err != nil {
+	if err := bmrc.tinkClient.Delete(bmrc.ctx, workflow); err != nil {
 		return fmt.Errorf("ensuring workflow has been removed: %w", err)
 	}
 
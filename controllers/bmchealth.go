@@ -0,0 +1,234 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/cluster-api/util/patch"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	rufiov1 "github.com/tinkerbell/rufio/api/v1alpha1"
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/internal/redfish"
+)
+
+// DefaultRedfishPort is the port BMC Redfish services are expected to listen on.
+const DefaultRedfishPort = 443
+
+// ErrBMCCredentialsMissing is returned when the BMC auth Secret has no username or password.
+var ErrBMCCredentialsMissing = fmt.Errorf("BMC auth secret must contain username and password")
+
+// BMCHealthPoller periodically reads the hardware health of TinkerbellMachines from the BMC of their
+// Hardware and reflects it as conditions on the TinkerbellMachine. The BMC address and credentials
+// are taken from the rufio Machine referenced by the Hardware.
+type BMCHealthPoller struct {
+	Client           client.Client
+	WatchFilterValue string
+
+	// Interval is the time between two polls of all machines.
+	Interval time.Duration
+
+	// RedfishPort is the port of the Redfish service of the BMCs. The rufio Machine port is the
+	// IPMI port, so it can't be used for Redfish.
+	RedfishPort int
+
+	// StackClientGetter builds clients for the Tinkerbell stacks of failure domains running outside
+	// of the management cluster. If nil, clients are built from the scheme of the manager.
+	StackClientGetter StackClientGetter
+}
+
+// +kubebuilder:rbac:groups=bmc.tinkerbell.org,resources=machines,verbs=get;list;watch
+
+// SetupWithManager registers the poller to be started with the manager.
+func (p *BMCHealthPoller) SetupWithManager(mgr ctrl.Manager) error {
+	if p.StackClientGetter == nil {
+		p.StackClientGetter = NewCachingStackClientGetter(mgr.GetScheme())
+	}
+
+	if err := mgr.Add(p); err != nil {
+		return fmt.Errorf("adding BMC health poller to manager: %w", err)
+	}
+
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, so only the leader polls BMCs.
+func (p *BMCHealthPoller) NeedLeaderElection() bool {
+	return true
+}
+
+// Start polls until the context is cancelled.
+func (p *BMCHealthPoller) Start(ctx context.Context) error {
+	wait.UntilWithContext(ctx, p.Poll, p.Interval)
+
+	return nil
+}
+
+// Poll updates the BMC health conditions of all TinkerbellMachines bound to Hardware.
+func (p *BMCHealthPoller) Poll(ctx context.Context) {
+	log := ctrl.LoggerFrom(ctx).WithName("bmc-health-poller")
+
+	listOptions := []client.ListOption{}
+	if p.WatchFilterValue != "" {
+		listOptions = append(listOptions, client.MatchingLabels{clusterv1.WatchLabel: p.WatchFilterValue})
+	}
+
+	machines := &infrastructurev1.TinkerbellMachineList{}
+	if err := p.Client.List(ctx, machines, listOptions...); err != nil {
+		log.Error(err, "Listing TinkerbellMachines")
+
+		return
+	}
+
+	for i := range machines.Items {
+		machine := &machines.Items[i]
+
+		if machine.Spec.HardwareName == "" || !machine.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		if err := p.pollMachine(ctx, machine); err != nil {
+			log.Error(err, "Updating BMC health", "TinkerbellMachine", client.ObjectKeyFromObject(machine))
+		}
+	}
+}
+
+func (p *BMCHealthPoller) pollMachine(ctx context.Context, machine *infrastructurev1.TinkerbellMachine) error {
+	patchHelper, err := patch.NewHelper(machine, p.Client)
+	if err != nil {
+		return fmt.Errorf("initializing patch helper: %w", err)
+	}
+
+	health, err := p.health(ctx, machine)
+
+	switch {
+	case health != nil:
+		conditions.MarkTrue(machine, infrastructurev1.BMCReachableCondition)
+		setComponentHealth(machine, infrastructurev1.PowerSupplyHealthyCondition,
+			infrastructurev1.PowerSupplyFaultReason, health.PowerSupplies)
+		setComponentHealth(machine, infrastructurev1.MemoryHealthyCondition,
+			infrastructurev1.MemoryFaultReason, health.Memory)
+		setComponentHealth(machine, infrastructurev1.ThermalHealthyCondition,
+			infrastructurev1.ThermalFaultReason, health.Thermal)
+	case err == nil:
+		conditions.MarkFalse(machine, infrastructurev1.BMCReachableCondition, infrastructurev1.BMCNotConfiguredReason,
+			clusterv1.ConditionSeverityInfo, "Hardware has no BMC reference")
+	default:
+		conditions.MarkFalse(machine, infrastructurev1.BMCReachableCondition, infrastructurev1.BMCUnreachableReason,
+			clusterv1.ConditionSeverityWarning, err.Error())
+	}
+
+	if err := patchHelper.Patch(ctx, machine, patch.WithOwnedConditions{Conditions: []clusterv1.ConditionType{
+		infrastructurev1.BMCReachableCondition,
+		infrastructurev1.PowerSupplyHealthyCondition,
+		infrastructurev1.MemoryHealthyCondition,
+		infrastructurev1.ThermalHealthyCondition,
+	}}); err != nil {
+		return fmt.Errorf("patching TinkerbellMachine: %w", err)
+	}
+
+	return nil
+}
+
+// health returns the health reported by the BMC of the machine's Hardware. A nil health and nil error
+// is returned if the Hardware has no BMC. The Hardware, BMC and its credentials are read from the
+// Tinkerbell stack of the machine.
+func (p *BMCHealthPoller) health(
+	ctx context.Context, machine *infrastructurev1.TinkerbellMachine,
+) (*redfish.Health, error) {
+	stack, err := MachineTinkerbellStack(ctx, p.Client, p.StackClientGetter, machine)
+	if err != nil {
+		return nil, err
+	}
+
+	hardware := &tinkv1.Hardware{}
+	hardwareKey := types.NamespacedName{Name: machine.Spec.HardwareName, Namespace: stack.Namespace}
+
+	if err := stack.Client.Get(ctx, hardwareKey, hardware); err != nil {
+		return nil, fmt.Errorf("getting hardware: %w", err)
+	}
+
+	if hardware.Spec.BMCRef == nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	bmc := &rufiov1.Machine{}
+	bmcKey := types.NamespacedName{Name: hardware.Spec.BMCRef.Name, Namespace: hardware.Namespace}
+
+	if err := stack.Client.Get(ctx, bmcKey, bmc); err != nil {
+		return nil, fmt.Errorf("getting BMC machine: %w", err)
+	}
+
+	secretRef := bmc.Spec.Connection.AuthSecretRef
+
+	secret := &corev1.Secret{}
+	secretKey := types.NamespacedName{Name: secretRef.Name, Namespace: secretRef.Namespace}
+
+	if err := stack.Client.Get(ctx, secretKey, secret); err != nil {
+		return nil, fmt.Errorf("getting BMC auth secret: %w", err)
+	}
+
+	username, password := string(secret.Data["username"]), string(secret.Data["password"])
+	if username == "" || password == "" {
+		return nil, ErrBMCCredentialsMissing
+	}
+
+	port := p.RedfishPort
+	if port == 0 {
+		port = DefaultRedfishPort
+	}
+
+	endpoint := "https://" + net.JoinHostPort(bmc.Spec.Connection.Host, strconv.Itoa(port))
+
+	health, err := redfish.NewClient(endpoint, username, password, bmc.Spec.Connection.InsecureTLS).Health(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading BMC health: %w", err)
+	}
+
+	return health, nil
+}
+
+func setComponentHealth(machine *infrastructurev1.TinkerbellMachine, conditionType clusterv1.ConditionType,
+	reason string, health redfish.ComponentHealth,
+) {
+	if health.Healthy() {
+		conditions.MarkTrue(machine, conditionType)
+
+		return
+	}
+
+	severity := clusterv1.ConditionSeverityWarning
+	if health.Health == redfish.HealthCritical {
+		severity = clusterv1.ConditionSeverityError
+	}
+
+	conditions.MarkFalse(machine, conditionType, reason, severity, strings.Join(health.Faults, "; "))
+}
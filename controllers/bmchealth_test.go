@@ -0,0 +1,184 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+
+	rufiov1 "github.com/tinkerbell/rufio/api/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/controllers"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/internal/redfish"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/internal/redfish/redfishtest"
+)
+
+const (
+	bmcName       = "myBMC"
+	bmcSecretName = "myBMCSecret"
+)
+
+func bmcObjects(t *testing.T, server *redfishtest.Server) ([]runtime.Object, int) {
+	t.Helper()
+	g := NewWithT(t)
+
+	serverURL, err := url.Parse(server.URL)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	host, port, err := net.SplitHostPort(serverURL.Host)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	redfishPort, err := strconv.Atoi(port)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	return []runtime.Object{
+		&rufiov1.Machine{
+			ObjectMeta: metav1.ObjectMeta{Name: bmcName, Namespace: clusterNamespace},
+			Spec: rufiov1.MachineSpec{
+				Connection: rufiov1.Connection{
+					Host:          host,
+					Port:          623, //nolint:gomnd
+					InsecureTLS:   true,
+					AuthSecretRef: corev1.SecretReference{Name: bmcSecretName, Namespace: clusterNamespace},
+				},
+			},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: bmcSecretName, Namespace: clusterNamespace},
+			Data: map[string][]byte{
+				"username": []byte(server.Username),
+				"password": []byte(server.Password),
+			},
+		},
+	}, redfishPort
+}
+
+func Test_BMC_health_poller(t *testing.T) {
+	t.Parallel()
+
+	for name, c := range map[string]struct {
+		mutateServer func(*redfishtest.Server)
+		withoutBMC   bool
+		validateF    func(*WithT, *infrastructurev1.TinkerbellMachine)
+	}{
+		"marks_healthy_components": {
+			validateF: func(g *WithT, m *infrastructurev1.TinkerbellMachine) {
+				g.Expect(conditions.IsTrue(m, infrastructurev1.BMCReachableCondition)).To(BeTrue())
+				g.Expect(conditions.IsTrue(m, infrastructurev1.PowerSupplyHealthyCondition)).To(BeTrue())
+				g.Expect(conditions.IsTrue(m, infrastructurev1.MemoryHealthyCondition)).To(BeTrue())
+				g.Expect(conditions.IsTrue(m, infrastructurev1.ThermalHealthyCondition)).To(BeTrue())
+			},
+		},
+		"marks_faulty_components": {
+			mutateServer: func(s *redfishtest.Server) {
+				s.PowerSupplyHealth = redfish.HealthCritical
+				s.MemoryHealth = redfish.HealthWarning
+			},
+			validateF: func(g *WithT, m *infrastructurev1.TinkerbellMachine) {
+				g.Expect(conditions.IsFalse(m, infrastructurev1.PowerSupplyHealthyCondition)).To(BeTrue())
+				g.Expect(conditions.GetReason(m, infrastructurev1.PowerSupplyHealthyCondition)).To(
+					Equal(infrastructurev1.PowerSupplyFaultReason))
+				g.Expect(*conditions.GetSeverity(m, infrastructurev1.PowerSupplyHealthyCondition)).To(
+					Equal(clusterv1.ConditionSeverityError))
+				g.Expect(conditions.GetMessage(m, infrastructurev1.PowerSupplyHealthyCondition)).To(
+					Equal("power supply PSU1 is Critical"))
+
+				g.Expect(conditions.IsFalse(m, infrastructurev1.MemoryHealthyCondition)).To(BeTrue())
+				g.Expect(*conditions.GetSeverity(m, infrastructurev1.MemoryHealthyCondition)).To(
+					Equal(clusterv1.ConditionSeverityWarning))
+
+				g.Expect(conditions.IsTrue(m, infrastructurev1.ThermalHealthyCondition)).To(BeTrue())
+			},
+		},
+		"marks_bmc_unreachable_with_wrong_credentials": {
+			mutateServer: func(s *redfishtest.Server) {
+				s.Password = "changed"
+			},
+			validateF: func(g *WithT, m *infrastructurev1.TinkerbellMachine) {
+				g.Expect(conditions.IsFalse(m, infrastructurev1.BMCReachableCondition)).To(BeTrue())
+				g.Expect(conditions.GetReason(m, infrastructurev1.BMCReachableCondition)).To(
+					Equal(infrastructurev1.BMCUnreachableReason))
+				g.Expect(conditions.Has(m, infrastructurev1.PowerSupplyHealthyCondition)).To(BeFalse())
+			},
+		},
+		"marks_bmc_not_configured_without_bmc_reference": {
+			withoutBMC: true,
+			validateF: func(g *WithT, m *infrastructurev1.TinkerbellMachine) {
+				g.Expect(conditions.GetReason(m, infrastructurev1.BMCReachableCondition)).To(
+					Equal(infrastructurev1.BMCNotConfiguredReason))
+			},
+		},
+	} {
+		c := c
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			g := NewWithT(t)
+
+			server := redfishtest.NewServer("admin", "secret")
+			defer server.Close()
+
+			objects, redfishPort := bmcObjects(t, server)
+
+			if c.mutateServer != nil {
+				c.mutateServer(server)
+			}
+
+			hardwareUUID := uuid.New().String()
+			hardware := validHardware(hardwareName, hardwareUUID, hardwareIP)
+
+			if !c.withoutBMC {
+				hardware.Spec.BMCRef = &corev1.TypedLocalObjectReference{Name: bmcName, Kind: "Machine"}
+			}
+
+			tinkerbellMachine := validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID)
+			tinkerbellMachine.Spec.HardwareName = hardwareName
+
+			objects = append(objects, hardware, tinkerbellMachine)
+
+			client := kubernetesClientWithObjects(t, objects)
+
+			poller := &controllers.BMCHealthPoller{
+				Client:      client,
+				RedfishPort: redfishPort,
+			}
+
+			ctx := context.Background()
+
+			poller.Poll(ctx)
+
+			updatedMachine := &infrastructurev1.TinkerbellMachine{}
+			g.Expect(client.Get(ctx, types.NamespacedName{Name: tinkerbellMachineName, Namespace: clusterNamespace},
+				updatedMachine)).To(Succeed())
+
+			c.validateF(g, updatedMachine)
+		})
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/internal/cloudinit"
+)
+
+const bootstrapPartFilename = "bootstrap"
+
+var (
+	// ErrCloudInitPartKeyMissing is returned when the Secret or ConfigMap of a cloud-init part does
+	// not have the referenced key.
+	ErrCloudInitPartKeyMissing = fmt.Errorf("cloud-init part key is missing")
+	// ErrCloudInitPartSourceMissing is returned when a cloud-init part references neither a Secret
+	// nor a ConfigMap.
+	ErrCloudInitPartSourceMissing = fmt.Errorf("cloud-init part has no secretRef or configMapRef")
+)
+
+// userData returns the user data of the machine. Without extra cloud-init parts, this is the
+// bootstrap data. Otherwise, the bootstrap data is combined with the parts of the TinkerbellCluster
+// and the TinkerbellMachine into a MIME multipart document.
+func (mrc *machineReconcileContext) userData(bootstrapData string) (string, error) {
+	extraParts := append(append([]infrastructurev1.CloudInitPart{},
+		mrc.tinkerbellCluster.Spec.CloudInitParts...), mrc.tinkerbellMachine.Spec.CloudInitParts...)
+
+	if len(extraParts) == 0 {
+		return bootstrapData, nil
+	}
+
+	parts := []cloudinit.Part{
+		{
+			Filename:    bootstrapPartFilename,
+			ContentType: cloudinit.ContentTypeOf(bootstrapData),
+			Content:     bootstrapData,
+		},
+	}
+
+	for _, extraPart := range extraParts {
+		content, err := mrc.cloudInitPartContent(extraPart)
+		if err != nil {
+			return "", fmt.Errorf("reading cloud-init part %q: %w", extraPart.Name, err)
+		}
+
+		parts = append(parts, cloudinit.Part{
+			Filename:    extraPart.Name,
+			ContentType: extraPart.ContentType,
+			MergeType:   extraPart.MergeType,
+			Content:     content,
+		})
+	}
+
+	userData, err := cloudinit.Multipart(parts)
+	if err != nil {
+		return "", fmt.Errorf("combining cloud-init parts: %w", err)
+	}
+
+	return userData, nil
+}
+
+// cloudInitPartContent reads a cloud-init part from its Secret or ConfigMap.
+func (mrc *machineReconcileContext) cloudInitPartContent(part infrastructurev1.CloudInitPart) (string, error) {
+	namespace := mrc.tinkerbellMachine.Namespace
+
+	if ref := part.SecretRef; ref != nil {
+		secret := &corev1.Secret{}
+		if err := mrc.client.Get(mrc.ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, secret); err != nil {
+			return "", fmt.Errorf("getting Secret: %w", err)
+		}
+
+		content, ok := secret.Data[ref.Key]
+		if !ok {
+			return "", fmt.Errorf("%w: Secret %s has no key %s", ErrCloudInitPartKeyMissing, ref.Name, ref.Key)
+		}
+
+		return string(content), nil
+	}
+
+	ref := part.ConfigMapRef
+	if ref == nil {
+		return "", ErrCloudInitPartSourceMissing
+	}
+
+	configMap := &corev1.ConfigMap{}
+	if err := mrc.client.Get(mrc.ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, configMap); err != nil {
+		return "", fmt.Errorf("getting ConfigMap: %w", err)
+	}
+
+	content, ok := configMap.Data[ref.Key]
+	if !ok {
+		return "", fmt.Errorf("%w: ConfigMap %s has no key %s", ErrCloudInitPartKeyMissing, ref.Name, ref.Key)
+	}
+
+	return content, nil
+}
@@ -0,0 +1,523 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/cluster-api/util/patch"
+	"sigs.k8s.io/cluster-api/util/predicates"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/yaml"
+
+	rufiov1 "github.com/tinkerbell/rufio/api/v1alpha1"
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+)
+
+const (
+	// HardwareDecommissionAnnotation requests the decommissioning of Hardware. Its value is the name
+	// of the Template of the workflow securely wiping the Hardware, in the namespace of the Hardware.
+	HardwareDecommissionAnnotation = "v1alpha1.tinkerbell.org/decommission"
+
+	// HardwareDecommissionPhaseAnnotation records the step of the decommissioning the Hardware is in.
+	HardwareDecommissionPhaseAnnotation = "v1alpha1.tinkerbell.org/decommissionPhase"
+
+	// HardwareDecommissionMessageAnnotation describes what the decommissioning waits for, or why it failed.
+	HardwareDecommissionMessageAnnotation = "v1alpha1.tinkerbell.org/decommissionMessage"
+
+	// HardwareDecommissioningLabel is set on Hardware being decommissioned. Such Hardware is never
+	// selected for new machines.
+	HardwareDecommissioningLabel = "v1alpha1.tinkerbell.org/decommissioning"
+
+	// DecommissionedHardwareLabel is set on the ConfigMap archiving the provisioning history of
+	// decommissioned Hardware, to the name of the Hardware.
+	DecommissionedHardwareLabel = "v1alpha1.tinkerbell.org/decommissionedHardware"
+
+	// decommissionPollInterval is how often Hardware being decommissioned is checked while waiting
+	// for its machine to be replaced.
+	decommissionPollInterval = 30 * time.Second
+)
+
+// Steps of the decommissioning of Hardware, recorded in HardwareDecommissionPhaseAnnotation.
+const (
+	DecommissionReplacing      = "Replacing"
+	DecommissionWiping         = "Wiping"
+	DecommissionPoweringOff    = "PoweringOff"
+	DecommissionArchiving      = "Archiving"
+	DecommissionDecommissioned = "Decommissioned"
+	DecommissionFailed         = "Failed"
+)
+
+// HardwareDecommissionReconciler retires Hardware annotated with HardwareDecommissionAnnotation.
+// The Hardware is made ineligible for new machines, the machine running on it is replaced, the
+// Hardware is wiped and powered off, its provisioning history is archived in a ConfigMap and the
+// CAPT finalizer is removed, so the Hardware can be deleted.
+type HardwareDecommissionReconciler struct {
+	client.Client
+	WatchFilterValue string
+}
+
+// decommissionContext holds the state of a single reconcile of Hardware being decommissioned.
+type decommissionContext struct {
+	ctx      context.Context
+	log      logr.Logger
+	client   client.Client
+	hardware *tinkv1.Hardware
+}
+
+// +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machines/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update
+
+// Reconcile advances the decommissioning of the Hardware.
+func (r *HardwareDecommissionReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, reterr error) {
+	log := ctrl.LoggerFrom(ctx).WithValues("hardware", req.NamespacedName)
+
+	hardware := &tinkv1.Hardware{}
+	if err := r.Get(ctx, req.NamespacedName, hardware); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+
+		return ctrl.Result{}, fmt.Errorf("getting Hardware: %w", err)
+	}
+
+	if _, ok := hardware.Annotations[HardwareDecommissionAnnotation]; !ok {
+		return ctrl.Result{}, nil
+	}
+
+	switch hardware.Annotations[HardwareDecommissionPhaseAnnotation] {
+	case DecommissionDecommissioned, DecommissionFailed:
+		return ctrl.Result{}, nil
+	}
+
+	patchHelper, err := patch.NewHelper(hardware, r.Client)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("initializing patch helper: %w", err)
+	}
+
+	defer func() {
+		if err := patchHelper.Patch(ctx, hardware); err != nil {
+			reterr = kerrors.NewAggregate([]error{reterr, fmt.Errorf("patching Hardware: %w", err)})
+		}
+	}()
+
+	dc := &decommissionContext{
+		ctx:      ctx,
+		log:      log,
+		client:   r.Client,
+		hardware: hardware,
+	}
+
+	if err := dc.reconcile(); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if hardware.Annotations[HardwareDecommissionPhaseAnnotation] != DecommissionReplacing {
+		return ctrl.Result{}, nil
+	}
+
+	return ctrl.Result{RequeueAfter: decommissionPollInterval}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *HardwareDecommissionReconciler) SetupWithManager(
+	ctx context.Context,
+	mgr ctrl.Manager,
+	options controller.Options,
+) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	err := ctrl.NewControllerManagedBy(mgr).
+		Named("hardwaredecommission").
+		WithOptions(options).
+		For(&tinkv1.Hardware{}).
+		WithEventFilter(predicates.ResourceNotPausedAndHasFilterLabel(log, r.WatchFilterValue)).
+		Owns(&tinkv1.Workflow{}).
+		Owns(&rufiov1.Job{}).
+		Complete(r)
+	if err != nil {
+		return fmt.Errorf("failed to create controller: %w", err)
+	}
+
+	return nil
+}
+
+// reconcile runs the step of the decommissioning matching the phase of the Hardware.
+func (dc *decommissionContext) reconcile() error {
+	if dc.hardware.Labels == nil {
+		dc.hardware.Labels = map[string]string{}
+	}
+
+	if _, ok := dc.hardware.Labels[HardwareDecommissioningLabel]; !ok {
+		dc.log.Info("Decommissioning Hardware")
+
+		dc.hardware.Labels[HardwareDecommissioningLabel] = "true"
+		dc.setPhase(DecommissionReplacing, "")
+	}
+
+	if dc.hardware.Annotations[HardwareDecommissionAnnotation] == "" {
+		dc.setPhase(DecommissionFailed, "no wipe Template named by the "+HardwareDecommissionAnnotation+" annotation")
+
+		return nil
+	}
+
+	switch dc.hardware.Annotations[HardwareDecommissionPhaseAnnotation] {
+	case DecommissionReplacing:
+		return dc.replaceMachine()
+	case DecommissionWiping:
+		return dc.wipe()
+	case DecommissionPoweringOff:
+		return dc.powerOff()
+	case DecommissionArchiving:
+		return dc.archive()
+	default:
+		dc.setPhase(DecommissionReplacing, "")
+	}
+
+	return nil
+}
+
+// setPhase records the step of the decommissioning and its message.
+func (dc *decommissionContext) setPhase(phase, message string) {
+	if dc.hardware.Annotations == nil {
+		dc.hardware.Annotations = map[string]string{}
+	}
+
+	dc.hardware.Annotations[HardwareDecommissionPhaseAnnotation] = phase
+
+	if message == "" {
+		delete(dc.hardware.Annotations, HardwareDecommissionMessageAnnotation)
+	} else {
+		dc.hardware.Annotations[HardwareDecommissionMessageAnnotation] = message
+	}
+}
+
+// replaceMachine asks the controller of the Machine running on the Hardware to remediate it, the
+// same way a MachineHealthCheck does, and waits for the Hardware to be released.
+func (dc *decommissionContext) replaceMachine() error {
+	ownerName, owned := dc.hardware.Labels[HardwareOwnerNameLabel]
+	if !owned {
+		dc.setPhase(DecommissionWiping, "")
+
+		return dc.wipe()
+	}
+
+	tinkerbellMachine := &infrastructurev1.TinkerbellMachine{}
+	key := client.ObjectKey{Namespace: dc.hardware.Labels[HardwareOwnerNamespaceLabel], Name: ownerName}
+
+	if err := dc.client.Get(dc.ctx, key, tinkerbellMachine); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return fmt.Errorf("getting TinkerbellMachine: %w", err)
+		}
+
+		// The machine is gone without releasing the Hardware.
+		delete(dc.hardware.Labels, HardwareOwnerNameLabel)
+		delete(dc.hardware.Labels, HardwareOwnerNamespaceLabel)
+		dc.setPhase(DecommissionWiping, "")
+
+		return dc.wipe()
+	}
+
+	if !tinkerbellMachine.DeletionTimestamp.IsZero() {
+		dc.setPhase(DecommissionReplacing, fmt.Sprintf("waiting for machine %s to release the Hardware", key))
+
+		return nil
+	}
+
+	machine, err := util.GetOwnerMachine(dc.ctx, dc.client, tinkerbellMachine.ObjectMeta)
+	if err != nil {
+		return fmt.Errorf("getting Machine: %w", err)
+	}
+
+	if machine == nil || metav1.GetControllerOf(machine) == nil {
+		dc.setPhase(DecommissionReplacing, fmt.Sprintf("machine %s has no controller to replace it, delete it to continue", key))
+
+		return nil
+	}
+
+	if !conditions.IsFalse(machine, clusterv1.MachineOwnerRemediatedCondition) {
+		dc.log.Info("Requesting replacement of machine", "machine", machine.Name)
+
+		patchHelper, err := patch.NewHelper(machine, dc.client)
+		if err != nil {
+			return fmt.Errorf("initializing patch helper for Machine: %w", err)
+		}
+
+		conditions.MarkFalse(machine, clusterv1.MachineHealthCheckSucceededCondition, "HardwareDecommissioned",
+			clusterv1.ConditionSeverityWarning, "Hardware %s is being decommissioned", dc.hardware.Name)
+		conditions.MarkFalse(machine, clusterv1.MachineOwnerRemediatedCondition, clusterv1.WaitingForRemediationReason,
+			clusterv1.ConditionSeverityWarning, "")
+
+		if err := patchHelper.Patch(dc.ctx, machine); err != nil {
+			return fmt.Errorf("patching Machine %s: %w", machine.Name, err)
+		}
+	}
+
+	dc.setPhase(DecommissionReplacing, fmt.Sprintf("waiting for machine %s to be replaced", key))
+
+	return nil
+}
+
+// objectMeta returns the metadata of an object created for the decommissioning, owned by the Hardware.
+func (dc *decommissionContext) objectMeta(suffix string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:      dc.hardware.Name + "-decommission" + suffix,
+		Namespace: dc.hardware.Namespace,
+		OwnerReferences: []metav1.OwnerReference{
+			{
+				APIVersion: tinkv1.GroupVersion.String(),
+				Kind:       "Hardware",
+				Name:       dc.hardware.Name,
+				UID:        dc.hardware.UID,
+				Controller: pointer.Bool(true),
+			},
+		},
+	}
+}
+
+// ensureJob returns the BMC job with the metadata, creating it from newJob if it does not exist.
+func (dc *decommissionContext) ensureJob(meta metav1.ObjectMeta, newJob func() *rufiov1.Job) (*rufiov1.Job, error) {
+	job := &rufiov1.Job{}
+
+	err := dc.client.Get(dc.ctx, client.ObjectKey{Namespace: meta.Namespace, Name: meta.Name}, job)
+	if err == nil {
+		return job, nil
+	}
+
+	if !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("getting BMC job: %w", err)
+	}
+
+	job = newJob()
+
+	if err := dc.client.Create(dc.ctx, job); err != nil {
+		return nil, fmt.Errorf("creating BMC job: %w", err)
+	}
+
+	return job, nil
+}
+
+// wipe runs the wipe workflow on the Hardware, network booting it into Tinkerbell.
+func (dc *decommissionContext) wipe() error {
+	if dc.hardware.Spec.BMCRef == nil {
+		dc.setPhase(DecommissionFailed, "Hardware has no BMC")
+
+		return nil
+	}
+
+	// Without an instance ID, no worker would ever pick the wipe workflow up.
+	if hardwareInstanceID(dc.hardware) == "" {
+		dc.setPhase(DecommissionFailed, "Hardware has no metadata instance ID to run the wipe workflow on")
+
+		return nil
+	}
+
+	workflow := &tinkv1.Workflow{}
+	meta := dc.objectMeta("")
+
+	err := dc.client.Get(dc.ctx, client.ObjectKey{Namespace: meta.Namespace, Name: meta.Name}, workflow)
+	if apierrors.IsNotFound(err) {
+		// Allow the Hardware to netboot into the workflow, see clearHardwareOwnership.
+		if dc.hardware.Spec.Metadata != nil {
+			dc.hardware.Spec.Metadata.State = ""
+
+			if dc.hardware.Spec.Metadata.Instance != nil {
+				dc.hardware.Spec.Metadata.Instance.State = ""
+			}
+		}
+
+		workflow = &tinkv1.Workflow{
+			ObjectMeta: meta,
+			Spec: tinkv1.WorkflowSpec{
+				TemplateRef: dc.hardware.Annotations[HardwareDecommissionAnnotation],
+				HardwareRef: dc.hardware.Name,
+				HardwareMap: map[string]string{"device_1": hardwareInstanceID(dc.hardware)},
+			},
+		}
+
+		if err := dc.client.Create(dc.ctx, workflow); err != nil {
+			return fmt.Errorf("creating wipe workflow: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("getting wipe workflow: %w", err)
+	}
+
+	job, err := dc.ensureJob(dc.objectMeta("-pxe"), func() *rufiov1.Job {
+		return newBootJob(dc.objectMeta("-pxe"), dc.hardware, rufiov1.PXE)
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case job.HasCondition(rufiov1.JobFailed, rufiov1.ConditionTrue):
+		dc.setPhase(DecommissionFailed, fmt.Sprintf("BMC job %s booting the Hardware into Tinkerbell failed", job.Name))
+	case workflow.Status.State == tinkv1.WorkflowStateSuccess:
+		dc.setPhase(DecommissionPoweringOff, "")
+
+		return dc.powerOff()
+	case workflow.Status.State == tinkv1.WorkflowStateFailed, workflow.Status.State == tinkv1.WorkflowStateTimeout:
+		dc.setPhase(DecommissionFailed, fmt.Sprintf("wipe workflow %s finished in state %s", workflow.Name, workflow.Status.State))
+	default:
+		dc.setPhase(DecommissionWiping, fmt.Sprintf("waiting for wipe workflow %s", workflow.Name))
+	}
+
+	return nil
+}
+
+// hardwareInstanceID returns the instance ID of the Hardware, identifying it to workflows.
+func hardwareInstanceID(hardware *tinkv1.Hardware) string {
+	if hardware.Spec.Metadata == nil || hardware.Spec.Metadata.Instance == nil {
+		return ""
+	}
+
+	return hardware.Spec.Metadata.Instance.ID
+}
+
+// powerOff powers the wiped Hardware off.
+func (dc *decommissionContext) powerOff() error {
+	meta := dc.objectMeta("-poweroff")
+
+	job, err := dc.ensureJob(meta, func() *rufiov1.Job {
+		return &rufiov1.Job{
+			ObjectMeta: meta,
+			Spec: rufiov1.JobSpec{
+				MachineRef: rufiov1.MachineRef{
+					Name:      dc.hardware.Spec.BMCRef.Name,
+					Namespace: dc.hardware.Namespace,
+				},
+				Tasks: []rufiov1.Action{
+					{
+						PowerAction: rufiov1.PowerHardOff.Ptr(),
+					},
+				},
+			},
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case job.HasCondition(rufiov1.JobFailed, rufiov1.ConditionTrue):
+		dc.setPhase(DecommissionFailed, fmt.Sprintf("BMC job %s powering the Hardware off failed", job.Name))
+	case job.HasCondition(rufiov1.JobCompleted, rufiov1.ConditionTrue):
+		dc.setPhase(DecommissionArchiving, "")
+
+		return dc.archive()
+	}
+
+	return nil
+}
+
+// archive stores the Hardware and the workflows and BMC jobs which ran on it in a ConfigMap, which
+// outlives the Hardware, then removes the CAPT finalizer from the Hardware.
+func (dc *decommissionContext) archive() error {
+	workflows := &tinkv1.WorkflowList{}
+	if err := dc.client.List(dc.ctx, workflows, client.InNamespace(dc.hardware.Namespace)); err != nil {
+		return fmt.Errorf("listing workflows: %w", err)
+	}
+
+	history := []tinkv1.Workflow{}
+
+	for _, workflow := range workflows.Items {
+		if workflow.Spec.HardwareRef != dc.hardware.Name {
+			continue
+		}
+
+		if workflow.Labels[TemplateSecretsLabel] == "true" {
+			redactWorkflowTasks(&workflow)
+		}
+
+		history = append(history, workflow)
+	}
+
+	jobs := &rufiov1.JobList{}
+	if err := dc.client.List(dc.ctx, jobs, client.InNamespace(dc.hardware.Namespace)); err != nil {
+		return fmt.Errorf("listing BMC jobs: %w", err)
+	}
+
+	bmcJobs := []rufiov1.Job{}
+
+	for _, job := range jobs.Items {
+		if dc.hardware.Spec.BMCRef != nil && job.Spec.MachineRef.Name == dc.hardware.Spec.BMCRef.Name {
+			bmcJobs = append(bmcJobs, job)
+		}
+	}
+
+	hardware := dc.hardware.DeepCopy()
+	hardware.Spec.UserData = nil
+
+	data := map[string]string{}
+
+	for name, obj := range map[string]interface{}{
+		"hardware.yaml":  hardware,
+		"workflows.yaml": history,
+		"jobs.yaml":      bmcJobs,
+	} {
+		out, err := yaml.Marshal(obj)
+		if err != nil {
+			return fmt.Errorf("marshaling %s: %w", name, err)
+		}
+
+		data[name] = string(out)
+	}
+
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dc.hardware.Name + "-history",
+			Namespace: dc.hardware.Namespace,
+			Labels:    map[string]string{DecommissionedHardwareLabel: dc.hardware.Name},
+		},
+	}
+
+	if _, err := controllerutil.CreateOrUpdate(dc.ctx, dc.client, configMap, func() error {
+		configMap.Data = data
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("archiving provisioning history: %w", err)
+	}
+
+	controllerutil.RemoveFinalizer(dc.hardware, infrastructurev1.MachineFinalizer)
+	dc.setPhase(DecommissionDecommissioned, "")
+	dc.log.Info("Decommissioned Hardware", "history", configMap.Name)
+
+	return nil
+}
+
+// redactWorkflowTasks drops the rendered tasks of the workflow, which hold the Secret values of
+// its Template in any of their fields.
+func redactWorkflowTasks(workflow *tinkv1.Workflow) {
+	workflow.Status.Tasks = nil
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	rufiov1 "github.com/tinkerbell/rufio/api/v1alpha1"
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/controllers"
+)
+
+//nolint:funlen
+func Test_Hardware_decommissioning(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	hardware := validHardware(hardwareName, "hw-uid", hardwareIP, testOptions{Labels: map[string]string{
+		controllers.HardwareOwnerNameLabel:      tinkerbellMachineName,
+		controllers.HardwareOwnerNamespaceLabel: clusterNamespace,
+	}})
+	hardware.Annotations = map[string]string{controllers.HardwareDecommissionAnnotation: "secure-wipe"}
+	hardware.Finalizers = []string{infrastructurev1.MachineFinalizer}
+	hardware.Spec.BMCRef = &corev1.TypedLocalObjectReference{Kind: "Machine", Name: "bmc-" + hardwareName}
+
+	controller := true
+	machine := validMachine(machineName, clusterNamespace, clusterName)
+	machine.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: clusterv1.GroupVersion.String(),
+		Kind:       "MachineSet",
+		Name:       "workers",
+		UID:        "workers-uid",
+		Controller: &controller,
+	}}
+
+	provisioning := validWorkflow(tinkerbellMachineName, clusterNamespace)
+	provisioning.Spec.HardwareRef = hardwareName
+	provisioning.Labels = map[string]string{controllers.TemplateSecretsLabel: "true"}
+	provisioning.Status.Tasks[0].Actions[0].Command = []string{"update", "--token", "portal-token"}
+
+	kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+		hardware,
+		machine,
+		validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, "machine-uid"),
+		provisioning,
+	})
+
+	reconciler := &controllers.HardwareDecommissionReconciler{Client: kubeClient}
+	hardwareKey := types.NamespacedName{Name: hardwareName, Namespace: clusterNamespace}
+
+	reconcile := func() *tinkv1.Hardware {
+		_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: hardwareKey})
+		g.Expect(err).NotTo(HaveOccurred())
+
+		updated := &tinkv1.Hardware{}
+		g.Expect(kubeClient.Get(ctx, hardwareKey, updated)).To(Succeed())
+
+		return updated
+	}
+
+	// The Hardware is made ineligible and its machine remediated by its MachineSet.
+	updated := reconcile()
+	g.Expect(updated.Labels).To(HaveKey(controllers.HardwareDecommissioningLabel))
+	g.Expect(updated.Annotations).To(HaveKeyWithValue(controllers.HardwareDecommissionPhaseAnnotation,
+		controllers.DecommissionReplacing))
+
+	updatedMachine := &clusterv1.Machine{}
+	g.Expect(kubeClient.Get(ctx, types.NamespacedName{Name: machineName, Namespace: clusterNamespace},
+		updatedMachine)).To(Succeed())
+	g.Expect(conditions.IsFalse(updatedMachine, clusterv1.MachineOwnerRemediatedCondition)).To(BeTrue())
+
+	// Once the machine released the Hardware, it is wiped.
+	delete(updated.Labels, controllers.HardwareOwnerNameLabel)
+	delete(updated.Labels, controllers.HardwareOwnerNamespaceLabel)
+	g.Expect(kubeClient.Update(ctx, updated)).To(Succeed())
+
+	updated = reconcile()
+	g.Expect(updated.Annotations).To(HaveKeyWithValue(controllers.HardwareDecommissionPhaseAnnotation,
+		controllers.DecommissionWiping))
+
+	// Released Hardware being decommissioned is not selected for new machines.
+	selectable, err := (&controllers.HardwareSelector{Client: kubeClient}).Select(ctx, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(selectable).To(BeEmpty())
+
+	wipe := &tinkv1.Workflow{}
+	g.Expect(kubeClient.Get(ctx, types.NamespacedName{Name: hardwareName + "-decommission", Namespace: clusterNamespace},
+		wipe)).To(Succeed())
+	g.Expect(wipe.Spec.TemplateRef).To(Equal("secure-wipe"))
+
+	pxeJob := &rufiov1.Job{}
+	g.Expect(kubeClient.Get(ctx, types.NamespacedName{Name: hardwareName + "-decommission-pxe", Namespace: clusterNamespace},
+		pxeJob)).To(Succeed())
+
+	wipe.Status.State = tinkv1.WorkflowStateSuccess
+	g.Expect(kubeClient.Update(ctx, wipe)).To(Succeed())
+
+	// Then it is powered off.
+	updated = reconcile()
+	g.Expect(updated.Annotations).To(HaveKeyWithValue(controllers.HardwareDecommissionPhaseAnnotation,
+		controllers.DecommissionPoweringOff))
+	g.Expect(updated.Finalizers).To(ContainElement(infrastructurev1.MachineFinalizer))
+
+	powerOffJob := &rufiov1.Job{}
+	powerOffKey := types.NamespacedName{Name: hardwareName + "-decommission-poweroff", Namespace: clusterNamespace}
+	g.Expect(kubeClient.Get(ctx, powerOffKey, powerOffJob)).To(Succeed())
+
+	powerOffJob.Status.Conditions = []rufiov1.JobCondition{{Type: rufiov1.JobCompleted, Status: rufiov1.ConditionTrue}}
+	g.Expect(kubeClient.Update(ctx, powerOffJob)).To(Succeed())
+
+	// Finally its history is archived and the finalizer removed.
+	updated = reconcile()
+	g.Expect(updated.Annotations).To(HaveKeyWithValue(controllers.HardwareDecommissionPhaseAnnotation,
+		controllers.DecommissionDecommissioned))
+	g.Expect(updated.Finalizers).NotTo(ContainElement(infrastructurev1.MachineFinalizer))
+
+	history := &corev1.ConfigMap{}
+	g.Expect(kubeClient.Get(ctx, types.NamespacedName{Name: hardwareName + "-history", Namespace: clusterNamespace},
+		history)).To(Succeed())
+	g.Expect(history.Labels).To(HaveKeyWithValue(controllers.DecommissionedHardwareLabel, hardwareName))
+	g.Expect(history.Data["workflows.yaml"]).To(ContainSubstring("name: " + tinkerbellMachineName))
+	g.Expect(history.Data["workflows.yaml"]).NotTo(ContainSubstring("portal-token"))
+	g.Expect(history.Data["workflows.yaml"]).To(ContainSubstring("name: " + hardwareName + "-decommission"))
+	g.Expect(history.Data["jobs.yaml"]).To(ContainSubstring(powerOffKey.Name))
+	g.Expect(history.Data["hardware.yaml"]).To(ContainSubstring(hardwareName))
+}
+
+func Test_Hardware_decommissioning_waits_for_unmanaged_machine(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	hardware := validHardware(hardwareName, "hw-uid", hardwareIP, testOptions{Labels: map[string]string{
+		controllers.HardwareOwnerNameLabel:      tinkerbellMachineName,
+		controllers.HardwareOwnerNamespaceLabel: clusterNamespace,
+	}})
+	hardware.Annotations = map[string]string{controllers.HardwareDecommissionAnnotation: "secure-wipe"}
+
+	kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+		hardware,
+		validMachine(machineName, clusterNamespace, clusterName),
+		validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, "machine-uid"),
+	})
+
+	reconciler := &controllers.HardwareDecommissionReconciler{Client: kubeClient}
+	hardwareKey := types.NamespacedName{Name: hardwareName, Namespace: clusterNamespace}
+
+	result, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: hardwareKey})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(BeNumerically(">", 0))
+
+	updated := &tinkv1.Hardware{}
+	g.Expect(kubeClient.Get(ctx, hardwareKey, updated)).To(Succeed())
+	g.Expect(updated.Annotations).To(HaveKeyWithValue(controllers.HardwareDecommissionPhaseAnnotation,
+		controllers.DecommissionReplacing))
+	g.Expect(updated.Annotations[controllers.HardwareDecommissionMessageAnnotation]).To(ContainSubstring("no controller"))
+
+	updatedMachine := &clusterv1.Machine{}
+	g.Expect(kubeClient.Get(ctx, types.NamespacedName{Name: machineName, Namespace: clusterNamespace},
+		updatedMachine)).To(Succeed())
+	g.Expect(updatedMachine.Status.Conditions).To(BeEmpty())
+}
+
+func Test_Hardware_decommissioning_fails_without_instance_id(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	hardware := validHardware(hardwareName, "hw-uid", hardwareIP)
+	hardware.Annotations = map[string]string{controllers.HardwareDecommissionAnnotation: "secure-wipe"}
+	hardware.Spec.BMCRef = &corev1.TypedLocalObjectReference{Kind: "Machine", Name: "bmc-" + hardwareName}
+	hardware.Spec.Metadata.Instance = nil
+
+	kubeClient := kubernetesClientWithObjects(t, []runtime.Object{hardware})
+
+	reconciler := &controllers.HardwareDecommissionReconciler{Client: kubeClient}
+	hardwareKey := types.NamespacedName{Name: hardwareName, Namespace: clusterNamespace}
+
+	_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: hardwareKey})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	updated := &tinkv1.Hardware{}
+	g.Expect(kubeClient.Get(ctx, hardwareKey, updated)).To(Succeed())
+	g.Expect(updated.Annotations).To(HaveKeyWithValue(controllers.HardwareDecommissionPhaseAnnotation,
+		controllers.DecommissionFailed))
+	g.Expect(updated.Annotations[controllers.HardwareDecommissionMessageAnnotation]).To(ContainSubstring("instance ID"))
+
+	err = kubeClient.Get(ctx, types.NamespacedName{Name: hardwareName + "-decommission", Namespace: clusterNamespace},
+		&tinkv1.Workflow{})
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue(), "Expected no wipe workflow to be created, got %v", err)
+}
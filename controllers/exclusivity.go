@@ -0,0 +1,339 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+)
+
+// topologyClaimBackoff is how long a machine waits, with jitter, before selecting Hardware again
+// after another cluster claimed the topology domain of the Hardware it selected at the same time.
+const topologyClaimBackoff = 10 * time.Second
+
+// topologyExclusions holds the topology domains a cluster may not use, as values by Hardware label.
+type topologyExclusions map[string]map[string]bool
+
+func (e topologyExclusions) add(label, value string) {
+	if e[label] == nil {
+		e[label] = map[string]bool{}
+	}
+
+	e[label][value] = true
+}
+
+// filter returns the Hardware which is in none of the excluded topology domains.
+func (e topologyExclusions) filter(hardware []tinkv1.Hardware) []tinkv1.Hardware {
+	allowed := []tinkv1.Hardware{}
+
+	for i := range hardware {
+		excluded := false
+
+		for label, values := range e {
+			if value, ok := hardware[i].Labels[label]; ok && values[value] {
+				excluded = true
+
+				break
+			}
+		}
+
+		if !excluded {
+			allowed = append(allowed, hardware[i])
+		}
+	}
+
+	return allowed
+}
+
+// exclusionsForCluster returns the topology domains the machines of the cluster may not use: the
+// domains claimed by other exclusive clusters and, when the cluster is exclusive itself, the domains
+// holding Hardware of machines of other clusters. Hardware is listed from hardwareClient with opts.
+//
+//nolint:lll
+func exclusionsForCluster(ctx context.Context, c, hardwareClient client.Client, tinkerbellCluster *infrastructurev1.TinkerbellCluster, clusterName string, opts ...client.ListOption) (topologyExclusions, error) {
+	exclusions := topologyExclusions{}
+
+	tinkerbellClusters := &infrastructurev1.TinkerbellClusterList{}
+	if err := c.List(ctx, tinkerbellClusters); err != nil {
+		return nil, fmt.Errorf("listing TinkerbellClusters: %w", err)
+	}
+
+	for i := range tinkerbellClusters.Items {
+		other := &tinkerbellClusters.Items[i]
+		self := client.ObjectKeyFromObject(other) == client.ObjectKeyFromObject(tinkerbellCluster)
+		if other.Spec.Exclusivity == nil || self {
+			continue
+		}
+
+		for _, value := range other.Status.ClaimedTopologyValues {
+			exclusions.add(other.Spec.Exclusivity.TopologyLabel, value)
+		}
+	}
+
+	exclusivity := tinkerbellCluster.Spec.Exclusivity
+	if exclusivity == nil {
+		return exclusions, nil
+	}
+
+	tinkerbellMachines := &infrastructurev1.TinkerbellMachineList{}
+	if err := c.List(ctx, tinkerbellMachines); err != nil {
+		return nil, fmt.Errorf("listing TinkerbellMachines: %w", err)
+	}
+
+	ownMachines := map[client.ObjectKey]bool{}
+
+	for i := range tinkerbellMachines.Items {
+		tinkerbellMachine := &tinkerbellMachines.Items[i]
+		if tinkerbellMachine.Namespace == tinkerbellCluster.Namespace &&
+			tinkerbellMachine.Labels[clusterv1.ClusterLabelName] == clusterName {
+			ownMachines[client.ObjectKeyFromObject(tinkerbellMachine)] = true
+		}
+	}
+
+	owned := &tinkv1.HardwareList{}
+	listOptions := append([]client.ListOption{client.HasLabels{HardwareOwnerNameLabel}}, opts...)
+	if err := hardwareClient.List(ctx, owned, listOptions...); err != nil {
+		return nil, fmt.Errorf("listing owned Hardware: %w", err)
+	}
+
+	for i := range owned.Items {
+		hardware := &owned.Items[i]
+
+		owner := client.ObjectKey{
+			Name:      hardware.Labels[HardwareOwnerNameLabel],
+			Namespace: hardware.Labels[HardwareOwnerNamespaceLabel],
+		}
+
+		if value, ok := hardware.Labels[exclusivity.TopologyLabel]; ok && !ownMachines[owner] {
+			exclusions.add(exclusivity.TopologyLabel, value)
+		}
+	}
+
+	return exclusions, nil
+}
+
+// allowedByTopology returns the Hardware the machines of the cluster may use with regard to
+// topology exclusivity.
+func (s *HardwareSelector) allowedByTopology(
+	ctx context.Context, hardware []tinkv1.Hardware,
+) ([]tinkv1.Hardware, error) {
+	if s.TinkerbellCluster == nil {
+		return hardware, nil
+	}
+
+	exclusions, err := exclusionsForCluster(ctx, s.Client, s.hardwareClient(), s.TinkerbellCluster, s.ClusterName,
+		s.ListOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	return exclusions.filter(hardware), nil
+}
+
+// claimTopology records the topology domain of the Hardware as claimed by the cluster of the
+// machine, before the machine takes the Hardware, if the cluster is exclusive.
+//
+// Two clusters may claim the same domain at once, as each only sees the claims of the other
+// recorded before its selection. After recording the claim, the claims of other clusters are
+// read again from the API server. If another cluster claims the domain as well, the machine backs
+// off and a claim it just recorded is withdrawn, so the domain is only used by a cluster which saw
+// no other claim after recording its own.
+func (mrc *machineReconcileContext) claimTopology(hardware *tinkv1.Hardware) error {
+	exclusivity := mrc.tinkerbellCluster.Spec.Exclusivity
+	if exclusivity == nil {
+		return nil
+	}
+
+	value, ok := hardware.Labels[exclusivity.TopologyLabel]
+	if !ok {
+		return nil
+	}
+
+	claimed := false
+
+	if !containsString(mrc.tinkerbellCluster.Status.ClaimedTopologyValues, value) {
+		if err := mrc.updateTopologyClaims(func(values []string) []string {
+			claimed = !containsString(values, value)
+			if !claimed {
+				return values
+			}
+
+			values = append(values, value)
+			sort.Strings(values)
+
+			return values
+		}); err != nil {
+			return fmt.Errorf("claiming topology value %s: %w", value, err)
+		}
+	}
+
+	other, err := mrc.otherTopologyClaim(exclusivity.TopologyLabel, value)
+	if err != nil {
+		return err
+	}
+
+	if other == nil {
+		if claimed {
+			mrc.log.Info("Claimed topology value for cluster", "label", exclusivity.TopologyLabel, "value", value)
+		}
+
+		return nil
+	}
+
+	mrc.log.Info("Topology value is claimed by another cluster, backing off",
+		"label", exclusivity.TopologyLabel, "value", value, "cluster", other)
+
+	if claimed {
+		if err := mrc.updateTopologyClaims(func(values []string) []string {
+			return removeString(values, value)
+		}); err != nil {
+			return fmt.Errorf("withdrawing claim of topology value %s: %w", value, err)
+		}
+	}
+
+	return &errRequeueAfter{after: wait.Jitter(topologyClaimBackoff, 1)}
+}
+
+// updateTopologyClaims replaces the topology values claimed by the cluster of the machine with the
+// values returned by update.
+func (mrc *machineReconcileContext) updateTopologyClaims(update func([]string) []string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error { //nolint:wrapcheck
+		key := client.ObjectKeyFromObject(mrc.tinkerbellCluster)
+		if err := mrc.client.Get(mrc.ctx, key, mrc.tinkerbellCluster); err != nil {
+			return fmt.Errorf("getting TinkerbellCluster: %w", err)
+		}
+
+		values := update(append([]string{}, mrc.tinkerbellCluster.Status.ClaimedTopologyValues...))
+		if len(values) == len(mrc.tinkerbellCluster.Status.ClaimedTopologyValues) {
+			return nil
+		}
+
+		mrc.tinkerbellCluster.Status.ClaimedTopologyValues = values
+
+		return mrc.client.Status().Update(mrc.ctx, mrc.tinkerbellCluster) //nolint:wrapcheck
+	})
+}
+
+// otherTopologyClaim returns the TinkerbellCluster of another exclusive cluster claiming the topology
+// value, or nil if there is none. TinkerbellClusters are read from the API server, as the cache may
+// not hold a claim recorded concurrently yet.
+func (mrc *machineReconcileContext) otherTopologyClaim(label, value string) (*client.ObjectKey, error) {
+	tinkerbellClusters := &infrastructurev1.TinkerbellClusterList{}
+	if err := mrc.apiReader.List(mrc.ctx, tinkerbellClusters); err != nil {
+		return nil, fmt.Errorf("listing TinkerbellClusters: %w", err)
+	}
+
+	for i := range tinkerbellClusters.Items {
+		other := &tinkerbellClusters.Items[i]
+
+		key := client.ObjectKeyFromObject(other)
+		if key == client.ObjectKeyFromObject(mrc.tinkerbellCluster) || other.Spec.Exclusivity == nil {
+			continue
+		}
+
+		if other.Spec.Exclusivity.TopologyLabel == label && containsString(other.Status.ClaimedTopologyValues, value) {
+			return &key, nil
+		}
+	}
+
+	return nil, nil //nolint:nilnil
+}
+
+// reconcileTopologyClaims releases the topology values claimed by the cluster once it's not
+// exclusive anymore or its last machine is gone.
+func (crc *clusterReconcileContext) reconcileTopologyClaims() error {
+	if len(crc.tinkerbellCluster.Status.ClaimedTopologyValues) == 0 {
+		return nil
+	}
+
+	if crc.tinkerbellCluster.Spec.Exclusivity != nil {
+		tinkerbellMachines := &infrastructurev1.TinkerbellMachineList{}
+		if err := crc.client.List(crc.ctx, tinkerbellMachines, client.InNamespace(crc.tinkerbellCluster.Namespace),
+			client.MatchingLabels{clusterv1.ClusterLabelName: crc.clusterName()}); err != nil {
+			return fmt.Errorf("listing TinkerbellMachines of cluster: %w", err)
+		}
+
+		if len(tinkerbellMachines.Items) > 0 {
+			return nil
+		}
+	}
+
+	crc.log.Info("Releasing claimed topology values", "values", crc.tinkerbellCluster.Status.ClaimedTopologyValues)
+
+	crc.tinkerbellCluster.Status.ClaimedTopologyValues = nil
+
+	return nil
+}
+
+// tinkerbellMachineToTinkerbellCluster maps a TinkerbellMachine to the TinkerbellCluster of its
+// cluster, so the claims of the cluster are released when its last machine is deleted.
+func (tcr *TinkerbellClusterReconciler) tinkerbellMachineToTinkerbellCluster(o client.Object) []reconcile.Request {
+	clusterName, ok := o.GetLabels()[clusterv1.ClusterLabelName]
+	if !ok {
+		return nil
+	}
+
+	cluster := &clusterv1.Cluster{}
+
+	key := client.ObjectKey{Name: clusterName, Namespace: o.GetNamespace()}
+	if err := tcr.Client.Get(context.Background(), key, cluster); err != nil {
+		return nil
+	}
+
+	if cluster.Spec.InfrastructureRef == nil {
+		return nil
+	}
+
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{
+		Name:      cluster.Spec.InfrastructureRef.Name,
+		Namespace: o.GetNamespace(),
+	}}}
+}
+
+func removeString(values []string, value string) []string {
+	kept := []string{}
+
+	for _, v := range values {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+
+	return kept
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
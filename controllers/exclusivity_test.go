@@ -0,0 +1,254 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/controllers"
+)
+
+const (
+	rackLabel        = "example.com/rack"
+	otherClusterName = "other-cluster"
+)
+
+func exclusiveTinkerbellCluster(name string, claimed ...string) *infrastructurev1.TinkerbellCluster {
+	tinkerbellCluster := validTinkerbellCluster(name, clusterNamespace)
+	tinkerbellCluster.Spec.Exclusivity = &infrastructurev1.TopologyExclusivity{TopologyLabel: rackLabel}
+	tinkerbellCluster.Status.ClaimedTopologyValues = claimed
+
+	return tinkerbellCluster
+}
+
+func selectedHardwareName(t *testing.T, kubeClient client.Client) string {
+	t.Helper()
+	g := NewWithT(t)
+
+	_, err := reconcileMachineWithClient(kubeClient, tinkerbellMachineName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	tinkerbellMachine := &infrastructurev1.TinkerbellMachine{}
+	g.Expect(kubeClient.Get(context.Background(),
+		types.NamespacedName{Name: tinkerbellMachineName, Namespace: clusterNamespace}, tinkerbellMachine)).To(Succeed())
+
+	return tinkerbellMachine.Spec.HardwareName
+}
+
+//nolint:funlen
+func Test_Machine_reconciliation_with_exclusive_racks(t *testing.T) {
+	t.Parallel()
+
+	machine := validMachine(machineName, clusterNamespace, clusterName)
+	machine.Spec.ClusterName = clusterName
+
+	rack := func(name string) testOptions {
+		return testOptions{Labels: map[string]string{rackLabel: name}}
+	}
+
+	t.Run("avoids_racks_claimed_by_exclusive_clusters", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		hardwareUUID := uuid.New().String()
+
+		kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+			validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID),
+			validCluster(clusterName, clusterNamespace),
+			validTinkerbellCluster(clusterName, clusterNamespace),
+			exclusiveTinkerbellCluster(otherClusterName, "rack-a"),
+			validHardware("hw-a", uuid.New().String(), "1.1.1.1", rack("rack-a")),
+			validHardware("hw-b", uuid.New().String(), "1.1.1.2", rack("rack-b")),
+			machine.DeepCopy(),
+			validSecret(machineName, clusterNamespace),
+		})
+
+		g.Expect(selectedHardwareName(t, kubeClient)).To(Equal("hw-b"))
+	})
+
+	t.Run("claims_rack_of_selected_hardware", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		hardwareUUID := uuid.New().String()
+
+		kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+			validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID),
+			validCluster(clusterName, clusterNamespace),
+			exclusiveTinkerbellCluster(clusterName, "rack-z"),
+			validHardware("hw-a", uuid.New().String(), "1.1.1.1", rack("rack-a")),
+			machine.DeepCopy(),
+			validSecret(machineName, clusterNamespace),
+		})
+
+		g.Expect(selectedHardwareName(t, kubeClient)).To(Equal("hw-a"))
+
+		tinkerbellCluster := &infrastructurev1.TinkerbellCluster{}
+		g.Expect(kubeClient.Get(context.Background(),
+			types.NamespacedName{Name: clusterName, Namespace: clusterNamespace}, tinkerbellCluster)).To(Succeed())
+		g.Expect(tinkerbellCluster.Status.ClaimedTopologyValues).To(Equal([]string{"rack-a", "rack-z"}))
+	})
+
+	t.Run("avoids_racks_used_by_other_clusters_when_exclusive", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		hardwareUUID := uuid.New().String()
+
+		otherMachineHardware := validHardware("hw-a1", uuid.New().String(), "1.1.1.1", rack("rack-a"))
+		otherMachineHardware.Labels[controllers.HardwareOwnerNameLabel] = "other-machine"
+		otherMachineHardware.Labels[controllers.HardwareOwnerNamespaceLabel] = clusterNamespace
+
+		kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+			validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID),
+			validTinkerbellMachine("other-machine", clusterNamespace, "other-machine", uuid.New().String(),
+				testOptions{Labels: map[string]string{clusterv1.ClusterLabelName: otherClusterName}}),
+			validCluster(clusterName, clusterNamespace),
+			exclusiveTinkerbellCluster(clusterName),
+			otherMachineHardware,
+			validHardware("hw-a2", uuid.New().String(), "1.1.1.2", rack("rack-a")),
+			validHardware("hw-b", uuid.New().String(), "1.1.1.3", rack("rack-b")),
+			machine.DeepCopy(),
+			validSecret(machineName, clusterNamespace),
+		})
+
+		g.Expect(selectedHardwareName(t, kubeClient)).To(Equal("hw-b"))
+	})
+
+	t.Run("backs_off_when_another_cluster_claims_the_rack_at_the_same_time", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+			validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, uuid.New().String()),
+			validCluster(clusterName, clusterNamespace),
+			exclusiveTinkerbellCluster(clusterName),
+			exclusiveTinkerbellCluster(otherClusterName),
+			validHardware("hw-a", uuid.New().String(), "1.1.1.1", rack("rack-a")),
+			machine.DeepCopy(),
+			validSecret(machineName, clusterNamespace),
+		})
+
+		// The API server already holds the claim of the other cluster, the cache doesn't yet.
+		apiReader := kubernetesClientWithObjects(t, []runtime.Object{
+			exclusiveTinkerbellCluster(clusterName),
+			exclusiveTinkerbellCluster(otherClusterName, "rack-a"),
+		})
+
+		reconciler := &controllers.TinkerbellMachineReconciler{Client: kubeClient, APIReader: apiReader}
+		request := ctrl.Request{NamespacedName: types.NamespacedName{Name: tinkerbellMachineName, Namespace: clusterNamespace}}
+
+		result, err := reconciler.Reconcile(context.Background(), request)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result.RequeueAfter).To(BeNumerically(">", 0), "Expected the machine to select Hardware again")
+
+		tinkerbellMachine := &infrastructurev1.TinkerbellMachine{}
+		g.Expect(kubeClient.Get(context.Background(), request.NamespacedName, tinkerbellMachine)).To(Succeed())
+		g.Expect(tinkerbellMachine.Spec.HardwareName).To(BeEmpty())
+
+		tinkerbellCluster := &infrastructurev1.TinkerbellCluster{}
+		g.Expect(kubeClient.Get(context.Background(),
+			types.NamespacedName{Name: clusterName, Namespace: clusterNamespace}, tinkerbellCluster)).To(Succeed())
+		g.Expect(tinkerbellCluster.Status.ClaimedTopologyValues).To(BeEmpty(), "Expected the claim to be withdrawn")
+
+		hardware := &tinkv1.Hardware{}
+		g.Expect(kubeClient.Get(context.Background(),
+			types.NamespacedName{Name: "hw-a", Namespace: clusterNamespace}, hardware)).To(Succeed())
+		g.Expect(hardware.Labels).NotTo(HaveKey(controllers.HardwareOwnerNameLabel))
+	})
+}
+
+func Test_HardwareSelector_excludes_racks_of_other_clusters(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+		exclusiveTinkerbellCluster(otherClusterName, "rack-a"),
+		validHardware("hw-a", uuid.New().String(), "1.1.1.1", testOptions{Labels: map[string]string{rackLabel: "rack-a"}}),
+		validHardware("hw-b", uuid.New().String(), "1.1.1.2", testOptions{Labels: map[string]string{rackLabel: "rack-b"}}),
+	})
+
+	selector := &controllers.HardwareSelector{
+		Client:            kubeClient,
+		TinkerbellCluster: validTinkerbellCluster(clusterName, clusterNamespace),
+		ClusterName:       clusterName,
+	}
+
+	available, err := selector.Select(context.Background(), nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(available).To(HaveLen(1))
+	g.Expect(available[0].Name).To(Equal("hw-b"))
+
+	// Without a cluster, topology exclusivity isn't considered.
+	available, err = (&controllers.HardwareSelector{Client: kubeClient}).Select(context.Background(), nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(available).To(HaveLen(2))
+}
+
+func Test_Cluster_reconciliation_releases_claimed_racks(t *testing.T) {
+	t.Parallel()
+
+	t.Run("keeps_claims_while_the_cluster_has_machines", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+			validCluster(clusterName, clusterNamespace),
+			exclusiveTinkerbellCluster(clusterName, "rack-a"),
+			validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, uuid.New().String(),
+				testOptions{Labels: map[string]string{clusterv1.ClusterLabelName: clusterName}}),
+		})
+
+		_, err := reconcileClusterWithClient(kubeClient, clusterName, clusterNamespace)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		tinkerbellCluster := &infrastructurev1.TinkerbellCluster{}
+		g.Expect(kubeClient.Get(context.Background(),
+			types.NamespacedName{Name: clusterName, Namespace: clusterNamespace}, tinkerbellCluster)).To(Succeed())
+		g.Expect(tinkerbellCluster.Status.ClaimedTopologyValues).To(Equal([]string{"rack-a"}))
+	})
+
+	t.Run("releases_claims_when_the_last_machine_is_gone", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+			validCluster(clusterName, clusterNamespace),
+			exclusiveTinkerbellCluster(clusterName, "rack-a"),
+		})
+
+		_, err := reconcileClusterWithClient(kubeClient, clusterName, clusterNamespace)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		tinkerbellCluster := &infrastructurev1.TinkerbellCluster{}
+		g.Expect(kubeClient.Get(context.Background(),
+			types.NamespacedName{Name: clusterName, Namespace: clusterNamespace}, tinkerbellCluster)).To(Succeed())
+		g.Expect(tinkerbellCluster.Status.ClaimedTopologyValues).To(BeEmpty())
+	})
+}
@@ -0,0 +1,376 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	rufiov1 "github.com/tinkerbell/rufio/api/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+)
+
+// unwatchedStackPollInterval is how often machines provisioned by a Tinkerbell stack whose objects
+// can't be owned, and thus watched, by the TinkerbellMachine are reconciled.
+const unwatchedStackPollInterval = 30 * time.Second
+
+var (
+	// ErrFailureDomainNotFound is returned when a Machine is placed in a failure domain which is not
+	// listed by its TinkerbellCluster.
+	ErrFailureDomainNotFound = fmt.Errorf("failure domain not found in TinkerbellCluster")
+	// ErrMissingKubeconfigSecretValueKey is returned when the kubeconfig Secret of a failure domain
+	// is missing the value key.
+	ErrMissingKubeconfigSecretValueKey = fmt.Errorf("kubeconfig secret value key is missing")
+	// ErrMissingStackClientGetter is returned when a failure domain requires a remote Tinkerbell stack
+	// but the reconciler has no way to build a client for it.
+	ErrMissingStackClientGetter = fmt.Errorf("stack client getter is nil")
+	// ErrInsecureMetadataURL is returned when the metadata URL of a failure domain is not an https URL
+	// while the cluster requires metadataTLS.
+	ErrInsecureMetadataURL = fmt.Errorf("metadata URL of failure domain must be an https URL with metadataTLS")
+)
+
+// StackClientGetter returns a client for the Tinkerbell stack reachable through the given kubeconfig.
+type StackClientGetter func(kubeconfig []byte) (client.Client, error)
+
+// stackClientCache builds clients for remote Tinkerbell stacks and reuses them across reconciliations.
+type stackClientCache struct {
+	scheme *runtime.Scheme
+
+	mu      sync.Mutex
+	clients map[[sha256.Size]byte]client.Client
+}
+
+// NewCachingStackClientGetter returns a StackClientGetter creating clients with the given scheme,
+// which are cached by kubeconfig.
+func NewCachingStackClientGetter(scheme *runtime.Scheme) StackClientGetter {
+	cache := &stackClientCache{
+		scheme:  scheme,
+		clients: map[[sha256.Size]byte]client.Client{},
+	}
+
+	return cache.get
+}
+
+func (c *stackClientCache) get(kubeconfig []byte) (client.Client, error) {
+	key := sha256.Sum256(kubeconfig)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stackClient, ok := c.clients[key]; ok {
+		return stackClient, nil
+	}
+
+	restConfig, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("parsing kubeconfig: %w", err)
+	}
+
+	stackClient, err := client.New(restConfig, client.Options{Scheme: c.scheme})
+	if err != nil {
+		return nil, fmt.Errorf("creating client: %w", err)
+	}
+
+	c.clients[key] = stackClient
+
+	return stackClient, nil
+}
+
+// TinkerbellStack addresses the Tinkerbell stack holding the Hardware, Templates, Workflows and BMC
+// Jobs of a failure domain.
+type TinkerbellStack struct {
+	// Client reaches the cluster running the stack.
+	Client client.Client
+	// Namespace holds the objects of the stack.
+	Namespace string
+	// FailureDomain is served by the stack, nil for the stack of the management cluster.
+	FailureDomain *infrastructurev1.TinkerbellFailureDomain
+}
+
+// Remote returns true if the stack runs outside of the management cluster.
+func (s *TinkerbellStack) Remote() bool {
+	return s.FailureDomain != nil && s.FailureDomain.KubeconfigSecretRef != nil
+}
+
+// NewTinkerbellStack returns the Tinkerbell stack serving a failure domain of a TinkerbellCluster in
+// namespace. Without a failure domain, the stack of the management cluster is returned.
+func NewTinkerbellStack(ctx context.Context, c client.Client, stackClientGetter StackClientGetter, namespace string,
+	failureDomain *infrastructurev1.TinkerbellFailureDomain,
+) (*TinkerbellStack, error) {
+	stack := &TinkerbellStack{Client: c, Namespace: namespace, FailureDomain: failureDomain}
+
+	if failureDomain == nil {
+		return stack, nil
+	}
+
+	if failureDomain.HardwareNamespace != "" {
+		stack.Namespace = failureDomain.HardwareNamespace
+	}
+
+	if failureDomain.KubeconfigSecretRef == nil {
+		return stack, nil
+	}
+
+	if stackClientGetter == nil {
+		return nil, ErrMissingStackClientGetter
+	}
+
+	secret := &corev1.Secret{}
+	key := types.NamespacedName{Namespace: namespace, Name: failureDomain.KubeconfigSecretRef.Name}
+
+	if err := c.Get(ctx, key, secret); err != nil {
+		return nil, fmt.Errorf("getting kubeconfig secret of failure domain %q: %w", failureDomain.Name, err)
+	}
+
+	kubeconfig, ok := secret.Data["value"]
+	if !ok {
+		return nil, fmt.Errorf("%w: failure domain %q", ErrMissingKubeconfigSecretValueKey, failureDomain.Name)
+	}
+
+	stackClient, err := stackClientGetter(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("getting client for Tinkerbell stack of failure domain %q: %w", failureDomain.Name, err)
+	}
+
+	stack.Client = stackClient
+
+	return stack, nil
+}
+
+// MachineTinkerbellStack returns the Tinkerbell stack of the failure domain recorded in the status of
+// the TinkerbellMachine.
+func MachineTinkerbellStack(ctx context.Context, c client.Client, stackClientGetter StackClientGetter,
+	tinkerbellMachine *infrastructurev1.TinkerbellMachine,
+) (*TinkerbellStack, error) {
+	return NewTinkerbellStack(ctx, c, stackClientGetter, tinkerbellMachine.Namespace,
+		tinkerbellMachine.Status.FailureDomain)
+}
+
+// RemoteTinkerbellStacks returns the Tinkerbell stacks of the failure domains of the TinkerbellCluster
+// which run outside of the management cluster.
+func RemoteTinkerbellStacks(ctx context.Context, c client.Client, stackClientGetter StackClientGetter,
+	tinkerbellCluster *infrastructurev1.TinkerbellCluster,
+) ([]*TinkerbellStack, error) {
+	stacks := []*TinkerbellStack{}
+
+	for i := range tinkerbellCluster.Spec.FailureDomains {
+		failureDomain := &tinkerbellCluster.Spec.FailureDomains[i]
+		if failureDomain.KubeconfigSecretRef == nil {
+			continue
+		}
+
+		stack, err := NewTinkerbellStack(ctx, c, stackClientGetter, tinkerbellCluster.Namespace, failureDomain)
+		if err != nil {
+			return nil, err
+		}
+
+		stacks = append(stacks, stack)
+	}
+
+	return stacks, nil
+}
+
+// resolveTinkerbellStack selects the Tinkerbell stack serving the failure domain of the machine.
+// Machines without a failure domain, or whose TinkerbellCluster does not define failure domains,
+// use the Tinkerbell stack of the management cluster. The failure domain is recorded in the status
+// of the machine, so a machine being deleted still finds its stack once the failure domain or the
+// TinkerbellCluster are gone. If the stack of a machine being deleted can't be found or reached,
+// stackUnavailable is set instead of failing.
+func (bmrc *baseMachineReconcileContext) resolveTinkerbellStack() error {
+	bmrc.tinkClient = bmrc.client
+	bmrc.tinkNamespace = bmrc.tinkerbellMachine.Namespace
+
+	failureDomain := bmrc.tinkerbellMachine.Status.FailureDomain
+
+	if !bmrc.MachineScheduledForDeletion() || failureDomain == nil {
+		var err error
+
+		if failureDomain, err = bmrc.getFailureDomain(); err != nil {
+			return bmrc.tolerateUnavailableStack(err)
+		}
+	}
+
+	if failureDomain == nil {
+		return nil
+	}
+
+	stack, err := NewTinkerbellStack(bmrc.ctx, bmrc.client, bmrc.stackClientGetter, bmrc.tinkerbellMachine.Namespace,
+		failureDomain)
+	if err != nil {
+		return bmrc.tolerateUnavailableStack(err)
+	}
+
+	bmrc.failureDomain = failureDomain
+	bmrc.tinkClient = stack.Client
+	bmrc.tinkNamespace = stack.Namespace
+
+	if !bmrc.MachineScheduledForDeletion() {
+		bmrc.tinkerbellMachine.Status.FailureDomain = failureDomain.DeepCopy()
+	}
+
+	return nil
+}
+
+// tolerateUnavailableStack records err as the reason the Tinkerbell stack of a machine being
+// deleted is unavailable, as otherwise the finalizer could never be removed. For other machines,
+// err is returned.
+func (bmrc *baseMachineReconcileContext) tolerateUnavailableStack(err error) error {
+	if !bmrc.MachineScheduledForDeletion() ||
+		(!apierrors.IsNotFound(err) && !errors.Is(err, ErrFailureDomainNotFound) &&
+			!errors.Is(err, ErrMissingKubeconfigSecretValueKey)) {
+		return err
+	}
+
+	bmrc.stackUnavailable = err
+
+	return nil
+}
+
+// getFailureDomain returns the failure domain of the machine as defined by its TinkerbellCluster.
+// If the machine is not placed in a failure domain, nil is returned.
+func (bmrc *baseMachineReconcileContext) getFailureDomain() (*infrastructurev1.TinkerbellFailureDomain, error) {
+	machine, err := util.GetOwnerMachine(bmrc.ctx, bmrc.client, bmrc.tinkerbellMachine.ObjectMeta)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("getting Machine object: %w", err)
+	}
+
+	if machine == nil || machine.Spec.FailureDomain == nil || *machine.Spec.FailureDomain == "" {
+		return nil, nil
+	}
+
+	cluster, err := util.GetClusterFromMetadata(bmrc.ctx, bmrc.client, machine.ObjectMeta)
+	if err != nil {
+		return nil, fmt.Errorf("getting cluster from metadata: %w", err)
+	}
+
+	if cluster.Spec.InfrastructureRef == nil {
+		return nil, nil
+	}
+
+	tinkerbellCluster := &infrastructurev1.TinkerbellCluster{}
+	key := client.ObjectKey{Namespace: bmrc.tinkerbellMachine.Namespace, Name: cluster.Spec.InfrastructureRef.Name}
+
+	if err := bmrc.client.Get(bmrc.ctx, key, tinkerbellCluster); err != nil {
+		return nil, fmt.Errorf("getting TinkerbellCluster object: %w", err)
+	}
+
+	if len(tinkerbellCluster.Spec.FailureDomains) == 0 {
+		return nil, nil
+	}
+
+	failureDomain := tinkerbellCluster.Spec.FailureDomain(*machine.Spec.FailureDomain)
+	if failureDomain == nil {
+		return nil, fmt.Errorf("%w: %s", ErrFailureDomainNotFound, *machine.Spec.FailureDomain)
+	}
+
+	return failureDomain, nil
+}
+
+// stackOwnsObjects returns true if the Templates, Workflows and BMC Jobs created in the Tinkerbell
+// stack can be owned by the TinkerbellMachine. Owner references only work within a namespace of a
+// single cluster, so objects of other stacks are neither garbage collected nor watched.
+func (bmrc *baseMachineReconcileContext) stackOwnsObjects() bool {
+	return bmrc.tinkClient == bmrc.client && bmrc.tinkNamespace == bmrc.tinkerbellMachine.Namespace
+}
+
+// stackListOptions restricts Hardware lookups to the namespace of the failure domain stack. Without
+// a failure domain Hardware is looked up in all namespaces.
+func (bmrc *baseMachineReconcileContext) stackListOptions() []client.ListOption {
+	if bmrc.failureDomain == nil {
+		return nil
+	}
+
+	return []client.ListOption{client.InNamespace(bmrc.tinkNamespace)}
+}
+
+// metadataURL returns the URL of the Tinkerbell metadata service provisioned machines read from.
+// With metadataTLS, the metadata service is reached over https, and a plain http metadata URL of the
+// failure domain is refused.
+func (bmrc *baseMachineReconcileContext) metadataURL(metadataTLS *infrastructurev1.MetadataTLS) (string, error) {
+	if bmrc.failureDomain != nil && bmrc.failureDomain.MetadataURL != "" {
+		if metadataTLS != nil && !strings.HasPrefix(strings.ToLower(bmrc.failureDomain.MetadataURL), "https://") {
+			return "", fmt.Errorf("%w: failure domain %q", ErrInsecureMetadataURL, bmrc.failureDomain.Name)
+		}
+
+		return bmrc.failureDomain.MetadataURL, nil
+	}
+
+	if metadataTLS != nil && metadataTLS.URL != "" {
+		return metadataTLS.URL, nil
+	}
+
+	metadataIP := os.Getenv("TINKERBELL_IP")
+	if metadataIP == "" {
+		metadataIP = "192.168.1.1"
+	}
+
+	scheme := "http://"
+	if metadataTLS != nil {
+		scheme = "https://"
+	}
+
+	return scheme + net.JoinHostPort(endpointHost(metadataIP), "50061"), nil
+}
+
+// removeUnownedJobs deletes the BMC Jobs of the machine which are not garbage collected with the
+// TinkerbellMachine because the stack can't own them.
+func (bmrc *baseMachineReconcileContext) removeUnownedJobs() error {
+	if bmrc.stackOwnsObjects() {
+		return nil
+	}
+
+	names := []string{
+		fmt.Sprintf("%s-provision", bmrc.tinkerbellMachine.Name),
+		fmt.Sprintf("%s-poweroff", bmrc.tinkerbellMachine.Name),
+	}
+
+	for _, attempt := range bmrc.tinkerbellMachine.Status.PXEAttempts {
+		names = append(names, attempt.JobName)
+	}
+
+	for _, name := range names {
+		job := &rufiov1.Job{}
+		job.Name = name
+		job.Namespace = bmrc.tinkNamespace
+
+		if err := bmrc.tinkClient.Delete(bmrc.ctx, job); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("deleting BMCJob %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,1002 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/controllers/remote"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/annotations"
+	"sigs.k8s.io/cluster-api/util/patch"
+	"sigs.k8s.io/cluster-api/util/predicates"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+
+	rufiov1 "github.com/tinkerbell/rufio/api/v1alpha1"
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+)
+
+const (
+	// firmwareRolloutSourceName identifies the rollout controller to the workload cluster client cache.
+	firmwareRolloutSourceName = "firmwarerollout-controller"
+
+	// firmwareRolloutPollInterval is how often a progressing rollout checks its machines, as Nodes
+	// and Pods of the workload cluster are not watched.
+	firmwareRolloutPollInterval = 15 * time.Second
+
+	// defaultFirmwareRolloutPhaseTimeout limits the phases of a machine update past draining if the
+	// rollout does not set a PhaseTimeout.
+	defaultFirmwareRolloutPhaseTimeout = 30 * time.Minute
+
+	// mirrorPodAnnotation marks static Pods, which can't be evicted.
+	mirrorPodAnnotation = "kubernetes.io/config.mirror"
+
+	// HardwareFirmwareUpdateAnnotation is set on the Hardware of a machine while it network boots into
+	// the firmware workflow of a TinkerbellFirmwareRollout, to <namespace>/<name> of the rollout. The
+	// Hardware is treated as provisioned while its netboot states are cleared.
+	HardwareFirmwareUpdateAnnotation = "v1alpha1.tinkerbell.org/firmwareUpdate"
+
+	// FirmwareRolloutNameLabel is set on Workflows and BMC Jobs a TinkerbellFirmwareRollout creates
+	// outside of its namespace, which it can't own, to the name of the rollout.
+	FirmwareRolloutNameLabel = "v1alpha1.tinkerbell.org/firmwareRolloutName"
+
+	// FirmwareRolloutNamespaceLabel is set next to FirmwareRolloutNameLabel to the namespace of the rollout.
+	FirmwareRolloutNamespaceLabel = "v1alpha1.tinkerbell.org/firmwareRolloutNamespace"
+)
+
+// PodEvicter evicts a Pod of a workload cluster through the Eviction API, so PodDisruptionBudgets
+// are honored. Evictions refused by a PodDisruptionBudget are not errors, they are retried on the
+// next reconcile.
+type PodEvicter func(ctx context.Context, cluster client.ObjectKey, pod *corev1.Pod) error
+
+// NewPodEvicter returns a PodEvicter for the workload clusters whose kubeconfig Secret is read with
+// the management cluster client c.
+func NewPodEvicter(c client.Client) PodEvicter {
+	return func(ctx context.Context, cluster client.ObjectKey, pod *corev1.Pod) error {
+		restConfig, err := remote.RESTConfig(ctx, firmwareRolloutSourceName, c, cluster)
+		if err != nil {
+			return fmt.Errorf("getting workload cluster REST config: %w", err)
+		}
+
+		clientset, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			return fmt.Errorf("creating workload cluster clientset: %w", err)
+		}
+
+		eviction := &policyv1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace},
+		}
+
+		err = clientset.PolicyV1().Evictions(pod.Namespace).Evict(ctx, eviction)
+		if err == nil || apierrors.IsNotFound(err) || apierrors.IsTooManyRequests(err) {
+			return nil
+		}
+
+		return fmt.Errorf("evicting Pod %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+}
+
+// TinkerbellFirmwareRolloutReconciler updates the firmware of the machines selected by
+// TinkerbellFirmwareRollouts, MaxConcurrent machines at a time.
+type TinkerbellFirmwareRolloutReconciler struct {
+	client.Client
+	WatchFilterValue string
+
+	// RemoteClientGetter returns a client for a workload cluster. If not set, remote.NewClusterClient is used.
+	RemoteClientGetter remote.ClusterClientGetter
+
+	// PodEvicter evicts Pods of workload clusters. If not set, NewPodEvicter is used.
+	PodEvicter PodEvicter
+
+	// StackClientGetter builds clients for the Tinkerbell stacks of failure domains running outside
+	// of the management cluster. If nil, clients are built from the scheme of the manager.
+	StackClientGetter StackClientGetter
+}
+
+// firmwareRolloutContext holds the state of a single reconcile of a TinkerbellFirmwareRollout.
+type firmwareRolloutContext struct {
+	ctx               context.Context
+	log               logr.Logger
+	client            client.Client
+	remoteClient      client.Client
+	evict             PodEvicter
+	stackClientGetter StackClientGetter
+	cluster           client.ObjectKey
+	rollout           *infrastructurev1.TinkerbellFirmwareRollout
+}
+
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=tinkerbellfirmwarerollouts,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=tinkerbellfirmwarerollouts/status,verbs=get;update;patch
+
+// Reconcile advances the update of the machines of a TinkerbellFirmwareRollout.
+func (r *TinkerbellFirmwareRolloutReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, reterr error) {
+	log := ctrl.LoggerFrom(ctx).WithValues("tinkerbellfirmwarerollout", req.NamespacedName)
+
+	rollout := &infrastructurev1.TinkerbellFirmwareRollout{}
+	if err := r.Get(ctx, req.NamespacedName, rollout); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+
+		return ctrl.Result{}, fmt.Errorf("getting TinkerbellFirmwareRollout: %w", err)
+	}
+
+	if !rollout.DeletionTimestamp.IsZero() || rollout.Status.Phase == infrastructurev1.FirmwareRolloutCompleted ||
+		rollout.Status.Phase == infrastructurev1.FirmwareRolloutFailed {
+		return ctrl.Result{}, nil
+	}
+
+	patchHelper, err := patch.NewHelper(rollout, r.Client)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("initializing patch helper: %w", err)
+	}
+
+	defer func() {
+		if err := patchHelper.Patch(ctx, rollout); err != nil {
+			reterr = kerrors.NewAggregate([]error{reterr, fmt.Errorf("patching TinkerbellFirmwareRollout: %w", err)})
+		}
+	}()
+
+	cluster := client.ObjectKey{Namespace: rollout.Namespace, Name: rollout.Spec.ClusterName}
+
+	remoteClientGetter := r.RemoteClientGetter
+	if remoteClientGetter == nil {
+		remoteClientGetter = remote.NewClusterClient
+	}
+
+	remoteClient, err := remoteClientGetter(ctx, firmwareRolloutSourceName, r.Client, cluster)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("getting workload cluster client: %w", err)
+	}
+
+	evict := r.PodEvicter
+	if evict == nil {
+		evict = NewPodEvicter(r.Client)
+	}
+
+	frc := &firmwareRolloutContext{
+		ctx:               ctx,
+		log:               log,
+		client:            r.Client,
+		remoteClient:      remoteClient,
+		evict:             evict,
+		stackClientGetter: r.StackClientGetter,
+		cluster:           cluster,
+		rollout:           rollout,
+	}
+
+	if err := frc.reconcile(); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if rollout.Status.Phase != infrastructurev1.FirmwareRolloutProgressing {
+		return ctrl.Result{}, nil
+	}
+
+	return ctrl.Result{RequeueAfter: firmwareRolloutPollInterval}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *TinkerbellFirmwareRolloutReconciler) SetupWithManager(
+	ctx context.Context,
+	mgr ctrl.Manager,
+	options controller.Options,
+) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	if r.StackClientGetter == nil {
+		r.StackClientGetter = NewCachingStackClientGetter(mgr.GetScheme())
+	}
+
+	err := ctrl.NewControllerManagedBy(mgr).
+		WithOptions(options).
+		For(&infrastructurev1.TinkerbellFirmwareRollout{}).
+		WithEventFilter(predicates.ResourceNotPausedAndHasFilterLabel(log, r.WatchFilterValue)).
+		Owns(&tinkv1.Workflow{}).
+		Owns(&rufiov1.Job{}).
+		Complete(r)
+	if err != nil {
+		return fmt.Errorf("failed to create controller: %w", err)
+	}
+
+	return nil
+}
+
+// reconcile selects the machines of the rollout on its first reconcile, then advances the machines
+// being updated and starts updating pending machines while fewer than MaxConcurrent are in progress.
+func (frc *firmwareRolloutContext) reconcile() error {
+	status := &frc.rollout.Status
+
+	if status.Phase == "" {
+		machines, err := frc.selectMachines()
+		if err != nil {
+			return err
+		}
+
+		status.Machines = machines
+		status.Phase = infrastructurev1.FirmwareRolloutProgressing
+	}
+
+	for i := range status.Machines {
+		if machineUpdateActive(status.Machines[i].Phase) {
+			if err := frc.advance(&status.Machines[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	maxConcurrent := int(frc.rollout.Spec.MaxConcurrent)
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+
+	for i := range status.Machines {
+		if frc.failed() || frc.active() >= maxConcurrent {
+			break
+		}
+
+		machine := &status.Machines[i]
+		if machine.Phase != infrastructurev1.FirmwareRolloutMachinePending {
+			continue
+		}
+
+		excluded, err := frc.machineExcluded(machine.Name)
+		if err != nil {
+			return err
+		}
+
+		// Held and paused machines stay pending until they are released.
+		if excluded {
+			continue
+		}
+
+		frc.log.Info("Updating firmware of machine", "machine", machine.Name)
+		setRolloutMachinePhase(machine, infrastructurev1.FirmwareRolloutMachineDraining, "")
+
+		if err := frc.advance(machine); err != nil {
+			return err
+		}
+	}
+
+	status.UpdatedMachines = 0
+
+	for _, machine := range status.Machines {
+		if machine.Phase == infrastructurev1.FirmwareRolloutMachineCompleted {
+			status.UpdatedMachines++
+		}
+	}
+
+	switch {
+	case frc.active() > 0:
+		return nil
+	case frc.failed():
+		status.Phase = infrastructurev1.FirmwareRolloutFailed
+	case int(status.UpdatedMachines) == len(status.Machines):
+		status.Phase = infrastructurev1.FirmwareRolloutCompleted
+	default:
+		return nil
+	}
+
+	return frc.removeUnownedObjects()
+}
+
+// removeUnownedObjects deletes the Workflows and BMC Jobs the rollout created outside of its
+// namespace or in the Tinkerbell stacks of failure domains once it finished, as they are not
+// garbage collected with the rollout.
+func (frc *firmwareRolloutContext) removeUnownedObjects() error {
+	clients := []client.Client{frc.client}
+	remote := map[string]bool{}
+
+	for _, machine := range frc.rollout.Status.Machines {
+		tinkerbellMachine := &infrastructurev1.TinkerbellMachine{}
+		key := client.ObjectKey{Namespace: frc.rollout.Namespace, Name: machine.Name}
+
+		if err := frc.client.Get(frc.ctx, key, tinkerbellMachine); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+
+			return fmt.Errorf("getting TinkerbellMachine: %w", err)
+		}
+
+		stack, err := MachineTinkerbellStack(frc.ctx, frc.client, frc.stackClientGetter, tinkerbellMachine)
+		if err != nil {
+			return err
+		}
+
+		if stack.Remote() && !remote[stack.FailureDomain.KubeconfigSecretRef.Name] {
+			remote[stack.FailureDomain.KubeconfigSecretRef.Name] = true
+			clients = append(clients, stack.Client)
+		}
+	}
+
+	for _, c := range clients {
+		if err := frc.removeUnownedObjectsWith(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeUnownedObjectsWith deletes the Workflows and BMC Jobs labeled for the rollout with the
+// client of a Tinkerbell stack.
+func (frc *firmwareRolloutContext) removeUnownedObjectsWith(c client.Client) error {
+	labels := client.MatchingLabels{
+		FirmwareRolloutNameLabel:      frc.rollout.Name,
+		FirmwareRolloutNamespaceLabel: frc.rollout.Namespace,
+	}
+
+	workflows := &tinkv1.WorkflowList{}
+	if err := c.List(frc.ctx, workflows, labels); err != nil {
+		return fmt.Errorf("listing firmware workflows: %w", err)
+	}
+
+	for i := range workflows.Items {
+		if err := c.Delete(frc.ctx, &workflows.Items[i]); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("deleting firmware workflow: %w", err)
+		}
+	}
+
+	jobs := &rufiov1.JobList{}
+	if err := c.List(frc.ctx, jobs, labels); err != nil {
+		return fmt.Errorf("listing BMC jobs: %w", err)
+	}
+
+	for i := range jobs.Items {
+		if err := c.Delete(frc.ctx, &jobs.Items[i]); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("deleting BMC job: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// selectMachines returns the provisioned TinkerbellMachines of the cluster matched by the selector
+// of the rollout, ordered by name, all pending. Held and paused machines are left out.
+func (frc *firmwareRolloutContext) selectMachines() ([]infrastructurev1.FirmwareRolloutMachine, error) {
+	selector, err := metav1.LabelSelectorAsSelector(&frc.rollout.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("parsing selector: %w", err)
+	}
+
+	tinkerbellMachines := &infrastructurev1.TinkerbellMachineList{}
+	if err := frc.client.List(frc.ctx, tinkerbellMachines, client.InNamespace(frc.rollout.Namespace),
+		client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, fmt.Errorf("listing TinkerbellMachines: %w", err)
+	}
+
+	machines := []infrastructurev1.FirmwareRolloutMachine{}
+
+	for _, tinkerbellMachine := range tinkerbellMachines.Items {
+		if tinkerbellMachine.Labels[clusterv1.ClusterLabelName] != frc.rollout.Spec.ClusterName ||
+			!tinkerbellMachine.DeletionTimestamp.IsZero() || !tinkerbellMachine.Status.Ready ||
+			tinkerbellMachine.Spec.HardwareName == "" || machineHeldOrPaused(&tinkerbellMachine) {
+			continue
+		}
+
+		machines = append(machines, infrastructurev1.FirmwareRolloutMachine{
+			Name:               tinkerbellMachine.Name,
+			Phase:              infrastructurev1.FirmwareRolloutMachinePending,
+			LastTransitionTime: metav1.Now(),
+		})
+	}
+
+	sort.Slice(machines, func(i, j int) bool { return machines[i].Name < machines[j].Name })
+
+	return machines, nil
+}
+
+// machineHeldOrPaused returns true if the TinkerbellMachine carries the hold annotation or is paused,
+// so its Hardware must not be touched.
+func machineHeldOrPaused(tinkerbellMachine *infrastructurev1.TinkerbellMachine) bool {
+	_, held := tinkerbellMachine.Annotations[infrastructurev1.HoldOnFailureAnnotation]
+
+	return held || annotations.HasPaused(tinkerbellMachine)
+}
+
+// machineExcluded returns true if the pending machine is held or paused.
+func (frc *firmwareRolloutContext) machineExcluded(name string) (bool, error) {
+	tinkerbellMachine := &infrastructurev1.TinkerbellMachine{}
+	key := client.ObjectKey{Namespace: frc.rollout.Namespace, Name: name}
+
+	if err := frc.client.Get(frc.ctx, key, tinkerbellMachine); err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("getting TinkerbellMachine: %w", err)
+	}
+
+	return machineHeldOrPaused(tinkerbellMachine), nil
+}
+
+// active returns the number of machines being updated.
+func (frc *firmwareRolloutContext) active() int {
+	active := 0
+
+	for _, machine := range frc.rollout.Status.Machines {
+		if machineUpdateActive(machine.Phase) {
+			active++
+		}
+	}
+
+	return active
+}
+
+// failed returns true if the update of a machine failed.
+func (frc *firmwareRolloutContext) failed() bool {
+	for _, machine := range frc.rollout.Status.Machines {
+		if machine.Phase == infrastructurev1.FirmwareRolloutMachineFailed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// machineUpdateActive returns true if the machine update is past Pending but not finished.
+func machineUpdateActive(phase infrastructurev1.FirmwareRolloutMachinePhase) bool {
+	switch phase {
+	case infrastructurev1.FirmwareRolloutMachinePending, infrastructurev1.FirmwareRolloutMachineCompleted,
+		infrastructurev1.FirmwareRolloutMachineFailed:
+		return false
+	default:
+		return true
+	}
+}
+
+// setRolloutMachinePhase moves the machine to the phase.
+func setRolloutMachinePhase(
+	machine *infrastructurev1.FirmwareRolloutMachine,
+	phase infrastructurev1.FirmwareRolloutMachinePhase,
+	message string,
+) {
+	machine.Phase = phase
+	machine.Message = message
+	machine.LastTransitionTime = metav1.Now()
+}
+
+// advance runs the step of the machine update matching its phase.
+func (frc *firmwareRolloutContext) advance(machine *infrastructurev1.FirmwareRolloutMachine) error {
+	tinkerbellMachine := &infrastructurev1.TinkerbellMachine{}
+	key := client.ObjectKey{Namespace: frc.rollout.Namespace, Name: machine.Name}
+
+	if err := frc.client.Get(frc.ctx, key, tinkerbellMachine); err != nil {
+		if apierrors.IsNotFound(err) {
+			setRolloutMachinePhase(machine, infrastructurev1.FirmwareRolloutMachineFailed, "TinkerbellMachine not found")
+
+			return nil
+		}
+
+		return fmt.Errorf("getting TinkerbellMachine: %w", err)
+	}
+
+	var err error
+
+	phase := machine.Phase
+
+	switch phase {
+	case infrastructurev1.FirmwareRolloutMachineDraining:
+		err = frc.drain(machine, tinkerbellMachine)
+	case infrastructurev1.FirmwareRolloutMachineUpdating:
+		err = frc.runFirmwareWorkflow(machine, tinkerbellMachine)
+	case infrastructurev1.FirmwareRolloutMachineRebooting:
+		err = frc.reboot(machine, tinkerbellMachine)
+	case infrastructurev1.FirmwareRolloutMachineWaitingForNode:
+		err = frc.waitForNode(machine)
+	case infrastructurev1.FirmwareRolloutMachinePending, infrastructurev1.FirmwareRolloutMachineCompleted,
+		infrastructurev1.FirmwareRolloutMachineFailed:
+	}
+
+	if err == nil && machine.Phase == phase {
+		err = frc.checkPhaseTimeout(machine)
+	}
+
+	var failure *firmwareRolloutFailure
+	if errors.As(err, &failure) {
+		frc.log.Info("Firmware update of machine failed", "machine", machine.Name, "reason", failure.message)
+		setRolloutMachinePhase(machine, infrastructurev1.FirmwareRolloutMachineFailed, failure.message)
+
+		// The Hardware must not be left network booting into Tinkerbell.
+		if phase == infrastructurev1.FirmwareRolloutMachineUpdating {
+			if err := frc.restoreNetboot(tinkerbellMachine); err != nil {
+				frc.log.Error(err, "Restoring netboot states of Hardware", "machine", machine.Name)
+			}
+		}
+
+		return nil
+	}
+
+	return err
+}
+
+// checkPhaseTimeout fails the machine if it spent longer than the PhaseTimeout of the rollout in
+// one of the phases past draining, which has its own timeout.
+func (frc *firmwareRolloutContext) checkPhaseTimeout(machine *infrastructurev1.FirmwareRolloutMachine) error {
+	switch machine.Phase {
+	case infrastructurev1.FirmwareRolloutMachineUpdating, infrastructurev1.FirmwareRolloutMachineRebooting,
+		infrastructurev1.FirmwareRolloutMachineWaitingForNode:
+	default:
+		return nil
+	}
+
+	timeout := defaultFirmwareRolloutPhaseTimeout
+	if frc.rollout.Spec.PhaseTimeout != nil {
+		timeout = frc.rollout.Spec.PhaseTimeout.Duration
+	}
+
+	if time.Since(machine.LastTransitionTime.Time) > timeout {
+		return failRollout("phase %s timed out after %s", machine.Phase, timeout)
+	}
+
+	return nil
+}
+
+// firmwareRolloutFailure is returned by the steps of a machine update which can't succeed.
+type firmwareRolloutFailure struct {
+	message string
+}
+
+func (f *firmwareRolloutFailure) Error() string {
+	return f.message
+}
+
+// failRollout returns a firmwareRolloutFailure with the formatted message.
+func failRollout(format string, args ...interface{}) error {
+	return &firmwareRolloutFailure{message: fmt.Sprintf(format, args...)}
+}
+
+// node returns the Node of the machine, recording its name and boot ID on first use.
+func (frc *firmwareRolloutContext) node(
+	machine *infrastructurev1.FirmwareRolloutMachine,
+	tinkerbellMachine *infrastructurev1.TinkerbellMachine,
+) (*corev1.Node, error) {
+	if machine.NodeName == "" {
+		owner, err := util.GetOwnerMachine(frc.ctx, frc.client, tinkerbellMachine.ObjectMeta)
+		if err != nil {
+			return nil, fmt.Errorf("getting Machine: %w", err)
+		}
+
+		if owner == nil || owner.Status.NodeRef == nil {
+			return nil, failRollout("machine has no Node")
+		}
+
+		machine.NodeName = owner.Status.NodeRef.Name
+	}
+
+	node := &corev1.Node{}
+	if err := frc.remoteClient.Get(frc.ctx, client.ObjectKey{Name: machine.NodeName}, node); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, failRollout("Node %s not found", machine.NodeName)
+		}
+
+		return nil, fmt.Errorf("getting Node: %w", err)
+	}
+
+	if machine.BootID == "" {
+		machine.BootID = node.Status.NodeInfo.BootID
+	}
+
+	return node, nil
+}
+
+// setUnschedulable cordons or uncordons the Node.
+func (frc *firmwareRolloutContext) setUnschedulable(node *corev1.Node, unschedulable bool) error {
+	if node.Spec.Unschedulable == unschedulable {
+		return nil
+	}
+
+	patch := client.MergeFrom(node.DeepCopy())
+	node.Spec.Unschedulable = unschedulable
+
+	if err := frc.remoteClient.Patch(frc.ctx, node, patch); err != nil {
+		return fmt.Errorf("patching Node %s: %w", node.Name, err)
+	}
+
+	return nil
+}
+
+// drain cordons the Node of the machine and evicts its Pods. The machine moves on once only
+// DaemonSet, static and finished Pods are left.
+func (frc *firmwareRolloutContext) drain(
+	machine *infrastructurev1.FirmwareRolloutMachine,
+	tinkerbellMachine *infrastructurev1.TinkerbellMachine,
+) error {
+	node, err := frc.node(machine, tinkerbellMachine)
+	if err != nil {
+		return err
+	}
+
+	if err := frc.setUnschedulable(node, true); err != nil {
+		return err
+	}
+
+	pods := &corev1.PodList{}
+	if err := frc.remoteClient.List(frc.ctx, pods, client.MatchingFields{"spec.nodeName": node.Name}); err != nil {
+		return fmt.Errorf("listing Pods: %w", err)
+	}
+
+	remaining := 0
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Spec.NodeName != node.Name || !podNeedsEviction(pod) {
+			continue
+		}
+
+		remaining++
+
+		if !pod.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		if err := frc.evict(frc.ctx, frc.cluster, pod); err != nil {
+			return err
+		}
+	}
+
+	if remaining == 0 {
+		setRolloutMachinePhase(machine, infrastructurev1.FirmwareRolloutMachineUpdating, "")
+
+		return nil
+	}
+
+	timeout := frc.rollout.Spec.DrainTimeout
+	if timeout != nil && time.Since(machine.LastTransitionTime.Time) > timeout.Duration {
+		return failRollout("draining Node %s timed out with %d Pods left", node.Name, remaining)
+	}
+
+	return nil
+}
+
+// podNeedsEviction returns false for Pods draining leaves on the Node: finished Pods, static
+// Pods and Pods of DaemonSets.
+func podNeedsEviction(pod *corev1.Pod) bool {
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return false
+	}
+
+	if _, ok := pod.Annotations[mirrorPodAnnotation]; ok {
+		return false
+	}
+
+	if owner := metav1.GetControllerOf(pod); owner != nil && owner.Kind == "DaemonSet" {
+		return false
+	}
+
+	return true
+}
+
+// rolloutObjectMeta returns the metadata of an object created for the machine update in the
+// Tinkerbell stack. The object is owned by the rollout if it lives in the same namespace of the
+// management cluster, and labeled for removeUnownedObjects otherwise.
+func (frc *firmwareRolloutContext) rolloutObjectMeta(
+	name string, stack *TinkerbellStack, namespace string,
+) metav1.ObjectMeta {
+	meta := metav1.ObjectMeta{
+		Name:      strings.Join([]string{frc.rollout.Name, name}, "-"),
+		Namespace: namespace,
+	}
+
+	if stack.Remote() || namespace != frc.rollout.Namespace {
+		meta.Labels = map[string]string{
+			FirmwareRolloutNameLabel:      frc.rollout.Name,
+			FirmwareRolloutNamespaceLabel: frc.rollout.Namespace,
+		}
+	} else {
+		meta.OwnerReferences = []metav1.OwnerReference{
+			{
+				APIVersion: infrastructurev1.GroupVersion.String(),
+				Kind:       "TinkerbellFirmwareRollout",
+				Name:       frc.rollout.Name,
+				UID:        frc.rollout.UID,
+				Controller: pointer.Bool(true),
+			},
+		}
+	}
+
+	return meta
+}
+
+// machineHardware returns the Tinkerbell stack of the machine and its Hardware.
+func (frc *firmwareRolloutContext) machineHardware(
+	tinkerbellMachine *infrastructurev1.TinkerbellMachine,
+) (*TinkerbellStack, *tinkv1.Hardware, error) {
+	stack, err := MachineTinkerbellStack(frc.ctx, frc.client, frc.stackClientGetter, tinkerbellMachine)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hardware, err := providerHardware(frc.ctx, stack.Client, tinkerbellMachine)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if hardware == nil {
+		return nil, nil, failRollout("Hardware %s not found", tinkerbellMachine.Spec.HardwareName)
+	}
+
+	if hardware.Spec.BMCRef == nil {
+		return nil, nil, failRollout("Hardware %s has no BMC", hardware.Name)
+	}
+
+	return stack, hardware, nil
+}
+
+// runFirmwareWorkflow creates the firmware workflow of the Hardware and network boots it into
+// Tinkerbell, then waits for the workflow to finish.
+func (frc *firmwareRolloutContext) runFirmwareWorkflow(
+	machine *infrastructurev1.FirmwareRolloutMachine,
+	tinkerbellMachine *infrastructurev1.TinkerbellMachine,
+) error {
+	stack, hardware, err := frc.machineHardware(tinkerbellMachine)
+	if err != nil {
+		return err
+	}
+
+	instanceID := hardwareInstanceID(hardware)
+	if instanceID == "" {
+		return failRollout("Hardware %s has no instance ID", hardware.Name)
+	}
+
+	workflow := &tinkv1.Workflow{}
+	meta := frc.rolloutObjectMeta(machine.Name, stack, hardware.Namespace)
+
+	err = stack.Client.Get(frc.ctx, client.ObjectKey{Namespace: meta.Namespace, Name: meta.Name}, workflow)
+	if apierrors.IsNotFound(err) {
+		workflow = &tinkv1.Workflow{
+			ObjectMeta: meta,
+			Spec: tinkv1.WorkflowSpec{
+				TemplateRef: frc.rollout.Spec.TemplateName,
+				HardwareRef: hardware.Name,
+				HardwareMap: map[string]string{"device_1": instanceID},
+			},
+		}
+
+		if err := stack.Client.Create(frc.ctx, workflow); err != nil {
+			return fmt.Errorf("creating firmware workflow: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("getting firmware workflow: %w", err)
+	}
+
+	switch workflow.Status.State {
+	case tinkv1.WorkflowStateSuccess:
+		if err := frc.setNetboot(stack, hardware, false); err != nil {
+			return err
+		}
+
+		setRolloutMachinePhase(machine, infrastructurev1.FirmwareRolloutMachineRebooting, "")
+
+		return nil
+	case tinkv1.WorkflowStateFailed, tinkv1.WorkflowStateTimeout:
+		return failRollout("firmware workflow %s finished in state %s", workflow.Name, workflow.Status.State)
+	case tinkv1.WorkflowStatePending, tinkv1.WorkflowStateRunning:
+	}
+
+	if err := frc.setNetboot(stack, hardware, true); err != nil {
+		return err
+	}
+
+	job, err := frc.ensureBootJob(machine.Name+"-pxe", stack, hardware, rufiov1.PXE)
+	if err != nil {
+		return err
+	}
+
+	if job.HasCondition(rufiov1.JobFailed, rufiov1.ConditionTrue) {
+		return failRollout("BMC job %s booting the Hardware into Tinkerbell failed", job.Name)
+	}
+
+	return nil
+}
+
+// setNetboot clears the netboot states of the provisioned Hardware so Boots network boots it into the
+// firmware workflow, or restores them. While they are cleared, the Hardware carries the
+// HardwareFirmwareUpdateAnnotation so the TinkerbellMachine controller keeps treating it as provisioned.
+func (frc *firmwareRolloutContext) setNetboot(stack *TinkerbellStack, hardware *tinkv1.Hardware, allow bool) error {
+	_, allowed := hardware.Annotations[HardwareFirmwareUpdateAnnotation]
+	if allowed == allow {
+		return nil
+	}
+
+	patch := client.MergeFrom(hardware.DeepCopy())
+
+	if allow {
+		if hardware.Annotations == nil {
+			hardware.Annotations = map[string]string{}
+		}
+
+		hardware.Annotations[HardwareFirmwareUpdateAnnotation] = frc.rollout.Namespace + "/" + frc.rollout.Name
+	} else {
+		delete(hardware.Annotations, HardwareFirmwareUpdateAnnotation)
+	}
+
+	// See clearHardwareOwnership for the states allowing Boots to netboot the Hardware.
+	if hardware.Spec.Metadata != nil {
+		hardware.Spec.Metadata.State = ""
+		if !allow {
+			hardware.Spec.Metadata.State = inUse
+		}
+
+		if hardware.Spec.Metadata.Instance != nil {
+			hardware.Spec.Metadata.Instance.State = ""
+			if !allow {
+				hardware.Spec.Metadata.Instance.State = provisioned
+			}
+		}
+	}
+
+	if err := stack.Client.Patch(frc.ctx, hardware, patch); err != nil {
+		return fmt.Errorf("patching netboot states of Hardware %s: %w", hardware.Name, err)
+	}
+
+	return nil
+}
+
+// restoreNetboot restores the netboot states of the Hardware of the machine if they were cleared.
+func (frc *firmwareRolloutContext) restoreNetboot(tinkerbellMachine *infrastructurev1.TinkerbellMachine) error {
+	stack, hardware, err := frc.machineHardware(tinkerbellMachine)
+
+	var failure *firmwareRolloutFailure
+	if errors.As(err, &failure) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return frc.setNetboot(stack, hardware, false)
+}
+
+// reboot boots the Hardware back into its installed OS.
+func (frc *firmwareRolloutContext) reboot(
+	machine *infrastructurev1.FirmwareRolloutMachine,
+	tinkerbellMachine *infrastructurev1.TinkerbellMachine,
+) error {
+	stack, hardware, err := frc.machineHardware(tinkerbellMachine)
+	if err != nil {
+		return err
+	}
+
+	job, err := frc.ensureBootJob(machine.Name+"-reboot", stack, hardware, rufiov1.Disk)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case job.HasCondition(rufiov1.JobFailed, rufiov1.ConditionTrue):
+		return failRollout("BMC job %s rebooting the Hardware failed", job.Name)
+	case job.HasCondition(rufiov1.JobCompleted, rufiov1.ConditionTrue):
+		setRolloutMachinePhase(machine, infrastructurev1.FirmwareRolloutMachineWaitingForNode, "")
+	}
+
+	return nil
+}
+
+// ensureBootJob returns the BMC job powering the Hardware off and on again from the boot device,
+// creating it in the Tinkerbell stack of the Hardware if needed.
+func (frc *firmwareRolloutContext) ensureBootJob(name string, stack *TinkerbellStack, hardware *tinkv1.Hardware,
+	device rufiov1.BootDevice,
+) (*rufiov1.Job, error) {
+	job := &rufiov1.Job{}
+	meta := frc.rolloutObjectMeta(name, stack, hardware.Namespace)
+
+	err := stack.Client.Get(frc.ctx, client.ObjectKey{Namespace: meta.Namespace, Name: meta.Name}, job)
+	if err == nil {
+		return job, nil
+	}
+
+	if !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("getting BMC job: %w", err)
+	}
+
+	job = newBootJob(meta, hardware, device)
+
+	if err := stack.Client.Create(frc.ctx, job); err != nil {
+		return nil, fmt.Errorf("creating BMC job: %w", err)
+	}
+
+	return job, nil
+}
+
+// newBootJob returns a BMC job powering the Hardware off and on again from the boot device.
+func newBootJob(meta metav1.ObjectMeta, hardware *tinkv1.Hardware, device rufiov1.BootDevice) *rufiov1.Job {
+	var efiBoot bool
+	if len(hardware.Spec.Interfaces) > 0 && hardware.Spec.Interfaces[0].DHCP != nil {
+		efiBoot = hardware.Spec.Interfaces[0].DHCP.UEFI
+	}
+
+	return &rufiov1.Job{
+		ObjectMeta: meta,
+		Spec: rufiov1.JobSpec{
+			MachineRef: rufiov1.MachineRef{
+				Name:      hardware.Spec.BMCRef.Name,
+				Namespace: hardware.Namespace,
+			},
+			Tasks: []rufiov1.Action{
+				{
+					PowerAction: rufiov1.PowerHardOff.Ptr(),
+				},
+				{
+					OneTimeBootDeviceAction: &rufiov1.OneTimeBootDeviceAction{
+						Devices: []rufiov1.BootDevice{device},
+						EFIBoot: efiBoot,
+					},
+				},
+				{
+					PowerAction: rufiov1.PowerOn.Ptr(),
+				},
+			},
+		},
+	}
+}
+
+// waitForNode uncordons the Node of the machine once it has rebooted and is Ready.
+func (frc *firmwareRolloutContext) waitForNode(machine *infrastructurev1.FirmwareRolloutMachine) error {
+	node := &corev1.Node{}
+	if err := frc.remoteClient.Get(frc.ctx, client.ObjectKey{Name: machine.NodeName}, node); err != nil {
+		if apierrors.IsNotFound(err) {
+			return failRollout("Node %s not found", machine.NodeName)
+		}
+
+		return fmt.Errorf("getting Node: %w", err)
+	}
+
+	if machine.BootID != "" && node.Status.NodeInfo.BootID == machine.BootID {
+		return nil
+	}
+
+	ready := false
+
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			ready = condition.Status == corev1.ConditionTrue
+		}
+	}
+
+	if !ready {
+		return nil
+	}
+
+	if err := frc.setUnschedulable(node, false); err != nil {
+		return err
+	}
+
+	setRolloutMachinePhase(machine, infrastructurev1.FirmwareRolloutMachineCompleted, "")
+
+	return nil
+}
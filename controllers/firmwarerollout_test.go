@@ -0,0 +1,520 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	rufiov1 "github.com/tinkerbell/rufio/api/v1alpha1"
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/controllers"
+)
+
+const firmwareRolloutName = "bios-update"
+
+// firmwareRolloutObjects returns the management cluster objects of a rollout over the named
+// machines, and the Nodes and Pods of the workload cluster.
+func firmwareRolloutObjects(names ...string) ([]runtime.Object, []runtime.Object) {
+	rollout := &infrastructurev1.TinkerbellFirmwareRollout{
+		ObjectMeta: metav1.ObjectMeta{Name: firmwareRolloutName, Namespace: clusterNamespace, UID: "rollout-uid"},
+		Spec: infrastructurev1.TinkerbellFirmwareRolloutSpec{
+			ClusterName:   clusterName,
+			TemplateName:  "bios",
+			MaxConcurrent: 1,
+			Selector:      metav1.LabelSelector{MatchLabels: map[string]string{"role": "worker"}},
+		},
+	}
+
+	objects := []runtime.Object{rollout}
+	remoteObjects := []runtime.Object{}
+
+	for i, name := range append(names, "control-plane") {
+		hardwareName := "hw-" + name
+
+		tinkerbellMachine := validTinkerbellMachine(name, clusterNamespace, name, fmt.Sprintf("uid-%d", i),
+			testOptions{Labels: map[string]string{clusterv1.ClusterLabelName: clusterName, "role": "worker"}})
+		tinkerbellMachine.Spec.HardwareName = hardwareName
+		tinkerbellMachine.Spec.ProviderID = fmt.Sprintf("tinkerbell://%s/%s", clusterNamespace, hardwareName)
+		tinkerbellMachine.Status.Ready = true
+
+		if name == "control-plane" {
+			tinkerbellMachine.Labels["role"] = "control-plane"
+		}
+
+		machine := validMachine(name, clusterNamespace, clusterName)
+		machine.Spec.ClusterName = clusterName
+		machine.Status.NodeRef = &corev1.ObjectReference{Kind: "Node", Name: "node-" + name}
+
+		hardware := validHardware(hardwareName, fmt.Sprintf("hw-uid-%d", i), fmt.Sprintf("10.0.0.%d", i+1))
+		hardware.Spec.BMCRef = &corev1.TypedLocalObjectReference{Kind: "Machine", Name: "bmc-" + name}
+		hardware.Spec.Metadata.State = "in_use"
+		hardware.Spec.Metadata.Instance.State = "provisioned"
+
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-" + name},
+			Status: corev1.NodeStatus{
+				NodeInfo:   corev1.NodeSystemInfo{BootID: "boot-1"},
+				Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+			},
+		}
+
+		controller := true
+		app := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "app-" + name, Namespace: "default"},
+			Spec:       corev1.PodSpec{NodeName: node.Name},
+		}
+		daemon := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "daemon-" + name,
+				Namespace:       "default",
+				OwnerReferences: []metav1.OwnerReference{{Kind: "DaemonSet", Name: "daemon", Controller: &controller}},
+			},
+			Spec: corev1.PodSpec{NodeName: node.Name},
+		}
+
+		objects = append(objects, tinkerbellMachine, machine, hardware)
+		remoteObjects = append(remoteObjects, node, app, daemon)
+	}
+
+	return objects, remoteObjects
+}
+
+//nolint:funlen
+func Test_Firmware_rollout_updates_one_machine_at_a_time(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	objects, remoteObjects := firmwareRolloutObjects("worker-0", "worker-1")
+	kubeClient := kubernetesClientWithObjects(t, objects)
+	remoteClient := kubernetesClientWithObjects(t, remoteObjects)
+
+	reconciler := &controllers.TinkerbellFirmwareRolloutReconciler{
+		Client: kubeClient,
+		RemoteClientGetter: func(context.Context, string, client.Client, client.ObjectKey) (client.Client, error) {
+			return remoteClient, nil
+		},
+		PodEvicter: func(ctx context.Context, _ client.ObjectKey, pod *corev1.Pod) error {
+			return remoteClient.Delete(ctx, pod)
+		},
+	}
+
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: firmwareRolloutName, Namespace: clusterNamespace}}
+
+	reconcile := func() *infrastructurev1.TinkerbellFirmwareRollout {
+		result, err := reconciler.Reconcile(ctx, request)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		rollout := &infrastructurev1.TinkerbellFirmwareRollout{}
+		g.Expect(kubeClient.Get(ctx, request.NamespacedName, rollout)).To(Succeed())
+
+		if rollout.Status.Phase == infrastructurev1.FirmwareRolloutProgressing {
+			g.Expect(result.RequeueAfter).To(BeNumerically(">", 0))
+		}
+
+		return rollout
+	}
+
+	phases := func(rollout *infrastructurev1.TinkerbellFirmwareRollout) []infrastructurev1.FirmwareRolloutMachinePhase {
+		phases := []infrastructurev1.FirmwareRolloutMachinePhase{}
+		for _, machine := range rollout.Status.Machines {
+			phases = append(phases, machine.Phase)
+		}
+
+		return phases
+	}
+
+	// The first machine is cordoned and its Pods evicted, except DaemonSet Pods.
+	rollout := reconcile()
+	g.Expect(rollout.Status.Phase).To(Equal(infrastructurev1.FirmwareRolloutProgressing))
+	g.Expect(rollout.Status.Machines).To(HaveLen(2), "control plane machine is not selected")
+	g.Expect(phases(rollout)).To(Equal([]infrastructurev1.FirmwareRolloutMachinePhase{
+		infrastructurev1.FirmwareRolloutMachineDraining, infrastructurev1.FirmwareRolloutMachinePending,
+	}))
+
+	node := &corev1.Node{}
+	g.Expect(remoteClient.Get(ctx, types.NamespacedName{Name: "node-worker-0"}, node)).To(Succeed())
+	g.Expect(node.Spec.Unschedulable).To(BeTrue())
+
+	pods := &corev1.PodList{}
+	g.Expect(remoteClient.List(ctx, pods)).To(Succeed())
+	g.Expect(pods.Items).To(HaveLen(5))
+
+	// Once drained, the firmware workflow is run after network booting the Hardware.
+	rollout = reconcile()
+	g.Expect(rollout.Status.Machines[0].Phase).To(Equal(infrastructurev1.FirmwareRolloutMachineUpdating))
+
+	rollout = reconcile()
+	g.Expect(rollout.Status.Machines[0].Phase).To(Equal(infrastructurev1.FirmwareRolloutMachineUpdating))
+
+	workflow := &tinkv1.Workflow{}
+	workflowKey := types.NamespacedName{Name: firmwareRolloutName + "-worker-0", Namespace: clusterNamespace}
+	g.Expect(kubeClient.Get(ctx, workflowKey, workflow)).To(Succeed())
+	g.Expect(workflow.Spec.TemplateRef).To(Equal("bios"))
+	g.Expect(workflow.Spec.HardwareRef).To(Equal("hw-worker-0"))
+
+	pxeJob := &rufiov1.Job{}
+	g.Expect(kubeClient.Get(ctx, types.NamespacedName{Name: workflowKey.Name + "-pxe", Namespace: clusterNamespace}, pxeJob)).To(Succeed())
+	g.Expect(pxeJob.Spec.MachineRef.Name).To(Equal("bmc-worker-0"))
+	g.Expect(pxeJob.Spec.Tasks[1].OneTimeBootDeviceAction.Devices).To(ConsistOf(rufiov1.PXE))
+
+	// The Hardware is allowed to netboot while the workflow runs.
+	hardware := &tinkv1.Hardware{}
+	hardwareKey := types.NamespacedName{Name: "hw-worker-0", Namespace: clusterNamespace}
+	g.Expect(kubeClient.Get(ctx, hardwareKey, hardware)).To(Succeed())
+	g.Expect(hardware.Annotations).To(HaveKey(controllers.HardwareFirmwareUpdateAnnotation))
+	g.Expect(hardware.Spec.Metadata.State).To(BeEmpty())
+	g.Expect(hardware.Spec.Metadata.Instance.State).To(BeEmpty())
+
+	workflow.Status.State = tinkv1.WorkflowStateSuccess
+	g.Expect(kubeClient.Update(ctx, workflow)).To(Succeed())
+
+	// The Hardware is then rebooted from its disk, with its netboot states restored.
+	rollout = reconcile()
+	g.Expect(rollout.Status.Machines[0].Phase).To(Equal(infrastructurev1.FirmwareRolloutMachineRebooting))
+
+	g.Expect(kubeClient.Get(ctx, hardwareKey, hardware)).To(Succeed())
+	g.Expect(hardware.Annotations).NotTo(HaveKey(controllers.HardwareFirmwareUpdateAnnotation))
+	g.Expect(hardware.Spec.Metadata.State).To(Equal("in_use"))
+	g.Expect(hardware.Spec.Metadata.Instance.State).To(Equal("provisioned"))
+
+	rollout = reconcile()
+	g.Expect(rollout.Status.Machines[0].Phase).To(Equal(infrastructurev1.FirmwareRolloutMachineRebooting))
+
+	rebootJob := &rufiov1.Job{}
+	g.Expect(kubeClient.Get(ctx, types.NamespacedName{Name: workflowKey.Name + "-reboot", Namespace: clusterNamespace}, rebootJob)).To(Succeed())
+	g.Expect(rebootJob.Spec.Tasks[1].OneTimeBootDeviceAction.Devices).To(ConsistOf(rufiov1.Disk))
+
+	rebootJob.Status.Conditions = []rufiov1.JobCondition{{Type: rufiov1.JobCompleted, Status: rufiov1.ConditionTrue}}
+	g.Expect(kubeClient.Update(ctx, rebootJob)).To(Succeed())
+
+	// The rollout waits for the Node to come back with a new boot ID.
+	rollout = reconcile()
+	g.Expect(rollout.Status.Machines[0].Phase).To(Equal(infrastructurev1.FirmwareRolloutMachineWaitingForNode))
+
+	rollout = reconcile()
+	g.Expect(rollout.Status.Machines[0].Phase).To(Equal(infrastructurev1.FirmwareRolloutMachineWaitingForNode))
+	g.Expect(rollout.Status.Machines[1].Phase).To(Equal(infrastructurev1.FirmwareRolloutMachinePending))
+
+	g.Expect(remoteClient.Get(ctx, types.NamespacedName{Name: "node-worker-0"}, node)).To(Succeed())
+	node.Status.NodeInfo.BootID = "boot-2"
+	g.Expect(remoteClient.Update(ctx, node)).To(Succeed())
+
+	// The Node is uncordoned and the next machine started.
+	rollout = reconcile()
+	g.Expect(phases(rollout)).To(Equal([]infrastructurev1.FirmwareRolloutMachinePhase{
+		infrastructurev1.FirmwareRolloutMachineCompleted, infrastructurev1.FirmwareRolloutMachineDraining,
+	}))
+	g.Expect(rollout.Status.UpdatedMachines).To(BeEquivalentTo(1))
+
+	g.Expect(remoteClient.Get(ctx, types.NamespacedName{Name: "node-worker-0"}, node)).To(Succeed())
+	g.Expect(node.Spec.Unschedulable).To(BeFalse())
+}
+
+func Test_Firmware_rollout_fails_when_firmware_workflow_fails(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	objects, remoteObjects := firmwareRolloutObjects("worker-0", "worker-1")
+	kubeClient := kubernetesClientWithObjects(t, objects)
+	remoteClient := kubernetesClientWithObjects(t, remoteObjects)
+
+	reconciler := &controllers.TinkerbellFirmwareRolloutReconciler{
+		Client: kubeClient,
+		RemoteClientGetter: func(context.Context, string, client.Client, client.ObjectKey) (client.Client, error) {
+			return remoteClient, nil
+		},
+		PodEvicter: func(ctx context.Context, _ client.ObjectKey, pod *corev1.Pod) error {
+			return remoteClient.Delete(ctx, pod)
+		},
+	}
+
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: firmwareRolloutName, Namespace: clusterNamespace}}
+
+	for i := 0; i < 3; i++ {
+		_, err := reconciler.Reconcile(ctx, request)
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+
+	workflow := &tinkv1.Workflow{}
+	workflowKey := types.NamespacedName{Name: firmwareRolloutName + "-worker-0", Namespace: clusterNamespace}
+	g.Expect(kubeClient.Get(ctx, workflowKey, workflow)).To(Succeed())
+
+	workflow.Status.State = tinkv1.WorkflowStateFailed
+	g.Expect(kubeClient.Update(ctx, workflow)).To(Succeed())
+
+	result, err := reconciler.Reconcile(ctx, request)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(BeZero())
+
+	rollout := &infrastructurev1.TinkerbellFirmwareRollout{}
+	g.Expect(kubeClient.Get(ctx, request.NamespacedName, rollout)).To(Succeed())
+	g.Expect(rollout.Status.Phase).To(Equal(infrastructurev1.FirmwareRolloutFailed))
+	g.Expect(rollout.Status.Machines[0].Phase).To(Equal(infrastructurev1.FirmwareRolloutMachineFailed))
+	g.Expect(rollout.Status.Machines[1].Phase).To(Equal(infrastructurev1.FirmwareRolloutMachinePending),
+		"no further machine is updated")
+
+	node := &corev1.Node{}
+	g.Expect(remoteClient.Get(ctx, types.NamespacedName{Name: "node-worker-0"}, node)).To(Succeed())
+	g.Expect(node.Spec.Unschedulable).To(BeTrue(), "the Node of a failed machine stays cordoned")
+}
+
+func Test_Firmware_rollout_removes_objects_outside_of_its_namespace(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	objects, remoteObjects := firmwareRolloutObjects("worker-0")
+
+	// The Hardware of the machine lives in another namespace, e.g. of a failure domain.
+	for _, object := range objects {
+		switch o := object.(type) {
+		case *tinkv1.Hardware:
+			o.Namespace = "tink"
+		case *infrastructurev1.TinkerbellMachine:
+			o.Spec.ProviderID = "tinkerbell://tink/" + o.Spec.HardwareName
+		}
+	}
+
+	kubeClient := kubernetesClientWithObjects(t, objects)
+	remoteClient := kubernetesClientWithObjects(t, remoteObjects)
+
+	reconciler := &controllers.TinkerbellFirmwareRolloutReconciler{
+		Client: kubeClient,
+		RemoteClientGetter: func(context.Context, string, client.Client, client.ObjectKey) (client.Client, error) {
+			return remoteClient, nil
+		},
+		PodEvicter: func(ctx context.Context, _ client.ObjectKey, pod *corev1.Pod) error {
+			return remoteClient.Delete(ctx, pod)
+		},
+	}
+
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: firmwareRolloutName, Namespace: clusterNamespace}}
+
+	for i := 0; i < 3; i++ {
+		_, err := reconciler.Reconcile(ctx, request)
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+
+	workflow := &tinkv1.Workflow{}
+	workflowKey := types.NamespacedName{Name: firmwareRolloutName + "-worker-0", Namespace: "tink"}
+	g.Expect(kubeClient.Get(ctx, workflowKey, workflow)).To(Succeed())
+	g.Expect(workflow.OwnerReferences).To(BeEmpty())
+	g.Expect(workflow.Labels).To(HaveKeyWithValue(controllers.FirmwareRolloutNameLabel, firmwareRolloutName))
+
+	pxeJobKey := types.NamespacedName{Name: workflowKey.Name + "-pxe", Namespace: "tink"}
+	g.Expect(kubeClient.Get(ctx, pxeJobKey, &rufiov1.Job{})).To(Succeed())
+
+	workflow.Status.State = tinkv1.WorkflowStateFailed
+	g.Expect(kubeClient.Update(ctx, workflow)).To(Succeed())
+
+	_, err := reconciler.Reconcile(ctx, request)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	rollout := &infrastructurev1.TinkerbellFirmwareRollout{}
+	g.Expect(kubeClient.Get(ctx, request.NamespacedName, rollout)).To(Succeed())
+	g.Expect(rollout.Status.Phase).To(Equal(infrastructurev1.FirmwareRolloutFailed))
+
+	g.Expect(apierrors.IsNotFound(kubeClient.Get(ctx, workflowKey, &tinkv1.Workflow{}))).To(BeTrue(),
+		"Expected the unowned workflow to be removed once the rollout finished")
+	g.Expect(apierrors.IsNotFound(kubeClient.Get(ctx, pxeJobKey, &rufiov1.Job{}))).To(BeTrue(),
+		"Expected the unowned BMC job to be removed once the rollout finished")
+}
+
+func Test_Firmware_rollout_fails_machine_when_phase_times_out(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	objects, remoteObjects := firmwareRolloutObjects("worker-0")
+	kubeClient := kubernetesClientWithObjects(t, objects)
+	remoteClient := kubernetesClientWithObjects(t, remoteObjects)
+
+	reconciler := &controllers.TinkerbellFirmwareRolloutReconciler{
+		Client: kubeClient,
+		RemoteClientGetter: func(context.Context, string, client.Client, client.ObjectKey) (client.Client, error) {
+			return remoteClient, nil
+		},
+		PodEvicter: func(ctx context.Context, _ client.ObjectKey, pod *corev1.Pod) error {
+			return remoteClient.Delete(ctx, pod)
+		},
+	}
+
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: firmwareRolloutName, Namespace: clusterNamespace}}
+
+	for i := 0; i < 3; i++ {
+		_, err := reconciler.Reconcile(ctx, request)
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+
+	// The workflow never starts, e.g. because the Hardware doesn't netboot.
+	rollout := &infrastructurev1.TinkerbellFirmwareRollout{}
+	g.Expect(kubeClient.Get(ctx, request.NamespacedName, rollout)).To(Succeed())
+	g.Expect(rollout.Status.Machines[0].Phase).To(Equal(infrastructurev1.FirmwareRolloutMachineUpdating))
+
+	rollout.Status.Machines[0].LastTransitionTime = metav1.NewTime(time.Now().Add(-time.Hour))
+	g.Expect(kubeClient.Update(ctx, rollout)).To(Succeed())
+
+	_, err := reconciler.Reconcile(ctx, request)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(kubeClient.Get(ctx, request.NamespacedName, rollout)).To(Succeed())
+	g.Expect(rollout.Status.Phase).To(Equal(infrastructurev1.FirmwareRolloutFailed))
+	g.Expect(rollout.Status.Machines[0].Phase).To(Equal(infrastructurev1.FirmwareRolloutMachineFailed))
+	g.Expect(rollout.Status.Machines[0].Message).To(Equal("phase Updating timed out after 30m0s"))
+
+	hardware := &tinkv1.Hardware{}
+	g.Expect(kubeClient.Get(ctx, types.NamespacedName{Name: "hw-worker-0", Namespace: clusterNamespace},
+		hardware)).To(Succeed())
+	g.Expect(hardware.Annotations).NotTo(HaveKey(controllers.HardwareFirmwareUpdateAnnotation))
+	g.Expect(hardware.Spec.Metadata.State).To(Equal("in_use"), "the netboot states are restored")
+}
+
+func Test_Firmware_rollout_skips_held_and_paused_machines(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	objects, remoteObjects := firmwareRolloutObjects("worker-0", "worker-1", "worker-2")
+
+	for _, object := range objects {
+		if o, ok := object.(*infrastructurev1.TinkerbellMachine); ok {
+			switch o.Name {
+			case "worker-0":
+				o.Annotations = map[string]string{infrastructurev1.HoldOnFailureAnnotation: ""}
+			case "worker-1":
+				o.Annotations = map[string]string{clusterv1.PausedAnnotation: ""}
+			}
+		}
+	}
+
+	kubeClient := kubernetesClientWithObjects(t, objects)
+	remoteClient := kubernetesClientWithObjects(t, remoteObjects)
+
+	reconciler := &controllers.TinkerbellFirmwareRolloutReconciler{
+		Client: kubeClient,
+		RemoteClientGetter: func(context.Context, string, client.Client, client.ObjectKey) (client.Client, error) {
+			return remoteClient, nil
+		},
+		PodEvicter: func(ctx context.Context, _ client.ObjectKey, pod *corev1.Pod) error {
+			return remoteClient.Delete(ctx, pod)
+		},
+	}
+
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: firmwareRolloutName, Namespace: clusterNamespace}}
+
+	_, err := reconciler.Reconcile(ctx, request)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	rollout := &infrastructurev1.TinkerbellFirmwareRollout{}
+	g.Expect(kubeClient.Get(ctx, request.NamespacedName, rollout)).To(Succeed())
+	g.Expect(rollout.Status.Machines).To(HaveLen(1))
+	g.Expect(rollout.Status.Machines[0].Name).To(Equal("worker-2"))
+}
+
+func Test_Firmware_rollout_runs_workflow_in_tinkerbell_stack_of_failure_domain(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	const stackNamespace = "tinkerbell"
+
+	objects, remoteObjects := firmwareRolloutObjects("worker-0")
+	stackObjects := []runtime.Object{}
+	managementObjects := []runtime.Object{}
+
+	for _, object := range objects {
+		switch o := object.(type) {
+		case *tinkv1.Hardware:
+			o.Namespace = stackNamespace
+			stackObjects = append(stackObjects, o)
+
+			continue
+		case *infrastructurev1.TinkerbellMachine:
+			o.Spec.ProviderID = fmt.Sprintf("tinkerbell://%s/%s", stackNamespace, o.Spec.HardwareName)
+			o.Status.FailureDomain = &infrastructurev1.TinkerbellFailureDomain{
+				Name:                "rack-b",
+				KubeconfigSecretRef: &corev1.LocalObjectReference{Name: "rack-b-kubeconfig"},
+				HardwareNamespace:   stackNamespace,
+			}
+		}
+
+		managementObjects = append(managementObjects, object)
+	}
+
+	kubeconfigSecret := validSecret("rack-b-kubeconfig", clusterNamespace)
+	kubeconfigSecret.Data["value"] = []byte("rack-b kubeconfig")
+
+	kubeClient := kubernetesClientWithObjects(t, append(managementObjects, kubeconfigSecret))
+	stackClient := kubernetesClientWithObjects(t, stackObjects)
+	remoteClient := kubernetesClientWithObjects(t, remoteObjects)
+
+	reconciler := &controllers.TinkerbellFirmwareRolloutReconciler{
+		Client: kubeClient,
+		RemoteClientGetter: func(context.Context, string, client.Client, client.ObjectKey) (client.Client, error) {
+			return remoteClient, nil
+		},
+		PodEvicter: func(ctx context.Context, _ client.ObjectKey, pod *corev1.Pod) error {
+			return remoteClient.Delete(ctx, pod)
+		},
+		StackClientGetter: func([]byte) (client.Client, error) {
+			return stackClient, nil
+		},
+	}
+
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: firmwareRolloutName, Namespace: clusterNamespace}}
+
+	for i := 0; i < 3; i++ {
+		_, err := reconciler.Reconcile(ctx, request)
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+
+	workflow := &tinkv1.Workflow{}
+	workflowKey := types.NamespacedName{Name: firmwareRolloutName + "-worker-0", Namespace: stackNamespace}
+	g.Expect(stackClient.Get(ctx, workflowKey, workflow)).To(Succeed())
+	g.Expect(workflow.OwnerReferences).To(BeEmpty())
+	g.Expect(workflow.Labels).To(HaveKeyWithValue(controllers.FirmwareRolloutNameLabel, firmwareRolloutName))
+
+	pxeJobKey := types.NamespacedName{Name: workflowKey.Name + "-pxe", Namespace: stackNamespace}
+	g.Expect(stackClient.Get(ctx, pxeJobKey, &rufiov1.Job{})).To(Succeed())
+
+	workflow.Status.State = tinkv1.WorkflowStateFailed
+	g.Expect(stackClient.Update(ctx, workflow)).To(Succeed())
+
+	_, err := reconciler.Reconcile(ctx, request)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(apierrors.IsNotFound(stackClient.Get(ctx, workflowKey, &tinkv1.Workflow{}))).To(BeTrue(),
+		"Expected the workflow to be removed from the stack once the rollout finished")
+	g.Expect(apierrors.IsNotFound(stackClient.Get(ctx, pxeJobKey, &rufiov1.Job{}))).To(BeTrue(),
+		"Expected the BMC job to be removed from the stack once the rollout finished")
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/cluster-api/util/patch"
+	"sigs.k8s.io/cluster-api/util/predicates"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	rufiov1 "github.com/tinkerbell/rufio/api/v1alpha1"
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+)
+
+const (
+	// HardwareBMCAddressAnnotation holds the host name or IP address of the BMC of the Hardware.
+	// When set, a BMC Machine is managed for the Hardware and referenced by its BMCRef.
+	HardwareBMCAddressAnnotation = "v1alpha1.tinkerbell.org/bmcAddress"
+
+	// HardwareBMCPortAnnotation holds the port of the BMC of the Hardware. Defaults to 623.
+	HardwareBMCPortAnnotation = "v1alpha1.tinkerbell.org/bmcPort"
+
+	// HardwareBMCSecretAnnotation holds the name of the Secret with the username and password keys
+	// to authenticate to the BMC with. The Secret must be in the namespace of the Hardware, so
+	// annotating Hardware does not grant access to the Secrets of other namespaces.
+	HardwareBMCSecretAnnotation = "v1alpha1.tinkerbell.org/bmcSecret"
+
+	// HardwareBMCInsecureTLSAnnotation, when "true", skips the verification of the certificate of the BMC.
+	HardwareBMCInsecureTLSAnnotation = "v1alpha1.tinkerbell.org/bmcInsecureTLS"
+
+	// defaultBMCPort is the IPMI port used when the Hardware doesn't set HardwareBMCPortAnnotation.
+	defaultBMCPort = 623
+)
+
+// ErrInvalidBMCAnnotations is returned when the BMC annotations of Hardware can't be turned into a
+// BMC Machine.
+var ErrInvalidBMCAnnotations = fmt.Errorf("invalid BMC annotations")
+
+// HardwareBMCReconciler manages BMC Machines from the BMC annotations of Hardware, so they don't
+// have to be maintained by hand. The BMC Machine is owned by the Hardware, so it's deleted with it,
+// and is deleted when the BMC annotations are removed.
+type HardwareBMCReconciler struct {
+	client.Client
+	WatchFilterValue string
+}
+
+// +kubebuilder:rbac:groups=bmc.tinkerbell.org,resources=machines,verbs=get;list;watch;create;update;patch;delete
+
+// Reconcile creates or updates the BMC Machine of the Hardware and references it from the Hardware.
+func (r *HardwareBMCReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, reterr error) {
+	log := ctrl.LoggerFrom(ctx).WithValues("hardware", req.NamespacedName)
+
+	hardware := &tinkv1.Hardware{}
+	if err := r.Get(ctx, req.NamespacedName, hardware); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+
+		return ctrl.Result{}, fmt.Errorf("getting Hardware: %w", err)
+	}
+
+	if !hardware.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	patchHelper, err := patch.NewHelper(hardware, r.Client)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("initializing patch helper: %w", err)
+	}
+
+	defer func() {
+		if err := patchHelper.Patch(ctx, hardware); err != nil {
+			reterr = kerrors.NewAggregate([]error{reterr, fmt.Errorf("patching Hardware: %w", err)})
+		}
+	}()
+
+	if _, ok := hardware.Annotations[HardwareBMCAddressAnnotation]; !ok {
+		return ctrl.Result{}, r.removeBMC(ctx, hardware)
+	}
+
+	connection, err := bmcConnection(hardware)
+	if err != nil {
+		// The annotations have to be fixed first, retrying won't help.
+		log.Error(err, "Not managing BMC Machine of Hardware")
+
+		return ctrl.Result{}, nil
+	}
+
+	bmcRef := hardware.Spec.BMCRef
+	if bmcRef != nil && bmcRef.Name != managedBMCName(hardware) {
+		log.Info("Hardware references a BMC Machine not managed from its annotations, leaving it", "BMCRef", bmcRef.Name)
+
+		return ctrl.Result{}, nil
+	}
+
+	bmc := &rufiov1.Machine{ObjectMeta: metav1.ObjectMeta{Name: managedBMCName(hardware), Namespace: hardware.Namespace}}
+
+	result, err := controllerutil.CreateOrUpdate(ctx, r.Client, bmc, func() error {
+		bmc.Spec.Connection = connection
+
+		return controllerutil.SetControllerReference(hardware, bmc, r.Scheme()) //nolint:wrapcheck
+	})
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("creating or updating BMC Machine: %w", err)
+	}
+
+	if result != controllerutil.OperationResultNone {
+		log.Info("Reconciled BMC Machine of Hardware", "BMC", bmc.Name, "result", result)
+	}
+
+	hardware.Spec.BMCRef = &corev1.TypedLocalObjectReference{
+		APIGroup: pointer.String(rufiov1.GroupVersion.Group),
+		Kind:     "Machine",
+		Name:     bmc.Name,
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// removeBMC deletes the BMC Machine managed for the Hardware once its BMC annotations are removed,
+// and drops the reference to it.
+func (r *HardwareBMCReconciler) removeBMC(ctx context.Context, hardware *tinkv1.Hardware) error {
+	bmc := &rufiov1.Machine{}
+
+	err := r.Get(ctx, client.ObjectKey{Name: managedBMCName(hardware), Namespace: hardware.Namespace}, bmc)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("getting BMC Machine: %w", err)
+	}
+
+	if !metav1.IsControlledBy(bmc, hardware) {
+		return nil
+	}
+
+	if err := r.Delete(ctx, bmc); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("deleting BMC Machine: %w", err)
+	}
+
+	if hardware.Spec.BMCRef != nil && hardware.Spec.BMCRef.Name == bmc.Name {
+		hardware.Spec.BMCRef = nil
+	}
+
+	return nil
+}
+
+// bmcConnection returns the BMC connection described by the annotations of the Hardware. There is
+// no annotation for provider options, as the rufio Connection only has the fields set here.
+func bmcConnection(hardware *tinkv1.Hardware) (rufiov1.Connection, error) {
+	annotations := hardware.Annotations
+
+	connection := rufiov1.Connection{
+		Host: annotations[HardwareBMCAddressAnnotation],
+		Port: defaultBMCPort,
+	}
+
+	if connection.Host == "" {
+		return connection, fmt.Errorf("%w: %s is empty", ErrInvalidBMCAnnotations, HardwareBMCAddressAnnotation)
+	}
+
+	if value, ok := annotations[HardwareBMCPortAnnotation]; ok {
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return connection, fmt.Errorf("%w: %s %q is not a port", ErrInvalidBMCAnnotations, HardwareBMCPortAnnotation, value)
+		}
+
+		connection.Port = port
+	}
+
+	secret := annotations[HardwareBMCSecretAnnotation]
+	if secret == "" {
+		return connection, fmt.Errorf("%w: %s is required", ErrInvalidBMCAnnotations, HardwareBMCSecretAnnotation)
+	}
+
+	if strings.Contains(secret, "/") {
+		return connection, fmt.Errorf("%w: %s %q must name a Secret in the namespace of the Hardware",
+			ErrInvalidBMCAnnotations, HardwareBMCSecretAnnotation, secret)
+	}
+
+	connection.AuthSecretRef = corev1.SecretReference{Name: secret, Namespace: hardware.Namespace}
+
+	if value, ok := annotations[HardwareBMCInsecureTLSAnnotation]; ok {
+		insecure, err := strconv.ParseBool(value)
+		if err != nil {
+			return connection, fmt.Errorf("%w: %s %q is not a boolean", ErrInvalidBMCAnnotations,
+				HardwareBMCInsecureTLSAnnotation, value)
+		}
+
+		connection.InsecureTLS = insecure
+	}
+
+	return connection, nil
+}
+
+// managedBMCName returns the name of the BMC Machine managed for the Hardware.
+func managedBMCName(hardware *tinkv1.Hardware) string {
+	return hardware.Name + "-bmc"
+}
+
+// SetupWithManager configures reconciler with a given manager.
+func (r *HardwareBMCReconciler) SetupWithManager(
+	ctx context.Context,
+	mgr ctrl.Manager,
+	options controller.Options,
+) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	err := ctrl.NewControllerManagedBy(mgr).
+		Named("hardwarebmc").
+		WithOptions(options).
+		For(&tinkv1.Hardware{}).
+		WithEventFilter(predicates.ResourceNotPausedAndHasFilterLabel(log, r.WatchFilterValue)).
+		Owns(&rufiov1.Machine{}).
+		Complete(r)
+	if err != nil {
+		return fmt.Errorf("failed to create controller: %w", err)
+	}
+
+	return nil
+}
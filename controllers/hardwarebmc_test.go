@@ -0,0 +1,163 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	rufiov1 "github.com/tinkerbell/rufio/api/v1alpha1"
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/controllers"
+)
+
+func reconcileHardwareBMC(t *testing.T, kubeClient client.Client) {
+	t.Helper()
+	g := NewWithT(t)
+
+	_, err := (&controllers.HardwareBMCReconciler{Client: kubeClient}).Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: types.NamespacedName{Name: hardwareName, Namespace: clusterNamespace},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+}
+
+//nolint:funlen
+func Test_Hardware_BMC_reconciliation(t *testing.T) {
+	t.Parallel()
+
+	bmcKey := types.NamespacedName{Name: hardwareName + "-bmc", Namespace: clusterNamespace}
+	hardwareKey := types.NamespacedName{Name: hardwareName, Namespace: clusterNamespace}
+
+	annotatedHardware := func(annotations map[string]string) *tinkv1.Hardware {
+		hardware := validHardware(hardwareName, uuid.New().String(), hardwareIP)
+		hardware.Annotations = annotations
+
+		return hardware
+	}
+
+	t.Run("manages_bmc_machine_from_annotations", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		kubeClient := kubernetesClientWithObjects(t, []runtime.Object{annotatedHardware(map[string]string{
+			controllers.HardwareBMCAddressAnnotation:     "10.0.0.10",
+			controllers.HardwareBMCSecretAnnotation:      "bmc-credentials",
+			controllers.HardwareBMCInsecureTLSAnnotation: "true",
+		})})
+
+		reconcileHardwareBMC(t, kubeClient)
+
+		bmc := &rufiov1.Machine{}
+		g.Expect(kubeClient.Get(context.Background(), bmcKey, bmc)).To(Succeed())
+		g.Expect(bmc.Spec.Connection).To(Equal(rufiov1.Connection{
+			Host:          "10.0.0.10",
+			Port:          623,
+			AuthSecretRef: corev1.SecretReference{Name: "bmc-credentials", Namespace: clusterNamespace},
+			InsecureTLS:   true,
+		}))
+
+		hardware := &tinkv1.Hardware{}
+		g.Expect(kubeClient.Get(context.Background(), hardwareKey, hardware)).To(Succeed())
+		g.Expect(metav1.IsControlledBy(bmc, hardware)).To(BeTrue(), "Expected the BMC Machine to be deleted with the Hardware")
+		g.Expect(hardware.Spec.BMCRef).NotTo(BeNil())
+		g.Expect(hardware.Spec.BMCRef.Kind).To(Equal("Machine"))
+		g.Expect(hardware.Spec.BMCRef.Name).To(Equal(bmcKey.Name))
+
+		hardware.Annotations[controllers.HardwareBMCPortAnnotation] = "6230"
+		hardware.Annotations[controllers.HardwareBMCSecretAnnotation] = "shared-credentials"
+		g.Expect(kubeClient.Update(context.Background(), hardware)).To(Succeed())
+
+		reconcileHardwareBMC(t, kubeClient)
+
+		g.Expect(kubeClient.Get(context.Background(), bmcKey, bmc)).To(Succeed())
+		g.Expect(bmc.Spec.Connection.Port).To(Equal(6230))
+		g.Expect(bmc.Spec.Connection.AuthSecretRef).To(Equal(corev1.SecretReference{
+			Name:      "shared-credentials",
+			Namespace: clusterNamespace,
+		}))
+
+		g.Expect(kubeClient.Get(context.Background(), hardwareKey, hardware)).To(Succeed())
+		delete(hardware.Annotations, controllers.HardwareBMCAddressAnnotation)
+		g.Expect(kubeClient.Update(context.Background(), hardware)).To(Succeed())
+
+		reconcileHardwareBMC(t, kubeClient)
+
+		g.Expect(apierrors.IsNotFound(kubeClient.Get(context.Background(), bmcKey, bmc))).To(BeTrue(),
+			"Expected the BMC Machine to be deleted with the annotations")
+		g.Expect(kubeClient.Get(context.Background(), hardwareKey, hardware)).To(Succeed())
+		g.Expect(hardware.Spec.BMCRef).To(BeNil())
+	})
+
+	t.Run("leaves_hand_made_bmc_machine_alone", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		hardware := annotatedHardware(map[string]string{
+			controllers.HardwareBMCAddressAnnotation: "10.0.0.10",
+			controllers.HardwareBMCSecretAnnotation:  "bmc-credentials",
+		})
+		hardware.Spec.BMCRef = &corev1.TypedLocalObjectReference{Kind: "Machine", Name: bmcName}
+
+		kubeClient := kubernetesClientWithObjects(t, []runtime.Object{hardware})
+
+		reconcileHardwareBMC(t, kubeClient)
+
+		g.Expect(apierrors.IsNotFound(kubeClient.Get(context.Background(), bmcKey, &rufiov1.Machine{}))).To(BeTrue())
+		g.Expect(kubeClient.Get(context.Background(), hardwareKey, hardware)).To(Succeed())
+		g.Expect(hardware.Spec.BMCRef.Name).To(Equal(bmcName))
+	})
+
+	t.Run("ignores_invalid_annotations", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		kubeClient := kubernetesClientWithObjects(t, []runtime.Object{annotatedHardware(map[string]string{
+			controllers.HardwareBMCAddressAnnotation: "10.0.0.10",
+			controllers.HardwareBMCPortAnnotation:    "ipmi",
+			controllers.HardwareBMCSecretAnnotation:  "bmc-credentials",
+		})})
+
+		reconcileHardwareBMC(t, kubeClient)
+
+		g.Expect(apierrors.IsNotFound(kubeClient.Get(context.Background(), bmcKey, &rufiov1.Machine{}))).To(BeTrue())
+	})
+
+	t.Run("rejects_secret_of_other_namespace", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		kubeClient := kubernetesClientWithObjects(t, []runtime.Object{annotatedHardware(map[string]string{
+			controllers.HardwareBMCAddressAnnotation: "10.0.0.10",
+			controllers.HardwareBMCSecretAnnotation:  "kube-system/bmc-credentials",
+		})})
+
+		reconcileHardwareBMC(t, kubeClient)
+
+		g.Expect(apierrors.IsNotFound(kubeClient.Get(context.Background(), bmcKey, &rufiov1.Machine{}))).To(BeTrue())
+	})
+}
@@ -21,7 +21,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
 	"regexp"
 	"sort"
 	"strings"
@@ -34,7 +33,9 @@ import (
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
 	"sigs.k8s.io/cluster-api/util/patch"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
@@ -42,6 +43,7 @@ import (
 	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
 
 	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/internal/imagecache"
 	"github.com/tinkerbell/cluster-api-provider-tinkerbell/internal/templates"
 )
 
@@ -59,9 +61,17 @@ type machineReconcileContext struct {
 	bootstrapCloudConfig string
 }
 
-// ErrHardwareMissingDiskConfiguration is returned when the referenced hardware is missing
-// disk configuration.
-var ErrHardwareMissingDiskConfiguration = fmt.Errorf("disk configuration is required")
+var (
+	// ErrHardwareMissingDiskConfiguration is returned when the referenced hardware is missing
+	// disk configuration.
+	ErrHardwareMissingDiskConfiguration = fmt.Errorf("disk configuration is required")
+
+	// ErrHardwareNoDiskForOS is returned when all disks of the referenced hardware are preserved.
+	ErrHardwareNoDiskForOS = fmt.Errorf("all hardware disks are preserved, no disk left for the OS")
+
+	// ErrTemplateWritesPreservedDisk is returned when the template override writes to a preserved disk.
+	ErrTemplateWritesPreservedDisk = fmt.Errorf("template writes to a preserved disk")
+)
 
 // MachineCreator is a subset of tinkerbellCluster used by machineReconcileContext.
 type MachineCreator interface {
@@ -94,7 +104,13 @@ func (mrc *machineReconcileContext) addFinalizer() error {
 	return nil
 }
 
+// isHardwareReady returns true if the Hardware has been provisioned. Hardware network booting into
+// the firmware workflow of a TinkerbellFirmwareRollout stays provisioned while its states are cleared.
 func isHardwareReady(hw *tinkv1.Hardware) bool {
+	if _, ok := hw.Annotations[HardwareFirmwareUpdateAnnotation]; ok {
+		return true
+	}
+
 	return hw.Spec.Metadata.State == inUse && hw.Spec.Metadata.Instance.State == provisioned
 }
 
@@ -134,19 +150,42 @@ func (mrc *machineReconcileContext) Reconcile() error {
 		}
 	}()
 
+	if mrc.provisioningFailed() {
+		mrc.log.Info("Provisioning failed; skipping reconciliation",
+			"reason", pointer.StringDeref(mrc.tinkerbellMachine.Status.ErrorMessage, ""))
+
+		return nil
+	}
+
 	hw, err := mrc.ensureHardware()
 	if err != nil {
+		if errors.Is(err, ErrNoHardwareAvailable) && mrc.phaseExpired(allocationPhase, mrc.tinkerbellMachine.CreationTimestamp.Time) {
+			return mrc.checkPhaseTimeout(allocationPhase, mrc.tinkerbellMachine.CreationTimestamp.Time)
+		}
+
 		return fmt.Errorf("failed to ensure hardware: %w", err)
 	}
 
-	return mrc.reconcile(hw)
+	err = mrc.reconcile(hw)
+
+	// Objects of other stacks are not watched, so they have to be polled for progress.
+	if !mrc.stackOwnsObjects() && !mrc.tinkerbellMachine.Status.Ready {
+		return earliestRequeue(err, unwatchedStackPollInterval)
+	}
+
+	return err
 }
 
 func (mrc *machineReconcileContext) reconcile(hw *tinkv1.Hardware) error {
 	if !isHardwareReady(hw) {
 		wf, err := mrc.ensureTemplateAndWorkflow(hw)
 
-		if ensureJobErr := mrc.ensureHardwareProvisionJob(hw); ensureJobErr != nil {
+		job, ensureJobErr := mrc.ensureHardwareProvisionJob(hw)
+		if ensureJobErr != nil {
+			if errors.Is(ensureJobErr, errBMCJobFailed) && mrc.holdRequested() {
+				return mrc.hold(mrc.provisionJobName(), ensureJobErr.Error())
+			}
+
 			return fmt.Errorf("failed to ensure hardware ready for provisioning: %w", ensureJobErr)
 		}
 
@@ -160,16 +199,45 @@ func (mrc *machineReconcileContext) reconcile(hw *tinkv1.Hardware) error {
 		s := wf.GetCurrentActionState()
 
 		if s == tinkv1.WorkflowStateFailed || s == tinkv1.WorkflowStateTimeout {
+			if err := mrc.removeSecretTemplate(); err != nil {
+				return err
+			}
+
+			if mrc.holdRequested() {
+				return mrc.hold(wf.GetCurrentAction(), fmt.Sprintf("workflow action is in state %s", s))
+			}
+
 			return errWorkflowFailed
 		}
 
 		if !lastActionStarted(wf) {
-			return nil
+			retried, retryAfter, err := mrc.retryPXEBoot(hw, job, wf)
+			if err != nil || retried {
+				return err
+			}
+
+			return earliestRequeue(mrc.checkProvisioningTimeouts(job, wf), retryAfter)
 		}
 
 		if err := mrc.patchHardwareStates(hw, inUse, provisioned); err != nil {
 			return fmt.Errorf("failed to patch hardware: %w", err)
 		}
+
+		if err := mrc.removeSecretTemplate(); err != nil {
+			return err
+		}
+
+		if err := mrc.removeSecretWorkflow(); err != nil {
+			return err
+		}
+	}
+
+	conditions.MarkTrue(mrc.tinkerbellMachine, infrastructurev1.ProvisionedCondition)
+
+	if pending := mrc.pendingReadinessGates(); len(pending) > 0 {
+		mrc.log.Info("Waiting for readiness gates", "conditions", pending)
+
+		return nil
 	}
 
 	mrc.log.Info("Marking TinkerbellMachine as Ready")
@@ -179,9 +247,27 @@ func (mrc *machineReconcileContext) reconcile(hw *tinkv1.Hardware) error {
 	return nil
 }
 
+// pendingReadinessGates returns the readiness gate conditions which are not True yet. A ready machine
+// has no pending gates, so a gate turning False later does not take readiness away.
+func (mrc *machineReconcileContext) pendingReadinessGates() []clusterv1.ConditionType {
+	if mrc.tinkerbellMachine.Status.Ready {
+		return nil
+	}
+
+	pending := []clusterv1.ConditionType{}
+
+	for _, gate := range mrc.tinkerbellMachine.Spec.ReadinessGates {
+		if !conditions.IsTrue(mrc.tinkerbellMachine, gate.ConditionType) {
+			pending = append(pending, gate.ConditionType)
+		}
+	}
+
+	return pending
+}
+
 // patchHardwareStates patches a hardware's metadata and instance states.
 func (mrc *machineReconcileContext) patchHardwareStates(hw *tinkv1.Hardware, mdState, iState string) error {
-	patchHelper, err := patch.NewHelper(hw, mrc.client)
+	patchHelper, err := patch.NewHelper(hw, mrc.tinkClient)
 	if err != nil {
 		return fmt.Errorf("initializing patch helper for selected hardware: %w", err)
 	}
@@ -199,10 +285,10 @@ func (mrc *machineReconcileContext) patchHardwareStates(hw *tinkv1.Hardware, mdS
 func (mrc *machineReconcileContext) templateExists() (bool, error) {
 	namespacedName := types.NamespacedName{
 		Name:      mrc.tinkerbellMachine.Name,
-		Namespace: mrc.tinkerbellMachine.Namespace,
+		Namespace: mrc.tinkNamespace,
 	}
 
-	err := mrc.client.Get(mrc.ctx, namespacedName, &tinkv1.Template{})
+	err := mrc.tinkClient.Get(mrc.ctx, namespacedName, &tinkv1.Template{})
 	if err == nil {
 		return true, nil
 	}
@@ -215,24 +301,34 @@ func (mrc *machineReconcileContext) templateExists() (bool, error) {
 }
 
 func (mrc *machineReconcileContext) imageURL() (string, error) {
-	imageLookupFormat := mrc.tinkerbellMachine.Spec.ImageLookupFormat
+	return machineImageURL(&mrc.tinkerbellMachine.Spec, &mrc.tinkerbellCluster.Spec, *mrc.machine.Spec.Version)
+}
+
+// machineImageURL returns the image URL of a machine of the given Kubernetes version. Image lookup
+// fields of the machine take precedence over the ones of the cluster.
+func machineImageURL(
+	machine *infrastructurev1.TinkerbellMachineSpec,
+	cluster *infrastructurev1.TinkerbellClusterSpec,
+	kubernetesVersion string,
+) (string, error) {
+	imageLookupFormat := machine.ImageLookupFormat
 	if imageLookupFormat == "" {
-		imageLookupFormat = mrc.tinkerbellCluster.Spec.ImageLookupFormat
+		imageLookupFormat = cluster.ImageLookupFormat
 	}
 
-	imageLookupBaseRegistry := mrc.tinkerbellMachine.Spec.ImageLookupBaseRegistry
+	imageLookupBaseRegistry := machine.ImageLookupBaseRegistry
 	if imageLookupBaseRegistry == "" {
-		imageLookupBaseRegistry = mrc.tinkerbellCluster.Spec.ImageLookupBaseRegistry
+		imageLookupBaseRegistry = cluster.ImageLookupBaseRegistry
 	}
 
-	imageLookupOSDistro := mrc.tinkerbellMachine.Spec.ImageLookupOSDistro
+	imageLookupOSDistro := machine.ImageLookupOSDistro
 	if imageLookupOSDistro == "" {
-		imageLookupOSDistro = mrc.tinkerbellCluster.Spec.ImageLookupOSDistro
+		imageLookupOSDistro = cluster.ImageLookupOSDistro
 	}
 
-	imageLookupOSVersion := mrc.tinkerbellMachine.Spec.ImageLookupOSVersion
+	imageLookupOSVersion := machine.ImageLookupOSVersion
 	if imageLookupOSVersion == "" {
-		imageLookupOSVersion = mrc.tinkerbellCluster.Spec.ImageLookupOSVersion
+		imageLookupOSVersion = cluster.ImageLookupOSVersion
 	}
 
 	return imageURL(
@@ -240,7 +336,7 @@ func (mrc *machineReconcileContext) imageURL() (string, error) {
 		imageLookupBaseRegistry,
 		imageLookupOSDistro,
 		imageLookupOSVersion,
-		*mrc.machine.Spec.Version,
+		kubernetesVersion,
 	)
 }
 
@@ -250,8 +346,35 @@ func (mrc *machineReconcileContext) createTemplate(hardware *tinkv1.Hardware) er
 	}
 
 	templateData := mrc.tinkerbellMachine.Spec.TemplateOverride
+	if templateData != "" {
+		for _, disk := range mrc.tinkerbellMachine.Spec.PreservedDisks {
+			if templates.WritesToDevice(templateData, disk.Device) {
+				return fmt.Errorf("%w: %s", ErrTemplateWritesPreservedDisk, disk.Device)
+			}
+		}
+
+		var err error
+
+		templateData, err = mrc.resolveTemplateSecrets(templateData)
+		if err != nil {
+			return err
+		}
+
+		// The Secrets are recorded before the Template is created, so a Template holding Secret
+		// values is never left without the status marking it for deletion.
+		if mrc.templateHoldsSecrets() {
+			if err := mrc.patch(); err != nil {
+				return err
+			}
+		}
+	}
+
 	if templateData == "" {
-		targetDisk := hardware.Spec.Disks[0].Device
+		targetDisk, err := mrc.osDisk(hardware)
+		if err != nil {
+			return err
+		}
+
 		targetDevice := firstPartitionFromDevice(targetDisk)
 
 		imageURL, err := mrc.imageURL()
@@ -259,19 +382,39 @@ func (mrc *machineReconcileContext) createTemplate(hardware *tinkv1.Hardware) er
 			return fmt.Errorf("failed to generate imageURL: %w", err)
 		}
 
-		metadataIP := os.Getenv("TINKERBELL_IP")
-		if metadataIP == "" {
-			metadataIP = "192.168.1.1"
+		if mrc.imageCacheURL != "" {
+			imageURL, err = imagecache.RewriteURL(mrc.imageCacheURL, imageURL)
+			if err != nil {
+				return fmt.Errorf("rewriting imageURL to image cache: %w", err)
+			}
+		}
+
+		metadataCABundle, err := mrc.metadataCABundle()
+		if err != nil {
+			return err
 		}
 
-		metadataURL := fmt.Sprintf("http://%s:50061", metadataIP)
+		metadataURL, err := mrc.metadataURL(mrc.tinkerbellCluster.Spec.MetadataTLS)
+		if err != nil {
+			return err
+		}
 
 		workflowTemplate := templates.WorkflowTemplate{
-			Name:          mrc.tinkerbellMachine.Name,
-			MetadataURL:   metadataURL,
-			ImageURL:      imageURL,
-			DestDisk:      targetDisk,
-			DestPartition: targetDevice,
+			Name:             mrc.tinkerbellMachine.Name,
+			MetadataURL:      metadataURL,
+			ImageURL:         imageURL,
+			DestDisk:         targetDisk,
+			DestPartition:    targetDevice,
+			MetadataCABundle: metadataCABundle,
+		}
+
+		for _, disk := range mrc.tinkerbellMachine.Spec.PreservedDisks {
+			workflowTemplate.PreservedDisks = append(workflowTemplate.PreservedDisks, templates.PreservedDisk{
+				FilesystemUUID: disk.FilesystemUUID,
+				MountPoint:     disk.MountPoint,
+				FilesystemType: disk.FilesystemType,
+				MountOptions:   disk.MountOptions,
+			})
 		}
 
 		templateData, err = workflowTemplate.Render()
@@ -283,7 +426,7 @@ func (mrc *machineReconcileContext) createTemplate(hardware *tinkv1.Hardware) er
 	templateObject := &tinkv1.Template{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      mrc.tinkerbellMachine.Name,
-			Namespace: mrc.tinkerbellMachine.Namespace,
+			Namespace: mrc.tinkNamespace,
 			OwnerReferences: []metav1.OwnerReference{
 				{
 					APIVersion: "infrastructure.cluster.x-k8s.io/v1beta1",
@@ -298,13 +441,41 @@ func (mrc *machineReconcileContext) createTemplate(hardware *tinkv1.Hardware) er
 		},
 	}
 
-	if err := mrc.client.Create(mrc.ctx, templateObject); err != nil {
+	if mrc.templateHoldsSecrets() {
+		// Only the machine uses the Template, so it is controlled by it and deleted with it.
+		controller := true
+		templateObject.Labels = map[string]string{TemplateSecretsLabel: "true"}
+		templateObject.OwnerReferences[0].Controller = &controller
+		templateObject.OwnerReferences[0].BlockOwnerDeletion = &controller
+	}
+
+	if !mrc.stackOwnsObjects() {
+		templateObject.OwnerReferences = nil
+	}
+
+	if err := mrc.tinkClient.Create(mrc.ctx, templateObject); err != nil {
 		return fmt.Errorf("creating Tinkerbell template: %w", err)
 	}
 
 	return nil
 }
 
+// osDisk returns the first Hardware disk which is not preserved by the TinkerbellMachine.
+func (mrc *machineReconcileContext) osDisk(hardware *tinkv1.Hardware) (string, error) {
+	preserved := map[string]bool{}
+	for _, disk := range mrc.tinkerbellMachine.Spec.PreservedDisks {
+		preserved[disk.Device] = true
+	}
+
+	for _, disk := range hardware.Spec.Disks {
+		if !preserved[disk.Device] {
+			return disk.Device, nil
+		}
+	}
+
+	return "", ErrHardwareNoDiskForOS
+}
+
 func firstPartitionFromDevice(device string) string {
 	nvmeDevice := regexp.MustCompile(`^/dev/nvme\d+n\d+$`)
 	emmcDevice := regexp.MustCompile(`^/dev/mmcblk\d+$`)
@@ -341,10 +512,16 @@ func (mrc *machineReconcileContext) takeHardwareOwnership(hardware *tinkv1.Hardw
 	hardware.ObjectMeta.Labels[HardwareOwnerNameLabel] = mrc.tinkerbellMachine.Name
 	hardware.ObjectMeta.Labels[HardwareOwnerNamespaceLabel] = mrc.tinkerbellMachine.Namespace
 
+	// Hardware taken from the remediation reserve leaves it, for the reserve to be refilled.
+	delete(hardware.ObjectMeta.Labels, HardwareReservedForClusterLabel)
+	delete(hardware.ObjectMeta.Labels, HardwareReservedForNamespaceLabel)
+
 	// Add finalizer to hardware as well to make sure we release it before Machine object is removed.
 	controllerutil.AddFinalizer(hardware, infrastructurev1.MachineFinalizer)
 
-	if err := mrc.client.Update(mrc.ctx, hardware); err != nil {
+	mrc.usageAccountant.startAllocation(hardware, mrc.machine.Spec.ClusterName)
+
+	if err := mrc.tinkClient.Update(mrc.ctx, hardware); err != nil {
 		return fmt.Errorf("updating Hardware object: %w", err)
 	}
 
@@ -357,34 +534,39 @@ func (mrc *machineReconcileContext) setStatus(hardware *tinkv1.Hardware) error {
 
 		namespacedName := types.NamespacedName{
 			Name:      mrc.tinkerbellMachine.Spec.HardwareName,
-			Namespace: mrc.tinkerbellMachine.Namespace,
+			Namespace: mrc.tinkNamespace,
 		}
 
-		if err := mrc.client.Get(mrc.ctx, namespacedName, hardware); err != nil {
+		if err := mrc.tinkClient.Get(mrc.ctx, namespacedName, hardware); err != nil {
 			return fmt.Errorf("getting Hardware: %w", err)
 		}
 	}
 
-	ip, err := hardwareIP(hardware)
+	ips, err := hardwareIPs(hardware)
 	if err != nil {
 		return fmt.Errorf("extracting Hardware IP address: %w", err)
 	}
 
-	mrc.tinkerbellMachine.Status.Addresses = []corev1.NodeAddress{
-		{
+	mrc.tinkerbellMachine.Status.Addresses = []corev1.NodeAddress{}
+
+	for _, ip := range ips {
+		mrc.tinkerbellMachine.Status.Addresses = append(mrc.tinkerbellMachine.Status.Addresses, corev1.NodeAddress{
 			Type:    corev1.NodeInternalIP,
 			Address: ip,
-		},
+		})
 	}
 
 	return mrc.patch()
 }
 
 func (mrc *machineReconcileContext) ensureHardwareUserData(hardware *tinkv1.Hardware, providerID string) error {
-	userData := strings.ReplaceAll(mrc.bootstrapCloudConfig, providerIDPlaceholder, providerID)
+	userData, err := mrc.userData(strings.ReplaceAll(mrc.bootstrapCloudConfig, providerIDPlaceholder, providerID))
+	if err != nil {
+		return err
+	}
 
 	if hardware.Spec.UserData == nil || *hardware.Spec.UserData != userData {
-		patchHelper, err := patch.NewHelper(hardware, mrc.client)
+		patchHelper, err := patch.NewHelper(hardware, mrc.tinkClient)
 		if err != nil {
 			return fmt.Errorf("initializing patch helper for selected hardware: %w", err)
 		}
@@ -405,6 +587,10 @@ func (mrc *machineReconcileContext) ensureHardware() (*tinkv1.Hardware, error) {
 		return nil, fmt.Errorf("getting hardware: %w", err)
 	}
 
+	if err := mrc.claimTopology(hardware); err != nil {
+		return nil, err
+	}
+
 	if err := mrc.takeHardwareOwnership(hardware); err != nil {
 		return nil, fmt.Errorf("taking Hardware ownership: %w", err)
 	}
@@ -431,8 +617,107 @@ func (mrc *machineReconcileContext) hardwareForMachine() (*tinkv1.Hardware, erro
 		return hardware, nil
 	}
 
-	// then fallback to searching for new hardware
-	hardwareSelector := mrc.tinkerbellMachine.Spec.HardwareAffinity.DeepCopy()
+	// legacy ownership markers are migrated before any Hardware is selected
+	if !mrc.ownershipMigrator.Migrated() {
+		mrc.log.Info("Waiting for Hardware ownership migration before selecting Hardware")
+
+		return nil, &errRequeueAfter{after: ownershipMigrationRetryInterval}
+	}
+
+	// then search for new hardware, replacements of remediated machines take Hardware from the
+	// reserve of their cluster first
+	replacement, err := mrc.replacesFromReserve()
+	if err != nil {
+		return nil, err
+	}
+
+	matchingHardware, err := mrc.hardwareSelector().SelectForMachine(mrc.ctx,
+		mrc.tinkerbellMachine.Spec.HardwareAffinity, replacement)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(matchingHardware) > 0 {
+		if _, reserved := matchingHardware[0].Labels[HardwareReservedForClusterLabel]; reserved {
+			mrc.log.Info("Taking Hardware from remediation reserve", "hardware", matchingHardware[0].Name)
+		} else if replacement {
+			mrc.log.Info("Remediation reserve is empty, falling back to the shared pool")
+		}
+
+		return &matchingHardware[0], nil
+	}
+	// nothing was found
+	return nil, ErrNoHardwareAvailable
+}
+
+// HardwareSelector selects the Hardware available to machines. Hardware owned by a machine or
+// according to a legacy ownership, quarantined, decommissioned or held in the remediation reserve of
+// a cluster is not available. Neither is Hardware in topology domains the cluster of the machines
+// may not use.
+type HardwareSelector struct {
+	// Client reads the TinkerbellClusters and TinkerbellMachines of the management cluster.
+	Client client.Client
+
+	// HardwareClient lists the Hardware, e.g. of the Tinkerbell stack of a failure domain. If nil,
+	// Hardware is listed with Client.
+	HardwareClient client.Client
+
+	// ListOptions restrict the listed Hardware, e.g. to a namespace.
+	ListOptions []client.ListOption
+
+	// TinkerbellCluster is the cluster of the machines, named ClusterName. If nil, topology
+	// exclusivity isn't considered.
+	TinkerbellCluster *infrastructurev1.TinkerbellCluster
+	ClusterName       string
+
+	// LegacyOwnerships are legacy Hardware ownership labels. Hardware carrying the name label of any
+	// of them is owned, even if the ownership migration didn't label it yet.
+	LegacyOwnerships []LegacyOwnership
+}
+
+// Select returns the Hardware available to a new machine with the given affinity, the most
+// preferred first. Machines pick the first Hardware of the list.
+func (s *HardwareSelector) Select(
+	ctx context.Context, affinity *infrastructurev1.HardwareAffinity,
+) ([]tinkv1.Hardware, error) {
+	notReserved := []metav1.LabelSelectorRequirement{{
+		Key:      HardwareReservedForClusterLabel,
+		Operator: metav1.LabelSelectorOpDoesNotExist,
+	}}
+
+	return s.selectHardware(ctx, affinity, notReserved)
+}
+
+// SelectForMachine returns the Hardware available to a new machine with the given affinity, in the
+// order machines pick it. Replacements of remediated machines get the Hardware held in the
+// remediation reserve of the cluster first, then the Hardware of the shared pool.
+func (s *HardwareSelector) SelectForMachine(
+	ctx context.Context, affinity *infrastructurev1.HardwareAffinity, replacement bool,
+) ([]tinkv1.Hardware, error) {
+	available, err := s.Select(ctx, affinity)
+	if err != nil {
+		return nil, err
+	}
+
+	if !replacement || s.TinkerbellCluster == nil || s.TinkerbellCluster.Spec.RemediationReserve == nil {
+		return available, nil
+	}
+
+	reserved, err := s.selectHardware(ctx, affinity, reservedFor(s.ClusterName, s.TinkerbellCluster.Namespace))
+	if err != nil {
+		return nil, fmt.Errorf("selecting reserved Hardware: %w", err)
+	}
+
+	return append(reserved, available...), nil
+}
+
+// selectHardware returns the unowned and not quarantined Hardware with the given affinity which
+// also meets the reservation requirements and the topology exclusivity of the cluster, the most
+// preferred first.
+//
+//nolint:lll
+func (s *HardwareSelector) selectHardware(ctx context.Context, affinity *infrastructurev1.HardwareAffinity, reservation []metav1.LabelSelectorRequirement) ([]tinkv1.Hardware, error) {
+	hardwareSelector := affinity.DeepCopy()
 	if hardwareSelector == nil {
 		hardwareSelector = &infrastructurev1.HardwareAffinity{}
 	}
@@ -443,29 +728,62 @@ func (mrc *machineReconcileContext) hardwareForMachine() (*tinkv1.Hardware, erro
 
 	var matchingHardware []tinkv1.Hardware
 
-	// OR all of the required terms by selecting each individually, we could end up with duplicates in matchingHardware
-	// but it doesn't matter
+	seen := map[client.ObjectKey]bool{}
+
+	// OR all of the required terms by selecting each individually, skipping Hardware matched by
+	// multiple terms
 	for i := range hardwareSelector.Required {
 		var matched tinkv1.HardwareList
 
-		// add a selector for unselected hardware
+		// add a selector for unselected, not foreign owned, not quarantined, not decommissioned and
+		// (not) reserved hardware
 		hardwareSelector.Required[i].LabelSelector.MatchExpressions = append(
 			hardwareSelector.Required[i].LabelSelector.MatchExpressions,
 			metav1.LabelSelectorRequirement{
 				Key:      HardwareOwnerNameLabel,
 				Operator: metav1.LabelSelectorOpDoesNotExist,
+			},
+			metav1.LabelSelectorRequirement{
+				Key:      HardwareForeignOwnerLabel,
+				Operator: metav1.LabelSelectorOpDoesNotExist,
+			},
+			metav1.LabelSelectorRequirement{
+				Key:      HardwareQuarantinedLabel,
+				Operator: metav1.LabelSelectorOpDoesNotExist,
+			},
+			metav1.LabelSelectorRequirement{
+				Key:      HardwareDecommissioningLabel,
+				Operator: metav1.LabelSelectorOpDoesNotExist,
 			})
+		hardwareSelector.Required[i].LabelSelector.MatchExpressions = append(
+			hardwareSelector.Required[i].LabelSelector.MatchExpressions, reservation...)
+
+		for _, ownership := range s.LegacyOwnerships {
+			hardwareSelector.Required[i].LabelSelector.MatchExpressions = append(
+				hardwareSelector.Required[i].LabelSelector.MatchExpressions,
+				metav1.LabelSelectorRequirement{
+					Key:      ownership.NameLabel,
+					Operator: metav1.LabelSelectorOpDoesNotExist,
+				})
+		}
 
 		selector, err := metav1.LabelSelectorAsSelector(&hardwareSelector.Required[i].LabelSelector)
 		if err != nil {
 			return nil, fmt.Errorf("converting label selector: %w", err)
 		}
 
-		if err := mrc.client.List(mrc.ctx, &matched, &client.ListOptions{LabelSelector: selector}); err != nil {
+		listOptions := append([]client.ListOption{&client.ListOptions{LabelSelector: selector}}, s.ListOptions...)
+		if err := s.hardwareClient().List(ctx, &matched, listOptions...); err != nil {
 			return nil, fmt.Errorf("listing hardware without owner: %w", err)
 		}
 
-		matchingHardware = append(matchingHardware, matched.Items...)
+		for i := range matched.Items {
+			if key := client.ObjectKeyFromObject(&matched.Items[i]); !seen[key] {
+				seen[key] = true
+
+				matchingHardware = append(matchingHardware, matched.Items[i])
+			}
+		}
 	}
 
 	// finally sort by our preferred affinity terms
@@ -476,21 +794,38 @@ func (mrc *machineReconcileContext) hardwareForMachine() (*tinkv1.Hardware, erro
 
 	sort.Slice(matchingHardware, cmp)
 
-	if len(matchingHardware) > 0 {
-		return &matchingHardware[0], nil
+	return s.allowedByTopology(ctx, matchingHardware)
+}
+
+func (s *HardwareSelector) hardwareClient() client.Client {
+	if s.HardwareClient == nil {
+		return s.Client
+	}
+
+	return s.HardwareClient
+}
+
+// hardwareSelector returns the selector of the Hardware available to the machine.
+func (mrc *machineReconcileContext) hardwareSelector() *HardwareSelector {
+	return &HardwareSelector{
+		Client:            mrc.client,
+		HardwareClient:    mrc.tinkClient,
+		ListOptions:       mrc.stackListOptions(),
+		TinkerbellCluster: mrc.tinkerbellCluster,
+		ClusterName:       mrc.machine.Spec.ClusterName,
+		LegacyOwnerships:  mrc.ownershipMigrator.legacyOwnerships(),
 	}
-	// nothing was found
-	return nil, ErrNoHardwareAvailable
 }
 
 // assignedHardware returns hardware that is already assigned. In the event of no hardware being assigned, it returns
 // nil, nil.
 func (mrc *machineReconcileContext) assignedHardware() (*tinkv1.Hardware, error) {
 	var selectedHardware tinkv1.HardwareList
-	if err := mrc.client.List(mrc.ctx, &selectedHardware, client.MatchingLabels{
+	listOptions := append(mrc.stackListOptions(), client.MatchingLabels{
 		HardwareOwnerNameLabel:      mrc.tinkerbellMachine.Name,
 		HardwareOwnerNamespaceLabel: mrc.tinkerbellMachine.Namespace,
-	}); err != nil {
+	})
+	if err := mrc.tinkClient.List(mrc.ctx, &selectedHardware, listOptions...); err != nil {
 		return nil, fmt.Errorf("listing hardware with owner: %w", err)
 	}
 
@@ -538,20 +873,18 @@ func byHardwareAffinity(hardware []tinkv1.Hardware, preferred []infrastructurev1
 	}, nil
 }
 
-// ensureHardwareProvisionJob ensures the hardware is ready to be provisioned.
-// Uses the BMCRef from the hardware to create a BMCJob.
-// The BMCJob is responsible for getting the machine to desired state for provisioning.
-// If a BMCJob is already found and has failed, we error.
-func (mrc *machineReconcileContext) ensureHardwareProvisionJob(hardware *tinkv1.Hardware) error {
+// ensureHardwareProvisionJob ensures the BMC Job powering the Hardware on into PXE exists and
+// returns it. No Job is returned if the Hardware has no BMC. If the Job has failed, we error.
+func (mrc *machineReconcileContext) ensureHardwareProvisionJob(hardware *tinkv1.Hardware) (*rufiov1.Job, error) {
 	if hardware.Spec.BMCRef == nil {
 		mrc.log.Info("Hardware BMC reference not present; skipping BMCJob creation",
 			"BMCRef", hardware.Spec.BMCRef, "Hardware", hardware.Name)
 
-		return nil
+		return nil, nil //nolint:nilnil
 	}
 
 	bmcJob := &rufiov1.Job{}
-	jobName := fmt.Sprintf("%s-provision", mrc.tinkerbellMachine.Name)
+	jobName := mrc.provisionJobName()
 
 	err := mrc.getBMCJob(jobName, bmcJob)
 	if err != nil {
@@ -560,24 +893,24 @@ func (mrc *machineReconcileContext) ensureHardwareProvisionJob(hardware *tinkv1.
 			return mrc.createHardwareProvisionJob(hardware, jobName)
 		}
 
-		return err
+		return nil, err
 	}
 
 	if bmcJob.HasCondition(rufiov1.JobFailed, rufiov1.ConditionTrue) {
-		return fmt.Errorf("bmc job %s/%s failed", bmcJob.Namespace, bmcJob.Name) //nolint:goerr113
+		return nil, fmt.Errorf("%w: %s/%s", errBMCJobFailed, bmcJob.Namespace, bmcJob.Name)
 	}
 
-	return nil
+	return bmcJob, nil
 }
 
 // getBMCJob fetches the BMCJob with name JName.
 func (mrc *machineReconcileContext) getBMCJob(jName string, bmj *rufiov1.Job) error {
 	namespacedName := types.NamespacedName{
 		Name:      jName,
-		Namespace: mrc.tinkerbellMachine.Namespace,
+		Namespace: mrc.tinkNamespace,
 	}
 
-	if err := mrc.client.Get(mrc.ctx, namespacedName, bmj); err != nil {
+	if err := mrc.tinkClient.Get(mrc.ctx, namespacedName, bmj); err != nil {
 		return fmt.Errorf("GET BMCJob: %w", err)
 	}
 
@@ -585,24 +918,25 @@ func (mrc *machineReconcileContext) getBMCJob(jName string, bmj *rufiov1.Job) er
 }
 
 // createHardwareProvisionJob creates a BMCJob object with the required tasks for hardware provisioning.
-func (mrc *machineReconcileContext) createHardwareProvisionJob(hardware *tinkv1.Hardware, name string) error {
+func (mrc *machineReconcileContext) createHardwareProvisionJob(hardware *tinkv1.Hardware, name string) (*rufiov1.Job, error) {
 	job := &rufiov1.Job{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
-			Namespace: mrc.tinkerbellMachine.Namespace,
+			Namespace: mrc.tinkNamespace,
 			OwnerReferences: []metav1.OwnerReference{
 				{
 					APIVersion: "infrastructure.cluster.x-k8s.io/v1beta1",
 					Kind:       "TinkerbellMachine",
 					Name:       mrc.tinkerbellMachine.Name,
 					UID:        mrc.tinkerbellMachine.ObjectMeta.UID,
+					Controller: pointer.Bool(true),
 				},
 			},
 		},
 		Spec: rufiov1.JobSpec{
 			MachineRef: rufiov1.MachineRef{
 				Name:      hardware.Spec.BMCRef.Name,
-				Namespace: mrc.tinkerbellMachine.Namespace,
+				Namespace: mrc.tinkNamespace,
 			},
 			Tasks: []rufiov1.Action{
 				{
@@ -623,26 +957,30 @@ func (mrc *machineReconcileContext) createHardwareProvisionJob(hardware *tinkv1.
 		},
 	}
 
-	if err := mrc.client.Create(mrc.ctx, job); err != nil {
-		return fmt.Errorf("creating job: %w", err)
+	if !mrc.stackOwnsObjects() {
+		job.OwnerReferences = nil
+	}
+
+	if err := mrc.tinkClient.Create(mrc.ctx, job); err != nil {
+		return nil, fmt.Errorf("creating job: %w", err)
 	}
 
 	mrc.log.Info("Created BMCJob to get hardware ready for provisioning",
 		"Name", job.Name,
 		"Namespace", job.Namespace)
 
-	return nil
+	return job, nil
 }
 
 func (mrc *machineReconcileContext) getWorkflow() (*tinkv1.Workflow, error) {
 	namespacedName := types.NamespacedName{
 		Name:      mrc.tinkerbellMachine.Name,
-		Namespace: mrc.tinkerbellMachine.Namespace,
+		Namespace: mrc.tinkNamespace,
 	}
 
 	t := &tinkv1.Workflow{}
 
-	err := mrc.client.Get(mrc.ctx, namespacedName, t)
+	err := mrc.tinkClient.Get(mrc.ctx, namespacedName, t)
 	if err != nil {
 		msg := "failed to get workflow: %w"
 		if !apierrors.IsNotFound(err) {
@@ -660,7 +998,7 @@ func (mrc *machineReconcileContext) createWorkflow(hardware *tinkv1.Hardware) er
 	workflow := &tinkv1.Workflow{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      mrc.tinkerbellMachine.Name,
-			Namespace: mrc.tinkerbellMachine.Namespace,
+			Namespace: mrc.tinkNamespace,
 			OwnerReferences: []metav1.OwnerReference{
 				{
 					APIVersion: "infrastructure.cluster.x-k8s.io/v1beta1",
@@ -678,7 +1016,16 @@ func (mrc *machineReconcileContext) createWorkflow(hardware *tinkv1.Hardware) er
 		},
 	}
 
-	if err := mrc.client.Create(mrc.ctx, workflow); err != nil {
+	if mrc.templateHoldsSecrets() {
+		// The workflow status holds the actions rendered from the Template, Secret values included.
+		workflow.Labels = map[string]string{TemplateSecretsLabel: "true"}
+	}
+
+	if !mrc.stackOwnsObjects() {
+		workflow.OwnerReferences = nil
+	}
+
+	if err := mrc.tinkClient.Create(mrc.ctx, workflow); err != nil {
 		return fmt.Errorf("creating workflow: %w", err)
 	}
 
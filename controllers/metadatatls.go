@@ -0,0 +1,97 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/pem"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// ErrMetadataCABundleKeyMissing is returned when the Secret or ConfigMap referenced as metadata
+	// CA bundle lacks the referenced key.
+	ErrMetadataCABundleKeyMissing = fmt.Errorf("metadata CA bundle key not found")
+
+	// ErrInvalidMetadataCABundle is returned when the metadata CA bundle holds no PEM encoded certificate.
+	ErrInvalidMetadataCABundle = fmt.Errorf("metadata CA bundle holds no PEM encoded certificate")
+)
+
+// metadataCABundle returns the CA bundle the metadata service is verified with by the machines of
+// the cluster, or an empty string if the cluster doesn't use metadata TLS.
+func (mrc *machineReconcileContext) metadataCABundle() (string, error) {
+	metadataTLS := mrc.tinkerbellCluster.Spec.MetadataTLS
+	if metadataTLS == nil {
+		return "", nil
+	}
+
+	var (
+		objectKey   = client.ObjectKey{Namespace: mrc.tinkerbellCluster.Namespace}
+		key, bundle string
+		found       bool
+	)
+
+	switch source := metadataTLS.CABundle; {
+	case source.SecretKeyRef != nil:
+		objectKey.Name, key = source.SecretKeyRef.Name, source.SecretKeyRef.Key
+
+		secret := &corev1.Secret{}
+		if err := mrc.client.Get(mrc.ctx, objectKey, secret); err != nil {
+			return "", fmt.Errorf("getting metadata CA bundle Secret: %w", err)
+		}
+
+		value, ok := secret.Data[key]
+		bundle, found = string(value), ok
+	case source.ConfigMapKeyRef != nil:
+		objectKey.Name, key = source.ConfigMapKeyRef.Name, source.ConfigMapKeyRef.Key
+
+		configMap := &corev1.ConfigMap{}
+		if err := mrc.client.Get(mrc.ctx, objectKey, configMap); err != nil {
+			return "", fmt.Errorf("getting metadata CA bundle ConfigMap: %w", err)
+		}
+
+		bundle, found = configMap.Data[key]
+	}
+
+	if !found {
+		return "", fmt.Errorf("%w: %s in %s", ErrMetadataCABundleKeyMissing, key, objectKey.Name)
+	}
+
+	if !holdsCertificate(bundle) {
+		return "", fmt.Errorf("%w: %s in %s", ErrInvalidMetadataCABundle, key, objectKey.Name)
+	}
+
+	return bundle, nil
+}
+
+// holdsCertificate reports whether the PEM data holds at least one certificate.
+func holdsCertificate(data string) bool {
+	for rest := []byte(data); ; {
+		var block *pem.Block
+
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return false
+		}
+
+		if block.Type == "CERTIFICATE" {
+			return true
+		}
+	}
+}
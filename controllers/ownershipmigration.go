@@ -0,0 +1,328 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/cluster-api/util/patch"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+)
+
+const (
+	// HardwareForeignOwnerLabel is set by CAPT on Hardware owned according to legacy or foreign
+	// ownership markers which can't be translated to a TinkerbellMachine. Such Hardware is never
+	// selected for machines.
+	HardwareForeignOwnerLabel = "v1alpha1.tinkerbell.org/foreignOwner"
+
+	// HardwareForeignOwnerAnnotation records the ownership markers Hardware labeled with
+	// HardwareForeignOwnerLabel carries.
+	HardwareForeignOwnerAnnotation = "v1alpha1.tinkerbell.org/foreignOwner"
+)
+
+// ownershipMigrationRetryInterval is the time between two attempts of the first migration.
+const ownershipMigrationRetryInterval = 10 * time.Second
+
+// ErrInvalidLegacyOwnership is returned when a legacy ownership can't be parsed.
+var ErrInvalidLegacyOwnership = fmt.Errorf("invalid legacy ownership")
+
+// LegacyOwnership describes Hardware ownership labels set by older CAPT releases or other tooling.
+type LegacyOwnership struct {
+	// NameLabel is the label holding the name of the owner. Hardware carrying it is owned.
+	NameLabel string
+
+	// NamespaceLabel is the label holding the namespace of the owner. If empty, the owner is
+	// looked up in the namespace of the Hardware.
+	NamespaceLabel string
+}
+
+// ParseLegacyOwnership parses a legacy ownership given as <name-label>[=<namespace-label>].
+func ParseLegacyOwnership(value string) (LegacyOwnership, error) {
+	nameLabel, namespaceLabel, _ := strings.Cut(value, "=")
+
+	ownership := LegacyOwnership{NameLabel: nameLabel, NamespaceLabel: namespaceLabel}
+
+	keys := []string{nameLabel}
+	if namespaceLabel != "" {
+		keys = append(keys, namespaceLabel)
+	}
+
+	for _, key := range keys {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return ownership, fmt.Errorf("%w %q: %s", ErrInvalidLegacyOwnership, value, strings.Join(errs, ", "))
+		}
+	}
+
+	return ownership, nil
+}
+
+// HardwareOwnershipMigrator translates legacy or foreign ownership markers of Hardware into the
+// ownership labels of CAPT. Hardware owned by an existing TinkerbellMachine according to the markers
+// is adopted by it. Other marked Hardware is labeled with HardwareForeignOwnerLabel, so it's never
+// selected for machines, until its markers are removed.
+//
+// The migrator runs on the leader only. Reconcilers given the migrator don't select Hardware before
+// its first migration succeeded, and never select Hardware carrying a legacy owner name label.
+type HardwareOwnershipMigrator struct {
+	Client client.Client
+
+	// Ownerships are the legacy ownership labels translated.
+	Ownerships []LegacyOwnership
+
+	// OwnedStates are the Hardware metadata states marking Hardware as owned, e.g. in_use.
+	OwnedStates []string
+
+	// Interval is the time between two migrations after the first one. If 0, Hardware is only
+	// migrated once.
+	Interval time.Duration
+
+	migrated atomic.Bool
+}
+
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=tinkerbellmachines,verbs=get;list;watch
+
+// SetupWithManager registers the migrator to be started with the manager.
+func (m *HardwareOwnershipMigrator) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.Add(m); err != nil {
+		return fmt.Errorf("adding hardware ownership migrator to manager: %w", err)
+	}
+
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, so only the leader migrates Hardware.
+func (m *HardwareOwnershipMigrator) NeedLeaderElection() bool {
+	return true
+}
+
+// Start migrates Hardware until the first migration succeeds, then again every interval until the
+// context is cancelled.
+func (m *HardwareOwnershipMigrator) Start(ctx context.Context) error {
+	migrate := func(ctx context.Context) (bool, error) {
+		if err := m.Migrate(ctx); err != nil {
+			ctrl.LoggerFrom(ctx).Error(err, "Migrating Hardware ownership, retrying")
+
+			return false, nil
+		}
+
+		return true, nil
+	}
+
+	if err := wait.PollImmediateUntilWithContext(ctx, ownershipMigrationRetryInterval, migrate); err != nil {
+		// The context was cancelled before Hardware could be migrated.
+		return nil //nolint:nilerr
+	}
+
+	m.migrated.Store(true)
+
+	if m.Interval == 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-time.After(m.Interval):
+	}
+
+	wait.UntilWithContext(ctx, m.migrateAndLog, m.Interval)
+
+	return nil
+}
+
+// Migrated returns true once the first migration succeeded. A nil migrator has nothing to migrate.
+func (m *HardwareOwnershipMigrator) Migrated() bool {
+	return m == nil || m.migrated.Load()
+}
+
+// legacyOwnerships returns the legacy ownerships of the migrator, none for a nil migrator.
+func (m *HardwareOwnershipMigrator) legacyOwnerships() []LegacyOwnership {
+	if m == nil {
+		return nil
+	}
+
+	return m.Ownerships
+}
+
+func (m *HardwareOwnershipMigrator) migrateAndLog(ctx context.Context) {
+	if err := m.Migrate(ctx); err != nil {
+		ctrl.LoggerFrom(ctx).Error(err, "Migrating Hardware ownership")
+	}
+}
+
+// Migrate translates the ownership markers of all Hardware.
+func (m *HardwareOwnershipMigrator) Migrate(ctx context.Context) error {
+	hardwareList := &tinkv1.HardwareList{}
+	if err := m.Client.List(ctx, hardwareList); err != nil {
+		return fmt.Errorf("listing Hardware: %w", err)
+	}
+
+	for i := range hardwareList.Items {
+		if err := m.migrate(ctx, &hardwareList.Items[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *HardwareOwnershipMigrator) migrate(ctx context.Context, hardware *tinkv1.Hardware) error {
+	log := ctrl.LoggerFrom(ctx).WithValues("Hardware", client.ObjectKeyFromObject(hardware))
+
+	patchHelper, err := patch.NewHelper(hardware, m.Client)
+	if err != nil {
+		return fmt.Errorf("initializing patch helper for Hardware: %w", err)
+	}
+
+	markers, owner, err := m.legacyOwner(ctx, hardware)
+	if err != nil {
+		return err
+	}
+
+	_, owned := hardware.Labels[HardwareOwnerNameLabel]
+
+	switch {
+	case owner != nil && !owned:
+		log.Info("Adopting Hardware with legacy ownership", "owner", client.ObjectKeyFromObject(owner))
+
+		hardware.Labels[HardwareOwnerNameLabel] = owner.Name
+		hardware.Labels[HardwareOwnerNamespaceLabel] = owner.Namespace
+
+		controllerutil.AddFinalizer(hardware, infrastructurev1.MachineFinalizer)
+
+		m.removeLegacyLabels(hardware)
+		clearForeignOwner(hardware)
+	case len(markers) > 0 && !owned:
+		if hardware.Labels[HardwareForeignOwnerLabel] != "true" {
+			log.Info("Hardware has foreign ownership markers, excluding it from selection", "markers", markers)
+		}
+
+		if hardware.Annotations == nil {
+			hardware.Annotations = map[string]string{}
+		}
+
+		hardware.Labels[HardwareForeignOwnerLabel] = "true"
+		hardware.Annotations[HardwareForeignOwnerAnnotation] = strings.Join(markers, ", ")
+	case owner != nil:
+		// CAPT ownership wins, legacy labels are only dropped when they name the same owner.
+		sameOwner := hardware.Labels[HardwareOwnerNameLabel] == owner.Name &&
+			hardware.Labels[HardwareOwnerNamespaceLabel] == owner.Namespace
+		if sameOwner {
+			m.removeLegacyLabels(hardware)
+		} else {
+			log.Info("Hardware owned by CAPT has conflicting legacy ownership labels", "markers", markers)
+		}
+
+		clearForeignOwner(hardware)
+	default:
+		clearForeignOwner(hardware)
+	}
+
+	if err := patchHelper.Patch(ctx, hardware); err != nil {
+		return fmt.Errorf("patching Hardware: %w", err)
+	}
+
+	return nil
+}
+
+// legacyOwner returns the ownership markers of the Hardware and the TinkerbellMachine owning it
+// according to them, if it exists.
+func (m *HardwareOwnershipMigrator) legacyOwner(ctx context.Context, hardware *tinkv1.Hardware) ([]string, *infrastructurev1.TinkerbellMachine, error) { //nolint:lll
+	var (
+		markers []string
+		owner   *infrastructurev1.TinkerbellMachine
+	)
+
+	if hardware.Labels == nil {
+		hardware.Labels = map[string]string{}
+	}
+
+	for _, ownership := range m.Ownerships {
+		name, ok := hardware.Labels[ownership.NameLabel]
+		if !ok {
+			continue
+		}
+
+		markers = append(markers, fmt.Sprintf("label %s=%s", ownership.NameLabel, name))
+
+		namespace := hardware.Namespace
+		if ownership.NamespaceLabel != "" {
+			namespace = hardware.Labels[ownership.NamespaceLabel]
+		}
+
+		if owner != nil || name == "" || namespace == "" {
+			continue
+		}
+
+		tinkerbellMachine := &infrastructurev1.TinkerbellMachine{}
+
+		err := m.Client.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, tinkerbellMachine)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, nil, fmt.Errorf("getting legacy owner of Hardware: %w", err)
+		}
+
+		if err == nil {
+			owner = tinkerbellMachine
+		}
+	}
+
+	if hardware.Spec.Metadata != nil {
+		for _, state := range m.OwnedStates {
+			if hardware.Spec.Metadata.State == state {
+				markers = append(markers, "state "+state)
+			}
+		}
+	}
+
+	sort.Strings(markers)
+
+	return markers, owner, nil
+}
+
+// removeLegacyLabels removes the legacy ownership labels translated into CAPT ownership labels.
+func (m *HardwareOwnershipMigrator) removeLegacyLabels(hardware *tinkv1.Hardware) {
+	for _, ownership := range m.Ownerships {
+		if ownership.NameLabel == HardwareOwnerNameLabel {
+			continue
+		}
+
+		delete(hardware.Labels, ownership.NameLabel)
+
+		if ownership.NamespaceLabel != HardwareOwnerNamespaceLabel {
+			delete(hardware.Labels, ownership.NamespaceLabel)
+		}
+	}
+}
+
+func clearForeignOwner(hardware *tinkv1.Hardware) {
+	delete(hardware.Labels, HardwareForeignOwnerLabel)
+	delete(hardware.Annotations, HardwareForeignOwnerAnnotation)
+}
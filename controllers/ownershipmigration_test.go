@@ -0,0 +1,241 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/controllers"
+)
+
+const (
+	legacyOwnerLabel     = "legacy.example.com/owner"
+	legacyNamespaceLabel = "legacy.example.com/namespace"
+)
+
+func Test_Parse_legacy_ownership(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	ownership, err := controllers.ParseLegacyOwnership(legacyOwnerLabel + "=" + legacyNamespaceLabel)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(ownership).To(Equal(controllers.LegacyOwnership{NameLabel: legacyOwnerLabel, NamespaceLabel: legacyNamespaceLabel}))
+
+	ownership, err = controllers.ParseLegacyOwnership(legacyOwnerLabel)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(ownership).To(Equal(controllers.LegacyOwnership{NameLabel: legacyOwnerLabel}))
+
+	for _, value := range []string{"", "=" + legacyNamespaceLabel, "not a label", legacyOwnerLabel + "=not a label"} {
+		_, err := controllers.ParseLegacyOwnership(value)
+		g.Expect(err).To(MatchError(controllers.ErrInvalidLegacyOwnership), value)
+	}
+}
+
+//nolint:funlen
+func Test_Hardware_ownership_migration(t *testing.T) {
+	t.Parallel()
+
+	migrator := func(m *controllers.HardwareOwnershipMigrator) *controllers.HardwareOwnershipMigrator {
+		m.Ownerships = []controllers.LegacyOwnership{{NameLabel: legacyOwnerLabel, NamespaceLabel: legacyNamespaceLabel}}
+		m.OwnedStates = []string{"allocated"}
+
+		return m
+	}
+
+	hardwareKey := types.NamespacedName{Name: hardwareName, Namespace: clusterNamespace}
+
+	t.Run("adopts_hardware_of_existing_machine", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		hardwareUUID := uuid.New().String()
+		hardware := validHardware(hardwareName, hardwareUUID, hardwareIP, testOptions{Labels: map[string]string{
+			legacyOwnerLabel:     tinkerbellMachineName,
+			legacyNamespaceLabel: clusterNamespace,
+		}})
+
+		kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+			hardware,
+			validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID),
+		})
+
+		g.Expect(migrator(&controllers.HardwareOwnershipMigrator{Client: kubeClient}).Migrate(context.Background())).To(Succeed())
+
+		updatedHardware := &tinkv1.Hardware{}
+		g.Expect(kubeClient.Get(context.Background(), hardwareKey, updatedHardware)).To(Succeed())
+		g.Expect(updatedHardware.Labels).To(HaveKeyWithValue(controllers.HardwareOwnerNameLabel, tinkerbellMachineName))
+		g.Expect(updatedHardware.Labels).To(HaveKeyWithValue(controllers.HardwareOwnerNamespaceLabel, clusterNamespace))
+		g.Expect(updatedHardware.Labels).NotTo(HaveKey(legacyOwnerLabel))
+		g.Expect(updatedHardware.Labels).NotTo(HaveKey(legacyNamespaceLabel))
+		g.Expect(updatedHardware.Labels).NotTo(HaveKey(controllers.HardwareForeignOwnerLabel))
+		g.Expect(updatedHardware.Finalizers).To(ContainElement(infrastructurev1.MachineFinalizer))
+	})
+
+	t.Run("excludes_foreign_owned_hardware_from_selection_until_released", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		hardware := validHardware(hardwareName, uuid.New().String(), hardwareIP, testOptions{Labels: map[string]string{
+			legacyOwnerLabel:     "some-other-tool",
+			legacyNamespaceLabel: clusterNamespace,
+		}})
+
+		kubeClient := kubernetesClientWithObjects(t, []runtime.Object{hardware})
+		m := migrator(&controllers.HardwareOwnershipMigrator{Client: kubeClient})
+
+		g.Expect(m.Migrate(context.Background())).To(Succeed())
+
+		updatedHardware := &tinkv1.Hardware{}
+		g.Expect(kubeClient.Get(context.Background(), hardwareKey, updatedHardware)).To(Succeed())
+		g.Expect(updatedHardware.Labels).To(HaveKeyWithValue(controllers.HardwareForeignOwnerLabel, "true"))
+		g.Expect(updatedHardware.Labels).To(HaveKey(legacyOwnerLabel), "Expected foreign labels to be kept")
+		g.Expect(updatedHardware.Labels).NotTo(HaveKey(controllers.HardwareOwnerNameLabel))
+		g.Expect(updatedHardware.Annotations).To(HaveKeyWithValue(controllers.HardwareForeignOwnerAnnotation,
+			"label "+legacyOwnerLabel+"=some-other-tool"))
+
+		available, err := (&controllers.HardwareSelector{Client: kubeClient}).Select(context.Background(), nil)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(available).To(BeEmpty())
+
+		delete(updatedHardware.Labels, legacyOwnerLabel)
+		g.Expect(kubeClient.Update(context.Background(), updatedHardware)).To(Succeed())
+
+		g.Expect(m.Migrate(context.Background())).To(Succeed())
+
+		g.Expect(kubeClient.Get(context.Background(), hardwareKey, updatedHardware)).To(Succeed())
+		g.Expect(updatedHardware.Labels).NotTo(HaveKey(controllers.HardwareForeignOwnerLabel))
+		g.Expect(updatedHardware.Annotations).NotTo(HaveKey(controllers.HardwareForeignOwnerAnnotation))
+
+		available, err = (&controllers.HardwareSelector{Client: kubeClient}).Select(context.Background(), nil)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(available).To(HaveLen(1))
+	})
+
+	t.Run("excludes_hardware_with_legacy_owner_label_from_selection_before_migration", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		hardware := validHardware(hardwareName, uuid.New().String(), hardwareIP, testOptions{Labels: map[string]string{
+			legacyOwnerLabel: "some-other-tool",
+		}})
+
+		kubeClient := kubernetesClientWithObjects(t, []runtime.Object{hardware})
+		selector := &controllers.HardwareSelector{
+			Client:           kubeClient,
+			LegacyOwnerships: []controllers.LegacyOwnership{{NameLabel: legacyOwnerLabel}},
+		}
+
+		available, err := selector.Select(context.Background(), nil)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(available).To(BeEmpty())
+	})
+
+	t.Run("excludes_hardware_in_owned_state_from_selection", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		hardware := validHardware(hardwareName, uuid.New().String(), hardwareIP)
+		hardware.Spec.Metadata.State = "allocated"
+
+		kubeClient := kubernetesClientWithObjects(t, []runtime.Object{hardware})
+
+		g.Expect(migrator(&controllers.HardwareOwnershipMigrator{Client: kubeClient}).Migrate(context.Background())).To(Succeed())
+
+		updatedHardware := &tinkv1.Hardware{}
+		g.Expect(kubeClient.Get(context.Background(), hardwareKey, updatedHardware)).To(Succeed())
+		g.Expect(updatedHardware.Labels).To(HaveKeyWithValue(controllers.HardwareForeignOwnerLabel, "true"))
+		g.Expect(updatedHardware.Annotations).To(HaveKeyWithValue(controllers.HardwareForeignOwnerAnnotation, "state allocated"))
+	})
+
+	t.Run("keeps_capt_ownership_of_owned_hardware", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		hardware := validHardware(hardwareName, uuid.New().String(), hardwareIP, testOptions{Labels: map[string]string{
+			controllers.HardwareOwnerNameLabel:      tinkerbellMachineName,
+			controllers.HardwareOwnerNamespaceLabel: clusterNamespace,
+		}})
+		hardware.Spec.Metadata.State = "allocated"
+
+		kubeClient := kubernetesClientWithObjects(t, []runtime.Object{hardware})
+
+		g.Expect(migrator(&controllers.HardwareOwnershipMigrator{Client: kubeClient}).Migrate(context.Background())).To(Succeed())
+
+		updatedHardware := &tinkv1.Hardware{}
+		g.Expect(kubeClient.Get(context.Background(), hardwareKey, updatedHardware)).To(Succeed())
+		g.Expect(updatedHardware.Labels).To(HaveKeyWithValue(controllers.HardwareOwnerNameLabel, tinkerbellMachineName))
+		g.Expect(updatedHardware.Labels).NotTo(HaveKey(controllers.HardwareForeignOwnerLabel))
+	})
+}
+
+func Test_Machine_reconciliation_waits_for_hardware_ownership_migration(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	machine := validMachine(machineName, clusterNamespace, clusterName)
+	machine.Spec.ClusterName = clusterName
+
+	kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+		validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, uuid.New().String()),
+		validCluster(clusterName, clusterNamespace),
+		validTinkerbellCluster(clusterName, clusterNamespace),
+		validHardware(hardwareName, uuid.New().String(), hardwareIP),
+		machine,
+		validSecret(machineName, clusterNamespace),
+	})
+
+	migrator := &controllers.HardwareOwnershipMigrator{
+		Client:     kubeClient,
+		Ownerships: []controllers.LegacyOwnership{{NameLabel: legacyOwnerLabel}},
+	}
+
+	reconciler := &controllers.TinkerbellMachineReconciler{Client: kubeClient, HardwareOwnershipMigrator: migrator}
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: tinkerbellMachineName, Namespace: clusterNamespace}}
+
+	result, err := reconciler.Reconcile(context.Background(), request)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(BeNumerically(">", 0), "Expected selection to wait for the migration")
+
+	tinkerbellMachine := &infrastructurev1.TinkerbellMachine{}
+	g.Expect(kubeClient.Get(context.Background(), request.NamespacedName, tinkerbellMachine)).To(Succeed())
+	g.Expect(tinkerbellMachine.Spec.HardwareName).To(BeEmpty())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		_ = migrator.Start(ctx)
+	}()
+
+	g.Eventually(migrator.Migrated).Should(BeTrue())
+
+	_, err = reconciler.Reconcile(context.Background(), request)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(kubeClient.Get(context.Background(), request.NamespacedName, tinkerbellMachine)).To(Succeed())
+	g.Expect(tinkerbellMachine.Spec.HardwareName).To(Equal(hardwareName))
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	rufiov1 "github.com/tinkerbell/rufio/api/v1alpha1"
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+)
+
+// provisionJobName returns the name of the current BMC Job powering the Hardware on into PXE, which
+// is the Job of the last PXE retry, if any.
+func (mrc *machineReconcileContext) provisionJobName() string {
+	if attempts := mrc.tinkerbellMachine.Status.PXEAttempts; len(attempts) > 0 {
+		return attempts[len(attempts)-1].JobName
+	}
+
+	return fmt.Sprintf("%s-provision", mrc.tinkerbellMachine.Name)
+}
+
+// retryPXEBoot issues a fresh BMC Job powering the Hardware on into PXE when the workflow has not
+// been started within the PXE retry window after the current Job completed. It returns true if a
+// retry was issued or provisioning failed, or the time left until the window expires. Once all
+// attempts are used up, provisioning fails.
+func (mrc *machineReconcileContext) retryPXEBoot(hardware *tinkv1.Hardware, job *rufiov1.Job,
+	wf *tinkv1.Workflow,
+) (bool, time.Duration, error) {
+	policy := mrc.tinkerbellMachine.Spec.PXERetry
+
+	if policy == nil || job == nil || job.Status.CompletionTime == nil || wf.GetStartTime() != nil {
+		return false, 0, nil
+	}
+
+	if remaining := time.Until(job.Status.CompletionTime.Add(policy.Window.Duration)); remaining > 0 {
+		return false, remaining, nil
+	}
+
+	attempts := mrc.tinkerbellMachine.Status.PXEAttempts
+	if len(attempts) >= int(policy.MaxAttempts) {
+		return true, 0, mrc.failProvisioning("pxe boot", infrastructurev1.PXERetriesExhaustedReason,
+			fmt.Sprintf("workflow was not started after %d PXE boot retries", len(attempts)))
+	}
+
+	jobName := fmt.Sprintf("%s-provision-%d", mrc.tinkerbellMachine.Name, len(attempts)+1)
+
+	mrc.log.Info("Workflow was not started; retrying PXE boot",
+		"attempt", len(attempts)+1, "maxAttempts", policy.MaxAttempts, "previousJob", job.Name)
+
+	// The Job may exist already if recording the attempt failed before.
+	if _, err := mrc.createHardwareProvisionJob(hardware, jobName); err != nil && !apierrors.IsAlreadyExists(err) {
+		return false, 0, fmt.Errorf("creating PXE retry job: %w", err)
+	}
+
+	mrc.tinkerbellMachine.Status.PXEAttempts = append(attempts, infrastructurev1.PXEAttempt{
+		JobName: jobName,
+		Time:    metav1.Now(),
+	})
+
+	return true, 0, nil
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/patch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+)
+
+const remoteClientSourceName = "tinkerbellmachine-controller"
+
+// hardwareFaultReason inspects the workload cluster Node backed by the machine's hardware and
+// returns a description of the configured fault conditions and labels found on it.
+//
+// An empty string is returned if no fault markers are configured or found. The Node being
+// unreachable is not considered a fault, as it must not block machine deletion.
+func (bmrc *baseMachineReconcileContext) hardwareFaultReason() string {
+	if len(bmrc.hardwareFaultConditions) == 0 && len(bmrc.hardwareFaultLabels) == 0 {
+		return ""
+	}
+
+	machine, err := util.GetOwnerMachine(bmrc.ctx, bmrc.client, bmrc.tinkerbellMachine.ObjectMeta)
+	if err != nil || machine == nil || machine.Status.NodeRef == nil {
+		bmrc.log.Info("Node for machine is not known; skipping hardware fault check", "error", err)
+
+		return ""
+	}
+
+	clusterKey := client.ObjectKey{Namespace: machine.Namespace, Name: machine.Spec.ClusterName}
+
+	remoteClient, err := bmrc.remoteClientGetter(bmrc.ctx, remoteClientSourceName, bmrc.client, clusterKey)
+	if err != nil {
+		bmrc.log.Error(err, "Unable to get workload cluster client; skipping hardware fault check", "cluster", clusterKey)
+
+		return ""
+	}
+
+	node := &corev1.Node{}
+	if err := remoteClient.Get(bmrc.ctx, client.ObjectKey{Name: machine.Status.NodeRef.Name}, node); err != nil {
+		bmrc.log.Error(err, "Unable to get workload cluster Node; skipping hardware fault check",
+			"node", machine.Status.NodeRef.Name)
+
+		return ""
+	}
+
+	return nodeFaultReason(node, bmrc.hardwareFaultConditions, bmrc.hardwareFaultLabels)
+}
+
+// nodeFaultReason returns a description of the given fault conditions and labels found on the Node.
+func nodeFaultReason(node *corev1.Node, faultConditions, faultLabels []string) string {
+	var reasons []string
+
+	for _, key := range faultLabels {
+		if value, ok := node.Labels[key]; ok {
+			reasons = append(reasons, fmt.Sprintf("label %s=%s", key, value))
+		}
+	}
+
+	for _, condition := range node.Status.Conditions {
+		for _, faultCondition := range faultConditions {
+			if string(condition.Type) != faultCondition || condition.Status != corev1.ConditionTrue {
+				continue
+			}
+
+			reason := fmt.Sprintf("condition %s", condition.Type)
+			if condition.Message != "" {
+				reason = fmt.Sprintf("%s: %s", reason, condition.Message)
+			}
+
+			reasons = append(reasons, reason)
+		}
+	}
+
+	sort.Strings(reasons)
+
+	return strings.Join(reasons, "; ")
+}
+
+// quarantineHardware releases the hardware from the machine, but marks it as quarantined, so it
+// won't be selected for other machines until an operator removes the quarantine label.
+func (bmrc *baseMachineReconcileContext) quarantineHardware(hardware *tinkv1.Hardware, reason string) error {
+	bmrc.log.Info("Quarantining faulty Hardware", "Hardware", hardware.Name, "reason", reason)
+
+	patchHelper, err := patch.NewHelper(hardware, bmrc.tinkClient)
+	if err != nil {
+		return fmt.Errorf("initializing patch helper for quarantined hardware: %w", err)
+	}
+
+	if hardware.ObjectMeta.Labels == nil {
+		hardware.ObjectMeta.Labels = map[string]string{}
+	}
+
+	if hardware.ObjectMeta.Annotations == nil {
+		hardware.ObjectMeta.Annotations = map[string]string{}
+	}
+
+	hardware.ObjectMeta.Labels[HardwareQuarantinedLabel] = "true"
+	hardware.ObjectMeta.Annotations[HardwareQuarantineReasonAnnotation] = reason
+
+	if err := bmrc.usageAccountant.endAllocation(bmrc.ctx, hardware); err != nil {
+		return fmt.Errorf("accounting hardware usage: %w", err)
+	}
+
+	clearHardwareOwnership(hardware)
+
+	if err := patchHelper.Patch(bmrc.ctx, hardware); err != nil {
+		return fmt.Errorf("patching Hardware object: %w", err)
+	}
+
+	return nil
+}
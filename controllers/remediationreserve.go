@@ -0,0 +1,278 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+)
+
+const (
+	// HardwareReservedForClusterLabel is set on Hardware held in the remediation reserve of the
+	// cluster it names. Reserved Hardware is only selected for replacements of remediated machines.
+	HardwareReservedForClusterLabel = "v1alpha1.tinkerbell.org/reservedForCluster"
+
+	// HardwareReservedForNamespaceLabel is the namespace of the cluster reserving the Hardware.
+	HardwareReservedForNamespaceLabel = "v1alpha1.tinkerbell.org/reservedForNamespace"
+
+	// RemediationForAnnotation is set by the KubeadmControlPlane controller on machines created to
+	// replace a remediated control plane machine.
+	RemediationForAnnotation = "controlplane.cluster.x-k8s.io/remediation-for"
+
+	// reserveRefillInterval is how often the remediation reserve of a cluster is checked for
+	// Hardware consumed by replacement machines.
+	reserveRefillInterval = time.Minute
+)
+
+// reservationLabels returns the labels marking Hardware reserved for the cluster.
+func reservationLabels(clusterName, namespace string) client.MatchingLabels {
+	return client.MatchingLabels{
+		HardwareReservedForClusterLabel:   clusterName,
+		HardwareReservedForNamespaceLabel: namespace,
+	}
+}
+
+// reservedFor returns the label selector requirements of Hardware reserved for the cluster.
+func reservedFor(clusterName, namespace string) []metav1.LabelSelectorRequirement {
+	return []metav1.LabelSelectorRequirement{
+		{
+			Key:      HardwareReservedForClusterLabel,
+			Operator: metav1.LabelSelectorOpIn,
+			Values:   []string{clusterName},
+		},
+		{
+			Key:      HardwareReservedForNamespaceLabel,
+			Operator: metav1.LabelSelectorOpIn,
+			Values:   []string{namespace},
+		},
+	}
+}
+
+// reconcileRemediationReserve fills the remediation reserve of the cluster up to its size, and
+// releases Hardware beyond it, or all of it when the reserve is removed.
+func (crc *clusterReconcileContext) reconcileRemediationReserve() error {
+	reserve := crc.tinkerbellCluster.Spec.RemediationReserve
+
+	size := 0
+	if reserve != nil {
+		size = int(reserve.Size)
+
+		// The reserve is released when the cluster is deleted.
+		controllerutil.AddFinalizer(crc.tinkerbellCluster, infrastructurev1.ClusterFinalizer)
+	}
+
+	reserved := &tinkv1.HardwareList{}
+	if err := crc.client.List(crc.ctx, reserved, reservationLabels(crc.clusterName(), crc.tinkerbellCluster.Namespace)); err != nil {
+		return fmt.Errorf("listing reserved Hardware: %w", err)
+	}
+
+	sort.Slice(reserved.Items, func(i, j int) bool {
+		return client.ObjectKeyFromObject(&reserved.Items[i]).String() < client.ObjectKeyFromObject(&reserved.Items[j]).String()
+	})
+
+	names := []string{}
+
+	for i := range reserved.Items {
+		hardware := &reserved.Items[i]
+
+		// Quarantined, decommissioned or foreign owned Hardware is of no use for replacements, it
+		// leaves the reserve to be replaced.
+		_, quarantined := hardware.Labels[HardwareQuarantinedLabel]
+		_, decommissioning := hardware.Labels[HardwareDecommissioningLabel]
+		_, foreign := hardware.Labels[HardwareForeignOwnerLabel]
+
+		if quarantined || decommissioning || foreign || len(names) >= size {
+			if err := crc.releaseReservedHardware(hardware); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		names = append(names, hardware.Name)
+	}
+
+	if len(names) < size {
+		var err error
+		if names, err = crc.fillRemediationReserve(names, size); err != nil {
+			return err
+		}
+	}
+
+	if len(names) < size {
+		crc.log.Info("Not enough Hardware available for remediation reserve", "reserved", len(names), "size", size)
+	}
+
+	crc.tinkerbellCluster.Status.ReservedHardware = nil
+	if len(names) > 0 {
+		crc.tinkerbellCluster.Status.ReservedHardware = names
+	}
+
+	if reserve == nil {
+		return nil
+	}
+
+	return &errRequeueAfter{after: reserveRefillInterval}
+}
+
+// fillRemediationReserve reserves available Hardware for the cluster until the reserve holding the
+// named Hardware reaches its size, and returns the names of the reserved Hardware. Nothing is
+// reserved before legacy Hardware ownership markers were migrated.
+func (crc *clusterReconcileContext) fillRemediationReserve(names []string, size int) ([]string, error) {
+	if !crc.ownershipMigrator.Migrated() {
+		crc.log.Info("Waiting for Hardware ownership migration before filling remediation reserve")
+
+		return names, nil
+	}
+
+	reserve := crc.tinkerbellCluster.Spec.RemediationReserve
+
+	selector := &HardwareSelector{
+		Client:            crc.client,
+		TinkerbellCluster: crc.tinkerbellCluster,
+		ClusterName:       crc.clusterName(),
+		LegacyOwnerships:  crc.ownershipMigrator.legacyOwnerships(),
+	}
+
+	available, err := selector.Select(crc.ctx, reserve.HardwareAffinity)
+	if err != nil {
+		return nil, fmt.Errorf("selecting Hardware for remediation reserve: %w", err)
+	}
+
+	for i := 0; i < len(available) && len(names) < size; i++ {
+		hardware := &available[i]
+
+		if hardware.Labels == nil {
+			hardware.Labels = map[string]string{}
+		}
+
+		hardware.Labels[HardwareReservedForClusterLabel] = crc.clusterName()
+		hardware.Labels[HardwareReservedForNamespaceLabel] = crc.tinkerbellCluster.Namespace
+
+		if err := crc.client.Update(crc.ctx, hardware); err != nil {
+			return nil, fmt.Errorf("reserving Hardware %s: %w", hardware.Name, err)
+		}
+
+		crc.log.Info("Reserved Hardware for remediation", "hardware", hardware.Name)
+
+		names = append(names, hardware.Name)
+	}
+
+	return names, nil
+}
+
+// releaseRemediationReserve returns all Hardware reserved for the cluster to the shared pool.
+func (crc *clusterReconcileContext) releaseRemediationReserve() error {
+	reserved := &tinkv1.HardwareList{}
+	if err := crc.client.List(crc.ctx, reserved, reservationLabels(crc.clusterName(), crc.tinkerbellCluster.Namespace)); err != nil {
+		return fmt.Errorf("listing reserved Hardware: %w", err)
+	}
+
+	for i := range reserved.Items {
+		if err := crc.releaseReservedHardware(&reserved.Items[i]); err != nil {
+			return err
+		}
+	}
+
+	crc.tinkerbellCluster.Status.ReservedHardware = nil
+
+	return nil
+}
+
+// clusterName returns the name of the Cluster owning the TinkerbellCluster, which may already be
+// gone when the TinkerbellCluster is deleted.
+func (crc *clusterReconcileContext) clusterName() string {
+	if crc.cluster != nil {
+		return crc.cluster.Name
+	}
+
+	return crc.tinkerbellCluster.Labels[clusterv1.ClusterLabelName]
+}
+
+func (crc *clusterReconcileContext) releaseReservedHardware(hardware *tinkv1.Hardware) error {
+	delete(hardware.Labels, HardwareReservedForClusterLabel)
+	delete(hardware.Labels, HardwareReservedForNamespaceLabel)
+
+	if err := crc.client.Update(crc.ctx, hardware); err != nil {
+		return fmt.Errorf("releasing reserved Hardware %s: %w", hardware.Name, err)
+	}
+
+	crc.log.Info("Released Hardware from remediation reserve", "hardware", hardware.Name)
+
+	return nil
+}
+
+// replacesFromReserve returns true if the machine takes Hardware from the remediation reserve of its
+// cluster first, as it replaces a remediated machine.
+func (mrc *machineReconcileContext) replacesFromReserve() (bool, error) {
+	if mrc.tinkerbellCluster.Spec.RemediationReserve == nil || !mrc.stackOwnsObjects() {
+		return false, nil
+	}
+
+	return mrc.isRemediationReplacement()
+}
+
+// isRemediationReplacement returns true if the machine replaces a machine remediated after a
+// MachineHealthCheck failed. Control plane replacements are annotated by the KubeadmControlPlane
+// controller. MachineSets don't mark their replacements, so a machine is considered a replacement
+// while a machine of the same MachineSet waits for its remediation.
+func (mrc *machineReconcileContext) isRemediationReplacement() (bool, error) {
+	if _, ok := mrc.machine.Annotations[RemediationForAnnotation]; ok {
+		return true, nil
+	}
+
+	owner := metav1.GetControllerOf(mrc.machine)
+	if owner == nil {
+		return false, nil
+	}
+
+	siblings := &clusterv1.MachineList{}
+	if err := mrc.client.List(mrc.ctx, siblings, client.InNamespace(mrc.machine.Namespace),
+		client.MatchingLabels{clusterv1.ClusterLabelName: mrc.machine.Spec.ClusterName}); err != nil {
+		return false, fmt.Errorf("listing machines of cluster: %w", err)
+	}
+
+	for i := range siblings.Items {
+		sibling := &siblings.Items[i]
+
+		if sibling.Name == mrc.machine.Name {
+			continue
+		}
+
+		siblingOwner := metav1.GetControllerOf(sibling)
+		if siblingOwner == nil || siblingOwner.UID != owner.UID {
+			continue
+		}
+
+		if conditions.Has(sibling, clusterv1.MachineOwnerRemediatedCondition) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,732 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	runtimecatalog "sigs.k8s.io/cluster-api/exp/runtime/catalog"
+	runtimehooksv1 "sigs.k8s.io/cluster-api/exp/runtime/hooks/api/v1alpha1"
+	"sigs.k8s.io/cluster-api/exp/runtime/server"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+)
+
+const (
+	// DefaultRuntimeExtensionRetryAfter is how long CAPI waits before calling a hook again which
+	// blocked an operation.
+	DefaultRuntimeExtensionRetryAfter = time.Minute
+
+	// imageCheckTimeout limits how long checking an image URL may take.
+	imageCheckTimeout = 5 * time.Second
+)
+
+// ErrImageNotResolved is returned when a machine image URL does not resolve.
+var ErrImageNotResolved = fmt.Errorf("image does not resolve")
+
+// RuntimeExtension implements the CAPI Runtime SDK lifecycle hooks vetoing ClusterClass operations
+// the Tinkerbell infrastructure cannot carry out. BeforeClusterCreate and BeforeClusterUpgrade
+// block until the machine images of the Kubernetes version resolve and there is enough free
+// Hardware matching the TinkerbellMachineTemplates of the ClusterClass for the new machines.
+type RuntimeExtension struct {
+	Client client.Client
+
+	// HTTPClient is used to check image URLs. If nil, a client with a short timeout is used.
+	HTTPClient *http.Client
+
+	// RetryAfter is how long CAPI waits before calling a blocking hook again. If 0,
+	// DefaultRuntimeExtensionRetryAfter is used.
+	RetryAfter time.Duration
+
+	// LegacyOwnerships are legacy Hardware ownership labels. Hardware carrying the name label of any
+	// of them is not free.
+	LegacyOwnerships []LegacyOwnership
+
+	// StackClientGetter returns a client for the Tinkerbell stack of a failure domain from its kubeconfig.
+	// If not set, clients are created with the scheme of the manager and cached.
+	StackClientGetter StackClientGetter
+}
+
+// stackHardwareKey identifies Hardware across Tinkerbell stacks.
+type stackHardwareKey struct {
+	// stack is the name of the kubeconfig Secret of a remote stack, empty for the management cluster.
+	stack    string
+	hardware client.ObjectKey
+}
+
+// unknownClusterSpec stands in for the image lookup fields of a TinkerbellCluster which can't be
+// known, to tell the image URLs depending on them.
+var unknownClusterSpec = &infrastructurev1.TinkerbellClusterSpec{
+	ImageLookupFormat:       "unknown",
+	ImageLookupBaseRegistry: "unknown",
+	ImageLookupOSDistro:     "unknown",
+	ImageLookupOSVersion:    "unknown",
+}
+
+// plannedMachines are machines of a cluster created from the same TinkerbellMachineTemplate.
+type plannedMachines struct {
+	// name describes the machines in messages.
+	name string
+	// deployment is the name of the MachineDeployment topology, empty for the control plane.
+	deployment string
+	// failureDomain is the failure domain of the MachineDeployment topology, if any.
+	failureDomain string
+	controlPlane  bool
+	template      *infrastructurev1.TinkerbellMachineTemplate
+	replicas      int
+	// count is the number of machines Hardware is needed for.
+	count int
+}
+
+// +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusterclasses;machinedeployments,verbs=get;list;watch
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=tinkerbellmachinetemplates,verbs=get;list;watch
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=tinkerbellclustertemplates,verbs=get
+
+// SetupWithManager adds a Runtime Extension server with the hooks of the RuntimeExtension to the
+// manager. options.Catalog is set by SetupWithManager.
+func (re *RuntimeExtension) SetupWithManager(mgr ctrl.Manager, options server.Options) error {
+	if re.StackClientGetter == nil {
+		re.StackClientGetter = NewCachingStackClientGetter(mgr.GetScheme())
+	}
+
+	catalog := runtimecatalog.New()
+	if err := runtimehooksv1.AddToCatalog(catalog); err != nil {
+		return fmt.Errorf("adding runtime hooks to catalog: %w", err)
+	}
+
+	options.Catalog = catalog
+
+	extensionServer, err := server.New(options)
+	if err != nil {
+		return fmt.Errorf("creating runtime extension server: %w", err)
+	}
+
+	handlers := []server.ExtensionHandler{
+		{
+			Hook:        runtimehooksv1.BeforeClusterCreate,
+			Name:        "before-cluster-create",
+			HandlerFunc: re.BeforeClusterCreate,
+		},
+		{
+			Hook:        runtimehooksv1.BeforeClusterUpgrade,
+			Name:        "before-cluster-upgrade",
+			HandlerFunc: re.BeforeClusterUpgrade,
+		},
+	}
+
+	for _, handler := range handlers {
+		if err := extensionServer.AddExtensionHandler(handler); err != nil {
+			return fmt.Errorf("adding %s runtime extension handler: %w", handler.Name, err)
+		}
+	}
+
+	return mgr.Add(&runtimeExtensionServer{Server: extensionServer}) //nolint:wrapcheck
+}
+
+// runtimeExtensionServer serves the Runtime Extension on every replica, so the hooks are answered
+// whichever replica the Service picks.
+type runtimeExtensionServer struct {
+	*server.Server
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable.
+func (s *runtimeExtensionServer) NeedLeaderElection() bool {
+	return false
+}
+
+// BeforeClusterCreate blocks the creation of the Cluster topology until the machine images resolve
+// and there is free Hardware for all of its machines.
+func (re *RuntimeExtension) BeforeClusterCreate(
+	ctx context.Context,
+	request *runtimehooksv1.BeforeClusterCreateRequest,
+	response *runtimehooksv1.BeforeClusterCreateResponse,
+) {
+	cluster := &request.Cluster
+	if cluster.Spec.Topology == nil {
+		response.SetStatus(runtimehooksv1.ResponseStatusSuccess)
+
+		return
+	}
+
+	class, err := re.clusterClass(ctx, cluster)
+	if err != nil {
+		response.SetStatus(runtimehooksv1.ResponseStatusFailure)
+		response.SetMessage(err.Error())
+
+		return
+	}
+
+	planned, err := re.plannedMachines(ctx, cluster, class)
+	if err != nil {
+		response.SetStatus(runtimehooksv1.ResponseStatusFailure)
+		response.SetMessage(err.Error())
+
+		return
+	}
+
+	for i := range planned {
+		planned[i].count = planned[i].replicas
+	}
+
+	// The TinkerbellCluster doesn't exist yet, it's built from the TinkerbellClusterTemplate of the
+	// ClusterClass if its fields can be known.
+	tinkerbellCluster, err := re.tinkerbellClusterFromClass(ctx, cluster, class)
+	if err != nil {
+		response.SetStatus(runtimehooksv1.ResponseStatusFailure)
+		response.SetMessage(err.Error())
+
+		return
+	}
+
+	re.check(ctx, cluster, tinkerbellCluster, cluster.Spec.Topology.Version, planned, &response.CommonRetryResponse)
+}
+
+// BeforeClusterUpgrade blocks the upgrade of the Cluster until the machine images of the target
+// version resolve and there is free Hardware for the machines surging during the rollout.
+func (re *RuntimeExtension) BeforeClusterUpgrade(
+	ctx context.Context,
+	request *runtimehooksv1.BeforeClusterUpgradeRequest,
+	response *runtimehooksv1.BeforeClusterUpgradeResponse,
+) {
+	cluster := &request.Cluster
+	if cluster.Spec.Topology == nil {
+		response.SetStatus(runtimehooksv1.ResponseStatusSuccess)
+
+		return
+	}
+
+	tinkerbellCluster, err := re.tinkerbellCluster(ctx, cluster)
+	if err != nil {
+		response.SetStatus(runtimehooksv1.ResponseStatusFailure)
+		response.SetMessage(err.Error())
+
+		return
+	}
+
+	class, err := re.clusterClass(ctx, cluster)
+	if err != nil {
+		response.SetStatus(runtimehooksv1.ResponseStatusFailure)
+		response.SetMessage(err.Error())
+
+		return
+	}
+
+	planned, err := re.plannedMachines(ctx, cluster, class)
+	if err != nil {
+		response.SetStatus(runtimehooksv1.ResponseStatusFailure)
+		response.SetMessage(err.Error())
+
+		return
+	}
+
+	for i := range planned {
+		if planned[i].count, err = re.surge(ctx, cluster, &planned[i]); err != nil {
+			response.SetStatus(runtimehooksv1.ResponseStatusFailure)
+			response.SetMessage(err.Error())
+
+			return
+		}
+	}
+
+	re.check(ctx, cluster, tinkerbellCluster, request.ToKubernetesVersion, planned, &response.CommonRetryResponse)
+}
+
+// check blocks the hook with a retry-after hint if the images of the planned machines do not
+// resolve or there isn't enough free Hardware for them and the remediation reserve of the cluster.
+// tinkerbellCluster is nil if its fields can't be known.
+func (re *RuntimeExtension) check(ctx context.Context, cluster *clusterv1.Cluster,
+	tinkerbellCluster *infrastructurev1.TinkerbellCluster, kubernetesVersion string, planned []plannedMachines,
+	response *runtimehooksv1.CommonRetryResponse,
+) {
+	problems := []string{}
+
+	var clusterSpec *infrastructurev1.TinkerbellClusterSpec
+	if tinkerbellCluster != nil {
+		clusterSpec = &tinkerbellCluster.Spec
+	}
+
+	for i := range planned {
+		if err := re.checkImage(ctx, &planned[i].template.Spec.Template.Spec, clusterSpec, kubernetesVersion); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", planned[i].name, err))
+		}
+	}
+
+	hardwareProblems, err := re.checkHardware(ctx, cluster.Name, tinkerbellCluster, planned)
+	if err != nil {
+		response.SetStatus(runtimehooksv1.ResponseStatusFailure)
+		response.SetMessage(err.Error())
+
+		return
+	}
+
+	problems = append(problems, hardwareProblems...)
+
+	response.SetStatus(runtimehooksv1.ResponseStatusSuccess)
+
+	if len(problems) > 0 {
+		retryAfter := re.RetryAfter
+		if retryAfter == 0 {
+			retryAfter = DefaultRuntimeExtensionRetryAfter
+		}
+
+		response.SetMessage(strings.Join(problems, "; "))
+		response.RetryAfterSeconds = int32(retryAfter.Seconds())
+	}
+}
+
+// checkImage checks that the image URL of a machine answers with 200 OK. Only http and https URLs
+// are checked, as others can't be resolved by CAPT. Machines with a TemplateOverride don't use
+// the image URL. If clusterSpec is nil, the image URL is only checked if it doesn't depend on the
+// image lookup fields of the TinkerbellCluster.
+func (re *RuntimeExtension) checkImage(ctx context.Context, machineSpec *infrastructurev1.TinkerbellMachineSpec,
+	clusterSpec *infrastructurev1.TinkerbellClusterSpec, kubernetesVersion string,
+) error {
+	if machineSpec.TemplateOverride != "" {
+		return nil
+	}
+
+	if clusterSpec == nil {
+		clusterSpec = &infrastructurev1.TinkerbellClusterSpec{}
+
+		withEmpty, _ := machineImageURL(machineSpec, clusterSpec, kubernetesVersion)
+		withUnknown, _ := machineImageURL(machineSpec, unknownClusterSpec, kubernetesVersion)
+
+		if withEmpty != withUnknown {
+			return nil
+		}
+	}
+
+	imageURL, err := machineImageURL(machineSpec, clusterSpec, kubernetesVersion)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := url.Parse(imageURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return nil //nolint:nilerr
+	}
+
+	httpClient := re.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: imageCheckTimeout}
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodHead, imageURL, nil)
+	if err != nil {
+		return fmt.Errorf("creating request for image %s: %w", imageURL, err)
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrImageNotResolved, imageURL, err) //nolint:errorlint
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s answered %s", ErrImageNotResolved, imageURL, response.Status)
+	}
+
+	return nil
+}
+
+// checkHardware describes the planned machines and the remediation reserve of the cluster there
+// isn't enough free Hardware for. Hardware is selected like for the machines of the cluster, in the
+// Tinkerbell stacks of the failure domains the machines may be placed in. It's counted for one
+// machine only, even if it matches the templates of several. tinkerbellCluster is nil if its fields
+// can't be known, then topology exclusivity, failure domains and the reserve aren't considered.
+func (re *RuntimeExtension) checkHardware(ctx context.Context, clusterName string,
+	tinkerbellCluster *infrastructurev1.TinkerbellCluster, planned []plannedMachines,
+) ([]string, error) {
+	problems := []string{}
+	counted := map[stackHardwareKey]bool{}
+
+	selector := HardwareSelector{
+		Client:            re.Client,
+		TinkerbellCluster: tinkerbellCluster,
+		ClusterName:       clusterName,
+		LegacyOwnerships:  re.LegacyOwnerships,
+	}
+
+	for i := range planned {
+		stacks, err := re.plannedStacks(ctx, tinkerbellCluster, &planned[i])
+		if err != nil {
+			return nil, err
+		}
+
+		free, err := freeHardware(ctx, selector, stacks, planned[i].template.Spec.Template.Spec.HardwareAffinity,
+			planned[i].count, counted)
+		if err != nil {
+			return nil, err
+		}
+
+		if free < planned[i].count {
+			problems = append(problems, fmt.Sprintf(
+				"%s: %d free Hardware matching TinkerbellMachineTemplate %s needed, %d available",
+				planned[i].name, planned[i].count, planned[i].template.Name, free))
+		}
+	}
+
+	if tinkerbellCluster == nil || tinkerbellCluster.Spec.RemediationReserve == nil {
+		return problems, nil
+	}
+
+	// The reserve is filled from the Hardware of the management cluster up to its size.
+	reserve := tinkerbellCluster.Spec.RemediationReserve
+
+	missing := int(reserve.Size) - len(tinkerbellCluster.Status.ReservedHardware)
+	if missing <= 0 {
+		return problems, nil
+	}
+
+	free, err := freeHardware(ctx, selector, []*TinkerbellStack{{Client: re.Client}}, reserve.HardwareAffinity,
+		missing, counted)
+	if err != nil {
+		return nil, err
+	}
+
+	if free < missing {
+		problems = append(problems, fmt.Sprintf(
+			"remediation reserve: %d free Hardware matching its affinity needed, %d available", missing, free))
+	}
+
+	return problems, nil
+}
+
+// freeHardware returns how much Hardware the selector finds for up to count machines with the
+// affinity in the stacks. Hardware already counted is skipped, the Hardware found is marked counted.
+func freeHardware(ctx context.Context, selector HardwareSelector, stacks []*TinkerbellStack,
+	affinity *infrastructurev1.HardwareAffinity, count int, counted map[stackHardwareKey]bool,
+) (int, error) {
+	free := 0
+
+	for _, stack := range stacks {
+		stackKey := ""
+		if stack.Remote() {
+			stackKey = stack.FailureDomain.KubeconfigSecretRef.Name
+		}
+
+		selector.HardwareClient = stack.Client
+		selector.ListOptions = nil
+
+		if stack.FailureDomain != nil {
+			selector.ListOptions = []client.ListOption{client.InNamespace(stack.Namespace)}
+		}
+
+		available, err := selector.Select(ctx, affinity)
+		if err != nil {
+			return 0, err
+		}
+
+		for j := range available {
+			if free == count {
+				return free, nil
+			}
+
+			key := stackHardwareKey{stack: stackKey, hardware: client.ObjectKeyFromObject(&available[j])}
+			if counted[key] {
+				continue
+			}
+
+			counted[key] = true
+			free++
+		}
+	}
+
+	return free, nil
+}
+
+// plannedStacks returns the Tinkerbell stacks of the failure domains the planned machines may be
+// placed in: the failure domain of their MachineDeployment topology, or the failure domains suitable
+// for the control plane. Machines without a failure domain use the stack of the management cluster.
+func (re *RuntimeExtension) plannedStacks(ctx context.Context, tinkerbellCluster *infrastructurev1.TinkerbellCluster,
+	planned *plannedMachines,
+) ([]*TinkerbellStack, error) {
+	stacks := []*TinkerbellStack{}
+
+	if tinkerbellCluster != nil {
+		for i := range tinkerbellCluster.Spec.FailureDomains {
+			failureDomain := &tinkerbellCluster.Spec.FailureDomains[i]
+
+			if planned.failureDomain != failureDomain.Name && (planned.failureDomain != "" ||
+				!planned.controlPlane || !failureDomain.ControlPlane) {
+				continue
+			}
+
+			stack, err := NewTinkerbellStack(ctx, re.Client, re.StackClientGetter, tinkerbellCluster.Namespace,
+				failureDomain)
+			if err != nil {
+				return nil, err
+			}
+
+			stacks = append(stacks, stack)
+		}
+	}
+
+	if len(stacks) == 0 {
+		stacks = append(stacks, &TinkerbellStack{Client: re.Client})
+	}
+
+	return stacks, nil
+}
+
+// clusterClass returns the ClusterClass of the Cluster topology.
+func (re *RuntimeExtension) clusterClass(
+	ctx context.Context, cluster *clusterv1.Cluster,
+) (*clusterv1.ClusterClass, error) {
+	topology := cluster.Spec.Topology
+
+	class := &clusterv1.ClusterClass{}
+	if err := re.Client.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: topology.Class}, class); err != nil {
+		return nil, fmt.Errorf("getting ClusterClass %s: %w", topology.Class, err)
+	}
+
+	return class, nil
+}
+
+// plannedMachines returns the machines of the Cluster topology which are created from
+// TinkerbellMachineTemplates of its ClusterClass.
+func (re *RuntimeExtension) plannedMachines(
+	ctx context.Context, cluster *clusterv1.Cluster, class *clusterv1.ClusterClass,
+) ([]plannedMachines, error) {
+	topology := cluster.Spec.Topology
+
+	planned := []plannedMachines{}
+
+	if class.Spec.ControlPlane.MachineInfrastructure != nil {
+		template, err := re.machineTemplate(ctx, cluster, class.Spec.ControlPlane.MachineInfrastructure.Ref)
+		if err != nil {
+			return nil, err
+		}
+
+		if template != nil {
+			planned = append(planned, plannedMachines{
+				name:         "control plane",
+				controlPlane: true,
+				template:     template,
+				replicas:     replicasOrOne(topology.ControlPlane.Replicas),
+			})
+		}
+	}
+
+	if topology.Workers == nil {
+		return planned, nil
+	}
+
+	for _, deployment := range topology.Workers.MachineDeployments {
+		for _, deploymentClass := range class.Spec.Workers.MachineDeployments {
+			if deploymentClass.Class != deployment.Class {
+				continue
+			}
+
+			template, err := re.machineTemplate(ctx, cluster, deploymentClass.Template.Infrastructure.Ref)
+			if err != nil {
+				return nil, err
+			}
+
+			if template != nil {
+				planned = append(planned, plannedMachines{
+					name:          "MachineDeployment " + deployment.Name,
+					deployment:    deployment.Name,
+					failureDomain: pointer.StringDeref(deployment.FailureDomain, ""),
+					template:      template,
+					replicas:      replicasOrOne(deployment.Replicas),
+				})
+			}
+		}
+	}
+
+	return planned, nil
+}
+
+// machineTemplate returns the TinkerbellMachineTemplate the reference points to, or nil if it points
+// to another kind of template.
+func (re *RuntimeExtension) machineTemplate(
+	ctx context.Context, cluster *clusterv1.Cluster, ref *corev1.ObjectReference,
+) (*infrastructurev1.TinkerbellMachineTemplate, error) {
+	if ref == nil || ref.Kind != "TinkerbellMachineTemplate" {
+		return nil, nil //nolint:nilnil
+	}
+
+	if gv, err := schema.ParseGroupVersion(ref.APIVersion); err != nil || gv.Group != infrastructurev1.GroupVersion.Group {
+		return nil, nil //nolint:nilnil,nilerr
+	}
+
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = cluster.Namespace
+	}
+
+	template := &infrastructurev1.TinkerbellMachineTemplate{}
+	if err := re.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: ref.Name}, template); err != nil {
+		return nil, fmt.Errorf("getting TinkerbellMachineTemplate %s: %w", ref.Name, err)
+	}
+
+	return template, nil
+}
+
+// tinkerbellCluster returns the TinkerbellCluster of the Cluster, or nil if it doesn't exist.
+func (re *RuntimeExtension) tinkerbellCluster(
+	ctx context.Context, cluster *clusterv1.Cluster,
+) (*infrastructurev1.TinkerbellCluster, error) {
+	ref := cluster.Spec.InfrastructureRef
+	if ref == nil || ref.Kind != "TinkerbellCluster" {
+		return nil, nil //nolint:nilnil
+	}
+
+	tinkerbellCluster := &infrastructurev1.TinkerbellCluster{}
+
+	err := re.Client.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: ref.Name}, tinkerbellCluster)
+	if apierrors.IsNotFound(err) {
+		return nil, nil //nolint:nilnil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("getting TinkerbellCluster %s: %w", ref.Name, err)
+	}
+
+	return tinkerbellCluster, nil
+}
+
+// tinkerbellClusterFromClass returns the TinkerbellCluster the Cluster topology will create from the
+// TinkerbellClusterTemplate of its ClusterClass. nil is returned if its fields can't be known: the
+// ClusterClass doesn't use a TinkerbellClusterTemplate, patches may change it or it doesn't exist.
+func (re *RuntimeExtension) tinkerbellClusterFromClass(ctx context.Context, cluster *clusterv1.Cluster,
+	class *clusterv1.ClusterClass,
+) (*infrastructurev1.TinkerbellCluster, error) {
+	if class.Spec.Infrastructure.Ref == nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	ref := class.Spec.Infrastructure.Ref
+
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil || gv.Group != infrastructurev1.GroupVersion.Group || ref.Kind != "TinkerbellClusterTemplate" {
+		return nil, nil //nolint:nilnil,nilerr
+	}
+
+	for i := range class.Spec.Patches {
+		patch := &class.Spec.Patches[i]
+		if patch.External != nil {
+			return nil, nil //nolint:nilnil
+		}
+
+		for j := range patch.Definitions {
+			if patch.Definitions[j].Selector.MatchResources.InfrastructureCluster {
+				return nil, nil //nolint:nilnil
+			}
+		}
+	}
+
+	template := &unstructured.Unstructured{}
+	template.SetGroupVersionKind(gv.WithKind(ref.Kind))
+
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = class.Namespace
+	}
+
+	err = re.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: ref.Name}, template)
+	if apierrors.IsNotFound(err) || meta.IsNoMatchError(err) {
+		return nil, nil //nolint:nilnil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("getting TinkerbellClusterTemplate %s: %w", ref.Name, err)
+	}
+
+	spec, found, err := unstructured.NestedMap(template.Object, "spec", "template", "spec")
+	if err != nil || !found {
+		return nil, nil //nolint:nilnil,nilerr
+	}
+
+	tinkerbellCluster := &infrastructurev1.TinkerbellCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: cluster.Name, Namespace: cluster.Namespace},
+	}
+
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(spec, &tinkerbellCluster.Spec); err != nil {
+		return nil, fmt.Errorf("converting TinkerbellClusterTemplate %s: %w", ref.Name, err)
+	}
+
+	return tinkerbellCluster, nil
+}
+
+// surge returns how many machines are added at most while the planned machines are rolled out. The
+// control plane surges by one machine, MachineDeployments by the maxSurge of their rolling update
+// strategy.
+func (re *RuntimeExtension) surge(
+	ctx context.Context, cluster *clusterv1.Cluster, planned *plannedMachines,
+) (int, error) {
+	if planned.deployment == "" {
+		return 1, nil
+	}
+
+	deployments := &clusterv1.MachineDeploymentList{}
+	if err := re.Client.List(ctx, deployments, client.InNamespace(cluster.Namespace), client.MatchingLabels{
+		clusterv1.ClusterLabelName:                          cluster.Name,
+		clusterv1.ClusterTopologyMachineDeploymentLabelName: planned.deployment,
+	}); err != nil {
+		return 0, fmt.Errorf("listing MachineDeployments of %s: %w", planned.name, err)
+	}
+
+	if len(deployments.Items) == 0 {
+		return 1, nil
+	}
+
+	deployment := deployments.Items[0]
+
+	strategy := deployment.Spec.Strategy
+	if strategy == nil || strategy.RollingUpdate == nil || strategy.RollingUpdate.MaxSurge == nil {
+		return 1, nil
+	}
+
+	replicas := planned.replicas
+	if deployment.Spec.Replicas != nil {
+		replicas = int(*deployment.Spec.Replicas)
+	}
+
+	surge, err := intstr.GetScaledValueFromIntOrPercent(strategy.RollingUpdate.MaxSurge, replicas, true)
+	if err != nil {
+		return 0, fmt.Errorf("getting maxSurge of %s: %w", planned.name, err)
+	}
+
+	return surge, nil
+}
+
+func replicasOrOne(replicas *int32) int {
+	if replicas == nil {
+		return 1
+	}
+
+	return int(*replicas)
+}
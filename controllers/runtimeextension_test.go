@@ -0,0 +1,422 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	runtimehooksv1 "sigs.k8s.io/cluster-api/exp/runtime/hooks/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/controllers"
+)
+
+func runtimeExtensionObjects(imageFormat string, hardware int) []runtime.Object {
+	machineTemplate := func(name, role string) *infrastructurev1.TinkerbellMachineTemplate {
+		return &infrastructurev1.TinkerbellMachineTemplate{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: clusterNamespace},
+			Spec: infrastructurev1.TinkerbellMachineTemplateSpec{
+				Template: infrastructurev1.TinkerbellMachineTemplateResource{
+					Spec: infrastructurev1.TinkerbellMachineSpec{
+						ImageLookupFormat: imageFormat,
+						HardwareAffinity: &infrastructurev1.HardwareAffinity{
+							Required: []infrastructurev1.HardwareAffinityTerm{{
+								LabelSelector: metav1.LabelSelector{MatchLabels: map[string]string{"role": role}},
+							}},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	templateRef := func(name string) *corev1.ObjectReference {
+		return &corev1.ObjectReference{
+			APIVersion: infrastructurev1.GroupVersion.String(),
+			Kind:       "TinkerbellMachineTemplate",
+			Name:       name,
+		}
+	}
+
+	objects := []runtime.Object{
+		&clusterv1.ClusterClass{
+			ObjectMeta: metav1.ObjectMeta{Name: "tinkerbell", Namespace: clusterNamespace},
+			Spec: clusterv1.ClusterClassSpec{
+				ControlPlane: clusterv1.ControlPlaneClass{
+					MachineInfrastructure: &clusterv1.LocalObjectTemplate{Ref: templateRef("control-plane")},
+				},
+				Workers: clusterv1.WorkersClass{
+					MachineDeployments: []clusterv1.MachineDeploymentClass{{
+						Class: "default-worker",
+						Template: clusterv1.MachineDeploymentClassTemplate{
+							Infrastructure: clusterv1.LocalObjectTemplate{Ref: templateRef("worker")},
+						},
+					}},
+				},
+			},
+		},
+		machineTemplate("control-plane", "control-plane"),
+		machineTemplate("worker", "worker"),
+	}
+
+	for i := 0; i < hardware; i++ {
+		objects = append(objects,
+			validHardware(uuid.New().String(), uuid.New().String(), hardwareIP, testOptions{
+				Labels: map[string]string{"role": "control-plane"},
+			}),
+			validHardware(uuid.New().String(), uuid.New().String(), hardwareIP, testOptions{
+				Labels: map[string]string{"role": "worker"},
+			}),
+		)
+	}
+
+	return objects
+}
+
+func topologyCluster() clusterv1.Cluster {
+	return clusterv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{Name: clusterName, Namespace: clusterNamespace},
+		Spec: clusterv1.ClusterSpec{
+			Topology: &clusterv1.Topology{
+				Class:        "tinkerbell",
+				Version:      "v1.25.4",
+				ControlPlane: clusterv1.ControlPlaneTopology{Replicas: pointer.Int32(3)},
+				Workers: &clusterv1.WorkersTopology{
+					MachineDeployments: []clusterv1.MachineDeploymentTopology{
+						{Class: "default-worker", Name: "md-0", Replicas: pointer.Int32(2)},
+					},
+				},
+			},
+		},
+	}
+}
+
+func Test_RuntimeExtension_BeforeClusterCreate(t *testing.T) {
+	t.Parallel()
+
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ubuntu-v1.25.4.gz" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(images.Close)
+
+	imageFormat := images.URL + "/ubuntu-{{.KubernetesVersion}}.gz"
+
+	t.Run("allows_create_with_images_and_hardware", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		extension := &controllers.RuntimeExtension{
+			Client: kubernetesClientWithObjects(t, runtimeExtensionObjects(imageFormat, 3)),
+		}
+
+		response := &runtimehooksv1.BeforeClusterCreateResponse{}
+		extension.BeforeClusterCreate(context.Background(),
+			&runtimehooksv1.BeforeClusterCreateRequest{Cluster: topologyCluster()}, response)
+
+		g.Expect(response.GetStatus()).To(Equal(runtimehooksv1.ResponseStatusSuccess))
+		g.Expect(response.GetRetryAfterSeconds()).To(BeZero(), response.GetMessage())
+	})
+
+	t.Run("blocks_create_without_enough_hardware", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		extension := &controllers.RuntimeExtension{
+			Client: kubernetesClientWithObjects(t, runtimeExtensionObjects(imageFormat, 2)),
+		}
+
+		response := &runtimehooksv1.BeforeClusterCreateResponse{}
+		extension.BeforeClusterCreate(context.Background(),
+			&runtimehooksv1.BeforeClusterCreateRequest{Cluster: topologyCluster()}, response)
+
+		g.Expect(response.GetStatus()).To(Equal(runtimehooksv1.ResponseStatusSuccess))
+		g.Expect(response.GetRetryAfterSeconds()).To(BeEquivalentTo(60))
+		g.Expect(response.GetMessage()).To(Equal(
+			"control plane: 3 free Hardware matching TinkerbellMachineTemplate control-plane needed, 2 available"))
+	})
+
+	t.Run("blocks_create_when_image_does_not_resolve", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		extension := &controllers.RuntimeExtension{
+			Client: kubernetesClientWithObjects(t, runtimeExtensionObjects(images.URL+"/missing.gz", 3)),
+		}
+
+		response := &runtimehooksv1.BeforeClusterCreateResponse{}
+		extension.BeforeClusterCreate(context.Background(),
+			&runtimehooksv1.BeforeClusterCreateRequest{Cluster: topologyCluster()}, response)
+
+		g.Expect(response.GetRetryAfterSeconds()).NotTo(BeZero())
+		g.Expect(response.GetMessage()).To(ContainSubstring("control plane: image does not resolve"))
+		g.Expect(response.GetMessage()).To(ContainSubstring("MachineDeployment md-0: image does not resolve"))
+	})
+
+	t.Run("skips_image_check_when_cluster_fields_are_unknown", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		// The ClusterClass has no TinkerbellClusterTemplate, so the OS distro can't be known.
+		objects := runtimeExtensionObjects(images.URL+"/{{.OSDistro}}-{{.KubernetesVersion}}.gz", 3)
+		extension := &controllers.RuntimeExtension{Client: kubernetesClientWithObjects(t, objects)}
+
+		response := &runtimehooksv1.BeforeClusterCreateResponse{}
+		extension.BeforeClusterCreate(context.Background(),
+			&runtimehooksv1.BeforeClusterCreateRequest{Cluster: topologyCluster()}, response)
+
+		g.Expect(response.GetStatus()).To(Equal(runtimehooksv1.ResponseStatusSuccess))
+		g.Expect(response.GetRetryAfterSeconds()).To(BeZero(), response.GetMessage())
+	})
+
+	t.Run("blocks_create_without_hardware_for_remediation_reserve_of_cluster_template", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		objects := runtimeExtensionObjects(images.URL+"/{{.OSDistro}}-{{.KubernetesVersion}}.gz", 3)
+
+		class, ok := objects[0].(*clusterv1.ClusterClass)
+		g.Expect(ok).To(BeTrue())
+
+		class.Spec.Infrastructure.Ref = &corev1.ObjectReference{
+			APIVersion: infrastructurev1.GroupVersion.String(),
+			Kind:       "TinkerbellClusterTemplate",
+			Name:       "tinkerbell",
+		}
+
+		template := &unstructured.Unstructured{Object: map[string]interface{}{
+			"spec": map[string]interface{}{"template": map[string]interface{}{"spec": map[string]interface{}{
+				"imageLookupOSDistro": "ubuntu",
+				"remediationReserve": map[string]interface{}{
+					"size": int64(2),
+					"hardwareAffinity": map[string]interface{}{"required": []interface{}{
+						map[string]interface{}{"labelSelector": map[string]interface{}{
+							"matchLabels": map[string]interface{}{"role": "worker"},
+						}},
+					}},
+				},
+			}}},
+		}}
+		template.SetGroupVersionKind(infrastructurev1.GroupVersion.WithKind("TinkerbellClusterTemplate"))
+		template.SetName("tinkerbell")
+		template.SetNamespace(clusterNamespace)
+
+		extension := &controllers.RuntimeExtension{
+			Client: kubernetesClientWithObjects(t, append(objects, template)),
+		}
+
+		response := &runtimehooksv1.BeforeClusterCreateResponse{}
+		extension.BeforeClusterCreate(context.Background(),
+			&runtimehooksv1.BeforeClusterCreateRequest{Cluster: topologyCluster()}, response)
+
+		// The image resolves with the OS distro of the template, the third worker Hardware is
+		// left for the reserve.
+		g.Expect(response.GetStatus()).To(Equal(runtimehooksv1.ResponseStatusSuccess))
+		g.Expect(response.GetRetryAfterSeconds()).NotTo(BeZero())
+		g.Expect(response.GetMessage()).To(Equal(
+			"remediation reserve: 2 free Hardware matching its affinity needed, 1 available"))
+	})
+}
+
+func Test_RuntimeExtension_BeforeClusterUpgrade(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ubuntu-v1.26.0.gz" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(images.Close)
+
+	maxSurge := intstr.FromString("100%")
+
+	// The cluster runs on all but one control plane and one worker Hardware.
+	objects := append(runtimeExtensionObjects(images.URL+"/ubuntu-{{.KubernetesVersion}}.gz", 1),
+		&clusterv1.MachineDeployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "md-0-abcde",
+				Namespace: clusterNamespace,
+				Labels: map[string]string{
+					clusterv1.ClusterLabelName:                          clusterName,
+					clusterv1.ClusterTopologyMachineDeploymentLabelName: "md-0",
+				},
+			},
+			Spec: clusterv1.MachineDeploymentSpec{
+				ClusterName: clusterName,
+				Replicas:    pointer.Int32(2),
+				Strategy: &clusterv1.MachineDeploymentStrategy{
+					Type:          clusterv1.RollingUpdateMachineDeploymentStrategyType,
+					RollingUpdate: &clusterv1.MachineRollingUpdateDeployment{MaxSurge: &maxSurge},
+				},
+			},
+		})
+
+	extension := &controllers.RuntimeExtension{Client: kubernetesClientWithObjects(t, objects)}
+
+	request := &runtimehooksv1.BeforeClusterUpgradeRequest{
+		Cluster:               topologyCluster(),
+		FromKubernetesVersion: "v1.25.4",
+		ToKubernetesVersion:   "v1.26.0",
+	}
+
+	response := &runtimehooksv1.BeforeClusterUpgradeResponse{}
+	extension.BeforeClusterUpgrade(context.Background(), request, response)
+
+	g.Expect(response.GetStatus()).To(Equal(runtimehooksv1.ResponseStatusSuccess))
+	g.Expect(response.GetRetryAfterSeconds()).NotTo(BeZero())
+	g.Expect(response.GetMessage()).To(Equal(
+		"MachineDeployment md-0: 2 free Hardware matching TinkerbellMachineTemplate worker needed, 1 available"))
+
+	// Upgrades to a version without images are blocked as well.
+	request.ToKubernetesVersion = "v1.27.0"
+
+	response = &runtimehooksv1.BeforeClusterUpgradeResponse{}
+	extension.BeforeClusterUpgrade(context.Background(), request, response)
+
+	g.Expect(response.GetMessage()).To(ContainSubstring("control plane: image does not resolve"))
+}
+
+func Test_RuntimeExtension_BeforeClusterUpgrade_counts_cluster_hardware(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(images.Close)
+
+	hardware := func(name, role, rack string) *tinkv1.Hardware {
+		return validHardware(name, uuid.New().String(), hardwareIP, testOptions{
+			Labels: map[string]string{"role": role, rackLabel: rack},
+		})
+	}
+
+	tinkerbellCluster := validTinkerbellCluster(clusterName, clusterNamespace)
+	tinkerbellCluster.Spec.RemediationReserve = &infrastructurev1.RemediationReserve{
+		Size: 2,
+		HardwareAffinity: &infrastructurev1.HardwareAffinity{
+			Required: []infrastructurev1.HardwareAffinityTerm{{
+				LabelSelector: metav1.LabelSelector{MatchLabels: map[string]string{"role": "control-plane"}},
+			}},
+		},
+	}
+
+	// Rack a is claimed by another cluster, so the worker Hardware isn't free for the surge of md-0.
+	// One control plane Hardware is left for the reserve after the control plane surge.
+	objects := append(runtimeExtensionObjects(images.URL+"/ubuntu-{{.KubernetesVersion}}.gz", 0),
+		tinkerbellCluster,
+		exclusiveTinkerbellCluster(otherClusterName, "rack-a"),
+		hardware("control-plane-0", "control-plane", "rack-b"),
+		hardware("control-plane-1", "control-plane", "rack-b"),
+		hardware("worker-0", "worker", "rack-a"),
+	)
+
+	cluster := topologyCluster()
+	cluster.Spec.InfrastructureRef = &corev1.ObjectReference{Kind: "TinkerbellCluster", Name: clusterName}
+
+	extension := &controllers.RuntimeExtension{Client: kubernetesClientWithObjects(t, objects)}
+
+	response := &runtimehooksv1.BeforeClusterUpgradeResponse{}
+	extension.BeforeClusterUpgrade(context.Background(), &runtimehooksv1.BeforeClusterUpgradeRequest{
+		Cluster:               cluster,
+		FromKubernetesVersion: "v1.25.4",
+		ToKubernetesVersion:   "v1.26.0",
+	}, response)
+
+	g.Expect(response.GetStatus()).To(Equal(runtimehooksv1.ResponseStatusSuccess))
+	g.Expect(response.GetRetryAfterSeconds()).NotTo(BeZero())
+	g.Expect(response.GetMessage()).To(ContainSubstring(
+		"MachineDeployment md-0: 1 free Hardware matching TinkerbellMachineTemplate worker needed, 0 available"))
+	g.Expect(response.GetMessage()).To(ContainSubstring(
+		"remediation reserve: 2 free Hardware matching its affinity needed, 1 available"))
+}
+
+func Test_RuntimeExtension_BeforeClusterUpgrade_counts_hardware_of_failure_domains(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(images.Close)
+
+	const stackNamespace = "tinkerbell"
+
+	tinkerbellCluster := validTinkerbellCluster(clusterName, clusterNamespace)
+	tinkerbellCluster.Spec.FailureDomains = []infrastructurev1.TinkerbellFailureDomain{{
+		Name:                "rack-b",
+		ControlPlane:        true,
+		KubeconfigSecretRef: &corev1.LocalObjectReference{Name: "rack-b-kubeconfig"},
+		HardwareNamespace:   stackNamespace,
+	}}
+
+	kubeconfigSecret := validSecret("rack-b-kubeconfig", clusterNamespace)
+	kubeconfigSecret.Data["value"] = []byte("rack-b kubeconfig")
+
+	// The management cluster only has worker Hardware, the stack of rack-b only control plane Hardware.
+	objects := append(runtimeExtensionObjects(images.URL+"/ubuntu-{{.KubernetesVersion}}.gz", 0),
+		tinkerbellCluster,
+		kubeconfigSecret,
+		validHardware("worker-0", uuid.New().String(), hardwareIP, testOptions{
+			Labels: map[string]string{"role": "worker"},
+		}),
+	)
+
+	stackHardware := validHardware("control-plane-0", uuid.New().String(), hardwareIP, testOptions{
+		Labels: map[string]string{"role": "control-plane"},
+	})
+	stackHardware.Namespace = stackNamespace
+
+	stackClient := kubernetesClientWithObjects(t, []runtime.Object{stackHardware})
+
+	cluster := topologyCluster()
+	cluster.Spec.InfrastructureRef = &corev1.ObjectReference{Kind: "TinkerbellCluster", Name: clusterName}
+	cluster.Spec.Topology.Workers.MachineDeployments[0].FailureDomain = pointer.String("rack-b")
+
+	extension := &controllers.RuntimeExtension{
+		Client: kubernetesClientWithObjects(t, objects),
+		StackClientGetter: func(kubeconfig []byte) (client.Client, error) {
+			g.Expect(string(kubeconfig)).To(Equal("rack-b kubeconfig"))
+
+			return stackClient, nil
+		},
+	}
+
+	response := &runtimehooksv1.BeforeClusterUpgradeResponse{}
+	extension.BeforeClusterUpgrade(context.Background(), &runtimehooksv1.BeforeClusterUpgradeRequest{
+		Cluster:               cluster,
+		FromKubernetesVersion: "v1.25.4",
+		ToKubernetesVersion:   "v1.26.0",
+	}, response)
+
+	g.Expect(response.GetStatus()).To(Equal(runtimehooksv1.ResponseStatusSuccess))
+	g.Expect(response.GetMessage()).To(Equal(
+		"MachineDeployment md-0: 1 free Hardware matching TinkerbellMachineTemplate worker needed, 0 available"))
+}
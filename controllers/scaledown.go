@@ -0,0 +1,487 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/cluster-api/util/predicates"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+)
+
+const (
+	// ScaleDownCandidateAnnotation marks Machines annotated with cluster.x-k8s.io/delete-machine by
+	// the ScaleDownReconciler, so the annotation is only ever removed from Machines it annotated.
+	ScaleDownCandidateAnnotation = "v1alpha1.tinkerbell.org/scaleDownCandidate"
+
+	// scaleDownResyncInterval is how often the ranking is refreshed, as Hardware health and labels
+	// are not watched.
+	scaleDownResyncInterval = 5 * time.Minute
+)
+
+// hardwareHealthConditions are the TinkerbellMachine conditions reporting hardware faults read from the BMC.
+//
+//nolint:gochecknoglobals
+var hardwareHealthConditions = []clusterv1.ConditionType{
+	infrastructurev1.PowerSupplyHealthyCondition,
+	infrastructurev1.MemoryHealthyCondition,
+	infrastructurev1.ThermalHealthyCondition,
+}
+
+// ScaleDownReconciler annotates the Machine of each MachineSet whose Hardware is the least desirable
+// according to the ScaleDownPolicy of its TinkerbellCluster, so it is deleted first on scale-down.
+type ScaleDownReconciler struct {
+	client.Client
+	WatchFilterValue string
+
+	// StackClientGetter builds clients for the Tinkerbell stacks of failure domains running outside
+	// of the management cluster. If nil, clients are built from the scheme of the manager.
+	StackClientGetter StackClientGetter
+}
+
+// scaleDownCandidate is a Machine of a MachineSet and the Hardware it runs on.
+type scaleDownCandidate struct {
+	machine           *clusterv1.Machine
+	tinkerbellMachine *infrastructurev1.TinkerbellMachine
+	hardware          *tinkv1.Hardware
+}
+
+// +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machinesets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machines,verbs=get;list;watch;update;patch
+
+// Reconcile ranks the Machines of a MachineSet and annotates the ones to delete first, as many as the
+// MachineSet is scaling down by.
+func (r *ScaleDownReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx).WithValues("machineset", req.NamespacedName)
+
+	machineSet := &clusterv1.MachineSet{}
+	if err := r.Get(ctx, req.NamespacedName, machineSet); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+
+		return ctrl.Result{}, fmt.Errorf("getting MachineSet: %w", err)
+	}
+
+	policy, err := r.scaleDownPolicy(ctx, machineSet)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	candidates, err := r.candidates(ctx, machineSet)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	selected := 0
+
+	if policy != nil && len(candidates) > 0 {
+		sort.SliceStable(candidates, byScaleDownPolicy(policy, candidates))
+		selected = scaleDownCount(machineSet, len(candidates))
+	}
+
+	names := []string{}
+
+	for i := range candidates {
+		if err := r.markCandidate(ctx, candidates[i].machine, i < selected); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		if i < selected {
+			names = append(names, candidates[i].machine.Name)
+		}
+	}
+
+	if selected > 0 {
+		log.V(4).Info("Ranked Machines first for scale-down", "machines", names) //nolint:gomnd
+	}
+
+	if policy == nil {
+		return ctrl.Result{}, nil
+	}
+
+	return ctrl.Result{RequeueAfter: scaleDownResyncInterval}, nil
+}
+
+// scaleDownCount returns the number of candidates to annotate for deletion: the number of Machines
+// the MachineSet has beyond its desired replicas. Machines of a MachineSet which is not scaling down
+// are not annotated, as CAPI deletes annotated Machines first on any later scale-down, overriding the
+// choice of the user or of an autoscaler.
+func scaleDownCount(machineSet *clusterv1.MachineSet, candidates int) int {
+	if machineSet.Spec.Replicas == nil {
+		return 0
+	}
+
+	count := int(machineSet.Status.Replicas - *machineSet.Spec.Replicas)
+	if count < 0 {
+		return 0
+	}
+
+	if count > candidates {
+		count = candidates
+	}
+
+	return count
+}
+
+// scaleDownPolicy returns the ScaleDownPolicy of the TinkerbellCluster of the MachineSet, or nil
+// if the cluster is not a Tinkerbell cluster or has no policy.
+func (r *ScaleDownReconciler) scaleDownPolicy(ctx context.Context, machineSet *clusterv1.MachineSet) (*infrastructurev1.ScaleDownPolicy, error) {
+	cluster := &clusterv1.Cluster{}
+	key := client.ObjectKey{Namespace: machineSet.Namespace, Name: machineSet.Spec.ClusterName}
+
+	if err := r.Get(ctx, key, cluster); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("getting Cluster: %w", err)
+	}
+
+	ref := cluster.Spec.InfrastructureRef
+	if ref == nil || ref.Kind != "TinkerbellCluster" {
+		return nil, nil
+	}
+
+	tinkerbellCluster := &infrastructurev1.TinkerbellCluster{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: ref.Name}, tinkerbellCluster); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("getting TinkerbellCluster: %w", err)
+	}
+
+	return tinkerbellCluster.Spec.ScaleDownPolicy, nil
+}
+
+// candidates returns the Machines of the MachineSet which are not being deleted, with their Hardware.
+// Machines whose Hardware can't be found, e.g. as their Tinkerbell stack can't be reached, are left
+// to the delete policy of the MachineSet.
+func (r *ScaleDownReconciler) candidates(ctx context.Context, machineSet *clusterv1.MachineSet) ([]scaleDownCandidate, error) {
+	machines := &clusterv1.MachineList{}
+	if err := r.List(ctx, machines, client.InNamespace(machineSet.Namespace),
+		client.MatchingLabels{clusterv1.ClusterLabelName: machineSet.Spec.ClusterName}); err != nil {
+		return nil, fmt.Errorf("listing Machines: %w", err)
+	}
+
+	candidates := []scaleDownCandidate{}
+
+	for i := range machines.Items {
+		machine := &machines.Items[i]
+
+		owner := metav1.GetControllerOf(machine)
+		if owner == nil || owner.UID != machineSet.UID || !machine.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		if machine.Spec.InfrastructureRef.Kind != "TinkerbellMachine" {
+			continue
+		}
+
+		tinkerbellMachine := &infrastructurev1.TinkerbellMachine{}
+		key := client.ObjectKey{Namespace: machine.Namespace, Name: machine.Spec.InfrastructureRef.Name}
+
+		if err := r.Get(ctx, key, tinkerbellMachine); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+
+			return nil, fmt.Errorf("getting TinkerbellMachine: %w", err)
+		}
+
+		stack, err := MachineTinkerbellStack(ctx, r.Client, r.StackClientGetter, tinkerbellMachine)
+		if err != nil {
+			ctrl.LoggerFrom(ctx).Error(err, "Getting Tinkerbell stack of machine; leaving it unranked",
+				"TinkerbellMachine", key)
+
+			continue
+		}
+
+		hardware, err := providerHardware(ctx, stack.Client, tinkerbellMachine)
+		if err != nil {
+			return nil, err
+		}
+
+		if hardware == nil {
+			continue
+		}
+
+		candidates = append(candidates, scaleDownCandidate{
+			machine:           machine,
+			tinkerbellMachine: tinkerbellMachine,
+			hardware:          hardware,
+		})
+	}
+
+	return candidates, nil
+}
+
+// providerHardware returns the Hardware of the TinkerbellMachine, located through its provider ID.
+// If the machine has no Hardware, or it can't be found, nil is returned.
+//
+//nolint:lll
+func providerHardware(ctx context.Context, c client.Client, tinkerbellMachine *infrastructurev1.TinkerbellMachine) (*tinkv1.Hardware, error) {
+	if tinkerbellMachine.Spec.HardwareName == "" {
+		return nil, nil
+	}
+
+	namespace := tinkerbellMachine.Namespace
+	if parts := strings.Split(strings.TrimPrefix(tinkerbellMachine.Spec.ProviderID, "tinkerbell://"), "/"); len(parts) == 2 { //nolint:gomnd
+		namespace = parts[0]
+	}
+
+	hardware := &tinkv1.Hardware{}
+	key := client.ObjectKey{Namespace: namespace, Name: tinkerbellMachine.Spec.HardwareName}
+
+	if err := c.Get(ctx, key, hardware); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("getting Hardware: %w", err)
+	}
+
+	return hardware, nil
+}
+
+// markCandidate sets or removes the delete-machine annotation of the Machine. The annotation is
+// only removed if it was set by the reconciler, and Machines annotated by someone else are left
+// untouched.
+func (r *ScaleDownReconciler) markCandidate(ctx context.Context, machine *clusterv1.Machine, selected bool) error {
+	_, marked := machine.Annotations[ScaleDownCandidateAnnotation]
+	if selected == marked || deletionRequested(machine) {
+		return nil
+	}
+
+	patch := client.MergeFrom(machine.DeepCopy())
+
+	if selected {
+		if machine.Annotations == nil {
+			machine.Annotations = map[string]string{}
+		}
+
+		machine.Annotations[clusterv1.DeleteMachineAnnotation] = ""
+		machine.Annotations[ScaleDownCandidateAnnotation] = ""
+	} else {
+		delete(machine.Annotations, clusterv1.DeleteMachineAnnotation)
+		delete(machine.Annotations, ScaleDownCandidateAnnotation)
+	}
+
+	if err := r.Patch(ctx, machine, patch); err != nil {
+		return fmt.Errorf("patching Machine %s: %w", machine.Name, err)
+	}
+
+	return nil
+}
+
+// deletionRequested returns true if the Machine carries the delete-machine annotation set by someone
+// other than the reconciler.
+func deletionRequested(machine *clusterv1.Machine) bool {
+	_, requested := machine.Annotations[clusterv1.DeleteMachineAnnotation]
+	_, marked := machine.Annotations[ScaleDownCandidateAnnotation]
+
+	return requested && !marked
+}
+
+// byScaleDownPolicy returns a less function ordering the candidates by the criteria of the policy,
+// the candidate to delete first ranked first. Machines whose deletion was requested by someone else
+// are ranked before all others.
+func byScaleDownPolicy(policy *infrastructurev1.ScaleDownPolicy, candidates []scaleDownCandidate) func(i, j int) bool {
+	numericGenerations := true
+	racks := map[string]int{}
+
+	for _, candidate := range candidates {
+		if _, err := strconv.ParseInt(candidate.hardware.Labels[policy.GenerationLabel], 10, 64); err != nil {
+			numericGenerations = false
+		}
+
+		racks[candidate.hardware.Labels[policy.RackLabel]]++
+	}
+
+	// compare returns a negative number if candidate a is to be deleted before b, a positive
+	// number if after, and 0 if the criterion does not tell them apart.
+	compare := func(criterion infrastructurev1.ScaleDownCriterion, a, b *scaleDownCandidate) int {
+		switch criterion {
+		case infrastructurev1.ScaleDownHardwareHealth:
+			return boolToInt(hardwareHealthy(a)) - boolToInt(hardwareHealthy(b))
+		case infrastructurev1.ScaleDownHardwareGeneration:
+			generationA := a.hardware.Labels[policy.GenerationLabel]
+			generationB := b.hardware.Labels[policy.GenerationLabel]
+
+			if numericGenerations {
+				numberA, _ := strconv.ParseInt(generationA, 10, 64)
+				numberB, _ := strconv.ParseInt(generationB, 10, 64)
+
+				return compareInt64(numberA, numberB)
+			}
+
+			return strings.Compare(generationA, generationB)
+		case infrastructurev1.ScaleDownAffinityScore:
+			return compareInt64(int64(affinityScore(a)), int64(affinityScore(b)))
+		case infrastructurev1.ScaleDownRackSpread:
+			rackA := a.hardware.Labels[policy.RackLabel]
+			rackB := b.hardware.Labels[policy.RackLabel]
+
+			return racks[rackB] - racks[rackA]
+		default:
+			return 0
+		}
+	}
+
+	return func(i, j int) bool {
+		if requestedI, requestedJ := deletionRequested(candidates[i].machine),
+			deletionRequested(candidates[j].machine); requestedI != requestedJ {
+			return requestedI
+		}
+
+		for _, criterion := range policy.Criteria {
+			if c := compare(criterion, &candidates[i], &candidates[j]); c != 0 {
+				return c < 0
+			}
+		}
+
+		// just give a consistent ordering so the same machine is picked while nothing changes
+		return candidates[i].machine.Name < candidates[j].machine.Name
+	}
+}
+
+// hardwareHealthy returns false if the BMC reports a fault of the Hardware of the candidate.
+func hardwareHealthy(candidate *scaleDownCandidate) bool {
+	for _, condition := range hardwareHealthConditions {
+		if conditions.IsFalse(candidate.tinkerbellMachine, condition) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// affinityScore sums the weights of the preferred hardware affinity terms of the TinkerbellMachine
+// matched by its Hardware.
+func affinityScore(candidate *scaleDownCandidate) int32 {
+	affinity := candidate.tinkerbellMachine.Spec.HardwareAffinity
+	if affinity == nil {
+		return 0
+	}
+
+	var score int32
+
+	for _, term := range affinity.Preferred {
+		selector, err := metav1.LabelSelectorAsSelector(&term.HardwareAffinityTerm.LabelSelector)
+		if err != nil {
+			continue
+		}
+
+		if selector.Matches(labels.Set(candidate.hardware.Labels)) {
+			score += term.Weight
+		}
+	}
+
+	return score
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// SetupWithManager configures reconciler with a given manager.
+func (r *ScaleDownReconciler) SetupWithManager(ctx context.Context, mgr ctrl.Manager, options controller.Options) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	if r.StackClientGetter == nil {
+		r.StackClientGetter = NewCachingStackClientGetter(mgr.GetScheme())
+	}
+
+	builder := ctrl.NewControllerManagedBy(mgr).
+		Named("scaledown").
+		WithOptions(options).
+		WithEventFilter(predicates.ResourceNotPausedAndHasFilterLabel(log, r.WatchFilterValue)).
+		For(&clusterv1.MachineSet{}).
+		Owns(&clusterv1.Machine{}).
+		Watches(
+			&source.Kind{Type: &infrastructurev1.TinkerbellCluster{}},
+			handler.EnqueueRequestsFromMapFunc(r.tinkerbellClusterToMachineSets(ctx)),
+		)
+
+	if err := builder.Complete(r); err != nil {
+		return fmt.Errorf("failed to create controller: %w", err)
+	}
+
+	return nil
+}
+
+// tinkerbellClusterToMachineSets maps a TinkerbellCluster to the MachineSets of its cluster, so
+// policy changes apply immediately.
+func (r *ScaleDownReconciler) tinkerbellClusterToMachineSets(ctx context.Context) handler.MapFunc {
+	log := ctrl.LoggerFrom(ctx)
+
+	return func(o client.Object) []ctrl.Request {
+		clusterName := o.GetLabels()[clusterv1.ClusterLabelName]
+		if clusterName == "" {
+			return nil
+		}
+
+		machineSets := &clusterv1.MachineSetList{}
+		if err := r.List(ctx, machineSets, client.InNamespace(o.GetNamespace()),
+			client.MatchingLabels{clusterv1.ClusterLabelName: clusterName}); err != nil {
+			log.Error(err, "failed to list MachineSets for TinkerbellCluster")
+
+			return nil
+		}
+
+		requests := make([]ctrl.Request, 0, len(machineSets.Items))
+		for i := range machineSets.Items {
+			requests = append(requests, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(&machineSets.Items[i])})
+		}
+
+		return requests
+	}
+}
@@ -0,0 +1,324 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/controllers"
+)
+
+// scaleDownMachine describes a Machine of the MachineSet and the labels of its Hardware.
+type scaleDownMachine struct {
+	hardwareLabels map[string]string
+	faulty         bool
+}
+
+//nolint:funlen
+func scaleDownObjects(policy *infrastructurev1.ScaleDownPolicy, machines map[string]scaleDownMachine) []runtime.Object {
+	// The MachineSet is scaling down by one Machine.
+	machineSet := &clusterv1.MachineSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "workers",
+			Namespace: clusterNamespace,
+			UID:       "workers-uid",
+			Labels:    map[string]string{clusterv1.ClusterLabelName: clusterName},
+		},
+		Spec: clusterv1.MachineSetSpec{
+			ClusterName: clusterName,
+			Replicas:    pointer.Int32(int32(len(machines) - 1)),
+		},
+		Status: clusterv1.MachineSetStatus{Replicas: int32(len(machines))},
+	}
+
+	cluster := validCluster(clusterName, clusterNamespace)
+	cluster.Spec.InfrastructureRef.Kind = "TinkerbellCluster"
+
+	tinkerbellCluster := validTinkerbellCluster(clusterName, clusterNamespace)
+	tinkerbellCluster.Spec.ScaleDownPolicy = policy
+
+	controller := true
+	objects := []runtime.Object{machineSet, cluster, tinkerbellCluster}
+
+	for name, m := range machines {
+		machine := validMachine(name, clusterNamespace, clusterName)
+		machine.Spec.ClusterName = clusterName
+		machine.Spec.InfrastructureRef = corev1.ObjectReference{Kind: "TinkerbellMachine", Name: name}
+		machine.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: clusterv1.GroupVersion.String(),
+			Kind:       "MachineSet",
+			Name:       machineSet.Name,
+			UID:        machineSet.UID,
+			Controller: &controller,
+		}}
+
+		hardwareName := "hw-" + name
+
+		tinkerbellMachine := validTinkerbellMachine(name, clusterNamespace, name, uuid.New().String())
+		tinkerbellMachine.Spec.HardwareName = hardwareName
+		tinkerbellMachine.Spec.ProviderID = fmt.Sprintf("tinkerbell://%s/%s", clusterNamespace, hardwareName)
+		tinkerbellMachine.Spec.HardwareAffinity = &infrastructurev1.HardwareAffinity{
+			Preferred: []infrastructurev1.WeightedHardwareAffinityTerm{{
+				Weight: 10,
+				HardwareAffinityTerm: infrastructurev1.HardwareAffinityTerm{
+					LabelSelector: metav1.LabelSelector{MatchLabels: map[string]string{"nvme": "true"}},
+				},
+			}},
+		}
+
+		if m.faulty {
+			conditions.MarkFalse(tinkerbellMachine, infrastructurev1.MemoryHealthyCondition,
+				infrastructurev1.MemoryFaultReason, clusterv1.ConditionSeverityError, "ECC errors")
+		}
+
+		objects = append(objects, machine, tinkerbellMachine,
+			validHardware(hardwareName, uuid.New().String(), hardwareIP, testOptions{Labels: m.hardwareLabels}))
+	}
+
+	return objects
+}
+
+func Test_Scale_down_ranks_machines_by_hardware(t *testing.T) {
+	t.Parallel()
+
+	machines := map[string]scaleDownMachine{
+		"m-0": {hardwareLabels: map[string]string{"generation": "10", "rack": "a", "nvme": "true"}},
+		"m-1": {hardwareLabels: map[string]string{"generation": "9", "rack": "b", "nvme": "true"}},
+		"m-2": {hardwareLabels: map[string]string{"generation": "10", "rack": "a"}},
+		"m-3": {hardwareLabels: map[string]string{"generation": "11", "rack": "c", "nvme": "true"}, faulty: true},
+	}
+
+	for name, c := range map[string]struct {
+		criteria []infrastructurev1.ScaleDownCriterion
+		expected string
+	}{
+		"hardware_health": {
+			criteria: []infrastructurev1.ScaleDownCriterion{infrastructurev1.ScaleDownHardwareHealth},
+			expected: "m-3",
+		},
+		"hardware_generation": {
+			criteria: []infrastructurev1.ScaleDownCriterion{infrastructurev1.ScaleDownHardwareGeneration},
+			expected: "m-1",
+		},
+		"affinity_score": {
+			criteria: []infrastructurev1.ScaleDownCriterion{infrastructurev1.ScaleDownAffinityScore},
+			expected: "m-2",
+		},
+		"rack_spread_then_affinity_score": {
+			criteria: []infrastructurev1.ScaleDownCriterion{
+				infrastructurev1.ScaleDownRackSpread,
+				infrastructurev1.ScaleDownAffinityScore,
+			},
+			expected: "m-2",
+		},
+	} {
+		c := c
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			g := NewWithT(t)
+
+			policy := &infrastructurev1.ScaleDownPolicy{
+				Criteria:        c.criteria,
+				GenerationLabel: "generation",
+				RackLabel:       "rack",
+			}
+
+			kubeClient := kubernetesClientWithObjects(t, scaleDownObjects(policy, machines))
+			reconciler := &controllers.ScaleDownReconciler{Client: kubeClient}
+			request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "workers", Namespace: clusterNamespace}}
+
+			result, err := reconciler.Reconcile(context.Background(), request)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(result.RequeueAfter).To(BeNumerically(">", 0))
+
+			for name := range machines {
+				machine := &clusterv1.Machine{}
+				g.Expect(kubeClient.Get(context.Background(),
+					types.NamespacedName{Name: name, Namespace: clusterNamespace}, machine)).To(Succeed())
+
+				if name == c.expected {
+					g.Expect(machine.Annotations).To(HaveKey(clusterv1.DeleteMachineAnnotation), "Machine %s", name)
+				} else {
+					g.Expect(machine.Annotations).NotTo(HaveKey(clusterv1.DeleteMachineAnnotation), "Machine %s", name)
+				}
+			}
+
+			// Removing the policy removes the annotation.
+			tinkerbellCluster := &infrastructurev1.TinkerbellCluster{}
+			g.Expect(kubeClient.Get(context.Background(),
+				types.NamespacedName{Name: clusterName, Namespace: clusterNamespace}, tinkerbellCluster)).To(Succeed())
+			tinkerbellCluster.Spec.ScaleDownPolicy = nil
+			g.Expect(kubeClient.Update(context.Background(), tinkerbellCluster)).To(Succeed())
+
+			_, err = reconciler.Reconcile(context.Background(), request)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			machine := &clusterv1.Machine{}
+			g.Expect(kubeClient.Get(context.Background(),
+				types.NamespacedName{Name: c.expected, Namespace: clusterNamespace}, machine)).To(Succeed())
+			g.Expect(machine.Annotations).NotTo(HaveKey(clusterv1.DeleteMachineAnnotation))
+		})
+	}
+}
+
+func Test_Scale_down_annotates_machines_beyond_replicas(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	machines := map[string]scaleDownMachine{
+		"m-0": {hardwareLabels: map[string]string{"generation": "10"}},
+		"m-1": {hardwareLabels: map[string]string{"generation": "9"}},
+		"m-2": {hardwareLabels: map[string]string{"generation": "11"}},
+		"m-3": {hardwareLabels: map[string]string{"generation": "11"}, faulty: true},
+	}
+
+	policy := &infrastructurev1.ScaleDownPolicy{
+		Criteria: []infrastructurev1.ScaleDownCriterion{
+			infrastructurev1.ScaleDownHardwareHealth,
+			infrastructurev1.ScaleDownHardwareGeneration,
+		},
+		GenerationLabel: "generation",
+	}
+
+	kubeClient := kubernetesClientWithObjects(t, scaleDownObjects(policy, machines))
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "workers", Namespace: clusterNamespace}}
+
+	// The MachineSet is scaled from 4 to 2 replicas.
+	machineSet := &clusterv1.MachineSet{}
+	g.Expect(kubeClient.Get(context.Background(), request.NamespacedName, machineSet)).To(Succeed())
+	machineSet.Spec.Replicas = pointer.Int32(2)
+	machineSet.Status.Replicas = 4
+	g.Expect(kubeClient.Update(context.Background(), machineSet)).To(Succeed())
+
+	reconciler := &controllers.ScaleDownReconciler{Client: kubeClient}
+	_, err := reconciler.Reconcile(context.Background(), request)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	annotated := []string{}
+
+	for name := range machines {
+		machine := &clusterv1.Machine{}
+		g.Expect(kubeClient.Get(context.Background(),
+			types.NamespacedName{Name: name, Namespace: clusterNamespace}, machine)).To(Succeed())
+
+		if _, ok := machine.Annotations[clusterv1.DeleteMachineAnnotation]; ok {
+			annotated = append(annotated, name)
+		}
+	}
+
+	g.Expect(annotated).To(ConsistOf("m-3", "m-1"))
+}
+
+func Test_Scale_down_leaves_machines_alone_without_scale_down(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	machines := map[string]scaleDownMachine{
+		"m-0": {hardwareLabels: map[string]string{"generation": "10"}},
+		"m-1": {hardwareLabels: map[string]string{"generation": "9"}},
+	}
+
+	policy := &infrastructurev1.ScaleDownPolicy{
+		Criteria:        []infrastructurev1.ScaleDownCriterion{infrastructurev1.ScaleDownHardwareGeneration},
+		GenerationLabel: "generation",
+	}
+
+	kubeClient := kubernetesClientWithObjects(t, scaleDownObjects(policy, machines))
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "workers", Namespace: clusterNamespace}}
+
+	// The MachineSet has as many Machines as it wants.
+	machineSet := &clusterv1.MachineSet{}
+	g.Expect(kubeClient.Get(context.Background(), request.NamespacedName, machineSet)).To(Succeed())
+	machineSet.Spec.Replicas = pointer.Int32(2)
+	g.Expect(kubeClient.Update(context.Background(), machineSet)).To(Succeed())
+
+	reconciler := &controllers.ScaleDownReconciler{Client: kubeClient}
+	_, err := reconciler.Reconcile(context.Background(), request)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	for name := range machines {
+		machine := &clusterv1.Machine{}
+		g.Expect(kubeClient.Get(context.Background(),
+			types.NamespacedName{Name: name, Namespace: clusterNamespace}, machine)).To(Succeed())
+		g.Expect(machine.Annotations).NotTo(HaveKey(clusterv1.DeleteMachineAnnotation), "Machine %s", name)
+	}
+}
+
+func Test_Scale_down_ranks_machines_annotated_by_the_user_first(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	machines := map[string]scaleDownMachine{
+		"m-0": {hardwareLabels: map[string]string{"generation": "10"}},
+		"m-1": {hardwareLabels: map[string]string{"generation": "9"}},
+		"m-2": {hardwareLabels: map[string]string{"generation": "11"}},
+	}
+
+	policy := &infrastructurev1.ScaleDownPolicy{
+		Criteria:        []infrastructurev1.ScaleDownCriterion{infrastructurev1.ScaleDownHardwareGeneration},
+		GenerationLabel: "generation",
+	}
+
+	objects := scaleDownObjects(policy, machines)
+
+	for _, object := range objects {
+		if machine, ok := object.(*clusterv1.Machine); ok && machine.Name == "m-2" {
+			machine.Annotations = map[string]string{clusterv1.DeleteMachineAnnotation: "yes"}
+		}
+	}
+
+	kubeClient := kubernetesClientWithObjects(t, objects)
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "workers", Namespace: clusterNamespace}}
+	reconciler := &controllers.ScaleDownReconciler{Client: kubeClient}
+
+	// The Machine annotated by the user takes the only slot of the scale-down.
+	_, err := reconciler.Reconcile(context.Background(), request)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	machine := &clusterv1.Machine{}
+	g.Expect(kubeClient.Get(context.Background(),
+		types.NamespacedName{Name: "m-1", Namespace: clusterNamespace}, machine)).To(Succeed())
+	g.Expect(machine.Annotations).NotTo(HaveKey(clusterv1.DeleteMachineAnnotation))
+
+	// Its annotation is kept, without being taken over, once the scale-down is over.
+	machineSet := &clusterv1.MachineSet{}
+	g.Expect(kubeClient.Get(context.Background(), request.NamespacedName, machineSet)).To(Succeed())
+	machineSet.Status.Replicas = 2
+	g.Expect(kubeClient.Update(context.Background(), machineSet)).To(Succeed())
+
+	_, err = reconciler.Reconcile(context.Background(), request)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(kubeClient.Get(context.Background(),
+		types.NamespacedName{Name: "m-2", Namespace: clusterNamespace}, machine)).To(Succeed())
+	g.Expect(machine.Annotations).To(Equal(map[string]string{clusterv1.DeleteMachineAnnotation: "yes"}))
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/internal/templates"
+)
+
+// TemplateSecretsLabel is set on Templates and Workflows holding values of Secrets referenced by
+// the TemplateOverride of their machine. Tools collecting these objects must treat them as secret.
+const TemplateSecretsLabel = "v1alpha1.tinkerbell.org/containsSecrets"
+
+// ErrTemplateSecretKeyMissing is returned when a Secret referenced by a template lacks the key.
+var ErrTemplateSecretKeyMissing = fmt.Errorf("secret key referenced by template is missing")
+
+// resolveTemplateSecrets resolves the Secret values referenced by the template data from the
+// namespace of the TinkerbellMachine, and records the referenced Secrets in its status.
+func (mrc *machineReconcileContext) resolveTemplateSecrets(data string) (string, error) {
+	refs := templates.SecretReferences(data)
+	if len(refs) == 0 {
+		return data, nil
+	}
+
+	resolved, err := templates.ResolveSecrets(data, func(ref templates.SecretReference) (string, error) {
+		secret := &corev1.Secret{}
+		key := client.ObjectKey{Namespace: mrc.tinkerbellMachine.Namespace, Name: ref.Name}
+
+		if err := mrc.client.Get(mrc.ctx, key, secret); err != nil {
+			return "", fmt.Errorf("getting Secret %s referenced by template: %w", ref.Name, err)
+		}
+
+		value, ok := secret.Data[ref.Key]
+		if !ok {
+			return "", fmt.Errorf("%w: %s/%s", ErrTemplateSecretKeyMissing, ref.Name, ref.Key)
+		}
+
+		return string(value), nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("resolving template secrets: %w", err)
+	}
+
+	now := metav1.Now()
+	names := []string{}
+	mrc.tinkerbellMachine.Status.TemplateSecrets = nil
+
+	for _, ref := range refs {
+		mrc.tinkerbellMachine.Status.TemplateSecrets = append(mrc.tinkerbellMachine.Status.TemplateSecrets,
+			infrastructurev1.TemplateSecretReference{Name: ref.Name, Key: ref.Key, ResolvedAt: now})
+		names = append(names, ref.Name+"/"+ref.Key)
+	}
+
+	mrc.log.Info("Resolved Secrets into Template", "secrets", names)
+
+	return resolved, nil
+}
+
+// templateHoldsSecrets returns true if the Template of the machine was rendered with Secret values.
+func (mrc *machineReconcileContext) templateHoldsSecrets() bool {
+	return len(mrc.tinkerbellMachine.Status.TemplateSecrets) > 0
+}
+
+// removeSecretTemplate deletes the Template of the machine once its workflow completed, if it
+// holds Secret values. The Template is not needed anymore, as the workflow has been rendered.
+func (mrc *machineReconcileContext) removeSecretTemplate() error {
+	if !mrc.templateHoldsSecrets() {
+		return nil
+	}
+
+	template := &tinkv1.Template{}
+	template.Name = mrc.tinkerbellMachine.Name
+	template.Namespace = mrc.tinkNamespace
+
+	if err := mrc.tinkClient.Delete(mrc.ctx, template); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("deleting Template holding Secrets: %w", err)
+	}
+
+	return nil
+}
+
+// removeSecretWorkflow deletes the workflow of the machine once provisioning completed, if its
+// Template held Secret values, as tink renders them into the tasks of the workflow status.
+func (mrc *machineReconcileContext) removeSecretWorkflow() error {
+	if !mrc.templateHoldsSecrets() {
+		return nil
+	}
+
+	workflow := &tinkv1.Workflow{}
+	workflow.Name = mrc.tinkerbellMachine.Name
+	workflow.Namespace = mrc.tinkNamespace
+
+	if err := mrc.tinkClient.Delete(mrc.ctx, workflow); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("deleting Workflow holding Secrets: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	capierrors "sigs.k8s.io/cluster-api/errors"
+	"sigs.k8s.io/cluster-api/util/conditions"
+
+	rufiov1 "github.com/tinkerbell/rufio/api/v1alpha1"
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+)
+
+// provisioningPhase is a phase of machine provisioning which can time out.
+type provisioningPhase struct {
+	name    string
+	reason  string
+	timeout func(*infrastructurev1.ProvisioningTimeouts) *metav1.Duration
+}
+
+//nolint:gochecknoglobals
+var (
+	allocationPhase = provisioningPhase{
+		name:    "allocation",
+		reason:  infrastructurev1.AllocationTimeoutReason,
+		timeout: func(t *infrastructurev1.ProvisioningTimeouts) *metav1.Duration { return t.Allocation },
+	}
+	powerOnPhase = provisioningPhase{
+		name:    "power-on",
+		reason:  infrastructurev1.PowerOnTimeoutReason,
+		timeout: func(t *infrastructurev1.ProvisioningTimeouts) *metav1.Duration { return t.PowerOn },
+	}
+	workflowStartPhase = provisioningPhase{
+		name:    "workflow start",
+		reason:  infrastructurev1.WorkflowStartTimeoutReason,
+		timeout: func(t *infrastructurev1.ProvisioningTimeouts) *metav1.Duration { return t.WorkflowStart },
+	}
+	workflowRunPhase = provisioningPhase{
+		name:    "workflow run",
+		reason:  infrastructurev1.WorkflowRunTimeoutReason,
+		timeout: func(t *infrastructurev1.ProvisioningTimeouts) *metav1.Duration { return t.WorkflowRun },
+	}
+)
+
+// errRequeueAfter requests the reconciliation to be repeated after the given duration.
+type errRequeueAfter struct {
+	after time.Duration
+}
+
+func (e *errRequeueAfter) Error() string {
+	return fmt.Sprintf("requeue requested after %s", e.after)
+}
+
+// earliestRequeue returns err, unless err is nil or requests a later requeue than after.
+func earliestRequeue(err error, after time.Duration) error {
+	if after <= 0 {
+		return err
+	}
+
+	requeue := &errRequeueAfter{}
+	if err == nil || (errors.As(err, &requeue) && requeue.after > after) {
+		return &errRequeueAfter{after: after}
+	}
+
+	return err
+}
+
+// phaseTimeout returns the timeout configured for the phase, or nil if the phase may take forever.
+func (mrc *machineReconcileContext) phaseTimeout(phase provisioningPhase) *metav1.Duration {
+	if mrc.tinkerbellMachine.Spec.ProvisioningTimeouts == nil {
+		return nil
+	}
+
+	return phase.timeout(mrc.tinkerbellMachine.Spec.ProvisioningTimeouts)
+}
+
+// phaseExpired returns true if the phase which started at since has exceeded its timeout.
+func (mrc *machineReconcileContext) phaseExpired(phase provisioningPhase, since time.Time) bool {
+	timeout := mrc.phaseTimeout(phase)
+
+	return timeout != nil && !since.IsZero() && time.Since(since) >= timeout.Duration
+}
+
+// checkPhaseTimeout fails provisioning if the phase which started at since has exceeded its timeout.
+// While the phase has time left, errRequeueAfter is returned, so the timeout is checked again when
+// it expires even if nothing else triggers a reconciliation.
+func (mrc *machineReconcileContext) checkPhaseTimeout(phase provisioningPhase, since time.Time) error {
+	timeout := mrc.phaseTimeout(phase)
+	if timeout == nil || since.IsZero() {
+		return nil
+	}
+
+	if mrc.phaseExpired(phase, since) {
+		return mrc.failProvisioning(phase.name, phase.reason,
+			fmt.Sprintf("%s did not complete within %s", phase.name, timeout.Duration))
+	}
+
+	return &errRequeueAfter{after: time.Until(since.Add(timeout.Duration))}
+}
+
+// checkProvisioningTimeouts checks the timeout of the phase the provisioning is in, given the BMC
+// Job powering the Hardware on, if any, and the workflow.
+func (mrc *machineReconcileContext) checkProvisioningTimeouts(job *rufiov1.Job, wf *tinkv1.Workflow) error {
+	if job != nil && !job.HasCondition(rufiov1.JobCompleted, rufiov1.ConditionTrue) {
+		return mrc.checkPhaseTimeout(powerOnPhase, job.CreationTimestamp.Time)
+	}
+
+	if startedAt := wf.GetStartTime(); startedAt != nil {
+		return mrc.checkPhaseTimeout(workflowRunPhase, startedAt.Time)
+	}
+
+	// tink-worker can only pick the workflow up once the Hardware has been powered on into PXE.
+	since := wf.CreationTimestamp.Time
+	if job != nil && job.Status.CompletionTime != nil && job.Status.CompletionTime.Time.After(since) {
+		since = job.Status.CompletionTime.Time
+	}
+
+	return mrc.checkPhaseTimeout(workflowStartPhase, since)
+}
+
+// failProvisioning records the failed provisioning step in the TinkerbellMachine status. If the
+// machine asks to be held on failure, it is held instead of failed.
+func (mrc *machineReconcileContext) failProvisioning(step, reason, message string) error {
+	conditions.MarkFalse(mrc.tinkerbellMachine, infrastructurev1.ProvisionedCondition, reason,
+		clusterv1.ConditionSeverityError, message)
+
+	if mrc.holdRequested() {
+		return mrc.hold(step, message)
+	}
+
+	mrc.log.Info("Provisioning failed", "step", step, "reason", message)
+
+	errorReason := capierrors.CreateMachineError
+	mrc.tinkerbellMachine.Status.ErrorReason = &errorReason
+	mrc.tinkerbellMachine.Status.ErrorMessage = &message
+
+	return nil
+}
+
+// provisioningFailed returns true if provisioning failed and must not be retried.
+func (mrc *machineReconcileContext) provisioningFailed() bool {
+	return mrc.tinkerbellMachine.Status.ErrorReason != nil
+}
@@ -19,7 +19,10 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"strings"
 
 	"github.com/go-logr/logr"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -33,6 +36,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
@@ -45,6 +49,10 @@ import (
 type TinkerbellClusterReconciler struct {
 	client.Client
 	WatchFilterValue string
+
+	// HardwareOwnershipMigrator migrates legacy Hardware ownership markers. If set, Hardware is only
+	// reserved once it migrated Hardware, and never if it carries a legacy owner name label.
+	HardwareOwnershipMigrator *HardwareOwnershipMigrator
 }
 
 // validate validates if context configuration has all required fields properly populated.
@@ -81,6 +89,7 @@ func (tcr *TinkerbellClusterReconciler) newReconcileContext(ctx context.Context,
 		tinkerbellCluster: &infrastructurev1.TinkerbellCluster{},
 		client:            tcr.Client,
 		namespacedName:    namespacedName,
+		ownershipMigrator: tcr.HardwareOwnershipMigrator,
 	}
 
 	if err := crc.client.Get(crc.ctx, namespacedName, crc.tinkerbellCluster); err != nil {
@@ -125,6 +134,7 @@ type clusterReconcileContext struct {
 	log               logr.Logger
 	client            client.Client
 	namespacedName    types.NamespacedName
+	ownershipMigrator *HardwareOwnershipMigrator
 }
 
 const (
@@ -142,6 +152,13 @@ const (
 	// ClusterNamespaceLabel is used to mark in which Namespace hardware is used.
 	ClusterNamespaceLabel = "v1alpha1.tinkerbell.org/clusterNamespace"
 
+	// HardwareQuarantinedLabel is set by CAPT controllers on hardware released from a Node which was
+	// flagged as faulty. Quarantined hardware is never selected for new machines.
+	HardwareQuarantinedLabel = "v1alpha1.tinkerbell.org/quarantined"
+
+	// HardwareQuarantineReasonAnnotation records why hardware has been quarantined.
+	HardwareQuarantineReasonAnnotation = "v1alpha1.tinkerbell.org/quarantineReason"
+
 	// KubernetesAPIPort is a port used by Tinkerbell clusters for Kubernetes API.
 	KubernetesAPIPort = 6443
 )
@@ -160,6 +177,9 @@ var (
 	// ErrHardwareFirstInterfaceDHCPMissingIP is the error returned when the referenced hardware does not have a
 	// DHCP IP address assigned for it's first interface.
 	ErrHardwareFirstInterfaceDHCPMissingIP = fmt.Errorf("hardware's first interface has no DHCP IP address defined")
+	// ErrHardwareInvalidIP is returned when hardware has an interface address which is neither an
+	// IPv4 nor an IPv6 address.
+	ErrHardwareInvalidIP = fmt.Errorf("hardware has an invalid IP address")
 	// ErrClusterNotReady is returned when trying to reconcile prior to the Cluster resource being ready.
 	ErrClusterNotReady = fmt.Errorf("cluster resource not ready")
 	// ErrControlPlaneEndpointNotSet is returned when trying to reconcile when the ControlPlane Endpoint is not defined.
@@ -187,10 +207,71 @@ func hardwareIP(hardware *tinkv1.Hardware) (string, error) {
 		return "", ErrHardwareFirstInterfaceDHCPMissingIP
 	}
 
-	return hardware.Spec.Interfaces[0].DHCP.IP.Address, nil
+	return canonicalIP(hardware.Spec.Interfaces[0].DHCP.IP.Address)
 }
 
+// hardwareIPs returns the DHCP addresses of all interfaces of the hardware, the address of the
+// first interface first. Dual-stack hardware lists an interface per address family.
+func hardwareIPs(hardware *tinkv1.Hardware) ([]string, error) {
+	primary, err := hardwareIP(hardware)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := []string{primary}
+	seen := map[string]bool{primary: true}
+
+	for _, iface := range hardware.Spec.Interfaces[1:] {
+		if iface.DHCP == nil || iface.DHCP.IP == nil || iface.DHCP.IP.Address == "" {
+			continue
+		}
+
+		ip, err := canonicalIP(iface.DHCP.IP.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		if !seen[ip] {
+			seen[ip] = true
+
+			ips = append(ips, ip)
+		}
+	}
+
+	return ips, nil
+}
+
+// canonicalIP returns the IPv4 or IPv6 address, which may be enclosed in brackets, in its
+// canonical form.
+func canonicalIP(address string) (string, error) {
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(address, "["), "]"))
+	if ip == nil {
+		return "", fmt.Errorf("%w: %q", ErrHardwareInvalidIP, address)
+	}
+
+	return ip.String(), nil
+}
+
+// endpointHost returns the host without the brackets enclosing IPv6 addresses, which are added
+// back when the host is joined with a port. IP addresses are returned in canonical form.
+func endpointHost(host string) string {
+	if ip, err := canonicalIP(host); err == nil {
+		return ip
+	}
+
+	return host
+}
+
+// controlPlaneEndpoint returns the control plane endpoint of the cluster. An IPv6 host is returned
+// without brackets, as expected by Cluster API.
 func (crc *clusterReconcileContext) controlPlaneEndpoint() (clusterv1.APIEndpoint, error) {
+	endpoint, err := crc.configuredControlPlaneEndpoint()
+	endpoint.Host = endpointHost(endpoint.Host)
+
+	return endpoint, err
+}
+
+func (crc *clusterReconcileContext) configuredControlPlaneEndpoint() (clusterv1.APIEndpoint, error) {
 	switch {
 	case crc.tinkerbellCluster.Spec.ControlPlaneEndpoint.IsValid():
 		// If the ControlPlaneEndpoint on tinkCluster is already configured, return it.
@@ -240,6 +321,19 @@ func (crc *clusterReconcileContext) reconcile() error {
 	crc.tinkerbellCluster.Spec.ControlPlaneEndpoint.Host = controlPlaneEndpoint.Host
 	crc.tinkerbellCluster.Spec.ControlPlaneEndpoint.Port = controlPlaneEndpoint.Port
 
+	crc.tinkerbellCluster.Status.FailureDomains = failureDomains(crc.tinkerbellCluster)
+
+	if err := crc.reconcileTopologyClaims(); err != nil {
+		return err
+	}
+
+	reserveErr := crc.reconcileRemediationReserve()
+
+	requeue := &errRequeueAfter{}
+	if reserveErr != nil && !errors.As(reserveErr, &requeue) {
+		return reserveErr
+	}
+
 	crc.tinkerbellCluster.Status.Ready = true
 
 	crc.log.Info("Setting cluster status to ready")
@@ -248,10 +342,43 @@ func (crc *clusterReconcileContext) reconcile() error {
 		return fmt.Errorf("patching cluster object: %w", err)
 	}
 
-	return nil
+	return reserveErr
+}
+
+// failureDomains returns the failure domains of the TinkerbellCluster in the form expected by
+// ClusterAPI for placing Machines.
+func failureDomains(tinkerbellCluster *infrastructurev1.TinkerbellCluster) clusterv1.FailureDomains {
+	if len(tinkerbellCluster.Spec.FailureDomains) == 0 {
+		return nil
+	}
+
+	domains := clusterv1.FailureDomains{}
+
+	for _, fd := range tinkerbellCluster.Spec.FailureDomains {
+		domains[fd.Name] = clusterv1.FailureDomainSpec{
+			ControlPlane: fd.ControlPlane,
+			Attributes:   fd.Attributes,
+		}
+	}
+
+	return domains
 }
 
 func (crc *clusterReconcileContext) reconcileDelete() error {
+	if !controllerutil.ContainsFinalizer(crc.tinkerbellCluster, infrastructurev1.ClusterFinalizer) {
+		return nil
+	}
+
+	if err := crc.releaseRemediationReserve(); err != nil {
+		return err
+	}
+
+	controllerutil.RemoveFinalizer(crc.tinkerbellCluster, infrastructurev1.ClusterFinalizer)
+
+	if err := crc.patchHelper.Patch(crc.ctx, crc.tinkerbellCluster); err != nil {
+		return fmt.Errorf("patching cluster object: %w", err)
+	}
+
 	return nil
 }
 
@@ -292,7 +419,14 @@ func (tcr *TinkerbellClusterReconciler) Reconcile(ctx context.Context, req ctrl.
 		return ctrl.Result{}, nil
 	}
 
-	return ctrl.Result{}, crc.reconcile()
+	err = crc.reconcile()
+
+	requeueAfter := &errRequeueAfter{}
+	if errors.As(err, &requeueAfter) {
+		return ctrl.Result{RequeueAfter: requeueAfter.after}, nil
+	}
+
+	return ctrl.Result{}, err
 }
 
 // SetupWithManager configures reconciler with a given manager.
@@ -319,6 +453,10 @@ func (tcr *TinkerbellClusterReconciler) SetupWithManager(
 			&source.Kind{Type: &clusterv1.Cluster{}},
 			handler.EnqueueRequestsFromMapFunc(mapper),
 			builder.WithPredicates(predicates.ClusterUnpaused(log)),
+		).
+		Watches(
+			&source.Kind{Type: &infrastructurev1.TinkerbellMachine{}},
+			handler.EnqueueRequestsFromMapFunc(tcr.tinkerbellMachineToTinkerbellCluster),
 		)
 
 	if err := builder.Complete(tcr); err != nil {
@@ -23,6 +23,7 @@ import (
 	"github.com/google/uuid"
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
@@ -30,6 +31,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 
+	rufiov1 "github.com/tinkerbell/rufio/api/v1alpha1"
 	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
 
 	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
@@ -100,6 +102,108 @@ func Test_Cluster_reconciliation_when_controlplane_endpoint_set_on_cluster(t *te
 	g.Expect(updatedTinkerbellCluster.Status.Ready).To(BeTrue(), "Expected infrastructure to be ready")
 }
 
+func Test_Cluster_reconciliation_publishes_failure_domains(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	tinkCluster := validTinkerbellCluster(clusterName, clusterNamespace)
+	tinkCluster.Spec.FailureDomains = []infrastructurev1.TinkerbellFailureDomain{
+		{Name: "rack-a", ControlPlane: true},
+		{Name: "rack-b", Attributes: map[string]string{"power": "feed-2"}},
+	}
+
+	objects := []runtime.Object{
+		validCluster(clusterName, clusterNamespace),
+		tinkCluster,
+	}
+
+	client := kubernetesClientWithObjects(t, objects)
+
+	_, err := reconcileClusterWithClient(client, clusterName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	updatedTinkerbellCluster := &infrastructurev1.TinkerbellCluster{}
+	namespacedName := types.NamespacedName{Name: clusterName, Namespace: clusterNamespace}
+
+	g.Expect(client.Get(context.Background(), namespacedName, updatedTinkerbellCluster)).To(Succeed())
+	g.Expect(updatedTinkerbellCluster.Status.FailureDomains).To(Equal(clusterv1.FailureDomains{
+		"rack-a": {ControlPlane: true},
+		"rack-b": {Attributes: map[string]string{"power": "feed-2"}},
+	}))
+}
+
+//nolint:funlen
+func Test_Cluster_reconciliation_fills_remediation_reserve(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	spare := testOptions{Labels: map[string]string{"pool": "spare"}}
+
+	tinkCluster := validTinkerbellCluster(clusterName, clusterNamespace)
+	tinkCluster.Spec.RemediationReserve = &infrastructurev1.RemediationReserve{
+		Size: 2,
+		HardwareAffinity: &infrastructurev1.HardwareAffinity{
+			Required: []infrastructurev1.HardwareAffinityTerm{
+				{LabelSelector: metav1.LabelSelector{MatchLabels: map[string]string{"pool": "spare"}}},
+			},
+		},
+	}
+
+	objects := []runtime.Object{
+		validCluster(clusterName, clusterNamespace),
+		tinkCluster,
+		validHardware("spare-0", uuid.New().String(), "10.0.0.10", spare),
+		validHardware("spare-1", uuid.New().String(), "10.0.0.11", spare),
+		validHardware("spare-2", uuid.New().String(), "10.0.0.12", spare),
+		validHardware("other-0", uuid.New().String(), "10.0.0.13"),
+	}
+
+	kubeClient := kubernetesClientWithObjects(t, objects)
+
+	result, err := reconcileClusterWithClient(kubeClient, clusterName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(BeNumerically(">", 0), "Expected the reserve to be checked for refills")
+
+	updated := &infrastructurev1.TinkerbellCluster{}
+	key := types.NamespacedName{Name: clusterName, Namespace: clusterNamespace}
+
+	g.Expect(kubeClient.Get(context.Background(), key, updated)).To(Succeed())
+	g.Expect(updated.Status.ReservedHardware).To(Equal([]string{"spare-0", "spare-1"}))
+	g.Expect(updated.Finalizers).To(ContainElement(infrastructurev1.ClusterFinalizer))
+
+	// Reserved Hardware is not available to other machines.
+	available, err := (&controllers.HardwareSelector{Client: kubeClient}).Select(context.Background(), nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(available).To(HaveLen(2))
+
+	// Consuming reserved Hardware removes it from the reserve, which is refilled.
+	consumed := &tinkv1.Hardware{}
+	g.Expect(kubeClient.Get(context.Background(), types.NamespacedName{Name: "spare-0", Namespace: clusterNamespace}, consumed)).To(Succeed())
+	delete(consumed.Labels, controllers.HardwareReservedForClusterLabel)
+	delete(consumed.Labels, controllers.HardwareReservedForNamespaceLabel)
+	consumed.Labels[controllers.HardwareOwnerNameLabel] = "replacement"
+	consumed.Labels[controllers.HardwareOwnerNamespaceLabel] = clusterNamespace
+	g.Expect(kubeClient.Update(context.Background(), consumed)).To(Succeed())
+
+	_, err = reconcileClusterWithClient(kubeClient, clusterName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(kubeClient.Get(context.Background(), key, updated)).To(Succeed())
+	g.Expect(updated.Status.ReservedHardware).To(Equal([]string{"spare-1", "spare-2"}))
+
+	// Removing the reserve releases its Hardware.
+	updated.Spec.RemediationReserve = nil
+	g.Expect(kubeClient.Update(context.Background(), updated)).To(Succeed())
+
+	_, err = reconcileClusterWithClient(kubeClient, clusterName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(kubeClient.Get(context.Background(), key, updated)).To(Succeed())
+	g.Expect(updated.Status.ReservedHardware).To(BeEmpty())
+
+	available, err = (&controllers.HardwareSelector{Client: kubeClient}).Select(context.Background(), nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(available).To(HaveLen(3))
+}
+
 func Test_Cluster_reconciliation_when_controlplane_endpoint_set_on_tinkerbellCluster(t *testing.T) {
 	t.Parallel()
 	g := NewWithT(t)
@@ -194,6 +298,7 @@ func kubernetesClientWithObjects(t *testing.T, objects []runtime.Object) client.
 	g.Expect(infrastructurev1.AddToScheme(scheme)).To(Succeed(), "Adding Tinkerbell CAPI objects to scheme should succeed")
 	g.Expect(clusterv1.AddToScheme(scheme)).To(Succeed(), "Adding CAPI objects to scheme should succeed")
 	g.Expect(corev1.AddToScheme(scheme)).To(Succeed(), "Adding Core V1 objects to scheme should succeed")
+	g.Expect(rufiov1.AddToScheme(scheme)).To(Succeed(), "Adding Rufio objects to scheme should succeed")
 
 	return fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objects...).Build()
 }
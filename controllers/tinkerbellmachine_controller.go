@@ -18,10 +18,12 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/controllers/remote"
 	"sigs.k8s.io/cluster-api/util"
 	"sigs.k8s.io/cluster-api/util/collections"
 	"sigs.k8s.io/cluster-api/util/predicates"
@@ -42,16 +44,46 @@ import (
 type TinkerbellMachineReconciler struct {
 	client.Client
 	WatchFilterValue string
+
+	// APIReader reads objects from the API server, bypassing the cache of Client. If not set, Client is used.
+	APIReader client.Reader
+
+	// HardwareFaultConditions are workload cluster Node condition types which, when True, mark the
+	// Node's hardware as faulty. Faulty hardware is quarantined instead of released on machine deletion.
+	HardwareFaultConditions []string
+
+	// HardwareFaultLabels are workload cluster Node label keys which mark the Node's hardware as faulty.
+	HardwareFaultLabels []string
+
+	// RemoteClientGetter returns a client for a workload cluster. If not set, remote.NewClusterClient is used.
+	RemoteClientGetter remote.ClusterClientGetter
+
+	// StackClientGetter returns a client for the Tinkerbell stack of a failure domain from its kubeconfig.
+	// If not set, clients are created with the scheme of the manager and cached.
+	StackClientGetter StackClientGetter
+
+	// ImageCacheURL is the URL of the image cache machine images are downloaded through. If empty,
+	// images are downloaded from their registry directly.
+	ImageCacheURL string
+
+	// UsageAccountant accounts the time Hardware is allocated to machines. If nil, usage is not accounted.
+	UsageAccountant *UsageAccountant
+
+	// HardwareOwnershipMigrator migrates legacy Hardware ownership markers. If set, Hardware is only
+	// selected once it migrated Hardware, and never if it carries a legacy owner name label.
+	HardwareOwnershipMigrator *HardwareOwnershipMigrator
 }
 
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=tinkerbellmachines,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=tinkerbellmachines/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machines;machines/status,verbs=get;list;watch
 // +kubebuilder:rbac:groups="",resources=secrets;,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=nodes,verbs=get
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
 // +kubebuilder:rbac:groups=tinkerbell.org,resources=hardware;hardware/status,verbs=get;list;watch;update;patch
 // +kubebuilder:rbac:groups=tinkerbell.org,resources=templates;templates/status,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=tinkerbell.org,resources=workflows;workflows/status,verbs=get;list;watch;create;update;patch;delete
-// +kubebuilder:rbac:groups=bmc.tinkerbell.org,resources=jobs,verbs=get;list;watch;create
+// +kubebuilder:rbac:groups=bmc.tinkerbell.org,resources=jobs,verbs=get;list;watch;create;delete
 
 // Reconcile ensures that all Tinkerbell machines are aligned with a given spec.
 func (tmr *TinkerbellMachineReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -64,8 +96,17 @@ func (tmr *TinkerbellMachineReconciler) Reconcile(ctx context.Context, req ctrl.
 		return result, nil
 	}
 
+	held, err := bmrc.MachineHeld()
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("checking machine hold: %w", err)
+	}
+
+	if held {
+		return ctrl.Result{}, nil
+	}
+
 	if bmrc.MachineScheduledForDeletion() {
-		return ctrl.Result{}, bmrc.DeleteMachineWithDependencies() //nolint:wrapcheck
+		return requeueResult(bmrc.DeleteMachineWithDependencies())
 	}
 
 	mrc, err := bmrc.IntoMachineReconcileContext()
@@ -77,7 +118,17 @@ func (tmr *TinkerbellMachineReconciler) Reconcile(ctx context.Context, req ctrl.
 		return ctrl.Result{}, nil
 	}
 
-	return ctrl.Result{}, mrc.Reconcile() //nolint:wrapcheck
+	return requeueResult(mrc.Reconcile())
+}
+
+// requeueResult turns an errRequeueAfter into a requeue of the TinkerbellMachine.
+func requeueResult(err error) (ctrl.Result, error) {
+	requeueAfter := &errRequeueAfter{}
+	if errors.As(err, &requeueAfter) {
+		return ctrl.Result{RequeueAfter: requeueAfter.after}, nil
+	}
+
+	return ctrl.Result{}, err //nolint:wrapcheck
 }
 
 // SetupWithManager configures reconciler with a given manager.
@@ -88,6 +139,10 @@ func (tmr *TinkerbellMachineReconciler) SetupWithManager(
 ) error {
 	log := ctrl.LoggerFrom(ctx)
 
+	if tmr.StackClientGetter == nil {
+		tmr.StackClientGetter = NewCachingStackClientGetter(mgr.GetScheme())
+	}
+
 	clusterToObjectFunc, err := util.ClusterToObjectsMapper(
 		tmr.Client,
 		&infrastructurev1.TinkerbellMachineList{},
@@ -19,20 +19,25 @@ package controllers_test
 import (
 	"context"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/uuid"
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/utils/pointer"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
+	rufiov1 "github.com/tinkerbell/rufio/api/v1alpha1"
 	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
 
 	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
@@ -49,7 +54,9 @@ func notImplemented(t *testing.T) {
 
 type testOptions struct {
 	// Labels allow providing labels for the machine
-	Labels           map[string]string
+	Labels map[string]string
+	// Annotations allow providing annotations for the machine
+	Annotations      map[string]string
 	HardwareAffinity *infrastructurev1.HardwareAffinity
 }
 
@@ -80,6 +87,14 @@ func validTinkerbellMachine(name, namespace, machineName, hardwareUUID string, o
 			m.Labels[k] = v
 		}
 
+		for k, v := range o.Annotations {
+			if m.Annotations == nil {
+				m.Annotations = map[string]string{}
+			}
+
+			m.Annotations[k] = v
+		}
+
 		if o.HardwareAffinity != nil {
 			m.Spec.HardwareAffinity = o.HardwareAffinity
 		}
@@ -433,140 +448,961 @@ func Test_Machine_reconciliation_with_available_hardware(t *testing.T) {
 	})
 }
 
-//nolint:funlen
-func Test_Machine_reconciliation_workflow_complete(t *testing.T) {
+//nolint:funlen
+func Test_Machine_reconciliation_workflow_complete(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	hardwareUUID := uuid.New().String()
+
+	objects := []runtime.Object{
+		validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID),
+		validCluster(clusterName, clusterNamespace),
+		validTinkerbellCluster(clusterName, clusterNamespace),
+		validHardware(hardwareName, hardwareUUID, hardwareIP),
+		validMachine(machineName, clusterNamespace, clusterName),
+		validSecret(machineName, clusterNamespace),
+		validTemplate(tinkerbellMachineName, clusterNamespace),
+		validWorkflow(tinkerbellMachineName, clusterNamespace),
+	}
+
+	client := kubernetesClientWithObjects(t, objects)
+
+	_, err := reconcileMachineWithClient(client, tinkerbellMachineName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred(), "Unexpected reconciliation error")
+
+	ctx := context.Background()
+
+	namespacedName := types.NamespacedName{
+		Name:      tinkerbellMachineName,
+		Namespace: clusterNamespace,
+	}
+
+	updatedMachine := &infrastructurev1.TinkerbellMachine{}
+	g.Expect(client.Get(ctx, namespacedName, updatedMachine)).To(Succeed())
+
+	// From https://cluster-api.sigs.k8s.io/developer/providers/machine-infrastructure.html#normal-resource.
+	t.Run("sets_provider_id_with_selected_hardware_id", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		g.Expect(updatedMachine.Spec.ProviderID).To(Equal(fmt.Sprintf("tinkerbell://%s/%s", clusterNamespace, hardwareName)),
+			"Expected ProviderID field to include hardwareUUID")
+	})
+
+	// From https://cluster-api.sigs.k8s.io/developer/providers/machine-infrastructure.html#normal-resource.
+	t.Run("sets_tinkerbell_machine_status_to_ready", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		g.Expect(updatedMachine.Status.Ready).To(BeTrue(), "Machine is not ready")
+	})
+
+	// From https://cluster-api.sigs.k8s.io/developer/providers/machine-infrastructure.html#normal-resource.
+	t.Run("sets_tinkerbell_finalizer", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		g.Expect(updatedMachine.ObjectMeta.Finalizers).NotTo(BeEmpty(), "Expected at least one finalizer to be set")
+	})
+
+	// From https://cluster-api.sigs.k8s.io/developer/providers/machine-infrastructure.html#normal-resource.
+	t.Run("sets_tinkerbell_machine_IP_address", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		g.Expect(updatedMachine.Status.Addresses).NotTo(BeEmpty(), "Expected at least one IP address to be populated")
+
+		g.Expect(updatedMachine.Status.Addresses[0].Address).To(BeEquivalentTo(hardwareIP),
+			"Expected first IP address to be %q", hardwareIP)
+	})
+
+	// So it becomes unavailable for other clusters.
+	t.Run("sets_ownership_label_on_selected_hardware", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		hardwareNamespacedName := types.NamespacedName{
+			Name:      hardwareName,
+			Namespace: clusterNamespace,
+		}
+
+		updatedHardware := &tinkv1.Hardware{}
+		g.Expect(client.Get(ctx, hardwareNamespacedName, updatedHardware)).To(Succeed())
+
+		g.Expect(updatedHardware.ObjectMeta.Labels).To(
+			HaveKeyWithValue(controllers.HardwareOwnerNameLabel, tinkerbellMachineName),
+			"Expected owner name label to be set on Hardware")
+
+		g.Expect(updatedHardware.ObjectMeta.Labels).To(
+			HaveKeyWithValue(controllers.HardwareOwnerNamespaceLabel, clusterNamespace),
+			"Expected owner namespace label to be set on Hardware")
+	})
+
+	// Ensure idempotency of reconcile operation. E.g. we shouldn't try to create the template with the same name
+	// on every iteration.
+	t.Run("succeeds_when_executed_twice", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		_, err := reconcileMachineWithClient(client, tinkerbellMachineName, clusterNamespace)
+		g.Expect(err).NotTo(HaveOccurred(), "Unexpected reconciliation error")
+	})
+
+	// Status should be updated on every run.
+	//
+	// Don't execute this test in parallel, as we reset status here.
+	t.Run("refreshes_status_when_machine_is_already_provisioned", func(t *testing.T) { //nolint:paralleltest
+		updatedMachine.Status.Addresses = nil
+		g := NewWithT(t)
+
+		g.Expect(client.Update(context.Background(), updatedMachine)).To(Succeed())
+		_, err := reconcileMachineWithClient(client, tinkerbellMachineName, clusterNamespace)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		updatedMachine = &infrastructurev1.TinkerbellMachine{}
+		g.Expect(client.Get(ctx, namespacedName, updatedMachine)).To(Succeed())
+		g.Expect(updatedMachine.Status.Addresses).NotTo(BeEmpty(), "Machine status should be updated on every reconciliation")
+	})
+
+	t.Run("in_use_states_are_set", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		hardwareNamespacedName := types.NamespacedName{
+			Name:      hardwareName,
+			Namespace: clusterNamespace,
+		}
+
+		updatedHardware := &tinkv1.Hardware{}
+		g.Expect(client.Get(ctx, hardwareNamespacedName, updatedHardware)).To(Succeed())
+		if diff := cmp.Diff(updatedHardware.Spec.Metadata.State, "in_use"); diff != "" {
+			t.Errorf(diff)
+		}
+		if diff := cmp.Diff(updatedHardware.Spec.Metadata.Instance.State, "provisioned"); diff != "" {
+			t.Errorf(diff)
+		}
+	})
+}
+
+func Test_Machine_reconciliation_waits_for_readiness_gates(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	hardwareUUID := uuid.New().String()
+
+	const agentRegistered clusterv1.ConditionType = "SecurityAgentRegistered"
+
+	tinkerbellMachine := validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID)
+	tinkerbellMachine.Spec.ReadinessGates = []infrastructurev1.TinkerbellMachineReadinessGate{
+		{ConditionType: agentRegistered},
+	}
+
+	kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+		tinkerbellMachine,
+		validCluster(clusterName, clusterNamespace),
+		validTinkerbellCluster(clusterName, clusterNamespace),
+		validHardware(hardwareName, hardwareUUID, hardwareIP),
+		validMachine(machineName, clusterNamespace, clusterName),
+		validSecret(machineName, clusterNamespace),
+		validTemplate(tinkerbellMachineName, clusterNamespace),
+		validWorkflow(tinkerbellMachineName, clusterNamespace),
+	})
+
+	_, err := reconcileMachineWithClient(kubeClient, tinkerbellMachineName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	key := types.NamespacedName{Name: tinkerbellMachineName, Namespace: clusterNamespace}
+
+	updatedMachine := &infrastructurev1.TinkerbellMachine{}
+	g.Expect(kubeClient.Get(context.Background(), key, updatedMachine)).To(Succeed())
+	g.Expect(conditions.IsTrue(updatedMachine, infrastructurev1.ProvisionedCondition)).To(BeTrue())
+	g.Expect(updatedMachine.Status.Ready).To(BeFalse(), "Machine must wait for its readiness gate")
+
+	// An external controller reports the gate as passed.
+	conditions.MarkTrue(updatedMachine, agentRegistered)
+	g.Expect(kubeClient.Status().Update(context.Background(), updatedMachine)).To(Succeed())
+
+	_, err = reconcileMachineWithClient(kubeClient, tinkerbellMachineName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(kubeClient.Get(context.Background(), key, updatedMachine)).To(Succeed())
+	g.Expect(updatedMachine.Status.Ready).To(BeTrue())
+}
+
+//nolint:funlen
+func Test_Machine_reconciliation_workflow_failed_with_hold_annotation(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	hardwareUUID := uuid.New().String()
+
+	workflow := validWorkflow(tinkerbellMachineName, clusterNamespace)
+	workflow.Status.Tasks[0].Actions[0].Status = tinkv1.WorkflowStateFailed
+
+	objects := []runtime.Object{
+		validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID, testOptions{
+			Annotations: map[string]string{infrastructurev1.HoldOnFailureAnnotation: ""},
+		}),
+		validCluster(clusterName, clusterNamespace),
+		validTinkerbellCluster(clusterName, clusterNamespace),
+		validHardware(hardwareName, hardwareUUID, hardwareIP),
+		validMachine(machineName, clusterNamespace, clusterName),
+		validSecret(machineName, clusterNamespace),
+		validTemplate(tinkerbellMachineName, clusterNamespace),
+		workflow,
+	}
+
+	client := kubernetesClientWithObjects(t, objects)
+
+	_, err := reconcileMachineWithClient(client, tinkerbellMachineName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred(), "Failed workflow should be held instead of returning an error")
+
+	ctx := context.Background()
+
+	namespacedName := types.NamespacedName{
+		Name:      tinkerbellMachineName,
+		Namespace: clusterNamespace,
+	}
+
+	hardwareNamespacedName := types.NamespacedName{
+		Name:      hardwareName,
+		Namespace: clusterNamespace,
+	}
+
+	updatedMachine := &infrastructurev1.TinkerbellMachine{}
+	g.Expect(client.Get(ctx, namespacedName, updatedMachine)).To(Succeed())
+
+	g.Expect(updatedMachine.Status.Hold).NotTo(BeNil(), "Expected hold to be set in status")
+	g.Expect(updatedMachine.Status.Hold.FailedAction).To(Equal(tinkerbellMachineName),
+		"Expected failed workflow action to be recorded")
+	g.Expect(updatedMachine.Status.Ready).To(BeFalse())
+
+	// Deleting a held machine must keep the hardware untouched.
+	now := metav1.Now()
+	updatedMachine.ObjectMeta.DeletionTimestamp = &now
+	g.Expect(client.Update(ctx, updatedMachine)).To(Succeed())
+
+	_, err = reconcileMachineWithClient(client, tinkerbellMachineName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	updatedHardware := &tinkv1.Hardware{}
+	g.Expect(client.Get(ctx, hardwareNamespacedName, updatedHardware)).To(Succeed())
+	g.Expect(updatedHardware.ObjectMeta.Labels).To(HaveKeyWithValue(controllers.HardwareOwnerNameLabel, tinkerbellMachineName),
+		"Expected held hardware to stay owned by the machine")
+	g.Expect(updatedHardware.ObjectMeta.Finalizers).NotTo(BeEmpty())
+
+	// Clearing the hold lets deletion proceed.
+	g.Expect(client.Get(ctx, namespacedName, updatedMachine)).To(Succeed())
+	delete(updatedMachine.Annotations, infrastructurev1.HoldOnFailureAnnotation)
+	g.Expect(client.Update(ctx, updatedMachine)).To(Succeed())
+
+	_, err = reconcileMachineWithClient(client, tinkerbellMachineName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(client.Get(ctx, hardwareNamespacedName, updatedHardware)).To(Succeed())
+	g.Expect(updatedHardware.ObjectMeta.Labels).NotTo(HaveKey(controllers.HardwareOwnerNameLabel),
+		"Expected hardware to be released once the hold is cleared")
+}
+
+func Test_Machine_reconciliation_quarantines_hardware_of_faulty_node(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	hardwareUUID := uuid.New().String()
+
+	machine := validMachine(machineName, clusterNamespace, clusterName)
+	machine.Spec.ClusterName = clusterName
+	machine.Status.NodeRef = &corev1.ObjectReference{Name: machineName}
+
+	objects := []runtime.Object{
+		validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID),
+		validCluster(clusterName, clusterNamespace),
+		validTinkerbellCluster(clusterName, clusterNamespace),
+		validHardware(hardwareName, hardwareUUID, hardwareIP),
+		machine,
+		validSecret(machineName, clusterNamespace),
+	}
+
+	kubeClient := kubernetesClientWithObjects(t, objects)
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: machineName},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{
+				{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+				{Type: "MemoryFault", Status: corev1.ConditionTrue, Message: "uncorrectable ECC errors"},
+			},
+		},
+	}
+
+	remoteClient := kubernetesClientWithObjects(t, []runtime.Object{node})
+
+	machineController := &controllers.TinkerbellMachineReconciler{
+		Client:                  kubeClient,
+		HardwareFaultConditions: []string{"MemoryFault"},
+		RemoteClientGetter: func(context.Context, string, client.Client, client.ObjectKey) (client.Client, error) {
+			return remoteClient, nil
+		},
+	}
+
+	ctx := context.Background()
+
+	request := ctrl.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      tinkerbellMachineName,
+			Namespace: clusterNamespace,
+		},
+	}
+
+	_, err := machineController.Reconcile(ctx, request)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	updatedMachine := &infrastructurev1.TinkerbellMachine{}
+	g.Expect(kubeClient.Get(ctx, request.NamespacedName, updatedMachine)).To(Succeed())
+
+	now := metav1.Now()
+	updatedMachine.ObjectMeta.DeletionTimestamp = &now
+	g.Expect(kubeClient.Update(ctx, updatedMachine)).To(Succeed())
+
+	_, err = machineController.Reconcile(ctx, request)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	updatedHardware := &tinkv1.Hardware{}
+	g.Expect(kubeClient.Get(ctx, types.NamespacedName{Name: hardwareName, Namespace: clusterNamespace}, updatedHardware)).To(Succeed())
+
+	g.Expect(updatedHardware.ObjectMeta.Labels).NotTo(HaveKey(controllers.HardwareOwnerNameLabel),
+		"Expected quarantined hardware to be released from the machine")
+	g.Expect(updatedHardware.ObjectMeta.Labels).To(HaveKeyWithValue(controllers.HardwareQuarantinedLabel, "true"))
+	g.Expect(updatedHardware.ObjectMeta.Annotations).To(HaveKeyWithValue(controllers.HardwareQuarantineReasonAnnotation,
+		"condition MemoryFault: uncorrectable ECC errors"))
+
+	// Quarantined hardware must not be selected for other machines.
+	secondMachineName := "secondMachineName"
+	secondTinkerbellMachineName := "secondTinkerbellMachineName"
+
+	g.Expect(kubeClient.Create(ctx, validTinkerbellMachine(secondTinkerbellMachineName, clusterNamespace, secondMachineName, ""))).To(Succeed())
+	g.Expect(kubeClient.Create(ctx, validMachine(secondMachineName, clusterNamespace, clusterName))).To(Succeed())
+	g.Expect(kubeClient.Create(ctx, validSecret(secondMachineName, clusterNamespace))).To(Succeed())
+
+	_, err = reconcileMachineWithClient(kubeClient, secondTinkerbellMachineName, clusterNamespace)
+	g.Expect(err).To(MatchError(controllers.ErrNoHardwareAvailable))
+}
+
+func Test_Machine_reconciliation_in_failure_domain_uses_its_Tinkerbell_stack(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	const (
+		failureDomain     = "rack-b"
+		stackNamespace    = "tinkerbell"
+		stackMetadataURL  = "http://10.1.0.1:50061"
+		stackKubeconfig   = "rack-b-kubeconfig"
+		localHardwareName = "localHardware"
+	)
+
+	hardwareUUID := uuid.New().String()
+
+	machine := validMachine(machineName, clusterNamespace, clusterName)
+	machine.Spec.FailureDomain = pointer.String(failureDomain)
+
+	tinkerbellCluster := validTinkerbellCluster(clusterName, clusterNamespace)
+	tinkerbellCluster.Spec.FailureDomains = []infrastructurev1.TinkerbellFailureDomain{
+		{
+			Name:                failureDomain,
+			KubeconfigSecretRef: &corev1.LocalObjectReference{Name: stackKubeconfig},
+			HardwareNamespace:   stackNamespace,
+			MetadataURL:         stackMetadataURL,
+		},
+	}
+
+	kubeconfigSecret := validSecret(stackKubeconfig, clusterNamespace)
+	kubeconfigSecret.Data["value"] = []byte("rack-b kubeconfig")
+
+	kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+		validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID),
+		validCluster(clusterName, clusterNamespace),
+		tinkerbellCluster,
+		machine,
+		validSecret(machineName, clusterNamespace),
+		kubeconfigSecret,
+		validHardware(localHardwareName, uuid.New().String(), "10.0.0.1"),
+	})
+
+	stackHardware := validHardware(hardwareName, hardwareUUID, hardwareIP)
+	stackHardware.Namespace = stackNamespace
+
+	stackClient := kubernetesClientWithObjects(t, []runtime.Object{stackHardware})
+
+	machineController := &controllers.TinkerbellMachineReconciler{
+		Client: kubeClient,
+		StackClientGetter: func(kubeconfig []byte) (client.Client, error) {
+			g.Expect(string(kubeconfig)).To(Equal("rack-b kubeconfig"))
+
+			return stackClient, nil
+		},
+	}
+
+	ctx := context.Background()
+
+	request := ctrl.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      tinkerbellMachineName,
+			Namespace: clusterNamespace,
+		},
+	}
+
+	result, err := machineController.Reconcile(ctx, request)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(BeNumerically(">", 0),
+		"Expected machines of unwatched stacks to be polled")
+
+	updatedMachine := &infrastructurev1.TinkerbellMachine{}
+	g.Expect(kubeClient.Get(ctx, request.NamespacedName, updatedMachine)).To(Succeed())
+	g.Expect(updatedMachine.Spec.HardwareName).To(Equal(hardwareName))
+	g.Expect(updatedMachine.Spec.ProviderID).To(Equal(fmt.Sprintf("tinkerbell://%s/%s", stackNamespace, hardwareName)))
+
+	updatedHardware := &tinkv1.Hardware{}
+	g.Expect(stackClient.Get(ctx, types.NamespacedName{Name: hardwareName, Namespace: stackNamespace}, updatedHardware)).To(Succeed())
+	g.Expect(updatedHardware.ObjectMeta.Labels).To(HaveKeyWithValue(controllers.HardwareOwnerNameLabel, tinkerbellMachineName))
+
+	localHardware := &tinkv1.Hardware{}
+	g.Expect(kubeClient.Get(ctx, types.NamespacedName{Name: localHardwareName, Namespace: clusterNamespace}, localHardware)).To(Succeed())
+	g.Expect(localHardware.ObjectMeta.Labels).NotTo(HaveKey(controllers.HardwareOwnerNameLabel),
+		"Expected hardware of the management cluster stack to stay unused")
+
+	template := &tinkv1.Template{}
+	g.Expect(stackClient.Get(ctx, types.NamespacedName{Name: tinkerbellMachineName, Namespace: stackNamespace}, template)).To(Succeed())
+	g.Expect(template.OwnerReferences).To(BeEmpty(), "Expected no owner references across clusters")
+	g.Expect(*template.Spec.Data).To(ContainSubstring(stackMetadataURL))
+
+	workflow := &tinkv1.Workflow{}
+	g.Expect(stackClient.Get(ctx, types.NamespacedName{Name: tinkerbellMachineName, Namespace: stackNamespace}, workflow)).To(Succeed())
+
+	g.Expect(updatedMachine.Status.FailureDomain).NotTo(BeNil())
+	g.Expect(updatedMachine.Status.FailureDomain.Name).To(Equal(failureDomain))
+
+	// Once the failure domain is removed from the TinkerbellCluster, the machine is still deleted
+	// through the stack it was provisioned by.
+	g.Expect(kubeClient.Get(ctx, client.ObjectKeyFromObject(tinkerbellCluster), tinkerbellCluster)).To(Succeed())
+	tinkerbellCluster.Spec.FailureDomains = nil
+	g.Expect(kubeClient.Update(ctx, tinkerbellCluster)).To(Succeed())
+	g.Expect(kubeClient.Delete(ctx, updatedMachine)).To(Succeed())
+
+	_, err = machineController.Reconcile(ctx, request)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(stackClient.Get(ctx, types.NamespacedName{Name: hardwareName, Namespace: stackNamespace}, updatedHardware)).To(Succeed())
+	g.Expect(updatedHardware.ObjectMeta.Labels).NotTo(HaveKey(controllers.HardwareOwnerNameLabel))
+
+	err = kubeClient.Get(ctx, request.NamespacedName, updatedMachine)
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue(), "Expected the finalizer to be removed, got %v", err)
+}
+
+func Test_Machine_deletion_with_unavailable_Tinkerbell_stack(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	hardwareUUID := uuid.New().String()
+
+	machine := validMachine(machineName, clusterNamespace, clusterName)
+	machine.Spec.FailureDomain = pointer.String("rack-b")
+
+	tinkerbellMachine := validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID)
+	tinkerbellMachine.Spec.HardwareName = hardwareName
+	tinkerbellMachine.Finalizers = []string{infrastructurev1.MachineFinalizer}
+	tinkerbellMachine.Status.FailureDomain = &infrastructurev1.TinkerbellFailureDomain{
+		Name:                "rack-b",
+		KubeconfigSecretRef: &corev1.LocalObjectReference{Name: "deleted-kubeconfig"},
+	}
+
+	// The TinkerbellCluster and the kubeconfig Secret of the stack are gone already.
+	kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+		tinkerbellMachine,
+		validCluster(clusterName, clusterNamespace),
+		machine,
+		validHardware(hardwareName, hardwareUUID, hardwareIP),
+	})
+
+	machineController := &controllers.TinkerbellMachineReconciler{
+		Client: kubeClient,
+		StackClientGetter: func(kubeconfig []byte) (client.Client, error) {
+			return nil, fmt.Errorf("unexpected kubeconfig %q", kubeconfig) //nolint:goerr113
+		},
+	}
+
+	ctx := context.Background()
+	g.Expect(kubeClient.Delete(ctx, tinkerbellMachine)).To(Succeed())
+
+	request := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(tinkerbellMachine)}
+
+	// The finalizer is kept, as the Hardware in the stack would stay owned forever.
+	result, err := machineController.Reconcile(ctx, request)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(BeNumerically(">", 0), "Expected the stack to be polled")
+
+	g.Expect(kubeClient.Get(ctx, request.NamespacedName, tinkerbellMachine)).To(Succeed())
+	g.Expect(tinkerbellMachine.Finalizers).To(ContainElement(infrastructurev1.MachineFinalizer))
+	g.Expect(conditions.IsFalse(tinkerbellMachine, infrastructurev1.TinkerbellStackAvailableCondition)).To(BeTrue())
+	g.Expect(conditions.GetReason(tinkerbellMachine, infrastructurev1.TinkerbellStackAvailableCondition)).To(
+		Equal(infrastructurev1.TinkerbellStackUnavailableReason))
+
+	// Abandoning the objects in the stack lets the machine go.
+	tinkerbellMachine.Annotations = map[string]string{infrastructurev1.AbandonStackObjectsAnnotation: ""}
+	g.Expect(kubeClient.Update(ctx, tinkerbellMachine)).To(Succeed())
+
+	_, err = machineController.Reconcile(ctx, request)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	err = kubeClient.Get(ctx, request.NamespacedName, tinkerbellMachine)
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue(), "Expected the finalizer to be removed, got %v", err)
+}
+
+func Test_Machine_reconciliation_merges_cloud_init_parts_into_user_data(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	hardwareUUID := uuid.New().String()
+
+	tinkerbellMachine := validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID)
+	tinkerbellMachine.Spec.CloudInitParts = []infrastructurev1.CloudInitPart{
+		{
+			Name: "packages",
+			SecretRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "packages"},
+				Key:                  "cloud-config",
+			},
+			MergeType: "list(append)+dict(no_replace,recurse_list)+str()",
+		},
+	}
+
+	tinkerbellCluster := validTinkerbellCluster(clusterName, clusterNamespace)
+	tinkerbellCluster.Spec.CloudInitParts = []infrastructurev1.CloudInitPart{
+		{
+			Name: "monitoring",
+			ConfigMapRef: &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "monitoring"},
+				Key:                  "cloud-config",
+			},
+		},
+	}
+
+	packages := validSecret("packages", clusterNamespace)
+	packages.Data = map[string][]byte{"cloud-config": []byte("#cloud-config\npackages: [htop]\n")}
+
+	monitoring := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "monitoring", Namespace: clusterNamespace},
+		Data:       map[string]string{"cloud-config": "#cloud-config\nruncmd: [start-agent]\n"},
+	}
+
+	kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+		tinkerbellMachine,
+		validCluster(clusterName, clusterNamespace),
+		tinkerbellCluster,
+		validHardware(hardwareName, hardwareUUID, hardwareIP),
+		validMachine(machineName, clusterNamespace, clusterName),
+		validSecret(machineName, clusterNamespace),
+		packages,
+		monitoring,
+	})
+
+	_, err := reconcileMachineWithClient(kubeClient, tinkerbellMachineName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	hardware := &tinkv1.Hardware{}
+	g.Expect(kubeClient.Get(context.Background(), types.NamespacedName{Name: hardwareName, Namespace: clusterNamespace}, hardware)).To(Succeed())
+	g.Expect(hardware.Spec.UserData).NotTo(BeNil())
+
+	userData := *hardware.Spec.UserData
+	g.Expect(userData).To(HavePrefix("Content-Type: multipart/mixed"))
+
+	bootstrapIndex := strings.Index(userData, "not nil bootstrap data")
+	monitoringIndex := strings.Index(userData, "start-agent")
+	packagesIndex := strings.Index(userData, "htop")
+
+	g.Expect(bootstrapIndex).To(BeNumerically(">", 0))
+	g.Expect(monitoringIndex).To(BeNumerically(">", bootstrapIndex), "Expected cluster parts after the bootstrap data")
+	g.Expect(packagesIndex).To(BeNumerically(">", monitoringIndex), "Expected machine parts after cluster parts")
+	g.Expect(userData).To(ContainSubstring("Merge-Type: list(append)+dict(no_replace,recurse_list)+str()"))
+
+	// Reconciling again must not change the user data.
+	_, err = reconcileMachineWithClient(kubeClient, tinkerbellMachineName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(kubeClient.Get(context.Background(), types.NamespacedName{Name: hardwareName, Namespace: clusterNamespace}, hardware)).To(Succeed())
+	g.Expect(*hardware.Spec.UserData).To(Equal(userData))
+}
+
+func Test_Machine_reconciliation_with_dual_stack_hardware(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	hardwareUUID := uuid.New().String()
+
+	hardware := validHardware(hardwareName, hardwareUUID, "fd00:0:0::10")
+	hardware.Spec.Interfaces = append(hardware.Spec.Interfaces, tinkv1.Interface{
+		DHCP: &tinkv1.DHCP{IP: &tinkv1.IP{Address: "10.0.0.10", Family: 4}},
+	})
+
+	kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+		validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID),
+		validCluster(clusterName, clusterNamespace),
+		validTinkerbellCluster(clusterName, clusterNamespace),
+		hardware,
+		validMachine(machineName, clusterNamespace, clusterName),
+		validSecret(machineName, clusterNamespace),
+	})
+
+	_, err := reconcileMachineWithClient(kubeClient, tinkerbellMachineName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	updatedMachine := &infrastructurev1.TinkerbellMachine{}
+	g.Expect(kubeClient.Get(context.Background(),
+		types.NamespacedName{Name: tinkerbellMachineName, Namespace: clusterNamespace}, updatedMachine)).To(Succeed())
+
+	g.Expect(updatedMachine.Status.Addresses).To(Equal([]corev1.NodeAddress{
+		{Type: corev1.NodeInternalIP, Address: "fd00::10"},
+		{Type: corev1.NodeInternalIP, Address: "10.0.0.10"},
+	}), "Expected the address of the first interface first, in canonical form")
+}
+
+func pendingWorkflow(name, namespace string) *tinkv1.Workflow {
+	workflow := validWorkflow(name, namespace)
+	workflow.Status.Tasks[0].Actions = []tinkv1.Action{
+		{Name: "stream-image", Status: tinkv1.WorkflowStatePending},
+		{Name: "reboot", Status: tinkv1.WorkflowStatePending},
+	}
+
+	return workflow
+}
+
+func Test_Machine_reconciliation_with_provisioning_timeouts(t *testing.T) {
+	t.Parallel()
+
+	expired := metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	timeout := &metav1.Duration{Duration: time.Hour}
+
+	for name, c := range map[string]struct {
+		timeouts    *infrastructurev1.ProvisioningTimeouts
+		annotations map[string]string
+		hardware    bool
+		workflow    func() *tinkv1.Workflow
+		validateF   func(*WithT, *infrastructurev1.TinkerbellMachine, ctrl.Result)
+	}{
+		"fails_when_no_hardware_is_allocated_in_time": {
+			timeouts: &infrastructurev1.ProvisioningTimeouts{Allocation: timeout},
+			validateF: func(g *WithT, m *infrastructurev1.TinkerbellMachine, _ ctrl.Result) {
+				g.Expect(m.Status.ErrorReason).NotTo(BeNil())
+				g.Expect(*m.Status.ErrorMessage).To(Equal("allocation did not complete within 1h0m0s"))
+				g.Expect(conditions.GetReason(m, infrastructurev1.ProvisionedCondition)).To(
+					Equal(infrastructurev1.AllocationTimeoutReason))
+			},
+		},
+		"fails_when_workflow_is_not_started_in_time": {
+			timeouts: &infrastructurev1.ProvisioningTimeouts{WorkflowStart: timeout},
+			hardware: true,
+			workflow: func() *tinkv1.Workflow {
+				workflow := pendingWorkflow(tinkerbellMachineName, clusterNamespace)
+				workflow.CreationTimestamp = expired
+
+				return workflow
+			},
+			validateF: func(g *WithT, m *infrastructurev1.TinkerbellMachine, _ ctrl.Result) {
+				g.Expect(m.Status.ErrorReason).NotTo(BeNil())
+				g.Expect(conditions.GetReason(m, infrastructurev1.ProvisionedCondition)).To(
+					Equal(infrastructurev1.WorkflowStartTimeoutReason))
+			},
+		},
+		"holds_when_workflow_does_not_complete_in_time_with_hold_annotation": {
+			timeouts:    &infrastructurev1.ProvisioningTimeouts{WorkflowRun: timeout},
+			annotations: map[string]string{infrastructurev1.HoldOnFailureAnnotation: ""},
+			hardware:    true,
+			workflow: func() *tinkv1.Workflow {
+				workflow := pendingWorkflow(tinkerbellMachineName, clusterNamespace)
+				workflow.Status.Tasks[0].Actions[0].Status = tinkv1.WorkflowStateRunning
+				workflow.Status.Tasks[0].Actions[0].StartedAt = &expired
+
+				return workflow
+			},
+			validateF: func(g *WithT, m *infrastructurev1.TinkerbellMachine, _ ctrl.Result) {
+				g.Expect(m.Status.ErrorReason).To(BeNil(), "Held machine should not be failed")
+				g.Expect(m.Status.Hold).NotTo(BeNil())
+				g.Expect(m.Status.Hold.FailedAction).To(Equal("workflow run"))
+				g.Expect(conditions.GetReason(m, infrastructurev1.ProvisionedCondition)).To(
+					Equal(infrastructurev1.WorkflowRunTimeoutReason))
+			},
+		},
+		"requeues_when_workflow_run_timeout_is_not_expired": {
+			timeouts: &infrastructurev1.ProvisioningTimeouts{WorkflowRun: timeout},
+			hardware: true,
+			workflow: func() *tinkv1.Workflow {
+				startedAt := metav1.Now()
+				workflow := pendingWorkflow(tinkerbellMachineName, clusterNamespace)
+				workflow.Status.Tasks[0].Actions[0].Status = tinkv1.WorkflowStateRunning
+				workflow.Status.Tasks[0].Actions[0].StartedAt = &startedAt
+
+				return workflow
+			},
+			validateF: func(g *WithT, m *infrastructurev1.TinkerbellMachine, result ctrl.Result) {
+				g.Expect(m.Status.ErrorReason).To(BeNil())
+				g.Expect(result.RequeueAfter).To(BeNumerically("~", time.Hour, time.Minute))
+			},
+		},
+	} {
+		c := c
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			g := NewWithT(t)
+
+			hardwareUUID := uuid.New().String()
+
+			tinkerbellMachine := validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID,
+				testOptions{Annotations: c.annotations})
+			tinkerbellMachine.CreationTimestamp = expired
+			tinkerbellMachine.Spec.ProvisioningTimeouts = c.timeouts
+
+			objects := []runtime.Object{
+				tinkerbellMachine,
+				validCluster(clusterName, clusterNamespace),
+				validTinkerbellCluster(clusterName, clusterNamespace),
+				validMachine(machineName, clusterNamespace, clusterName),
+				validSecret(machineName, clusterNamespace),
+			}
+
+			if c.hardware {
+				objects = append(objects, validHardware(hardwareName, hardwareUUID, hardwareIP),
+					validTemplate(tinkerbellMachineName, clusterNamespace))
+			}
+
+			if c.workflow != nil {
+				objects = append(objects, c.workflow())
+			}
+
+			client := kubernetesClientWithObjects(t, objects)
+
+			result, err := reconcileMachineWithClient(client, tinkerbellMachineName, clusterNamespace)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			updatedMachine := &infrastructurev1.TinkerbellMachine{}
+			g.Expect(client.Get(context.Background(), types.NamespacedName{
+				Name:      tinkerbellMachineName,
+				Namespace: clusterNamespace,
+			}, updatedMachine)).To(Succeed())
+
+			c.validateF(g, updatedMachine, result)
+		})
+	}
+}
+
+func completedProvisionJob(name, namespace string, completedAt time.Time) *rufiov1.Job {
+	completionTime := metav1.NewTime(completedAt)
+
+	return &rufiov1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Status: rufiov1.JobStatus{
+			Conditions: []rufiov1.JobCondition{
+				{Type: rufiov1.JobCompleted, Status: rufiov1.ConditionTrue},
+			},
+			CompletionTime: &completionTime,
+		},
+	}
+}
+
+func Test_Machine_reconciliation_with_pxe_retry(t *testing.T) {
 	t.Parallel()
 	g := NewWithT(t)
 
 	hardwareUUID := uuid.New().String()
 
+	tinkerbellMachine := validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID)
+	tinkerbellMachine.Spec.PXERetry = &infrastructurev1.PXERetryPolicy{
+		Window:      metav1.Duration{Duration: 10 * time.Minute},
+		MaxAttempts: 1,
+	}
+	// The workflow start timeout expires together with the last PXE retry window.
+	tinkerbellMachine.Spec.ProvisioningTimeouts = &infrastructurev1.ProvisioningTimeouts{
+		WorkflowStart: &metav1.Duration{Duration: 10 * time.Minute},
+	}
+
+	hardware := validHardware(hardwareName, hardwareUUID, hardwareIP)
+	hardware.Spec.BMCRef = &corev1.TypedLocalObjectReference{Kind: "Machine", Name: "myBMC"}
+
+	provisionJobName := tinkerbellMachineName + "-provision"
+
 	objects := []runtime.Object{
-		validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID),
+		tinkerbellMachine,
 		validCluster(clusterName, clusterNamespace),
 		validTinkerbellCluster(clusterName, clusterNamespace),
-		validHardware(hardwareName, hardwareUUID, hardwareIP),
+		hardware,
 		validMachine(machineName, clusterNamespace, clusterName),
 		validSecret(machineName, clusterNamespace),
 		validTemplate(tinkerbellMachineName, clusterNamespace),
-		validWorkflow(tinkerbellMachineName, clusterNamespace),
+		pendingWorkflow(tinkerbellMachineName, clusterNamespace),
+		completedProvisionJob(provisionJobName, clusterNamespace, time.Now().Add(-5*time.Minute)),
 	}
 
 	client := kubernetesClientWithObjects(t, objects)
+	ctx := context.Background()
 
-	_, err := reconcileMachineWithClient(client, tinkerbellMachineName, clusterNamespace)
-	g.Expect(err).NotTo(HaveOccurred(), "Unexpected reconciliation error")
+	namespacedName := types.NamespacedName{Name: tinkerbellMachineName, Namespace: clusterNamespace}
+	updatedMachine := &infrastructurev1.TinkerbellMachine{}
 
-	ctx := context.Background()
+	// Within the window, the reconciliation is requeued for when the window expires.
+	result, err := reconcileMachineWithClient(client, tinkerbellMachineName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(BeNumerically("~", 5*time.Minute, time.Minute))
 
-	namespacedName := types.NamespacedName{
-		Name:      tinkerbellMachineName,
-		Namespace: clusterNamespace,
-	}
+	// Once the window expired, a fresh job is issued and recorded.
+	job := &rufiov1.Job{}
+	g.Expect(client.Get(ctx, types.NamespacedName{Name: provisionJobName, Namespace: clusterNamespace}, job)).To(Succeed())
+	job.Status.CompletionTime = &metav1.Time{Time: time.Now().Add(-15 * time.Minute)}
+	g.Expect(client.Status().Update(ctx, job)).To(Succeed())
+
+	_, err = reconcileMachineWithClient(client, tinkerbellMachineName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred())
 
-	updatedMachine := &infrastructurev1.TinkerbellMachine{}
 	g.Expect(client.Get(ctx, namespacedName, updatedMachine)).To(Succeed())
+	g.Expect(updatedMachine.Status.PXEAttempts).To(HaveLen(1))
+	g.Expect(updatedMachine.Status.PXEAttempts[0].JobName).To(Equal(provisionJobName + "-1"))
 
-	// From https://cluster-api.sigs.k8s.io/developer/providers/machine-infrastructure.html#normal-resource.
-	t.Run("sets_provider_id_with_selected_hardware_id", func(t *testing.T) {
-		t.Parallel()
-		g := NewWithT(t)
+	retryJob := &rufiov1.Job{}
+	g.Expect(client.Get(ctx, types.NamespacedName{Name: provisionJobName + "-1", Namespace: clusterNamespace},
+		retryJob)).To(Succeed())
+	g.Expect(retryJob.Spec.Tasks).To(HaveLen(3), "Expected retry job to power cycle into PXE")
 
-		g.Expect(updatedMachine.Spec.ProviderID).To(Equal(fmt.Sprintf("tinkerbell://%s/%s", clusterNamespace, hardwareName)),
-			"Expected ProviderID field to include hardwareUUID")
-	})
+	// Once all attempts are used up, provisioning fails.
+	completedRetryJob := completedProvisionJob(retryJob.Name, clusterNamespace, time.Now().Add(-15*time.Minute))
+	retryJob.Status = completedRetryJob.Status
+	g.Expect(client.Status().Update(ctx, retryJob)).To(Succeed())
 
-	// From https://cluster-api.sigs.k8s.io/developer/providers/machine-infrastructure.html#normal-resource.
-	t.Run("sets_tinkerbell_machine_status_to_ready", func(t *testing.T) {
-		t.Parallel()
-		g := NewWithT(t)
+	_, err = reconcileMachineWithClient(client, tinkerbellMachineName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred())
 
-		g.Expect(updatedMachine.Status.Ready).To(BeTrue(), "Machine is not ready")
-	})
+	g.Expect(client.Get(ctx, namespacedName, updatedMachine)).To(Succeed())
+	g.Expect(updatedMachine.Status.ErrorReason).NotTo(BeNil())
+	g.Expect(*updatedMachine.Status.ErrorMessage).To(Equal("workflow was not started after 1 PXE boot retries"))
+	g.Expect(conditions.GetReason(updatedMachine, infrastructurev1.ProvisionedCondition)).To(
+		Equal(infrastructurev1.PXERetriesExhaustedReason))
+}
 
-	// From https://cluster-api.sigs.k8s.io/developer/providers/machine-infrastructure.html#normal-resource.
-	t.Run("sets_tinkerbell_finalizer", func(t *testing.T) {
-		t.Parallel()
-		g := NewWithT(t)
+func Test_Machine_reconciliation_failed_pxe_retry_job_with_hold_annotation(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
 
-		g.Expect(updatedMachine.ObjectMeta.Finalizers).NotTo(BeEmpty(), "Expected at least one finalizer to be set")
-	})
+	hardwareUUID := uuid.New().String()
 
-	// From https://cluster-api.sigs.k8s.io/developer/providers/machine-infrastructure.html#normal-resource.
-	t.Run("sets_tinkerbell_machine_IP_address", func(t *testing.T) {
-		t.Parallel()
-		g := NewWithT(t)
+	retryJobName := tinkerbellMachineName + "-provision-1"
 
-		g.Expect(updatedMachine.Status.Addresses).NotTo(BeEmpty(), "Expected at least one IP address to be populated")
+	tinkerbellMachine := validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID,
+		testOptions{Annotations: map[string]string{infrastructurev1.HoldOnFailureAnnotation: ""}})
+	tinkerbellMachine.Status.PXEAttempts = []infrastructurev1.PXEAttempt{{JobName: retryJobName, Time: metav1.Now()}}
 
-		g.Expect(updatedMachine.Status.Addresses[0].Address).To(BeEquivalentTo(hardwareIP),
-			"Expected first IP address to be %q", hardwareIP)
-	})
+	hardware := validHardware(hardwareName, hardwareUUID, hardwareIP)
+	hardware.Spec.BMCRef = &corev1.TypedLocalObjectReference{Kind: "Machine", Name: "myBMC"}
 
-	// So it becomes unavailable for other clusters.
-	t.Run("sets_ownership_label_on_selected_hardware", func(t *testing.T) {
-		t.Parallel()
-		g := NewWithT(t)
+	failedRetryJob := &rufiov1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: retryJobName, Namespace: clusterNamespace},
+		Status: rufiov1.JobStatus{
+			Conditions: []rufiov1.JobCondition{{Type: rufiov1.JobFailed, Status: rufiov1.ConditionTrue}},
+		},
+	}
 
-		hardwareNamespacedName := types.NamespacedName{
-			Name:      hardwareName,
-			Namespace: clusterNamespace,
-		}
+	client := kubernetesClientWithObjects(t, []runtime.Object{
+		tinkerbellMachine,
+		validCluster(clusterName, clusterNamespace),
+		validTinkerbellCluster(clusterName, clusterNamespace),
+		hardware,
+		validMachine(machineName, clusterNamespace, clusterName),
+		validSecret(machineName, clusterNamespace),
+		validTemplate(tinkerbellMachineName, clusterNamespace),
+		pendingWorkflow(tinkerbellMachineName, clusterNamespace),
+		failedRetryJob,
+	})
 
-		updatedHardware := &tinkv1.Hardware{}
-		g.Expect(client.Get(ctx, hardwareNamespacedName, updatedHardware)).To(Succeed())
+	_, err := reconcileMachineWithClient(client, tinkerbellMachineName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred(), "Failed BMC job should be held instead of returning an error")
 
-		g.Expect(updatedHardware.ObjectMeta.Labels).To(
-			HaveKeyWithValue(controllers.HardwareOwnerNameLabel, tinkerbellMachineName),
-			"Expected owner name label to be set on Hardware")
+	updatedMachine := &infrastructurev1.TinkerbellMachine{}
+	g.Expect(client.Get(context.Background(), types.NamespacedName{Name: tinkerbellMachineName, Namespace: clusterNamespace},
+		updatedMachine)).To(Succeed())
+	g.Expect(updatedMachine.Status.Hold).NotTo(BeNil(), "Expected hold to be set in status")
+	g.Expect(updatedMachine.Status.Hold.FailedAction).To(Equal(retryJobName),
+		"Expected the failed PXE retry job to be recorded")
+}
 
-		g.Expect(updatedHardware.ObjectMeta.Labels).To(
-			HaveKeyWithValue(controllers.HardwareOwnerNamespaceLabel, clusterNamespace),
-			"Expected owner namespace label to be set on Hardware")
-	})
+func Test_Machine_reconciliation_with_preserved_disks(t *testing.T) {
+	t.Parallel()
 
-	// Ensure idempotency of reconcile operation. E.g. we shouldn't try to create the template with the same name
-	// on every iteration.
-	t.Run("succeeds_when_executed_twice", func(t *testing.T) {
+	preservedDisk := infrastructurev1.PreservedDisk{
+		Device:         "/dev/sda",
+		FilesystemUUID: "5b6c2a8e-3f1d-4a4e-9d0e-0c6f3c1a2b7d",
+		MountPoint:     "/var/lib/data",
+	}
+
+	t.Run("writes_os_to_first_disk_which_is_not_preserved", func(t *testing.T) {
 		t.Parallel()
 		g := NewWithT(t)
 
-		_, err := reconcileMachineWithClient(client, tinkerbellMachineName, clusterNamespace)
-		g.Expect(err).NotTo(HaveOccurred(), "Unexpected reconciliation error")
-	})
+		hardwareUUID := uuid.New().String()
 
-	// Status should be updated on every run.
-	//
-	// Don't execute this test in parallel, as we reset status here.
-	t.Run("refreshes_status_when_machine_is_already_provisioned", func(t *testing.T) { //nolint:paralleltest
-		updatedMachine.Status.Addresses = nil
-		g := NewWithT(t)
+		tinkerbellMachine := validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID)
+		tinkerbellMachine.Spec.PreservedDisks = []infrastructurev1.PreservedDisk{preservedDisk}
+
+		hardware := validHardware(hardwareName, hardwareUUID, hardwareIP)
+		hardware.Spec.Disks = append(hardware.Spec.Disks, tinkv1.Disk{Device: "/dev/sdb"})
+
+		objects := []runtime.Object{
+			tinkerbellMachine,
+			validCluster(clusterName, clusterNamespace),
+			validTinkerbellCluster(clusterName, clusterNamespace),
+			hardware,
+			validMachine(machineName, clusterNamespace, clusterName),
+			validSecret(machineName, clusterNamespace),
+		}
+
+		client := kubernetesClientWithObjects(t, objects)
 
-		g.Expect(client.Update(context.Background(), updatedMachine)).To(Succeed())
 		_, err := reconcileMachineWithClient(client, tinkerbellMachineName, clusterNamespace)
 		g.Expect(err).NotTo(HaveOccurred())
 
-		updatedMachine = &infrastructurev1.TinkerbellMachine{}
-		g.Expect(client.Get(ctx, namespacedName, updatedMachine)).To(Succeed())
-		g.Expect(updatedMachine.Status.Addresses).NotTo(BeEmpty(), "Machine status should be updated on every reconciliation")
+		template := &tinkv1.Template{}
+		g.Expect(client.Get(context.Background(), types.NamespacedName{
+			Name:      tinkerbellMachineName,
+			Namespace: clusterNamespace,
+		}, template)).To(Succeed())
+
+		g.Expect(*template.Spec.Data).To(ContainSubstring("DEST_DISK: /dev/sdb\n"))
+		g.Expect(*template.Spec.Data).NotTo(ContainSubstring("DEST_DISK: /dev/sda"))
+		g.Expect(*template.Spec.Data).To(ContainSubstring("UUID=" + preservedDisk.FilesystemUUID))
 	})
 
-	t.Run("in_use_states_are_set", func(t *testing.T) {
+	t.Run("fails_when_template_override_writes_to_preserved_disk", func(t *testing.T) {
 		t.Parallel()
 		g := NewWithT(t)
 
-		hardwareNamespacedName := types.NamespacedName{
-			Name:      hardwareName,
-			Namespace: clusterNamespace,
-		}
+		hardwareUUID := uuid.New().String()
 
-		updatedHardware := &tinkv1.Hardware{}
-		g.Expect(client.Get(ctx, hardwareNamespacedName, updatedHardware)).To(Succeed())
-		if diff := cmp.Diff(updatedHardware.Spec.Metadata.State, "in_use"); diff != "" {
-			t.Errorf(diff)
-		}
-		if diff := cmp.Diff(updatedHardware.Spec.Metadata.Instance.State, "provisioned"); diff != "" {
-			t.Errorf(diff)
+		tinkerbellMachine := validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID)
+		tinkerbellMachine.Spec.PreservedDisks = []infrastructurev1.PreservedDisk{preservedDisk}
+		tinkerbellMachine.Spec.TemplateOverride = *validTemplate(tinkerbellMachineName, clusterNamespace).Spec.Data +
+			"\n\t\tenvironment:\n\t\t  DEST_DISK: /dev/sda"
+
+		objects := []runtime.Object{
+			tinkerbellMachine,
+			validCluster(clusterName, clusterNamespace),
+			validTinkerbellCluster(clusterName, clusterNamespace),
+			validHardware(hardwareName, hardwareUUID, hardwareIP),
+			validMachine(machineName, clusterNamespace, clusterName),
+			validSecret(machineName, clusterNamespace),
 		}
+
+		client := kubernetesClientWithObjects(t, objects)
+
+		_, err := reconcileMachineWithClient(client, tinkerbellMachineName, clusterNamespace)
+		g.Expect(err).To(MatchError(controllers.ErrTemplateWritesPreservedDisk))
 	})
 }
 
@@ -1459,3 +2295,297 @@ func machineReconciliationHardwareAffinityHelper(t *testing.T, fooOptions testOp
 	g.Expect(barMachine.Spec.HardwareName).To(Equal(barHardwareName))
 	g.Expect(bazMachine.Spec.HardwareName).To(Equal(bazHardwareName))
 }
+
+// templateCreateRecordingClient records the stored TemplateSecrets of the TinkerbellMachine when its
+// Template is created.
+type templateCreateRecordingClient struct {
+	client.Client
+	templateSecrets []infrastructurev1.TemplateSecretReference
+}
+
+func (c *templateCreateRecordingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if _, ok := obj.(*tinkv1.Template); ok {
+		machine := &infrastructurev1.TinkerbellMachine{}
+		key := types.NamespacedName{Name: tinkerbellMachineName, Namespace: clusterNamespace}
+
+		if err := c.Get(ctx, key, machine); err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		c.templateSecrets = machine.Status.TemplateSecrets
+	}
+
+	return c.Client.Create(ctx, obj, opts...) //nolint:wrapcheck
+}
+
+func Test_Machine_reconciliation_records_template_secrets_before_creating_template(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	hardwareUUID := uuid.New().String()
+
+	tinkerbellMachine := validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID)
+	tinkerbellMachine.Spec.TemplateOverride = `TOKEN: {{ secret "firmware-portal" "token" }}`
+
+	portal := validSecret("firmware-portal", clusterNamespace)
+	portal.Data = map[string][]byte{"token": []byte("portal-token")}
+
+	kubeClient := &templateCreateRecordingClient{Client: kubernetesClientWithObjects(t, []runtime.Object{
+		tinkerbellMachine,
+		validCluster(clusterName, clusterNamespace),
+		validTinkerbellCluster(clusterName, clusterNamespace),
+		validHardware(hardwareName, hardwareUUID, hardwareIP),
+		validMachine(machineName, clusterNamespace, clusterName),
+		validSecret(machineName, clusterNamespace),
+		portal,
+	})}
+
+	_, err := reconcileMachineWithClient(kubeClient, tinkerbellMachineName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(kubeClient.templateSecrets).To(HaveLen(1),
+		"Expected the Secrets to be recorded before the Template holding them is created")
+}
+
+func Test_Machine_reconciliation_resolves_template_secrets(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	hardwareUUID := uuid.New().String()
+
+	tinkerbellMachine := validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID)
+	tinkerbellMachine.Spec.TemplateOverride = `version: "0.1"
+name: firmware
+tasks:
+  - name: "firmware"
+    worker: "{{.device_1}}"
+    actions:
+      - name: "update"
+        image: firmware:v1.0.0
+        environment:
+          TOKEN: {{ secret "firmware-portal" "token" }}`
+
+	portal := validSecret("firmware-portal", clusterNamespace)
+	portal.Data = map[string][]byte{"token": []byte("portal-token")}
+
+	kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+		tinkerbellMachine,
+		validCluster(clusterName, clusterNamespace),
+		validTinkerbellCluster(clusterName, clusterNamespace),
+		validHardware(hardwareName, hardwareUUID, hardwareIP),
+		validMachine(machineName, clusterNamespace, clusterName),
+		validSecret(machineName, clusterNamespace),
+		portal,
+	})
+
+	_, err := reconcileMachineWithClient(kubeClient, tinkerbellMachineName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	key := types.NamespacedName{Name: tinkerbellMachineName, Namespace: clusterNamespace}
+
+	template := &tinkv1.Template{}
+	g.Expect(kubeClient.Get(context.Background(), key, template)).To(Succeed())
+	g.Expect(*template.Spec.Data).To(ContainSubstring(`TOKEN: "portal-token"`))
+	g.Expect(*template.Spec.Data).To(ContainSubstring(`worker: "{{.device_1}}"`))
+	g.Expect(template.Labels).To(HaveKey(controllers.TemplateSecretsLabel))
+	g.Expect(template.OwnerReferences).To(HaveLen(1))
+	g.Expect(*template.OwnerReferences[0].Controller).To(BeTrue())
+
+	machine := &infrastructurev1.TinkerbellMachine{}
+	g.Expect(kubeClient.Get(context.Background(), key, machine)).To(Succeed())
+	g.Expect(machine.Status.TemplateSecrets).To(HaveLen(1))
+	g.Expect(machine.Status.TemplateSecrets[0].Name).To(Equal("firmware-portal"))
+	g.Expect(machine.Status.TemplateSecrets[0].Key).To(Equal("token"))
+
+	workflow := &tinkv1.Workflow{}
+	g.Expect(kubeClient.Get(context.Background(), key, workflow)).To(Succeed())
+	g.Expect(workflow.Labels).To(HaveKey(controllers.TemplateSecretsLabel))
+
+	// Once the workflow completes, the Template and the Workflow holding the Secret are deleted.
+	workflow.Status = validWorkflow(tinkerbellMachineName, clusterNamespace).Status
+	g.Expect(kubeClient.Update(context.Background(), workflow)).To(Succeed())
+
+	_, err = reconcileMachineWithClient(kubeClient, tinkerbellMachineName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(kubeClient.Get(context.Background(), key, machine)).To(Succeed())
+	g.Expect(machine.Status.Ready).To(BeTrue())
+
+	err = kubeClient.Get(context.Background(), key, template)
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue(), "Expected the Template to be deleted, got %v", err)
+
+	err = kubeClient.Get(context.Background(), key, workflow)
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue(), "Expected the Workflow to be deleted, got %v", err)
+
+	// The machine stays provisioned without its Workflow.
+	_, err = reconcileMachineWithClient(kubeClient, tinkerbellMachineName, clusterNamespace)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(kubeClient.Get(context.Background(), key, workflow)).NotTo(Succeed())
+}
+
+func Test_Machine_reconciliation_fails_on_missing_template_secret(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	hardwareUUID := uuid.New().String()
+
+	tinkerbellMachine := validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID)
+	tinkerbellMachine.Spec.TemplateOverride = `TOKEN: {{ secret "firmware-portal" "token" }}`
+
+	kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+		tinkerbellMachine,
+		validCluster(clusterName, clusterNamespace),
+		validTinkerbellCluster(clusterName, clusterNamespace),
+		validHardware(hardwareName, hardwareUUID, hardwareIP),
+		validMachine(machineName, clusterNamespace, clusterName),
+		validSecret(machineName, clusterNamespace),
+	})
+
+	_, err := reconcileMachineWithClient(kubeClient, tinkerbellMachineName, clusterNamespace)
+	g.Expect(err).To(HaveOccurred())
+
+	template := &tinkv1.Template{}
+	err = kubeClient.Get(context.Background(), types.NamespacedName{Name: tinkerbellMachineName, Namespace: clusterNamespace}, template)
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue(), "Expected no Template to be created, got %v", err)
+}
+
+func Test_Machine_reconciliation_consumes_remediation_reserve(t *testing.T) {
+	t.Parallel()
+
+	for name, c := range map[string]struct {
+		annotations map[string]string
+		expected    string
+	}{
+		"replacement_takes_reserved_hardware": {
+			annotations: map[string]string{controllers.RemediationForAnnotation: `{"machine":"failed-0"}`},
+			expected:    "b-reserved",
+		},
+		"other_machines_skip_reserved_hardware": {
+			expected: "c-free",
+		},
+	} {
+		c := c
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			g := NewWithT(t)
+
+			tinkerbellCluster := validTinkerbellCluster(clusterName, clusterNamespace)
+			tinkerbellCluster.Spec.RemediationReserve = &infrastructurev1.RemediationReserve{Size: 1}
+
+			machine := validMachine(machineName, clusterNamespace, clusterName)
+			machine.Spec.ClusterName = clusterName
+			machine.Annotations = c.annotations
+
+			reserved := testOptions{Labels: map[string]string{
+				controllers.HardwareReservedForClusterLabel:   clusterName,
+				controllers.HardwareReservedForNamespaceLabel: clusterNamespace,
+			}}
+			otherReserve := testOptions{Labels: map[string]string{
+				controllers.HardwareReservedForClusterLabel:   "other",
+				controllers.HardwareReservedForNamespaceLabel: clusterNamespace,
+			}}
+
+			kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+				validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, uuid.New().String()),
+				validCluster(clusterName, clusterNamespace),
+				tinkerbellCluster,
+				validHardware("a-reserved-by-other", uuid.New().String(), "10.0.0.10", otherReserve),
+				validHardware("b-reserved", uuid.New().String(), "10.0.0.11", reserved),
+				validHardware("c-free", uuid.New().String(), "10.0.0.12"),
+				machine,
+				validSecret(machineName, clusterNamespace),
+			})
+
+			_, err := reconcileMachineWithClient(kubeClient, tinkerbellMachineName, clusterNamespace)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			tinkerbellMachine := &infrastructurev1.TinkerbellMachine{}
+			key := types.NamespacedName{Name: tinkerbellMachineName, Namespace: clusterNamespace}
+			g.Expect(kubeClient.Get(context.Background(), key, tinkerbellMachine)).To(Succeed())
+			g.Expect(tinkerbellMachine.Spec.HardwareName).To(Equal(c.expected))
+
+			hardware := &tinkv1.Hardware{}
+			key = types.NamespacedName{Name: c.expected, Namespace: clusterNamespace}
+			g.Expect(kubeClient.Get(context.Background(), key, hardware)).To(Succeed())
+			g.Expect(hardware.Labels).NotTo(HaveKey(controllers.HardwareReservedForClusterLabel),
+				"Expected Hardware taken from the reserve to leave it")
+		})
+	}
+}
+
+func Test_Machine_reconciliation_with_metadata_tls(t *testing.T) {
+	t.Parallel()
+
+	const caBundle = "-----BEGIN CERTIFICATE-----\nMIIBdzCCAR2gAwIBAgIUTinkerbellTestCA\n-----END CERTIFICATE-----\n"
+
+	objects := func(hardwareUUID string, caData map[string]string) []runtime.Object {
+		tinkerbellCluster := validTinkerbellCluster(clusterName, clusterNamespace)
+		tinkerbellCluster.Spec.MetadataTLS = &infrastructurev1.MetadataTLS{
+			URL: "https://hegel.example.com:50061",
+			CABundle: infrastructurev1.CABundleSource{
+				ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "hegel-ca"},
+					Key:                  "ca.crt",
+				},
+			},
+		}
+
+		return []runtime.Object{
+			validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID),
+			validCluster(clusterName, clusterNamespace),
+			tinkerbellCluster,
+			validHardware(hardwareName, hardwareUUID, hardwareIP),
+			validMachine(machineName, clusterNamespace, clusterName),
+			validSecret(machineName, clusterNamespace),
+			&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "hegel-ca", Namespace: clusterNamespace},
+				Data:       caData,
+			},
+		}
+	}
+
+	t.Run("injects_ca_bundle_into_template", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		hardwareUUID := uuid.New().String()
+		kubeClient := kubernetesClientWithObjects(t, objects(hardwareUUID, map[string]string{"ca.crt": caBundle}))
+
+		_, err := reconcileMachineWithClient(kubeClient, tinkerbellMachineName, clusterNamespace)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		template := &tinkv1.Template{}
+		g.Expect(kubeClient.Get(context.Background(), types.NamespacedName{
+			Name:      tinkerbellMachineName,
+			Namespace: clusterNamespace,
+		}, template)).To(Succeed())
+
+		g.Expect(*template.Spec.Data).To(ContainSubstring(`metadata_urls: ["https://hegel.example.com:50061"]`))
+		g.Expect(*template.Spec.Data).To(ContainSubstring("/usr/local/share/ca-certificates/tinkerbell-metadata.crt"))
+		g.Expect(*template.Spec.Data).To(ContainSubstring("ca_certs:"))
+		g.Expect(*template.Spec.Data).To(ContainSubstring("MIIBdzCCAR2gAwIBAgIUTinkerbellTestCA"))
+	})
+
+	t.Run("fails_without_certificate_in_ca_bundle", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		hardwareUUID := uuid.New().String()
+		kubeClient := kubernetesClientWithObjects(t, objects(hardwareUUID, map[string]string{"ca.crt": "not a certificate"}))
+
+		_, err := reconcileMachineWithClient(kubeClient, tinkerbellMachineName, clusterNamespace)
+		g.Expect(err).To(MatchError(controllers.ErrInvalidMetadataCABundle))
+	})
+
+	t.Run("fails_without_ca_bundle_key", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		hardwareUUID := uuid.New().String()
+		kubeClient := kubernetesClientWithObjects(t, objects(hardwareUUID, nil))
+
+		_, err := reconcileMachineWithClient(kubeClient, tinkerbellMachineName, clusterNamespace)
+		g.Expect(err).To(MatchError(controllers.ErrMetadataCABundleKeyMissing))
+	})
+}
@@ -0,0 +1,332 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/cluster-api/util/patch"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+)
+
+const (
+	// HardwareAllocatedClusterAnnotation records the cluster allocated Hardware is used by, for usage accounting.
+	HardwareAllocatedClusterAnnotation = "v1alpha1.tinkerbell.org/allocatedCluster"
+
+	// HardwareUsageAccountedAtAnnotation records the time up to which the usage of allocated
+	// Hardware has been accounted.
+	HardwareUsageAccountedAtAnnotation = "v1alpha1.tinkerbell.org/usageAccountedAt"
+
+	// usageReportPeriod is the period covered by a TinkerbellUsageReport.
+	usageReportPeriod = 24 * time.Hour
+)
+
+//nolint:gochecknoglobals
+var hardwareUsageHours = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "capt_hardware_usage_hours_total",
+	Help: "Hardware-hours of Hardware allocated to clusters, by namespace, cluster, Hardware and hardware class.",
+}, []string{"namespace", "cluster", "hardware", "hardware_class"})
+
+//nolint:gochecknoinits
+func init() {
+	metrics.Registry.MustRegister(hardwareUsageHours)
+}
+
+// UsageAccountant accounts the time Hardware is allocated to clusters, from the moment a machine
+// takes ownership of the Hardware until it releases it. Usage is exposed as Prometheus counters and
+// recorded in a daily TinkerbellUsageReport of the namespace of the machine.
+type UsageAccountant struct {
+	Client client.Client
+
+	// Interval is the time between two accountings of the Hardware still allocated, so long
+	// allocations show up before they end.
+	Interval time.Duration
+
+	// HardwareClassLabel is the Hardware label usage is broken down by, e.g. the server model.
+	HardwareClassLabel string
+
+	// Now returns the current time. If not set, time.Now is used.
+	Now func() time.Time
+}
+
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=tinkerbellusagereports,verbs=get;list;watch;create;update
+
+// SetupWithManager registers the accountant to be started with the manager.
+func (a *UsageAccountant) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.Add(a); err != nil {
+		return fmt.Errorf("adding usage accountant to manager: %w", err)
+	}
+
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, so only the leader accounts usage.
+func (a *UsageAccountant) NeedLeaderElection() bool {
+	return true
+}
+
+// Start accounts the usage of allocated Hardware every interval until the context is cancelled.
+func (a *UsageAccountant) Start(ctx context.Context) error {
+	wait.UntilWithContext(ctx, a.AccountAllocated, a.Interval)
+
+	return nil
+}
+
+// AccountAllocated accounts the usage of all Hardware allocated to machines up to now.
+func (a *UsageAccountant) AccountAllocated(ctx context.Context) {
+	log := ctrl.LoggerFrom(ctx).WithName("usage-accountant")
+
+	hardwareList := &tinkv1.HardwareList{}
+	if err := a.Client.List(ctx, hardwareList, client.HasLabels{HardwareOwnerNameLabel}); err != nil {
+		log.Error(err, "Listing Hardware")
+
+		return
+	}
+
+	for i := range hardwareList.Items {
+		hardware := &hardwareList.Items[i]
+		if _, ok := hardware.Annotations[HardwareUsageAccountedAtAnnotation]; !ok {
+			continue
+		}
+
+		patchHelper, err := patch.NewHelper(hardware, a.Client)
+		if err != nil {
+			log.Error(err, "Initializing patch helper", "Hardware", client.ObjectKeyFromObject(hardware))
+
+			continue
+		}
+
+		if err := a.account(ctx, hardware); err != nil {
+			log.Error(err, "Accounting Hardware usage", "Hardware", client.ObjectKeyFromObject(hardware))
+
+			continue
+		}
+
+		if err := patchHelper.Patch(ctx, hardware); err != nil {
+			log.Error(err, "Patching Hardware", "Hardware", client.ObjectKeyFromObject(hardware))
+		}
+	}
+}
+
+func (a *UsageAccountant) now() time.Time {
+	if a.Now != nil {
+		return a.Now().UTC().Truncate(time.Second)
+	}
+
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+// startAllocation marks the Hardware as allocated to the cluster from now on, unless its
+// allocation is already being accounted. The caller persists the Hardware.
+func (a *UsageAccountant) startAllocation(hardware *tinkv1.Hardware, cluster string) {
+	if a == nil {
+		return
+	}
+
+	if hardware.Annotations == nil {
+		hardware.Annotations = map[string]string{}
+	}
+
+	if _, ok := hardware.Annotations[HardwareUsageAccountedAtAnnotation]; ok {
+		return
+	}
+
+	hardware.Annotations[HardwareAllocatedClusterAnnotation] = cluster
+	hardware.Annotations[HardwareUsageAccountedAtAnnotation] = a.now().Format(time.RFC3339)
+}
+
+// endAllocation accounts the usage of the Hardware up to now, as it is being released. The
+// caller clears the allocation annotations and persists the Hardware.
+func (a *UsageAccountant) endAllocation(ctx context.Context, hardware *tinkv1.Hardware) error {
+	if a == nil {
+		return nil
+	}
+
+	return a.account(ctx, hardware)
+}
+
+// account records the usage of the Hardware from its accounting checkpoint up to now, splitting
+// it between the daily reports it spans, and moves the checkpoint to now.
+func (a *UsageAccountant) account(ctx context.Context, hardware *tinkv1.Hardware) error {
+	accountedAt, ok := hardware.Annotations[HardwareUsageAccountedAtAnnotation]
+	if !ok {
+		return nil
+	}
+
+	now := a.now()
+
+	from, err := time.Parse(time.RFC3339, accountedAt)
+	if err != nil || !from.Before(now) {
+		hardware.Annotations[HardwareUsageAccountedAtAnnotation] = now.Format(time.RFC3339)
+
+		return nil
+	}
+
+	usage := infrastructurev1.HardwareUsage{
+		Hardware: hardware.Name,
+		Cluster:  hardware.Annotations[HardwareAllocatedClusterAnnotation],
+	}
+
+	if a.HardwareClassLabel != "" {
+		usage.HardwareClass = hardware.Labels[a.HardwareClassLabel]
+	}
+
+	namespace := hardware.Labels[HardwareOwnerNamespaceLabel]
+
+	var accounted int64
+
+	for start := from.UTC(); start.Before(now); {
+		day := start.Truncate(usageReportPeriod)
+
+		end := day.Add(usageReportPeriod)
+		if end.After(now) {
+			end = now
+		}
+
+		seconds, err := a.addToReport(ctx, namespace, day, usage, start, end)
+		if err != nil {
+			return err
+		}
+
+		accounted += seconds
+		start = end
+	}
+
+	hardwareUsageHours.WithLabelValues(namespace, usage.Cluster, usage.Hardware, usage.HardwareClass).
+		Add(time.Duration(accounted * int64(time.Second)).Hours())
+
+	hardware.Annotations[HardwareUsageAccountedAtAnnotation] = now.Format(time.RFC3339)
+
+	return nil
+}
+
+// addToReport adds the usage from start to end to the report of the day in the namespace, creating
+// the report if needed. It returns the seconds added.
+func (a *UsageAccountant) addToReport(ctx context.Context, namespace string, day time.Time,
+	usage infrastructurev1.HardwareUsage, start, end time.Time,
+) (int64, error) {
+	key := client.ObjectKey{Namespace: namespace, Name: "hardware-usage-" + day.Format("2006-01-02")}
+
+	var added int64
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		report := &infrastructurev1.TinkerbellUsageReport{}
+
+		err := a.Client.Get(ctx, key, report)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("getting TinkerbellUsageReport: %w", err)
+		}
+
+		create := apierrors.IsNotFound(err)
+		if create {
+			report = &infrastructurev1.TinkerbellUsageReport{
+				ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+				Spec: infrastructurev1.TinkerbellUsageReportSpec{
+					Start: metav1.NewTime(day),
+					End:   metav1.NewTime(day.Add(usageReportPeriod)),
+				},
+			}
+		}
+
+		if added = addUsage(&report.Status, usage, start, end); added == 0 {
+			return nil
+		}
+
+		if create {
+			return a.Client.Create(ctx, report) //nolint:wrapcheck
+		}
+
+		return a.Client.Update(ctx, report) //nolint:wrapcheck
+	})
+	if err != nil {
+		return 0, fmt.Errorf("updating TinkerbellUsageReport %s: %w", key, err)
+	}
+
+	return added, nil
+}
+
+// addUsage adds the usage from start to end to the entry of the same Hardware, class and cluster of
+// the report, skipping the part already accounted by the entry. It returns the seconds added.
+func addUsage(status *infrastructurev1.TinkerbellUsageReportStatus, usage infrastructurev1.HardwareUsage,
+	start, end time.Time,
+) int64 {
+	var entry *infrastructurev1.HardwareUsage
+
+	for i := range status.Usage {
+		e := &status.Usage[i]
+		if e.Hardware == usage.Hardware && e.Cluster == usage.Cluster && e.HardwareClass == usage.HardwareClass {
+			entry = e
+		}
+	}
+
+	if entry != nil && entry.AccountedUntil != nil && entry.AccountedUntil.Time.After(start) {
+		start = entry.AccountedUntil.Time
+	}
+
+	if !start.Before(end) {
+		return 0
+	}
+
+	seconds := int64(end.Sub(start).Seconds())
+
+	if entry == nil {
+		status.Usage = append(status.Usage, usage)
+		entry = &status.Usage[len(status.Usage)-1]
+	}
+
+	entry.Seconds += seconds
+	entry.AccountedUntil = &metav1.Time{Time: end}
+
+	sort.Slice(status.Usage, func(i, j int) bool {
+		if status.Usage[i].Cluster != status.Usage[j].Cluster {
+			return status.Usage[i].Cluster < status.Usage[j].Cluster
+		}
+
+		return status.Usage[i].Hardware < status.Usage[j].Hardware
+	})
+
+	var total int64
+
+	for i := range status.Usage {
+		status.Usage[i].Hours = secondsToHours(status.Usage[i].Seconds)
+		total += status.Usage[i].Seconds
+	}
+
+	status.TotalHours = secondsToHours(total)
+
+	return seconds
+}
+
+// secondsToHours returns the seconds in hours, rounded to the thousandth of an hour.
+func secondsToHours(seconds int64) resource.Quantity {
+	return *resource.NewMilliQuantity(seconds*1000/3600, resource.DecimalSI) //nolint:gomnd
+}
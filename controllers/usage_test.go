@@ -0,0 +1,137 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/controllers"
+)
+
+func Test_Hardware_usage_is_accounted_per_day(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	hardwareUUID := uuid.New().String()
+
+	hardware := validHardware(hardwareName, hardwareUUID, hardwareIP)
+	hardware.Labels = map[string]string{"example.com/model": "r640"}
+
+	machine := validMachine(machineName, clusterNamespace, clusterName)
+	machine.Spec.ClusterName = clusterName
+
+	kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+		validTinkerbellMachine(tinkerbellMachineName, clusterNamespace, machineName, hardwareUUID),
+		validCluster(clusterName, clusterNamespace),
+		validTinkerbellCluster(clusterName, clusterNamespace),
+		hardware,
+		machine,
+		validSecret(machineName, clusterNamespace),
+	})
+
+	now := time.Date(2026, time.January, 1, 22, 0, 0, 0, time.UTC)
+	accountant := &controllers.UsageAccountant{
+		Client:             kubeClient,
+		HardwareClassLabel: "example.com/model",
+		Now:                func() time.Time { return now },
+	}
+
+	reconcile := func() {
+		_, err := (&controllers.TinkerbellMachineReconciler{
+			Client:          kubeClient,
+			UsageAccountant: accountant,
+		}).Reconcile(context.Background(), ctrl.Request{
+			NamespacedName: types.NamespacedName{Name: tinkerbellMachineName, Namespace: clusterNamespace},
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+
+	reconcile()
+
+	hardwareKey := types.NamespacedName{Name: hardwareName, Namespace: clusterNamespace}
+	updatedHardware := &tinkv1.Hardware{}
+	g.Expect(kubeClient.Get(context.Background(), hardwareKey, updatedHardware)).To(Succeed())
+	g.Expect(updatedHardware.Annotations).To(HaveKeyWithValue(controllers.HardwareAllocatedClusterAnnotation, clusterName))
+	g.Expect(updatedHardware.Annotations).To(HaveKeyWithValue(controllers.HardwareUsageAccountedAtAnnotation,
+		"2026-01-01T22:00:00Z"))
+
+	// Reconciling the machine again must not restart the allocation.
+	now = now.Add(time.Hour)
+	reconcile()
+
+	now = now.Add(150 * time.Minute)
+	accountant.AccountAllocated(context.Background())
+
+	g.Expect(kubeClient.Get(context.Background(), hardwareKey, updatedHardware)).To(Succeed())
+	g.Expect(updatedHardware.Annotations).To(HaveKeyWithValue(controllers.HardwareUsageAccountedAtAnnotation,
+		"2026-01-02T01:30:00Z"))
+
+	firstDay := &infrastructurev1.TinkerbellUsageReport{}
+	g.Expect(kubeClient.Get(context.Background(),
+		types.NamespacedName{Name: "hardware-usage-2026-01-01", Namespace: clusterNamespace}, firstDay)).To(Succeed())
+	g.Expect(firstDay.Spec.Start.Time).To(BeTemporally("==", time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)))
+	g.Expect(firstDay.Status.Usage).To(HaveLen(1))
+	g.Expect(firstDay.Status.Usage[0].Hardware).To(Equal(hardwareName))
+	g.Expect(firstDay.Status.Usage[0].Cluster).To(Equal(clusterName))
+	g.Expect(firstDay.Status.Usage[0].HardwareClass).To(Equal("r640"))
+	g.Expect(firstDay.Status.Usage[0].Seconds).To(Equal(int64(2 * 3600)))
+	g.Expect(firstDay.Status.TotalHours.Cmp(resource.MustParse("2"))).To(Equal(0))
+
+	secondDay := &infrastructurev1.TinkerbellUsageReport{}
+	g.Expect(kubeClient.Get(context.Background(),
+		types.NamespacedName{Name: "hardware-usage-2026-01-02", Namespace: clusterNamespace}, secondDay)).To(Succeed())
+	g.Expect(secondDay.Status.Usage).To(HaveLen(1))
+	g.Expect(secondDay.Status.Usage[0].Seconds).To(Equal(int64(90 * 60)))
+	g.Expect(secondDay.Status.TotalHours.Cmp(resource.MustParse("1.5"))).To(Equal(0))
+
+	// Accounting again adds only the time elapsed since the last accounting.
+	now = now.Add(30 * time.Minute)
+	accountant.AccountAllocated(context.Background())
+
+	g.Expect(kubeClient.Get(context.Background(),
+		types.NamespacedName{Name: "hardware-usage-2026-01-02", Namespace: clusterNamespace}, secondDay)).To(Succeed())
+	g.Expect(secondDay.Status.Usage[0].Seconds).To(Equal(int64(2 * 3600)))
+
+	// An accounting from a stale checkpoint, e.g. racing with the release of the Hardware, only adds
+	// the time not accounted yet.
+	g.Expect(kubeClient.Get(context.Background(), hardwareKey, updatedHardware)).To(Succeed())
+	updatedHardware.Annotations[controllers.HardwareUsageAccountedAtAnnotation] = "2026-01-01T23:00:00Z"
+	g.Expect(kubeClient.Update(context.Background(), updatedHardware)).To(Succeed())
+
+	now = now.Add(30 * time.Minute)
+	accountant.AccountAllocated(context.Background())
+
+	g.Expect(kubeClient.Get(context.Background(),
+		types.NamespacedName{Name: "hardware-usage-2026-01-01", Namespace: clusterNamespace}, firstDay)).To(Succeed())
+	g.Expect(firstDay.Status.Usage[0].Seconds).To(Equal(int64(2 * 3600)))
+
+	g.Expect(kubeClient.Get(context.Background(),
+		types.NamespacedName{Name: "hardware-usage-2026-01-02", Namespace: clusterNamespace}, secondDay)).To(Succeed())
+	g.Expect(secondDay.Status.Usage[0].Seconds).To(Equal(int64(150 * 60)))
+}
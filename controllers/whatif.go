@@ -0,0 +1,67 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+)
+
+// AllocationSimulation is the outcome of simulating the Hardware selection of new machines.
+type AllocationSimulation struct {
+	// Requested is the number of simulated machines.
+	Requested int `json:"requested"`
+
+	// Selected is the Hardware the machines would be provisioned on, in order of creation.
+	Selected []client.ObjectKey `json:"selected"`
+
+	// Shortfall is the number of machines no Hardware would be available for.
+	Shortfall int `json:"shortfall"`
+}
+
+// SimulateAllocation runs the Hardware selection of machines for the given number of new machines
+// created from the TinkerbellMachineTemplate, without taking ownership of any Hardware. Each
+// machine gets the Hardware it would pick once the previous machines took theirs. The selector
+// determines the Hardware available, like for the machines of its cluster. Replacements of
+// remediated machines take Hardware from the remediation reserve of the cluster first.
+func SimulateAllocation(ctx context.Context, selector *HardwareSelector,
+	template *infrastructurev1.TinkerbellMachineTemplate, machines int, replacements bool,
+) (*AllocationSimulation, error) {
+	available, err := selector.SelectForMachine(ctx, template.Spec.Template.Spec.HardwareAffinity, replacements)
+	if err != nil {
+		return nil, err
+	}
+
+	simulation := &AllocationSimulation{
+		Requested: machines,
+		Selected:  []client.ObjectKey{},
+	}
+
+	// All machines share the affinity of the template, so taking Hardware only removes it from the
+	// front of the preference order of the next machine. The topology domains the cluster may use
+	// don't change either, as its own claims don't exclude domains.
+	for i := 0; i < machines && i < len(available); i++ {
+		simulation.Selected = append(simulation.Selected, client.ObjectKeyFromObject(&available[i]))
+	}
+
+	simulation.Shortfall = machines - len(simulation.Selected)
+
+	return simulation, nil
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/controllers"
+)
+
+func Test_SimulateAllocation(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	affinity := &infrastructurev1.HardwareAffinity{
+		Required: []infrastructurev1.HardwareAffinityTerm{
+			{LabelSelector: metav1.LabelSelector{MatchLabels: map[string]string{"type": "worker"}}},
+		},
+		Preferred: []infrastructurev1.WeightedHardwareAffinityTerm{
+			{
+				Weight: 50,
+				HardwareAffinityTerm: infrastructurev1.HardwareAffinityTerm{
+					LabelSelector: metav1.LabelSelector{MatchLabels: map[string]string{"rack": "b"}},
+				},
+			},
+		},
+	}
+
+	template := &infrastructurev1.TinkerbellMachineTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: "workers", Namespace: clusterNamespace},
+		Spec: infrastructurev1.TinkerbellMachineTemplateSpec{
+			Template: infrastructurev1.TinkerbellMachineTemplateResource{
+				Spec: infrastructurev1.TinkerbellMachineSpec{HardwareAffinity: affinity},
+			},
+		},
+	}
+
+	worker := func(name, rack string) *tinkv1.Hardware {
+		return validHardware(name, uuid.New().String(), "10.0.0.1", testOptions{
+			Labels: map[string]string{"type": "worker", "rack": rack},
+		})
+	}
+
+	controlPlane := validHardware("cp", uuid.New().String(), "10.0.0.2", testOptions{
+		Labels: map[string]string{"type": "control-plane", "rack": "b"},
+	})
+
+	taken := worker("taken", "b")
+	taken.Labels[controllers.HardwareOwnerNameLabel] = "other"
+
+	kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+		template,
+		worker("worker-a1", "a"),
+		worker("worker-a2", "a"),
+		worker("worker-b1", "b"),
+		controlPlane,
+		taken,
+	})
+
+	ctx := context.Background()
+	selector := &controllers.HardwareSelector{Client: kubeClient}
+
+	simulation, err := controllers.SimulateAllocation(ctx, selector, template, 2, false)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(simulation.Selected).To(Equal([]client.ObjectKey{
+		{Namespace: clusterNamespace, Name: "worker-b1"},
+		{Namespace: clusterNamespace, Name: "worker-a1"},
+	}))
+	g.Expect(simulation.Shortfall).To(BeZero())
+
+	simulation, err = controllers.SimulateAllocation(ctx, selector, template, 5, false)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(simulation.Selected).To(HaveLen(3))
+	g.Expect(simulation.Shortfall).To(Equal(2))
+
+	hardware := &tinkv1.Hardware{}
+	g.Expect(kubeClient.Get(ctx, types.NamespacedName{Name: "worker-b1", Namespace: clusterNamespace}, hardware)).To(Succeed())
+	g.Expect(hardware.Labels).NotTo(HaveKey(controllers.HardwareOwnerNameLabel), "Expected simulation not to take ownership")
+}
+
+func Test_SimulateAllocation_for_cluster(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	template := &infrastructurev1.TinkerbellMachineTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: "workers", Namespace: clusterNamespace},
+	}
+
+	hardware := func(name, rack string, labels map[string]string) *tinkv1.Hardware {
+		options := testOptions{Labels: map[string]string{rackLabel: rack}}
+		for key, value := range labels {
+			options.Labels[key] = value
+		}
+
+		return validHardware(name, uuid.New().String(), "10.0.0.1", options)
+	}
+
+	reserved := map[string]string{
+		controllers.HardwareReservedForClusterLabel:   clusterName,
+		controllers.HardwareReservedForNamespaceLabel: clusterNamespace,
+	}
+
+	tinkerbellCluster := validTinkerbellCluster(clusterName, clusterNamespace)
+	tinkerbellCluster.Spec.RemediationReserve = &infrastructurev1.RemediationReserve{Size: 1}
+
+	kubeClient := kubernetesClientWithObjects(t, []runtime.Object{
+		template,
+		exclusiveTinkerbellCluster(otherClusterName, "rack-a"),
+		hardware("hw-a", "rack-a", nil),
+		hardware("hw-b", "rack-b", nil),
+		hardware("hw-reserved", "rack-b", reserved),
+	})
+
+	selector := &controllers.HardwareSelector{
+		Client:            kubeClient,
+		TinkerbellCluster: tinkerbellCluster,
+		ClusterName:       clusterName,
+	}
+
+	simulation, err := controllers.SimulateAllocation(context.Background(), selector, template, 2, false)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(simulation.Selected).To(Equal([]client.ObjectKey{{Namespace: clusterNamespace, Name: "hw-b"}}),
+		"Expected Hardware in racks claimed by other clusters and reserved Hardware not to be selected")
+	g.Expect(simulation.Shortfall).To(Equal(1))
+
+	simulation, err = controllers.SimulateAllocation(context.Background(), selector, template, 2, true)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(simulation.Selected).To(Equal([]client.ObjectKey{
+		{Namespace: clusterNamespace, Name: "hw-reserved"},
+		{Namespace: clusterNamespace, Name: "hw-b"},
+	}), "Expected replacements to take reserved Hardware first")
+	g.Expect(simulation.Shortfall).To(BeZero())
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cloudinit combines cloud-init user data parts into a MIME multipart document.
+package cloudinit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+const (
+	// ContentTypeCloudConfig is the MIME type of cloud-config parts.
+	ContentTypeCloudConfig = "text/cloud-config"
+	// ContentTypeJinja2 is the MIME type of parts rendered as Jinja templates by cloud-init.
+	ContentTypeJinja2 = "text/jinja2"
+
+	jinjaHeader    = "## template: jinja"
+	boundaryLength = 32
+)
+
+// Part is a single part of the user data.
+type Part struct {
+	// Filename names the part.
+	Filename string
+	// ContentType is the MIME type of the part. Defaults to ContentTypeCloudConfig.
+	ContentType string
+	// MergeType controls how cloud-init merges the part into the preceding parts.
+	MergeType string
+	// Content is the part itself.
+	Content string
+}
+
+// ContentTypeOf returns the MIME type of a user data document based on its header, as detected by
+// cloud-init.
+func ContentTypeOf(content string) string {
+	if strings.HasPrefix(content, jinjaHeader) {
+		return ContentTypeJinja2
+	}
+
+	return ContentTypeCloudConfig
+}
+
+// Multipart returns a MIME multipart document with the given parts, in order. The document only
+// depends on the parts, so the same parts always result in the same document.
+func Multipart(parts []Part) (string, error) {
+	buf := &bytes.Buffer{}
+	writer := multipart.NewWriter(buf)
+
+	if err := writer.SetBoundary(boundary(parts)); err != nil {
+		return "", fmt.Errorf("setting boundary: %w", err)
+	}
+
+	for _, part := range parts {
+		contentType := part.ContentType
+		if contentType == "" {
+			contentType = ContentTypeCloudConfig
+		}
+
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", fmt.Sprintf("%s; charset=\"utf-8\"", contentType))
+		header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", part.Filename))
+		header.Set("Content-Transfer-Encoding", "7bit")
+
+		if part.MergeType != "" {
+			header.Set("Merge-Type", part.MergeType)
+		}
+
+		w, err := writer.CreatePart(header)
+		if err != nil {
+			return "", fmt.Errorf("creating part %s: %w", part.Filename, err)
+		}
+
+		if _, err := w.Write([]byte(part.Content)); err != nil {
+			return "", fmt.Errorf("writing part %s: %w", part.Filename, err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", fmt.Errorf("closing multipart document: %w", err)
+	}
+
+	return fmt.Sprintf("Content-Type: multipart/mixed; boundary=%q\nMIME-Version: 1.0\n\n%s",
+		writer.Boundary(), buf.String()), nil
+}
+
+// boundary derives the boundary from the parts, which makes it stable and practically impossible
+// to occur in them.
+func boundary(parts []Part) string {
+	hash := sha256.New()
+
+	for _, part := range parts {
+		fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%s\x00", part.Filename, part.ContentType, part.MergeType, part.Content)
+	}
+
+	return "==CAPT" + hex.EncodeToString(hash.Sum(nil))[:boundaryLength]
+}
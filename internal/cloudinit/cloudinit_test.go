@@ -0,0 +1,80 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudinit_test
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/internal/cloudinit"
+)
+
+func Test_Multipart(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	parts := []cloudinit.Part{
+		{
+			Filename:    "bootstrap",
+			ContentType: cloudinit.ContentTypeOf("## template: jinja\n#cloud-config\nruncmd: [kubeadm join]\n"),
+			Content:     "## template: jinja\n#cloud-config\nruncmd: [kubeadm join]\n",
+		},
+		{
+			Filename:  "packages",
+			MergeType: "list(append)+dict(no_replace,recurse_list)+str()",
+			Content:   "#cloud-config\npackages: [htop]\n",
+		},
+	}
+
+	document, err := cloudinit.Multipart(parts)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	again, err := cloudinit.Multipart(parts)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(again).To(Equal(document), "Expected the same parts to result in the same document")
+
+	message, err := mail.ReadMessage(strings.NewReader(document))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mediaType).To(Equal("multipart/mixed"))
+
+	reader := multipart.NewReader(message.Body, params["boundary"])
+
+	bootstrap, err := reader.NextPart()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(bootstrap.FileName()).To(Equal("bootstrap"))
+	g.Expect(bootstrap.Header.Get("Content-Type")).To(HavePrefix(cloudinit.ContentTypeJinja2))
+	g.Expect(io.ReadAll(bootstrap)).To(BeEquivalentTo(parts[0].Content))
+
+	packages, err := reader.NextPart()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(packages.FileName()).To(Equal("packages"))
+	g.Expect(packages.Header.Get("Content-Type")).To(HavePrefix(cloudinit.ContentTypeCloudConfig))
+	g.Expect(packages.Header.Get("Merge-Type")).To(Equal(parts[1].MergeType))
+	g.Expect(io.ReadAll(packages)).To(BeEquivalentTo(parts[1].Content))
+
+	_, err = reader.NextPart()
+	g.Expect(err).To(Equal(io.EOF))
+}
@@ -0,0 +1,620 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package imagecache implements a caching HTTP proxy for machine images. Each upstream image is
+// downloaded once, verified against its checksum and served to all provisions from local disk.
+//
+// Images are requested as /<scheme>/<host>/<path>, e.g. /https/example.com/ubuntu.gz proxies
+// https://example.com/ubuntu.gz. RewriteURL converts image URLs into this form. Only images of the
+// allowed registry hosts are proxied.
+package imagecache
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ChecksumSuffix is appended to an image URL to get the URL of its SHA-256 checksum file, in
+	// the format written by sha256sum.
+	ChecksumSuffix = ".sha256"
+
+	partialSuffix = ".partial"
+	// maxRedirects is the number of redirects http.Client follows by default.
+	maxRedirects = 10
+
+	defaultDownloadTimeout = time.Hour
+	dialTimeout            = 30 * time.Second
+	responseHeaderTimeout  = 30 * time.Second
+	idleConnTimeout        = 90 * time.Second
+)
+
+var (
+	// ErrChecksumMismatch is returned when a downloaded image does not match its checksum.
+	ErrChecksumMismatch = fmt.Errorf("image checksum mismatch")
+	// ErrChecksumMissing is returned when checksums are required but the image has none.
+	ErrChecksumMissing = fmt.Errorf("image checksum missing")
+	// ErrInvalidImagePath is returned for requests not in the /<scheme>/<host>/<path> form.
+	ErrInvalidImagePath = fmt.Errorf("image path must be /<scheme>/<host>/<path>")
+	// ErrUnexpectedStatus is returned when the upstream answers with a non 200 HTTP status.
+	ErrUnexpectedStatus = fmt.Errorf("unexpected HTTP status")
+	// ErrImageTooLarge is returned when an image does not fit into the cache.
+	ErrImageTooLarge = fmt.Errorf("image is larger than the cache")
+	// ErrHostNotAllowed is returned for images of hosts which are not in the allowed hosts.
+	ErrHostNotAllowed = fmt.Errorf("image host is not allowed")
+	// ErrTooManyRedirects is returned when the upstream redirects more often than http.Client allows.
+	ErrTooManyRedirects = fmt.Errorf("too many redirects")
+	// ErrNoAllowedHosts is returned when a Cache is created without allowed hosts.
+	ErrNoAllowedHosts = fmt.Errorf("at least one allowed image host is required")
+	// ErrCacheFull is returned when an image does not fit next to the images being downloaded.
+	ErrCacheFull = fmt.Errorf("cache is full with images being downloaded")
+)
+
+// Options configure a Cache.
+type Options struct {
+	// Dir is the directory images are stored in. Images already in it are served after a restart.
+	Dir string
+
+	// MaxBytes caps the total size of the cached images. The least recently used images are
+	// evicted to stay below it.
+	MaxBytes int64
+
+	// AllowedHosts are the registry hosts images are downloaded from. An entry without a port
+	// allows all ports of the host. Requests for images of other hosts, including redirects to
+	// them, are rejected.
+	AllowedHosts []string
+
+	// RequireChecksum rejects images without a checksum file. Otherwise, images are only verified
+	// if the upstream provides a checksum.
+	RequireChecksum bool
+
+	// Client is used to download images. If nil, a client with dial, response header and idle
+	// connection timeouts is used.
+	Client *http.Client
+
+	// DownloadTimeout bounds the download of an image, including its checksum. Defaults to an hour.
+	DownloadTimeout time.Duration
+}
+
+// Cache is an http.Handler serving images from local disk, downloading them on first use.
+type Cache struct {
+	opts Options
+
+	mu       sync.Mutex
+	size     int64
+	reserved int64
+	lru      *list.List
+	entries  map[string]*list.Element
+	inflight map[string]*download
+}
+
+type entry struct {
+	name string
+	size int64
+}
+
+// download is an image being fetched from upstream, which concurrent requests wait for.
+type download struct {
+	done chan struct{}
+	err  error
+}
+
+// New returns a Cache for the given options, indexing images already present in the cache
+// directory.
+func New(opts Options) (*Cache, error) {
+	if len(opts.AllowedHosts) == 0 {
+		return nil, ErrNoAllowedHosts
+	}
+
+	if opts.Client == nil {
+		opts.Client = defaultClient()
+	}
+
+	if opts.DownloadTimeout == 0 {
+		opts.DownloadTimeout = defaultDownloadTimeout
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0o750); err != nil { //nolint:gomnd
+		return nil, fmt.Errorf("creating cache directory: %w", err)
+	}
+
+	c := &Cache{
+		opts:     opts,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+		inflight: map[string]*download{},
+	}
+
+	// Redirects are followed only to allowed hosts, so an allowed registry can't be used to reach
+	// others.
+	client := *opts.Client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !c.allowed(req.URL.Host) {
+			return fmt.Errorf("%w: redirect to %s", ErrHostNotAllowed, req.URL.Host)
+		}
+
+		if opts.Client.CheckRedirect != nil {
+			return opts.Client.CheckRedirect(req, via)
+		}
+
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("%w: %d", ErrTooManyRedirects, len(via))
+		}
+
+		return nil
+	}
+	c.opts.Client = &client
+
+	if err := c.index(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// defaultClient returns a client which gives up on upstreams not accepting connections or not
+// answering requests, instead of blocking the download of an image forever.
+func defaultClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert
+	transport.DialContext = (&net.Dialer{Timeout: dialTimeout, KeepAlive: dialTimeout}).DialContext
+	transport.ResponseHeaderTimeout = responseHeaderTimeout
+	transport.IdleConnTimeout = idleConnTimeout
+
+	return &http.Client{Transport: transport}
+}
+
+// index adds the images in the cache directory to the LRU, the most recently modified first, and
+// removes leftovers of interrupted downloads.
+func (c *Cache) index() error {
+	dirEntries, err := os.ReadDir(c.opts.Dir)
+	if err != nil {
+		return fmt.Errorf("reading cache directory: %w", err)
+	}
+
+	type cached struct {
+		entry
+		modTime int64
+	}
+
+	var images []cached
+
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() {
+			continue
+		}
+
+		if strings.HasSuffix(dirEntry.Name(), partialSuffix) {
+			_ = os.Remove(filepath.Join(c.opts.Dir, dirEntry.Name()))
+
+			continue
+		}
+
+		info, err := dirEntry.Info()
+		if err != nil {
+			return fmt.Errorf("reading cached image: %w", err)
+		}
+
+		images = append(images, cached{
+			entry:   entry{name: dirEntry.Name(), size: info.Size()},
+			modTime: info.ModTime().UnixNano(),
+		})
+	}
+
+	sort.Slice(images, func(i, j int) bool { return images[i].modTime > images[j].modTime })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, image := range images {
+		c.entries[image.name] = c.lru.PushBack(&entry{name: image.name, size: image.size})
+		c.size += image.size
+	}
+
+	c.evictLocked(0)
+
+	return nil
+}
+
+// RewriteURL returns the URL of imageURL when served through the cache at cacheURL. Image URLs
+// without a scheme are assumed to be https.
+func RewriteURL(cacheURL, imageURL string) (string, error) {
+	if !strings.Contains(imageURL, "://") {
+		imageURL = "https://" + imageURL
+	}
+
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return "", fmt.Errorf("parsing image URL: %w", err)
+	}
+
+	rewritten := strings.TrimSuffix(cacheURL, "/") + "/" + u.Scheme + "/" + u.Host + u.EscapedPath()
+	if u.RawQuery != "" {
+		rewritten += "?" + u.RawQuery
+	}
+
+	return rewritten, nil
+}
+
+// allowed returns whether images may be downloaded from host, given as host or host:port.
+func (c *Cache) allowed(host string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+
+	for _, allowed := range c.opts.AllowedHosts {
+		if strings.EqualFold(allowed, host) || strings.EqualFold(allowed, hostname) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// upstreamURL returns the upstream URL of a request in the /<scheme>/<host>/<path> form.
+func upstreamURL(r *http.Request) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/", 3) //nolint:gomnd
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+		return "", ErrInvalidImagePath
+	}
+
+	if parts[0] != "http" && parts[0] != "https" {
+		return "", ErrInvalidImagePath
+	}
+
+	upstream := parts[0] + "://" + parts[1] + "/" + parts[2]
+	if r.URL.RawQuery != "" {
+		upstream += "?" + r.URL.RawQuery
+	}
+
+	return upstream, nil
+}
+
+func cacheName(upstream string) string {
+	sum := sha256.Sum256([]byte(upstream))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// ServeHTTP serves the requested image from disk, downloading it first if it is not cached.
+func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	upstream, err := upstreamURL(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+
+		return
+	}
+
+	if u, err := url.Parse(upstream); err != nil || !c.allowed(u.Host) {
+		requestsTotal.WithLabelValues(resultError).Inc()
+		http.Error(w, ErrHostNotAllowed.Error(), http.StatusForbidden)
+
+		return
+	}
+
+	file, err := c.open(r.Context(), upstream)
+	if err != nil {
+		requestsTotal.WithLabelValues(resultError).Inc()
+		http.Error(w, err.Error(), http.StatusBadGateway)
+
+		return
+	}
+
+	defer file.Close() //nolint:errcheck
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	// The file stays readable even if it is evicted while being served.
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
+
+// open returns the cached image of upstream, downloading it if needed.
+func (c *Cache) open(ctx context.Context, upstream string) (*os.File, error) {
+	name := cacheName(upstream)
+
+	for {
+		c.mu.Lock()
+
+		if elem, ok := c.entries[name]; ok {
+			c.lru.MoveToFront(elem)
+			c.mu.Unlock()
+
+			file, err := os.Open(filepath.Join(c.opts.Dir, name))
+			if err == nil {
+				requestsTotal.WithLabelValues(resultHit).Inc()
+
+				return file, nil
+			}
+
+			// The image was evicted in the meantime, or removed behind the cache's back.
+			c.mu.Lock()
+			if c.entries[name] == elem {
+				c.removeLocked(elem)
+			}
+			c.mu.Unlock()
+
+			continue
+		}
+
+		d, ok := c.inflight[name]
+		if !ok {
+			d = &download{done: make(chan struct{})}
+			c.inflight[name] = d
+			c.mu.Unlock()
+
+			requestsTotal.WithLabelValues(resultMiss).Inc()
+
+			// The download is not bound to the request, as other requests may be waiting for it.
+			fetchCtx, cancel := context.WithTimeout(context.Background(), c.opts.DownloadTimeout) //nolint:contextcheck
+			d.err = c.fetch(fetchCtx, upstream, name)
+			cancel()
+
+			c.mu.Lock()
+			delete(c.inflight, name)
+			c.mu.Unlock()
+			close(d.done)
+
+			if d.err != nil {
+				return nil, d.err
+			}
+
+			continue
+		}
+
+		c.mu.Unlock()
+
+		select {
+		case <-d.done:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for image download: %w", ctx.Err())
+		}
+
+		if d.err != nil {
+			return nil, d.err
+		}
+	}
+}
+
+// fetch downloads upstream into the cache, verifying its checksum.
+func (c *Cache) fetch(ctx context.Context, upstream, name string) error {
+	checksum, err := c.checksum(ctx, upstream)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.get(ctx, upstream)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	// The space of the image is reserved while it is downloaded, so concurrent downloads can't
+	// exceed MaxBytes together.
+	r := &reservation{cache: c, upstream: upstream}
+	defer r.release()
+
+	if err := r.grow(resp.ContentLength); err != nil {
+		return err
+	}
+
+	partial := filepath.Join(c.opts.Dir, name+partialSuffix)
+
+	file, err := os.Create(partial)
+	if err != nil {
+		return fmt.Errorf("creating cache file: %w", err)
+	}
+
+	defer os.Remove(partial) //nolint:errcheck
+
+	hash := sha256.New()
+
+	size, err := io.Copy(io.MultiWriter(r, file, hash), resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("downloading %s: %w", upstream, err)
+	}
+
+	if checksum != "" && !strings.EqualFold(checksum, hex.EncodeToString(hash.Sum(nil))) {
+		return fmt.Errorf("%w: %s", ErrChecksumMismatch, upstream)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.reserved -= r.bytes
+	r.bytes = 0
+	c.evictLocked(size)
+
+	if err := os.Rename(partial, filepath.Join(c.opts.Dir, name)); err != nil {
+		return fmt.Errorf("storing image: %w", err)
+	}
+
+	c.entries[name] = c.lru.PushFront(&entry{name: name, size: size})
+	c.size += size
+	cacheSize.Set(float64(c.size))
+
+	return nil
+}
+
+// checksum returns the expected SHA-256 of upstream, or an empty string if the upstream has no
+// checksum and checksums are not required.
+func (c *Cache) checksum(ctx context.Context, upstream string) (string, error) {
+	checksumURL := upstream + ChecksumSuffix
+	if i := strings.Index(upstream, "?"); i >= 0 {
+		checksumURL = upstream[:i] + ChecksumSuffix + upstream[i:]
+	}
+
+	resp, err := c.do(ctx, checksumURL)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound && !c.opts.RequireChecksum:
+		return "", nil
+	case resp.StatusCode == http.StatusNotFound:
+		return "", fmt.Errorf("%w: %s", ErrChecksumMissing, checksumURL)
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("%w: %s returned %d", ErrUnexpectedStatus, checksumURL, resp.StatusCode)
+	}
+
+	// sha256sum writes "<checksum>  <file name>".
+	scanner := bufio.NewScanner(resp.Body)
+	if !scanner.Scan() {
+		return "", fmt.Errorf("%w: empty checksum file %s", ErrChecksumMissing, checksumURL)
+	}
+
+	fields := strings.Fields(scanner.Text())
+	if len(fields) == 0 {
+		return "", fmt.Errorf("%w: empty checksum file %s", ErrChecksumMissing, checksumURL)
+	}
+
+	return fields[0], nil
+}
+
+// get requests rawURL and fails unless the upstream answers with 200.
+func (c *Cache) get(ctx context.Context, rawURL string) (*http.Response, error) {
+	resp, err := c.do(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close() //nolint:errcheck,gosec
+
+		return nil, fmt.Errorf("%w: %s returned %d", ErrUnexpectedStatus, rawURL, resp.StatusCode)
+	}
+
+	return resp, nil
+}
+
+func (c *Cache) do(ctx context.Context, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	resp, err := c.opts.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting %s: %w", rawURL, err)
+	}
+
+	return resp, nil
+}
+
+// reservation is the space reserved for an image being downloaded. It implements io.Writer to
+// grow with the bytes written.
+type reservation struct {
+	cache    *Cache
+	upstream string
+	bytes    int64
+	written  int64
+}
+
+// grow reserves the space for an image of total bytes, evicting images to make room for it.
+func (r *reservation) grow(total int64) error {
+	if total <= r.bytes {
+		return nil
+	}
+
+	if total > r.cache.opts.MaxBytes {
+		return fmt.Errorf("%w: %s has more than %d bytes", ErrImageTooLarge, r.upstream, r.cache.opts.MaxBytes)
+	}
+
+	r.cache.mu.Lock()
+	defer r.cache.mu.Unlock()
+
+	if r.cache.reserved+total-r.bytes > r.cache.opts.MaxBytes {
+		return fmt.Errorf("%w: %s", ErrCacheFull, r.upstream)
+	}
+
+	r.cache.reserved += total - r.bytes
+	r.bytes = total
+	r.cache.evictLocked(0)
+
+	return nil
+}
+
+func (r *reservation) Write(p []byte) (int, error) {
+	r.written += int64(len(p))
+	if err := r.grow(r.written); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// release frees the space still reserved.
+func (r *reservation) release() {
+	r.cache.mu.Lock()
+	defer r.cache.mu.Unlock()
+
+	r.cache.reserved -= r.bytes
+	r.bytes = 0
+}
+
+// evictLocked removes the least recently used images until an image of the given size fits next
+// to the images being downloaded.
+func (c *Cache) evictLocked(incoming int64) {
+	for c.size+c.reserved+incoming > c.opts.MaxBytes && c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back())
+		evictionsTotal.Inc()
+	}
+}
+
+// removeLocked drops the image of the LRU element from the cache.
+func (c *Cache) removeLocked(elem *list.Element) {
+	e := elem.Value.(*entry) //nolint:forcetypeassert
+
+	c.lru.Remove(elem)
+	delete(c.entries, e.name)
+	c.size -= e.size
+
+	_ = os.Remove(filepath.Join(c.opts.Dir, e.name))
+
+	cacheSize.Set(float64(c.size))
+}
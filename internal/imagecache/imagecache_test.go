@@ -0,0 +1,395 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagecache_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/internal/imagecache"
+)
+
+// upstream serves images and their checksum files, counting image downloads.
+type upstream struct {
+	images    map[string]string
+	checksums map[string]string
+	downloads int32
+}
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, imagecache.ChecksumSuffix) {
+		checksum, ok := u.checksums[strings.TrimSuffix(r.URL.Path, imagecache.ChecksumSuffix)]
+		if !ok {
+			http.NotFound(w, r)
+
+			return
+		}
+
+		_, _ = io.WriteString(w, checksum+"  image.gz\n")
+
+		return
+	}
+
+	image, ok := u.images[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	atomic.AddInt32(&u.downloads, 1)
+	_, _ = io.WriteString(w, image)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// host returns the host:port of a test server.
+func host(server *httptest.Server) string {
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func newCache(t *testing.T, opts imagecache.Options) (*httptest.Server, string) {
+	t.Helper()
+
+	if opts.Dir == "" {
+		opts.Dir = t.TempDir()
+	}
+
+	cache, err := imagecache.New(opts)
+	if err != nil {
+		t.Fatalf("creating cache: %v", err)
+	}
+
+	server := httptest.NewServer(cache)
+	t.Cleanup(server.Close)
+
+	return server, opts.Dir
+}
+
+func fetch(t *testing.T, url string) (int, string) {
+	t.Helper()
+
+	resp, err := http.Get(url) //nolint:gosec,noctx
+	if err != nil {
+		t.Fatalf("requesting %s: %v", url, err)
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading %s: %v", url, err)
+	}
+
+	return resp.StatusCode, string(body)
+}
+
+func Test_Cache_serves_verified_images_from_disk(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	images := &upstream{
+		images:    map[string]string{"/ubuntu.gz": "ubuntu image"},
+		checksums: map[string]string{"/ubuntu.gz": sha256Hex("ubuntu image")},
+	}
+
+	registry := httptest.NewServer(images)
+	defer registry.Close()
+
+	cache, _ := newCache(t, imagecache.Options{MaxBytes: 1024, AllowedHosts: []string{host(registry)}})
+
+	imageURL, err := imagecache.RewriteURL(cache.URL, registry.URL+"/ubuntu.gz")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			status, body := fetch(t, imageURL)
+			g.Expect(status).To(Equal(http.StatusOK))
+			g.Expect(body).To(Equal("ubuntu image"))
+		}()
+	}
+
+	wg.Wait()
+
+	status, body := fetch(t, imageURL)
+	g.Expect(status).To(Equal(http.StatusOK))
+	g.Expect(body).To(Equal("ubuntu image"))
+
+	g.Expect(atomic.LoadInt32(&images.downloads)).To(BeEquivalentTo(1), "Expected the image to be downloaded once")
+}
+
+func Test_Cache_rejects_images_with_invalid_checksum(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	images := &upstream{
+		images:    map[string]string{"/ubuntu.gz": "tampered image", "/flatcar.gz": "flatcar image"},
+		checksums: map[string]string{"/ubuntu.gz": sha256Hex("ubuntu image")},
+	}
+
+	registry := httptest.NewServer(images)
+	defer registry.Close()
+
+	cache, dir := newCache(t, imagecache.Options{
+		MaxBytes:        1024,
+		AllowedHosts:    []string{host(registry)},
+		RequireChecksum: true,
+	})
+
+	imageURL, err := imagecache.RewriteURL(cache.URL, registry.URL+"/ubuntu.gz")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	status, body := fetch(t, imageURL)
+	g.Expect(status).To(Equal(http.StatusBadGateway))
+	g.Expect(body).To(ContainSubstring(imagecache.ErrChecksumMismatch.Error()))
+
+	imageURL, err = imagecache.RewriteURL(cache.URL, registry.URL+"/flatcar.gz")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	status, body = fetch(t, imageURL)
+	g.Expect(status).To(Equal(http.StatusBadGateway))
+	g.Expect(body).To(ContainSubstring(imagecache.ErrChecksumMissing.Error()))
+
+	files, err := os.ReadDir(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(files).To(BeEmpty(), "Expected rejected images not to be stored")
+}
+
+func Test_Cache_rejects_images_of_other_hosts(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	images := &upstream{images: map[string]string{"/ubuntu.gz": "ubuntu image"}}
+
+	registry := httptest.NewServer(images)
+	defer registry.Close()
+
+	redirecting := httptest.NewServer(http.RedirectHandler(registry.URL+"/ubuntu.gz", http.StatusFound))
+	defer redirecting.Close()
+
+	cache, _ := newCache(t, imagecache.Options{MaxBytes: 1024, AllowedHosts: []string{host(redirecting)}})
+
+	imageURL, err := imagecache.RewriteURL(cache.URL, registry.URL+"/ubuntu.gz")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	status, body := fetch(t, imageURL)
+	g.Expect(status).To(Equal(http.StatusForbidden))
+	g.Expect(body).To(ContainSubstring(imagecache.ErrHostNotAllowed.Error()))
+
+	imageURL, err = imagecache.RewriteURL(cache.URL, redirecting.URL+"/ubuntu.gz")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	status, body = fetch(t, imageURL)
+	g.Expect(status).To(Equal(http.StatusBadGateway))
+	g.Expect(body).To(ContainSubstring(imagecache.ErrHostNotAllowed.Error()))
+
+	g.Expect(atomic.LoadInt32(&images.downloads)).To(BeZero(), "Expected no download from the other host")
+
+	_, err = imagecache.New(imagecache.Options{Dir: t.TempDir(), MaxBytes: 1024})
+	g.Expect(err).To(MatchError(imagecache.ErrNoAllowedHosts))
+}
+
+func Test_Cache_evicts_least_recently_used_images(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	images := &upstream{
+		images: map[string]string{
+			"/a.gz": strings.Repeat("a", 400),
+			"/b.gz": strings.Repeat("b", 400),
+			"/c.gz": strings.Repeat("c", 400),
+		},
+	}
+
+	registry := httptest.NewServer(images)
+	defer registry.Close()
+
+	cache, dir := newCache(t, imagecache.Options{MaxBytes: 1000, AllowedHosts: []string{host(registry)}})
+
+	get := func(name string) {
+		imageURL, err := imagecache.RewriteURL(cache.URL, registry.URL+name)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		status, _ := fetch(t, imageURL)
+		g.Expect(status).To(Equal(http.StatusOK))
+	}
+
+	get("/a.gz")
+	get("/b.gz")
+	get("/a.gz")
+	get("/c.gz") // evicts b, the least recently used image.
+	g.Expect(atomic.LoadInt32(&images.downloads)).To(BeEquivalentTo(3))
+
+	get("/a.gz")
+	g.Expect(atomic.LoadInt32(&images.downloads)).To(BeEquivalentTo(3), "Expected a to still be cached")
+
+	get("/b.gz")
+	g.Expect(atomic.LoadInt32(&images.downloads)).To(BeEquivalentTo(4), "Expected b to have been evicted")
+
+	files, err := os.ReadDir(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(files).To(HaveLen(2))
+
+	// Images stored by a previous run are served after a restart.
+	restarted, _ := newCache(t, imagecache.Options{Dir: dir, MaxBytes: 1000, AllowedHosts: []string{host(registry)}})
+
+	imageURL, err := imagecache.RewriteURL(restarted.URL, registry.URL+"/b.gz")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	status, body := fetch(t, imageURL)
+	g.Expect(status).To(Equal(http.StatusOK))
+	g.Expect(body).To(Equal(strings.Repeat("b", 400)))
+	g.Expect(atomic.LoadInt32(&images.downloads)).To(BeEquivalentTo(4))
+}
+
+func Test_Cache_gives_up_on_stalled_downloads(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer registry.Close()
+
+	cache, _ := newCache(t, imagecache.Options{
+		MaxBytes:        1024,
+		AllowedHosts:    []string{host(registry)},
+		DownloadTimeout: 100 * time.Millisecond,
+	})
+
+	imageURL, err := imagecache.RewriteURL(cache.URL, registry.URL+"/ubuntu.gz")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	status, body := fetch(t, imageURL)
+	g.Expect(status).To(Equal(http.StatusBadGateway))
+	g.Expect(body).To(ContainSubstring(context.DeadlineExceeded.Error()))
+}
+
+func Test_Cache_reserves_space_of_images_being_downloaded(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, imagecache.ChecksumSuffix) {
+			http.NotFound(w, r)
+
+			return
+		}
+
+		image := strings.Repeat("b", 600)
+		if r.URL.Path == "/a.gz" {
+			image = strings.Repeat("a", 600)
+			w.Header().Set("Content-Length", "600")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			close(started)
+			<-release
+		}
+
+		_, _ = io.WriteString(w, image)
+	}))
+	defer registry.Close()
+
+	cache, _ := newCache(t, imagecache.Options{MaxBytes: 1000, AllowedHosts: []string{host(registry)}})
+
+	imageURL := func(name string) string {
+		rewritten, err := imagecache.RewriteURL(cache.URL, registry.URL+name)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		return rewritten
+	}
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		status, _ := fetch(t, imageURL("/a.gz"))
+		g.Expect(status).To(Equal(http.StatusOK))
+	}()
+
+	<-started
+
+	status, body := fetch(t, imageURL("/b.gz"))
+	g.Expect(status).To(Equal(http.StatusBadGateway))
+	g.Expect(body).To(ContainSubstring(imagecache.ErrCacheFull.Error()))
+
+	close(release)
+	wg.Wait()
+}
+
+func Test_RewriteURL(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		imageURL string
+		expected string
+	}{
+		"with scheme": {
+			imageURL: "http://images.example.com/ubuntu-2004/v1.23.5.gz",
+			expected: "http://10.0.0.5:8081/http/images.example.com/ubuntu-2004/v1.23.5.gz",
+		},
+		"without scheme": {
+			imageURL: "ghcr.io/tinkerbell/cluster-api-provider-tinkerbell/ubuntu-2004:v1.23.5.gz",
+			expected: "http://10.0.0.5:8081/https/ghcr.io/tinkerbell/cluster-api-provider-tinkerbell/ubuntu-2004:v1.23.5.gz",
+		},
+		"with query": {
+			imageURL: "https://images.example.com/ubuntu.gz?token=abc",
+			expected: "http://10.0.0.5:8081/https/images.example.com/ubuntu.gz?token=abc",
+		},
+	}
+
+	for name, c := range cases {
+		c := c
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			g := NewWithT(t)
+
+			rewritten, err := imagecache.RewriteURL("http://10.0.0.5:8081/", c.imageURL)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(rewritten).To(Equal(c.expected))
+		})
+	}
+}
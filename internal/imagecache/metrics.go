@@ -0,0 +1,51 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagecache
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	resultHit   = "hit"
+	resultMiss  = "miss"
+	resultError = "error"
+)
+
+//nolint:gochecknoglobals
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "capt_image_cache_requests_total",
+		Help: "Number of image requests served by the image cache, by result (hit, miss or error).",
+	}, []string{"result"})
+
+	evictionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "capt_image_cache_evictions_total",
+		Help: "Number of images evicted from the image cache to stay below its size cap.",
+	})
+
+	cacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "capt_image_cache_size_bytes",
+		Help: "Total size of the images stored in the image cache.",
+	})
+)
+
+//nolint:gochecknoinits
+func init() {
+	metrics.Registry.MustRegister(requestsTotal, evictionsTotal, cacheSize)
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	readHeaderTimeout = 30 * time.Second
+	shutdownTimeout   = 30 * time.Second
+)
+
+// Server serves a Cache over HTTP as a manager Runnable.
+type Server struct {
+	// Addr is the address the server listens on.
+	Addr  string
+	Cache *Cache
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable. Every replica serves images.
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+// Start serves the cache until the context is cancelled.
+func (s *Server) Start(ctx context.Context) error {
+	server := &http.Server{
+		Addr:              s.Addr,
+		Handler:           s.Cache,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("serving image cache: %w", err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) { //nolint:contextcheck
+		return fmt.Errorf("shutting down image cache: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,585 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package inventoryapi serves a read-only HTTP/JSON API on the Hardware inventory, its allocation
+// to machines and the state of machines and clusters, for consumers which should not get access
+// to the Kubernetes API.
+package inventoryapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/labels"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/controllers"
+)
+
+const (
+	// DefaultLimit is the page size used when a request does not set one.
+	DefaultLimit = 100
+	// MaxLimit is the largest page size a request may ask for.
+	MaxLimit = 1000
+)
+
+// ErrInvalidParameter is returned for malformed query parameters.
+var ErrInvalidParameter = fmt.Errorf("invalid parameter")
+
+// Hardware phases.
+const (
+	HardwarePhaseAvailable       = "Available"
+	HardwarePhaseReserved        = "Reserved"
+	HardwarePhaseAllocated       = "Allocated"
+	HardwarePhaseQuarantined     = "Quarantined"
+	HardwarePhaseDecommissioning = "Decommissioning"
+	HardwarePhaseForeign         = "Foreign"
+)
+
+// Machine phases.
+const (
+	MachinePhasePending      = "Pending"
+	MachinePhaseProvisioning = "Provisioning"
+	MachinePhaseReady        = "Ready"
+	MachinePhaseFailed       = "Failed"
+	MachinePhaseDeleting     = "Deleting"
+)
+
+// Hardware is the inventory entry of a Hardware.
+type Hardware struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Phase     string            `json:"phase"`
+	// Machine is the TinkerbellMachine the Hardware is allocated to, as namespace/name.
+	Machine string `json:"machine,omitempty"`
+	Cluster string `json:"cluster,omitempty"`
+	// Stack is the kubeconfig Secret, as namespace/name, of the remote Tinkerbell stack the Hardware
+	// lives in. It is empty for Hardware of the management cluster.
+	Stack string `json:"stack,omitempty"`
+}
+
+// key orders Hardware entries and identifies them in continue parameters.
+func (h Hardware) key() string {
+	if h.Stack == "" {
+		return h.Namespace + "/" + h.Name
+	}
+
+	return h.Stack + ":" + h.Namespace + "/" + h.Name
+}
+
+// Machine is the state of a TinkerbellMachine.
+type Machine struct {
+	Name       string            `json:"name"`
+	Namespace  string            `json:"namespace"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Cluster    string            `json:"cluster,omitempty"`
+	Phase      string            `json:"phase"`
+	Hardware   string            `json:"hardware,omitempty"`
+	ProviderID string            `json:"providerID,omitempty"`
+	Addresses  []string          `json:"addresses,omitempty"`
+	Message    string            `json:"message,omitempty"`
+}
+
+// Cluster summarizes a TinkerbellCluster and its machines.
+type Cluster struct {
+	Name                 string            `json:"name"`
+	Namespace            string            `json:"namespace"`
+	Labels               map[string]string `json:"labels,omitempty"`
+	Ready                bool              `json:"ready"`
+	ControlPlaneEndpoint string            `json:"controlPlaneEndpoint,omitempty"`
+	// Machines counts the machines of the cluster by phase.
+	Machines map[string]int `json:"machines"`
+}
+
+// List is a page of results. Continue is set if there are more results, and is passed as the
+// continue parameter to get the next page.
+type List struct {
+	Items    interface{} `json:"items"`
+	Continue string      `json:"continue,omitempty"`
+	// UnavailableStacks lists the remote Tinkerbell stacks whose Hardware could not be read, and
+	// is therefore missing from the items.
+	UnavailableStacks []UnavailableStack `json:"unavailableStacks,omitempty"`
+}
+
+// UnavailableStack is a remote Tinkerbell stack whose Hardware could not be read.
+type UnavailableStack struct {
+	// Stack is the kubeconfig Secret of the stack, as namespace/name.
+	Stack string `json:"stack"`
+	Error string `json:"error"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// filter holds the query parameters common to all lists.
+type filter struct {
+	cluster  string
+	phase    string
+	selector labels.Selector
+	limit    int
+	cont     string
+}
+
+// Handler serves the API from a client, usually reading from the manager cache. Hardware of the
+// remote Tinkerbell stacks of failure domains is read through clients from stackClientGetter by
+// Refresh, and served from the result of the last refresh.
+type Handler struct {
+	client            client.Client
+	stackClientGetter controllers.StackClientGetter
+	token             string
+	mux               *http.ServeMux
+
+	mu     sync.RWMutex
+	stacks map[string]stackSnapshot
+}
+
+// stackSnapshot is the Hardware of a remote Tinkerbell stack as of the last refresh, or the error
+// reading it.
+type stackSnapshot struct {
+	hardware []tinkv1.Hardware
+	err      error
+}
+
+// NewHandler returns a Handler serving requests which present token as bearer token.
+func NewHandler(c client.Client, stackClientGetter controllers.StackClientGetter, token string) *Handler {
+	h := &Handler{
+		client:            c,
+		stackClientGetter: stackClientGetter,
+		token:             token,
+		mux:               http.NewServeMux(),
+		stacks:            map[string]stackSnapshot{},
+	}
+
+	h.mux.HandleFunc("/api/v1/hardware", h.listHardware)
+	h.mux.HandleFunc("/api/v1/machines", h.listMachines)
+	h.mux.HandleFunc("/api/v1/clusters", h.listClusters)
+
+	return h
+}
+
+// ServeHTTP authenticates the request and serves it.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	authorization := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(authorization, "Bearer ")
+
+	if token == authorization || h.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "unauthorized"})
+
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "only GET is supported"})
+
+		return
+	}
+
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) listHardware(w http.ResponseWriter, r *http.Request) {
+	f, err := parseFilter(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+
+		return
+	}
+
+	items, unavailable, err := h.hardware(r.Context(), f)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+
+		return
+	}
+
+	start, end, next := page(len(items), func(i int) string { return items[i].key() }, f)
+	writeJSON(w, http.StatusOK, List{Items: items[start:end], Continue: next, UnavailableStacks: unavailable})
+}
+
+// hardware lists the Hardware of the management cluster and of the remote Tinkerbell stacks of the
+// last refresh, and the remote stacks which could not be read.
+func (h *Handler) hardware(ctx context.Context, f filter) ([]Hardware, []UnavailableStack, error) {
+	machineClusters, err := h.machineClusters(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hardwareList := &tinkv1.HardwareList{}
+	if err := h.client.List(ctx, hardwareList, client.MatchingLabelsSelector{Selector: f.selector}); err != nil {
+		return nil, nil, fmt.Errorf("listing Hardware: %w", err)
+	}
+
+	items := []Hardware{}
+	unavailable := []UnavailableStack{}
+
+	add := func(hw *tinkv1.Hardware, stack string) {
+		item := hardwareItem(hw, machineClusters)
+		item.Stack = stack
+
+		if f.matches(item.Cluster, item.Phase) {
+			items = append(items, item)
+		}
+	}
+
+	for i := range hardwareList.Items {
+		add(&hardwareList.Items[i], "")
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for name, snapshot := range h.stacks {
+		if snapshot.err != nil {
+			unavailable = append(unavailable, UnavailableStack{Stack: name, Error: snapshot.err.Error()})
+
+			continue
+		}
+
+		for i := range snapshot.hardware {
+			if f.selector.Matches(labels.Set(snapshot.hardware[i].Labels)) {
+				add(&snapshot.hardware[i], name)
+			}
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].key() < items[j].key()
+	})
+
+	sort.Slice(unavailable, func(i, j int) bool {
+		return unavailable[i].Stack < unavailable[j].Stack
+	})
+
+	return items, unavailable, nil
+}
+
+// Refresh reads the Hardware of the remote Tinkerbell stacks of all TinkerbellClusters, by the
+// namespace/name of their kubeconfig Secret. Hardware of a stack shared by several TinkerbellClusters
+// is read once. A stack which can't be read is reported as unavailable until the next refresh.
+func (h *Handler) Refresh(ctx context.Context) error {
+	tinkerbellClusters := &infrastructurev1.TinkerbellClusterList{}
+	if err := h.client.List(ctx, tinkerbellClusters); err != nil {
+		return fmt.Errorf("listing TinkerbellClusters: %w", err)
+	}
+
+	stacks := map[string]stackSnapshot{}
+
+	for i := range tinkerbellClusters.Items {
+		tinkerbellCluster := &tinkerbellClusters.Items[i]
+
+		for j := range tinkerbellCluster.Spec.FailureDomains {
+			failureDomain := &tinkerbellCluster.Spec.FailureDomains[j]
+			if failureDomain.KubeconfigSecretRef == nil {
+				continue
+			}
+
+			name := tinkerbellCluster.Namespace + "/" + failureDomain.KubeconfigSecretRef.Name
+			if _, ok := stacks[name]; ok {
+				continue
+			}
+
+			stacks[name] = h.readStack(ctx, tinkerbellCluster.Namespace, failureDomain)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.stacks = stacks
+
+	return nil
+}
+
+// readStack lists the Hardware of the remote Tinkerbell stack of a failure domain.
+func (h *Handler) readStack(ctx context.Context, namespace string,
+	failureDomain *infrastructurev1.TinkerbellFailureDomain,
+) stackSnapshot {
+	stack, err := controllers.NewTinkerbellStack(ctx, h.client, h.stackClientGetter, namespace, failureDomain)
+	if err != nil {
+		return stackSnapshot{err: err}
+	}
+
+	hardwareList := &tinkv1.HardwareList{}
+	if err := stack.Client.List(ctx, hardwareList, client.InNamespace(stack.Namespace)); err != nil {
+		return stackSnapshot{err: fmt.Errorf("listing Hardware: %w", err)}
+	}
+
+	return stackSnapshot{hardware: hardwareList.Items}
+}
+
+func hardwareItem(hw *tinkv1.Hardware, machineClusters map[string]string) Hardware {
+	item := Hardware{
+		Name:      hw.Name,
+		Namespace: hw.Namespace,
+		Labels:    hw.Labels,
+		Phase:     HardwarePhaseAvailable,
+	}
+
+	if cluster, ok := hw.Labels[controllers.HardwareReservedForClusterLabel]; ok {
+		item.Phase = HardwarePhaseReserved
+		item.Cluster = hw.Labels[controllers.HardwareReservedForNamespaceLabel] + "/" + cluster
+	}
+
+	if owner, ok := hw.Labels[controllers.HardwareOwnerNameLabel]; ok {
+		item.Phase = HardwarePhaseAllocated
+		item.Machine = hw.Labels[controllers.HardwareOwnerNamespaceLabel] + "/" + owner
+		item.Cluster = machineClusters[item.Machine]
+	}
+
+	if _, ok := hw.Labels[controllers.HardwareForeignOwnerLabel]; ok {
+		item.Phase = HardwarePhaseForeign
+	}
+
+	if _, ok := hw.Labels[controllers.HardwareQuarantinedLabel]; ok {
+		item.Phase = HardwarePhaseQuarantined
+	}
+
+	if _, ok := hw.Labels[controllers.HardwareDecommissioningLabel]; ok {
+		item.Phase = HardwarePhaseDecommissioning
+	}
+
+	return item
+}
+
+// machineClusters maps namespace/name of TinkerbellMachines to the namespace/name of their cluster.
+func (h *Handler) machineClusters(ctx context.Context) (map[string]string, error) {
+	machines := &infrastructurev1.TinkerbellMachineList{}
+	if err := h.client.List(ctx, machines); err != nil {
+		return nil, fmt.Errorf("listing TinkerbellMachines: %w", err)
+	}
+
+	clusters := map[string]string{}
+
+	for _, machine := range machines.Items {
+		if cluster := machine.Labels[clusterv1.ClusterLabelName]; cluster != "" {
+			clusters[machine.Namespace+"/"+machine.Name] = machine.Namespace + "/" + cluster
+		}
+	}
+
+	return clusters, nil
+}
+
+func (h *Handler) listMachines(w http.ResponseWriter, r *http.Request) {
+	f, err := parseFilter(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+
+		return
+	}
+
+	machines := &infrastructurev1.TinkerbellMachineList{}
+	if err := h.client.List(r.Context(), machines, client.MatchingLabelsSelector{Selector: f.selector}); err != nil {
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: fmt.Sprintf("listing TinkerbellMachines: %s", err)})
+
+		return
+	}
+
+	items := []Machine{}
+
+	for i := range machines.Items {
+		item := machineItem(&machines.Items[i])
+
+		if f.matches(item.Cluster, item.Phase) {
+			items = append(items, item)
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Namespace+"/"+items[i].Name < items[j].Namespace+"/"+items[j].Name
+	})
+
+	start, end, next := page(len(items), func(i int) string { return items[i].Namespace + "/" + items[i].Name }, f)
+	writeJSON(w, http.StatusOK, List{Items: items[start:end], Continue: next})
+}
+
+func machineItem(machine *infrastructurev1.TinkerbellMachine) Machine {
+	item := Machine{
+		Name:       machine.Name,
+		Namespace:  machine.Namespace,
+		Labels:     machine.Labels,
+		Phase:      machinePhase(machine),
+		Hardware:   machine.Spec.HardwareName,
+		ProviderID: machine.Spec.ProviderID,
+	}
+
+	if cluster := machine.Labels[clusterv1.ClusterLabelName]; cluster != "" {
+		item.Cluster = machine.Namespace + "/" + cluster
+	}
+
+	for _, address := range machine.Status.Addresses {
+		item.Addresses = append(item.Addresses, address.Address)
+	}
+
+	if machine.Status.ErrorMessage != nil {
+		item.Message = *machine.Status.ErrorMessage
+	}
+
+	return item
+}
+
+func machinePhase(machine *infrastructurev1.TinkerbellMachine) string {
+	switch {
+	case !machine.DeletionTimestamp.IsZero():
+		return MachinePhaseDeleting
+	case machine.Status.ErrorReason != nil:
+		return MachinePhaseFailed
+	case machine.Status.Ready:
+		return MachinePhaseReady
+	case machine.Spec.HardwareName != "":
+		return MachinePhaseProvisioning
+	default:
+		return MachinePhasePending
+	}
+}
+
+func (h *Handler) listClusters(w http.ResponseWriter, r *http.Request) {
+	f, err := parseFilter(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+
+		return
+	}
+
+	clusters := &infrastructurev1.TinkerbellClusterList{}
+	if err := h.client.List(r.Context(), clusters, client.MatchingLabelsSelector{Selector: f.selector}); err != nil {
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: fmt.Sprintf("listing TinkerbellClusters: %s", err)})
+
+		return
+	}
+
+	machines := &infrastructurev1.TinkerbellMachineList{}
+	if err := h.client.List(r.Context(), machines); err != nil {
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: fmt.Sprintf("listing TinkerbellMachines: %s", err)})
+
+		return
+	}
+
+	items := []Cluster{}
+
+	for _, tinkerbellCluster := range clusters.Items {
+		name := tinkerbellCluster.Labels[clusterv1.ClusterLabelName]
+		if name == "" {
+			name = tinkerbellCluster.Name
+		}
+
+		if f.cluster != "" && f.cluster != tinkerbellCluster.Namespace+"/"+name {
+			continue
+		}
+
+		item := Cluster{
+			Name:      name,
+			Namespace: tinkerbellCluster.Namespace,
+			Labels:    tinkerbellCluster.Labels,
+			Ready:     tinkerbellCluster.Status.Ready,
+			Machines:  map[string]int{},
+		}
+
+		if endpoint := tinkerbellCluster.Spec.ControlPlaneEndpoint; endpoint.IsValid() {
+			item.ControlPlaneEndpoint = endpoint.String()
+		}
+
+		for i := range machines.Items {
+			machine := &machines.Items[i]
+			if machine.Namespace == item.Namespace && machine.Labels[clusterv1.ClusterLabelName] == name {
+				item.Machines[machinePhase(machine)]++
+			}
+		}
+
+		items = append(items, item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Namespace+"/"+items[i].Name < items[j].Namespace+"/"+items[j].Name
+	})
+
+	start, end, next := page(len(items), func(i int) string { return items[i].Namespace + "/" + items[i].Name }, f)
+	writeJSON(w, http.StatusOK, List{Items: items[start:end], Continue: next})
+}
+
+func parseFilter(r *http.Request) (filter, error) {
+	query := r.URL.Query()
+
+	f := filter{
+		cluster:  query.Get("cluster"),
+		phase:    query.Get("phase"),
+		selector: labels.Everything(),
+		limit:    DefaultLimit,
+		cont:     query.Get("continue"),
+	}
+
+	if selector := query.Get("labelSelector"); selector != "" {
+		parsed, err := labels.Parse(selector)
+		if err != nil {
+			return f, fmt.Errorf("invalid labelSelector: %w", err)
+		}
+
+		f.selector = parsed
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 1 || parsed > MaxLimit {
+			return f, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidParameter, MaxLimit)
+		}
+
+		f.limit = parsed
+	}
+
+	return f, nil
+}
+
+// matches returns true if an item of the given cluster, as namespace/name, and phase passes the filter.
+func (f filter) matches(cluster, phase string) bool {
+	return (f.cluster == "" || f.cluster == cluster) && (f.phase == "" || strings.EqualFold(f.phase, phase))
+}
+
+// page returns the bounds of the requested page of n items sorted by key, and the continue token
+// of the next page. Items are continued after the key of the last item of the previous page, so
+// pages stay consistent when items are added or removed in between.
+func page(n int, key func(i int) string, f filter) (int, int, string) {
+	start := 0
+	if f.cont != "" {
+		start = sort.Search(n, func(i int) bool { return key(i) > f.cont })
+	}
+
+	end := start + f.limit
+	if end >= n {
+		return start, n, ""
+	}
+
+	return start, end, key(end - 1)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,371 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventoryapi_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/controllers"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/internal/inventoryapi"
+)
+
+const token = "s3cr3t"
+
+func hardware(name string, labels map[string]string) *tinkv1.Hardware {
+	return &tinkv1.Hardware{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: labels},
+	}
+}
+
+func tinkerbellMachine(name, cluster, hardwareName string, ready bool) *infrastructurev1.TinkerbellMachine {
+	return &infrastructurev1.TinkerbellMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{clusterv1.ClusterLabelName: cluster},
+		},
+		Spec:   infrastructurev1.TinkerbellMachineSpec{HardwareName: hardwareName},
+		Status: infrastructurev1.TinkerbellMachineStatus{Ready: ready},
+	}
+}
+
+func newServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	g := NewWithT(t)
+
+	scheme := runtime.NewScheme()
+	g.Expect(tinkv1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(infrastructurev1.AddToScheme(scheme)).To(Succeed())
+
+	owned := func(machine string) map[string]string {
+		return map[string]string{
+			controllers.HardwareOwnerNameLabel:      machine,
+			controllers.HardwareOwnerNamespaceLabel: "default",
+			"rack":                                  "r1",
+		}
+	}
+
+	objects := []runtime.Object{
+		hardware("hw-0", owned("cp-0")),
+		hardware("hw-1", owned("worker-0")),
+		hardware("hw-2", map[string]string{"rack": "r1"}),
+		hardware("hw-3", map[string]string{"rack": "r2", controllers.HardwareQuarantinedLabel: "true"}),
+		hardware("hw-4", map[string]string{"rack": "r2"}),
+		hardware("hw-5", owned("other-0")),
+		tinkerbellMachine("cp-0", "prod", "hw-0", true),
+		tinkerbellMachine("worker-0", "prod", "hw-1", false),
+		tinkerbellMachine("worker-1", "prod", "", false),
+		tinkerbellMachine("other-0", "dev", "hw-5", true),
+		&infrastructurev1.TinkerbellCluster{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "prod",
+				Namespace: "default",
+				Labels:    map[string]string{clusterv1.ClusterLabelName: "prod"},
+			},
+			Spec: infrastructurev1.TinkerbellClusterSpec{
+				ControlPlaneEndpoint: clusterv1.APIEndpoint{Host: "10.0.0.10", Port: 6443},
+			},
+			Status: infrastructurev1.TinkerbellClusterStatus{Ready: true},
+		},
+	}
+
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objects...).Build()
+
+	server := httptest.NewServer(inventoryapi.NewHandler(kubeClient, nil, token))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// list gets a page of the API and decodes its items into items.
+func list(t *testing.T, server *httptest.Server, path string, items interface{}) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+path, nil) //nolint:noctx
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("requesting %s: %v", path, err)
+	}
+
+	defer resp.Body.Close()
+
+	page := struct {
+		Items    json.RawMessage `json:"items"`
+		Continue string          `json:"continue"`
+	}{}
+
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatalf("decoding %s: %v", path, err)
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		if err := json.Unmarshal(page.Items, items); err != nil {
+			t.Fatalf("decoding items of %s: %v", path, err)
+		}
+	}
+
+	return resp.StatusCode, page.Continue
+}
+
+func hardwareNames(items []inventoryapi.Hardware) []string {
+	names := []string{}
+	for _, item := range items {
+		names = append(names, item.Name)
+	}
+
+	return names
+}
+
+func Test_Handler_requires_token(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	server := newServer(t)
+
+	for _, authorization := range []string{"", "Bearer wrong", token} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/api/v1/hardware", nil) //nolint:noctx
+		g.Expect(err).NotTo(HaveOccurred())
+
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		g.Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+
+		g.Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized), "Authorization %q", authorization)
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"/api/v1/hardware", nil) //nolint:noctx
+	g.Expect(err).NotTo(HaveOccurred())
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	g.Expect(err).NotTo(HaveOccurred())
+	resp.Body.Close()
+
+	g.Expect(resp.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+}
+
+func Test_Handler_lists_hardware_allocation(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	server := newServer(t)
+
+	items := []inventoryapi.Hardware{}
+	status, _ := list(t, server, "/api/v1/hardware", &items)
+	g.Expect(status).To(Equal(http.StatusOK))
+	g.Expect(hardwareNames(items)).To(Equal([]string{"hw-0", "hw-1", "hw-2", "hw-3", "hw-4", "hw-5"}))
+	g.Expect(items[0].Phase).To(Equal(inventoryapi.HardwarePhaseAllocated))
+	g.Expect(items[0].Machine).To(Equal("default/cp-0"))
+	g.Expect(items[0].Cluster).To(Equal("default/prod"))
+	g.Expect(items[2].Phase).To(Equal(inventoryapi.HardwarePhaseAvailable))
+	g.Expect(items[3].Phase).To(Equal(inventoryapi.HardwarePhaseQuarantined))
+
+	cases := map[string][]string{
+		"?cluster=default/prod":                    {"hw-0", "hw-1"},
+		"?phase=available":                         {"hw-2", "hw-4"},
+		"?labelSelector=rack%3Dr2":                 {"hw-3", "hw-4"},
+		"?labelSelector=rack%3Dr1&phase=Allocated": {"hw-0", "hw-1", "hw-5"},
+	}
+
+	for query, expected := range cases {
+		items := []inventoryapi.Hardware{}
+		status, _ := list(t, server, "/api/v1/hardware"+query, &items)
+		g.Expect(status).To(Equal(http.StatusOK))
+		g.Expect(hardwareNames(items)).To(Equal(expected), "Query %s", query)
+	}
+
+	status, _ = list(t, server, "/api/v1/hardware?labelSelector=%3D%3D", &items)
+	g.Expect(status).To(Equal(http.StatusBadRequest))
+}
+
+func Test_Handler_lists_hardware_of_remote_stacks(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	scheme := runtime.NewScheme()
+	g.Expect(corev1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(tinkv1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(infrastructurev1.AddToScheme(scheme)).To(Succeed())
+
+	// Both clusters use the remote stack, whose Hardware must be listed once.
+	tinkerbellCluster := func(name string) *infrastructurev1.TinkerbellCluster {
+		return &infrastructurev1.TinkerbellCluster{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: infrastructurev1.TinkerbellClusterSpec{
+				FailureDomains: []infrastructurev1.TinkerbellFailureDomain{{
+					Name:                "remote",
+					KubeconfigSecretRef: &corev1.LocalObjectReference{Name: "remote-kubeconfig"},
+					HardwareNamespace:   "tink",
+				}},
+			},
+		}
+	}
+
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(
+		hardware("hw-0", nil),
+		tinkerbellCluster("prod"),
+		tinkerbellCluster("dev"),
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "remote-kubeconfig", Namespace: "default"},
+			Data:       map[string][]byte{"value": []byte("kubeconfig")},
+		},
+	).Build()
+
+	remoteHardware := hardware("hw-0", nil)
+	remoteHardware.Namespace = "tink"
+
+	stackClient := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(remoteHardware).Build()
+	stackClientGetter := func([]byte) (client.Client, error) { return stackClient, nil }
+
+	handler := inventoryapi.NewHandler(kubeClient, stackClientGetter, token)
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	// Remote stacks are only read by a refresh.
+	items := []inventoryapi.Hardware{}
+	status, _ := list(t, server, "/api/v1/hardware", &items)
+	g.Expect(status).To(Equal(http.StatusOK))
+	g.Expect(items).To(HaveLen(1))
+
+	g.Expect(handler.Refresh(context.Background())).To(Succeed())
+
+	status, _ = list(t, server, "/api/v1/hardware", &items)
+	g.Expect(status).To(Equal(http.StatusOK))
+	g.Expect(items).To(HaveLen(2))
+	g.Expect(items[0].Namespace).To(Equal("default"))
+	g.Expect(items[0].Stack).To(BeEmpty())
+	g.Expect(items[1].Namespace).To(Equal("tink"))
+	g.Expect(items[1].Stack).To(Equal("default/remote-kubeconfig"))
+
+	// A stack which can't be read is reported, while the Hardware of the other stacks is still listed.
+	g.Expect(kubeClient.Delete(context.Background(), &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "remote-kubeconfig", Namespace: "default"},
+	})).To(Succeed())
+	g.Expect(handler.Refresh(context.Background())).To(Succeed())
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/api/v1/hardware", nil) //nolint:noctx
+	g.Expect(err).NotTo(HaveOccurred())
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	defer resp.Body.Close()
+
+	page := &inventoryapi.List{}
+	g.Expect(json.NewDecoder(resp.Body).Decode(page)).To(Succeed())
+	g.Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	g.Expect(page.Items).To(HaveLen(1))
+	g.Expect(page.UnavailableStacks).To(HaveLen(1))
+	g.Expect(page.UnavailableStacks[0].Stack).To(Equal("default/remote-kubeconfig"))
+	g.Expect(page.UnavailableStacks[0].Error).To(ContainSubstring("not found"))
+}
+
+func Test_Server_refuses_plain_HTTP_unless_insecure(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	server := &inventoryapi.Server{Addr: "127.0.0.1:0", Handler: inventoryapi.NewHandler(nil, nil, token)}
+	g.Expect(server.Start(context.Background())).To(MatchError(inventoryapi.ErrInsecureServer))
+}
+
+func Test_Handler_paginates(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	server := newServer(t)
+
+	names := []string{}
+	cont := ""
+
+	for pages := 0; ; pages++ {
+		g.Expect(pages).To(BeNumerically("<", 3))
+
+		items := []inventoryapi.Hardware{}
+		status, next := list(t, server, fmt.Sprintf("/api/v1/hardware?limit=4&continue=%s", cont), &items)
+		g.Expect(status).To(Equal(http.StatusOK))
+		g.Expect(len(items)).To(BeNumerically("<=", 4))
+
+		names = append(names, hardwareNames(items)...)
+
+		if next == "" {
+			break
+		}
+
+		cont = next
+	}
+
+	g.Expect(names).To(Equal([]string{"hw-0", "hw-1", "hw-2", "hw-3", "hw-4", "hw-5"}))
+
+	status, _ := list(t, server, "/api/v1/hardware?limit=0", &[]inventoryapi.Hardware{})
+	g.Expect(status).To(Equal(http.StatusBadRequest))
+}
+
+func Test_Handler_lists_machines_and_clusters(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	server := newServer(t)
+
+	machines := []inventoryapi.Machine{}
+	status, _ := list(t, server, "/api/v1/machines?cluster=default/prod", &machines)
+	g.Expect(status).To(Equal(http.StatusOK))
+	g.Expect(machines).To(HaveLen(3))
+	g.Expect(machines[0].Name).To(Equal("cp-0"))
+	g.Expect(machines[0].Phase).To(Equal(inventoryapi.MachinePhaseReady))
+	g.Expect(machines[0].Hardware).To(Equal("hw-0"))
+	g.Expect(machines[1].Phase).To(Equal(inventoryapi.MachinePhaseProvisioning))
+	g.Expect(machines[2].Phase).To(Equal(inventoryapi.MachinePhasePending))
+
+	clusters := []inventoryapi.Cluster{}
+	status, _ = list(t, server, "/api/v1/clusters", &clusters)
+	g.Expect(status).To(Equal(http.StatusOK))
+	g.Expect(clusters).To(HaveLen(1))
+	g.Expect(clusters[0].Ready).To(BeTrue())
+	g.Expect(clusters[0].ControlPlaneEndpoint).To(Equal("10.0.0.10:6443"))
+	g.Expect(clusters[0].Machines).To(Equal(map[string]int{
+		inventoryapi.MachinePhaseReady:        1,
+		inventoryapi.MachinePhaseProvisioning: 1,
+		inventoryapi.MachinePhasePending:      1,
+	}))
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventoryapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	readHeaderTimeout = 30 * time.Second
+	shutdownTimeout   = 30 * time.Second
+	// refreshInterval is how often the Hardware of remote Tinkerbell stacks is read.
+	refreshInterval = 30 * time.Second
+)
+
+// ErrInsecureServer is returned when the server would send the bearer token over plain HTTP
+// without Insecure being set.
+var ErrInsecureServer = fmt.Errorf("inventory API requires a TLS certificate and key unless insecure is set")
+
+// Server serves a Handler over HTTP as a manager Runnable. If CertFile and KeyFile are set, the
+// server uses TLS. Otherwise Insecure must be set, as clients send the bearer token in plain text.
+type Server struct {
+	// Addr is the address the server listens on.
+	Addr     string
+	Handler  *Handler
+	CertFile string
+	KeyFile  string
+	Insecure bool
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable. Every replica serves the API from
+// its own cache.
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+// Start serves the API until the context is cancelled, refreshing the Hardware of remote Tinkerbell
+// stacks in the background.
+func (s *Server) Start(ctx context.Context) error {
+	useTLS := s.CertFile != "" && s.KeyFile != ""
+	if !useTLS && !s.Insecure {
+		return ErrInsecureServer
+	}
+
+	go s.refresh(ctx)
+
+	server := &http.Server{
+		Addr:              s.Addr,
+		Handler:           s.Handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		if useTLS {
+			errCh <- server.ListenAndServeTLS(s.CertFile, s.KeyFile)
+
+			return
+		}
+
+		errCh <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("serving inventory API: %w", err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) { //nolint:contextcheck
+		return fmt.Errorf("shutting down inventory API: %w", err)
+	}
+
+	return nil
+}
+
+// refresh refreshes the Handler until the context is cancelled.
+func (s *Server) refresh(ctx context.Context) {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Handler.Refresh(ctx); err != nil {
+			ctrl.LoggerFrom(ctx).Error(err, "Refreshing Hardware of remote Tinkerbell stacks")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
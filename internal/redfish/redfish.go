@@ -0,0 +1,282 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package redfish implements a minimal Redfish client reading hardware health from a BMC.
+package redfish
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// HealthOK means the resource is normal.
+	HealthOK = "OK"
+	// HealthWarning means the resource is in a condition requiring attention.
+	HealthWarning = "Warning"
+	// HealthCritical means the resource is in a critical condition requiring immediate attention.
+	HealthCritical = "Critical"
+
+	defaultTimeout = 30 * time.Second
+)
+
+// ErrUnexpectedStatus is returned when the BMC answers with a non 2xx HTTP status.
+var ErrUnexpectedStatus = fmt.Errorf("unexpected HTTP status")
+
+// Client reads resources from a Redfish service.
+type Client struct {
+	endpoint   string
+	username   string
+	password   string
+	httpClient *http.Client
+}
+
+// transports are shared by all clients, so polling many BMCs reuses their connections instead of
+// leaking a connection pool per client.
+//
+//nolint:gochecknoglobals
+var transports = map[bool]*http.Transport{
+	false: newTransport(false),
+	true:  newTransport(true),
+}
+
+func newTransport(insecureTLS bool) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()             //nolint:forcetypeassert
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: insecureTLS} //nolint:gosec
+
+	return transport
+}
+
+// NewClient returns a Client for the Redfish service at endpoint, e.g. https://10.0.0.1:443.
+func NewClient(endpoint, username, password string, insecureTLS bool) *Client {
+	return &Client{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		username: username,
+		password: password,
+		httpClient: &http.Client{
+			Timeout:   defaultTimeout,
+			Transport: transports[insecureTLS],
+		},
+	}
+}
+
+// ComponentHealth is the aggregated health of a class of components.
+type ComponentHealth struct {
+	// Health is the worst health reported by any of the components, one of HealthOK, HealthWarning
+	// or HealthCritical. It is HealthOK when no component reported its health.
+	Health string
+
+	// Faults describes each component which reported a health other than HealthOK.
+	Faults []string
+}
+
+// Healthy returns true when no component reported a fault.
+func (c ComponentHealth) Healthy() bool {
+	return c.Health == HealthOK
+}
+
+// Health is the hardware health reported by a BMC.
+type Health struct {
+	PowerSupplies ComponentHealth
+	Memory        ComponentHealth
+	Thermal       ComponentHealth
+}
+
+type link struct {
+	ID string `json:"@odata.id"`
+}
+
+type collection struct {
+	Members []link `json:"Members"`
+}
+
+type status struct {
+	State        string `json:"State"`
+	Health       string `json:"Health"`
+	HealthRollup string `json:"HealthRollup"`
+}
+
+type chassis struct {
+	Power   *link `json:"Power"`
+	Thermal *link `json:"Thermal"`
+}
+
+type power struct {
+	PowerSupplies []struct {
+		Name   string `json:"Name"`
+		Status status `json:"Status"`
+	} `json:"PowerSupplies"`
+}
+
+type thermal struct {
+	Temperatures []struct {
+		Name   string `json:"Name"`
+		Status status `json:"Status"`
+	} `json:"Temperatures"`
+	Fans []struct {
+		Name   string `json:"Name"`
+		Status status `json:"Status"`
+	} `json:"Fans"`
+}
+
+type system struct {
+	ID            string `json:"Id"`
+	MemorySummary struct {
+		Status status `json:"Status"`
+	} `json:"MemorySummary"`
+}
+
+// Health walks the chassis and systems of the Redfish service and aggregates the health of power
+// supplies, memory, temperature sensors and fans.
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	health := &Health{
+		PowerSupplies: ComponentHealth{Health: HealthOK},
+		Memory:        ComponentHealth{Health: HealthOK},
+		Thermal:       ComponentHealth{Health: HealthOK},
+	}
+
+	if err := c.chassisHealth(ctx, health); err != nil {
+		return nil, err
+	}
+
+	if err := c.systemsHealth(ctx, health); err != nil {
+		return nil, err
+	}
+
+	return health, nil
+}
+
+func (c *Client) chassisHealth(ctx context.Context, health *Health) error {
+	chassisCollection := &collection{}
+	if err := c.get(ctx, "/redfish/v1/Chassis", chassisCollection); err != nil {
+		return fmt.Errorf("listing chassis: %w", err)
+	}
+
+	for _, member := range chassisCollection.Members {
+		ch := &chassis{}
+		if err := c.get(ctx, member.ID, ch); err != nil {
+			return fmt.Errorf("getting chassis %q: %w", member.ID, err)
+		}
+
+		if ch.Power != nil {
+			p := &power{}
+			if err := c.get(ctx, ch.Power.ID, p); err != nil {
+				return fmt.Errorf("getting power of chassis %q: %w", member.ID, err)
+			}
+
+			for _, psu := range p.PowerSupplies {
+				health.PowerSupplies.add("power supply", psu.Name, psu.Status)
+			}
+		}
+
+		if ch.Thermal != nil {
+			t := &thermal{}
+			if err := c.get(ctx, ch.Thermal.ID, t); err != nil {
+				return fmt.Errorf("getting thermal of chassis %q: %w", member.ID, err)
+			}
+
+			for _, sensor := range t.Temperatures {
+				health.Thermal.add("temperature sensor", sensor.Name, sensor.Status)
+			}
+
+			for _, fan := range t.Fans {
+				health.Thermal.add("fan", fan.Name, fan.Status)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) systemsHealth(ctx context.Context, health *Health) error {
+	systems := &collection{}
+	if err := c.get(ctx, "/redfish/v1/Systems", systems); err != nil {
+		return fmt.Errorf("listing systems: %w", err)
+	}
+
+	for _, member := range systems.Members {
+		sys := &system{}
+		if err := c.get(ctx, member.ID, sys); err != nil {
+			return fmt.Errorf("getting system %q: %w", member.ID, err)
+		}
+
+		memoryStatus := sys.MemorySummary.Status
+		if memoryStatus.HealthRollup != "" {
+			memoryStatus.Health = memoryStatus.HealthRollup
+		}
+
+		health.Memory.add("memory of system", sys.ID, memoryStatus)
+	}
+
+	return nil
+}
+
+// add records the status of a single component.
+func (c *ComponentHealth) add(kind, name string, s status) {
+	// Absent components have no meaningful health.
+	if s.State == "Absent" || s.Health == "" || s.Health == HealthOK {
+		return
+	}
+
+	c.Faults = append(c.Faults, fmt.Sprintf("%s %s is %s", kind, name, s.Health))
+
+	if severity(s.Health) > severity(c.Health) {
+		c.Health = s.Health
+	}
+}
+
+func severity(health string) int {
+	switch health {
+	case HealthOK:
+		return 0
+	case HealthWarning:
+		return 1
+	default:
+		return 2 //nolint:gomnd
+	}
+}
+
+func (c *Client) get(ctx context.Context, path string, into interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint+path, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	req.SetBasicAuth(c.username, c.password)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("requesting %s: %w", path, err)
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%w: %s returned %d", ErrUnexpectedStatus, path, resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(into); err != nil {
+		return fmt.Errorf("decoding %s: %w", path, err)
+	}
+
+	return nil
+}
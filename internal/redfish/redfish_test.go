@@ -0,0 +1,109 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redfish_test
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/internal/redfish"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/internal/redfish/redfishtest"
+)
+
+func Test_Health(t *testing.T) {
+	t.Parallel()
+
+	for name, c := range map[string]struct {
+		mutateServer func(*redfishtest.Server)
+		expected     redfish.Health
+	}{
+		"all_components_healthy": {
+			mutateServer: func(*redfishtest.Server) {},
+			expected: redfish.Health{
+				PowerSupplies: redfish.ComponentHealth{Health: redfish.HealthOK},
+				Memory:        redfish.ComponentHealth{Health: redfish.HealthOK},
+				Thermal:       redfish.ComponentHealth{Health: redfish.HealthOK},
+			},
+		},
+		"reports_faulty_components": {
+			mutateServer: func(s *redfishtest.Server) {
+				s.PowerSupplyHealth = redfish.HealthCritical
+				s.MemoryHealth = redfish.HealthWarning
+				s.FanHealth = redfish.HealthWarning
+				s.TemperatureHealth = redfish.HealthCritical
+			},
+			expected: redfish.Health{
+				PowerSupplies: redfish.ComponentHealth{
+					Health: redfish.HealthCritical,
+					Faults: []string{"power supply PSU1 is Critical"},
+				},
+				Memory: redfish.ComponentHealth{
+					Health: redfish.HealthWarning,
+					Faults: []string{"memory of system 1 is Warning"},
+				},
+				Thermal: redfish.ComponentHealth{
+					Health: redfish.HealthCritical,
+					Faults: []string{"temperature sensor CPU1 Temp is Critical", "fan Fan1 is Warning"},
+				},
+			},
+		},
+	} {
+		c := c
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			g := NewWithT(t)
+
+			server := redfishtest.NewServer("admin", "secret")
+			defer server.Close()
+
+			c.mutateServer(server)
+
+			health, err := redfish.NewClient(server.URL, "admin", "secret", true).Health(context.Background())
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(*health).To(Equal(c.expected))
+		})
+	}
+}
+
+func Test_Health_with_invalid_credentials(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	server := redfishtest.NewServer("admin", "secret")
+	defer server.Close()
+
+	_, err := redfish.NewClient(server.URL, "admin", "wrong", true).Health(context.Background())
+	g.Expect(err).To(MatchError(redfish.ErrUnexpectedStatus))
+}
+
+func Test_Health_reuses_connections_across_clients(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	server := redfishtest.NewServer("admin", "secret")
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := redfish.NewClient(server.URL, "admin", "secret", true).Health(context.Background())
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+
+	g.Expect(server.Connections()).To(Equal(1))
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package redfishtest provides a Redfish service mock for tests.
+package redfishtest
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+)
+
+// Server is a Redfish service mock serving a single chassis and system over TLS.
+type Server struct {
+	*httptest.Server
+
+	// Username and Password are the credentials the mock accepts.
+	Username string
+	Password string
+
+	// PowerSupplyHealth, MemoryHealth, TemperatureHealth and FanHealth are the health values
+	// reported for the mocked components. They default to "OK".
+	PowerSupplyHealth string
+	MemoryHealth      string
+	TemperatureHealth string
+	FanHealth         string
+
+	connections int32
+}
+
+// NewServer starts a Redfish service mock accepting the given credentials. The caller must Close it.
+func NewServer(username, password string) *Server {
+	s := &Server{
+		Username:          username,
+		Password:          password,
+		PowerSupplyHealth: "OK",
+		MemoryHealth:      "OK",
+		TemperatureHealth: "OK",
+		FanHealth:         "OK",
+	}
+
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serve))
+	s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&s.connections, 1)
+		}
+	}
+	s.StartTLS()
+
+	return s
+}
+
+// Connections returns the number of connections the mock accepted.
+func (s *Server) Connections() int {
+	return int(atomic.LoadInt32(&s.connections))
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if username, password, ok := r.BasicAuth(); !ok || username != s.Username || password != s.Password {
+		w.WriteHeader(http.StatusUnauthorized)
+
+		return
+	}
+
+	resources := map[string]interface{}{
+		"/redfish/v1/Chassis": map[string]interface{}{
+			"Members": []map[string]string{{"@odata.id": "/redfish/v1/Chassis/1"}},
+		},
+		"/redfish/v1/Chassis/1": map[string]interface{}{
+			"Power":   map[string]string{"@odata.id": "/redfish/v1/Chassis/1/Power"},
+			"Thermal": map[string]string{"@odata.id": "/redfish/v1/Chassis/1/Thermal"},
+		},
+		"/redfish/v1/Chassis/1/Power": map[string]interface{}{
+			"PowerSupplies": []map[string]interface{}{
+				{"Name": "PSU1", "Status": map[string]string{"State": "Enabled", "Health": s.PowerSupplyHealth}},
+				{"Name": "PSU2", "Status": map[string]string{"State": "Absent"}},
+			},
+		},
+		"/redfish/v1/Chassis/1/Thermal": map[string]interface{}{
+			"Temperatures": []map[string]interface{}{
+				{"Name": "CPU1 Temp", "Status": map[string]string{"State": "Enabled", "Health": s.TemperatureHealth}},
+			},
+			"Fans": []map[string]interface{}{
+				{"Name": "Fan1", "Status": map[string]string{"State": "Enabled", "Health": s.FanHealth}},
+			},
+		},
+		"/redfish/v1/Systems": map[string]interface{}{
+			"Members": []map[string]string{{"@odata.id": "/redfish/v1/Systems/1"}},
+		},
+		"/redfish/v1/Systems/1": map[string]interface{}{
+			"Id": "1",
+			"MemorySummary": map[string]interface{}{
+				"Status": map[string]string{"State": "Enabled", "HealthRollup": s.MemoryHealth},
+			},
+		},
+	}
+
+	resource, ok := resources[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resource)
+}
@@ -0,0 +1,560 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package supportbundle collects the objects, events and logs related to a cluster or machine into
+// a tarball which can be attached to bug reports.
+package supportbundle
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/yaml"
+
+	rufiov1 "github.com/tinkerbell/rufio/api/v1alpha1"
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/controllers"
+)
+
+// Redacted replaces sensitive values in the bundle.
+const Redacted = "REDACTED"
+
+// IndexFileName is the name of the bundle index in the tarball.
+const IndexFileName = "index.json"
+
+// coreGroup is the directory of the objects of the core API group, which has no name.
+const coreGroup = "core"
+
+var (
+	// ErrNoTarget is returned when neither a cluster nor a machine is selected.
+	ErrNoTarget = fmt.Errorf("either a cluster or a machine name is required")
+	// ErrDuplicatePath is returned when two files of the bundle would be written to the same path.
+	ErrDuplicatePath = fmt.Errorf("duplicate path in support bundle")
+)
+
+// Options select what is collected into the bundle.
+type Options struct {
+	// Namespace of the cluster or machine.
+	Namespace string
+
+	// ClusterName selects all machines of the CAPI Cluster.
+	ClusterName string
+
+	// MachineName selects a single TinkerbellMachine. It takes precedence over ClusterName.
+	MachineName string
+
+	// ManagerNamespace and ManagerSelector select the manager pods to collect logs from.
+	ManagerNamespace string
+	ManagerSelector  string
+}
+
+// PodLogsFunc returns the logs of a pod container.
+type PodLogsFunc func(ctx context.Context, namespace, pod, container string) ([]byte, error)
+
+// Collector collects support bundles.
+type Collector struct {
+	Client client.Client
+
+	// StackClientGetter builds clients for the Tinkerbell stacks of failure domains running outside
+	// of the management cluster. The objects of those stacks are not collected if nil.
+	StackClientGetter controllers.StackClientGetter
+
+	// PodLogs is used to read manager logs. Logs are not collected if nil.
+	PodLogs PodLogsFunc
+}
+
+// IndexEntry describes a file in the bundle.
+type IndexEntry struct {
+	Path      string `json:"path"`
+	Group     string `json:"group,omitempty"`
+	Kind      string `json:"kind"`
+	Stack     string `json:"stack,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+}
+
+// Index lists the content of the bundle.
+type Index struct {
+	CreatedAt time.Time    `json:"createdAt"`
+	Options   Options      `json:"options"`
+	Entries   []IndexEntry `json:"entries"`
+}
+
+// Bundle holds the collected files until they are written.
+type Bundle struct {
+	Index Index
+	files map[string][]byte
+	uids  map[types.UID]bool
+}
+
+// Collect gathers the objects, events and manager logs selected by the options.
+func (c *Collector) Collect(ctx context.Context, opts Options) (*Bundle, error) {
+	if opts.ClusterName == "" && opts.MachineName == "" {
+		return nil, ErrNoTarget
+	}
+
+	b := &Bundle{
+		Index: Index{CreatedAt: time.Now().UTC(), Options: opts},
+		files: map[string][]byte{},
+		uids:  map[types.UID]bool{},
+	}
+
+	tinkerbellMachines, clusterName, err := c.tinkerbellMachines(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.collectCluster(ctx, b, opts.Namespace, clusterName); err != nil {
+		return nil, err
+	}
+
+	if err := c.collectMachines(ctx, b, opts, clusterName, tinkerbellMachines); err != nil {
+		return nil, err
+	}
+
+	if err := c.collectEvents(ctx, b, opts.Namespace); err != nil {
+		return nil, err
+	}
+
+	if err := c.collectLogs(ctx, b, opts); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (c *Collector) tinkerbellMachines(ctx context.Context, opts Options) ([]infrastructurev1.TinkerbellMachine, string, error) {
+	if opts.MachineName != "" {
+		tinkerbellMachine := &infrastructurev1.TinkerbellMachine{}
+
+		key := client.ObjectKey{Name: opts.MachineName, Namespace: opts.Namespace}
+		if err := c.Client.Get(ctx, key, tinkerbellMachine); err != nil {
+			return nil, "", fmt.Errorf("getting TinkerbellMachine: %w", err)
+		}
+
+		return []infrastructurev1.TinkerbellMachine{*tinkerbellMachine}, tinkerbellMachine.Labels[clusterv1.ClusterLabelName], nil
+	}
+
+	tinkerbellMachines := &infrastructurev1.TinkerbellMachineList{}
+	if err := c.Client.List(ctx, tinkerbellMachines, client.InNamespace(opts.Namespace),
+		client.MatchingLabels{clusterv1.ClusterLabelName: opts.ClusterName}); err != nil {
+		return nil, "", fmt.Errorf("listing TinkerbellMachines: %w", err)
+	}
+
+	return tinkerbellMachines.Items, opts.ClusterName, nil
+}
+
+func (c *Collector) collectCluster(ctx context.Context, b *Bundle, namespace, clusterName string) error {
+	if clusterName == "" {
+		return nil
+	}
+
+	cluster := &clusterv1.Cluster{}
+	if err := c.get(ctx, b, client.ObjectKey{Name: clusterName, Namespace: namespace}, cluster); err != nil {
+		return err
+	}
+
+	tinkerbellClusterName := clusterName
+	if cluster.Spec.InfrastructureRef != nil {
+		tinkerbellClusterName = cluster.Spec.InfrastructureRef.Name
+	}
+
+	return c.get(ctx, b, client.ObjectKey{Name: tinkerbellClusterName, Namespace: namespace},
+		&infrastructurev1.TinkerbellCluster{})
+}
+
+func (c *Collector) collectMachines(ctx context.Context, b *Bundle, opts Options, clusterName string,
+	tinkerbellMachines []infrastructurev1.TinkerbellMachine,
+) error {
+	machines := &clusterv1.MachineList{}
+	if clusterName != "" {
+		if err := c.Client.List(ctx, machines, client.InNamespace(opts.Namespace),
+			client.MatchingLabels{clusterv1.ClusterLabelName: clusterName}); err != nil {
+			return fmt.Errorf("listing Machines: %w", err)
+		}
+	}
+
+	for i := range tinkerbellMachines {
+		tinkerbellMachine := &tinkerbellMachines[i]
+
+		if err := b.add(c.Client, "", tinkerbellMachine); err != nil {
+			return err
+		}
+
+		if err := c.collectMachineDependencies(ctx, b, tinkerbellMachine); err != nil {
+			return err
+		}
+	}
+
+	for i := range machines.Items {
+		machine := &machines.Items[i]
+
+		// With a single machine selected, only its owner Machine is relevant.
+		if opts.MachineName != "" && !ownedBy(tinkerbellMachines[0].OwnerReferences, "Machine", machine.Name) {
+			continue
+		}
+
+		if err := b.add(c.Client, "", machine); err != nil {
+			return err
+		}
+
+		if machine.Spec.Bootstrap.DataSecretName != nil {
+			key := client.ObjectKey{Name: *machine.Spec.Bootstrap.DataSecretName, Namespace: machine.Namespace}
+			if err := c.get(ctx, b, key, &corev1.Secret{}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Collector) collectMachineDependencies(ctx context.Context, b *Bundle,
+	tinkerbellMachine *infrastructurev1.TinkerbellMachine,
+) error {
+	// The Template, Workflow, Hardware and BMC objects live in the Tinkerbell stack of the machine.
+	stack, err := controllers.MachineTinkerbellStack(ctx, c.Client, c.StackClientGetter, tinkerbellMachine)
+	if err != nil {
+		if errors.Is(err, controllers.ErrMissingStackClientGetter) {
+			return nil
+		}
+
+		return fmt.Errorf("getting Tinkerbell stack of %s: %w", tinkerbellMachine.Name, err)
+	}
+
+	// Objects of remote stacks are stored apart, as their names may collide with the ones of the
+	// management cluster.
+	stackName := ""
+	if stack.Remote() {
+		stackName = stack.FailureDomain.Name
+	}
+
+	key := client.ObjectKey{Name: tinkerbellMachine.Name, Namespace: stack.Namespace}
+
+	if err := c.getFrom(ctx, b, stack.Client, stackName, key, &tinkv1.Template{}); err != nil {
+		return err
+	}
+
+	if err := c.getFrom(ctx, b, stack.Client, stackName, key, &tinkv1.Workflow{}); err != nil {
+		return err
+	}
+
+	if tinkerbellMachine.Spec.HardwareName == "" {
+		return nil
+	}
+
+	hardware := &tinkv1.Hardware{}
+	hardwareKey := client.ObjectKey{Name: tinkerbellMachine.Spec.HardwareName, Namespace: stack.Namespace}
+
+	if err := c.getFrom(ctx, b, stack.Client, stackName, hardwareKey, hardware); err != nil {
+		return err
+	}
+
+	if hardware.Spec.BMCRef != nil {
+		bmcKey := client.ObjectKey{Name: hardware.Spec.BMCRef.Name, Namespace: hardware.Namespace}
+		if err := c.getFrom(ctx, b, stack.Client, stackName, bmcKey, &rufiov1.Machine{}); err != nil {
+			return err
+		}
+	}
+
+	jobs := &rufiov1.JobList{}
+	if err := stack.Client.List(ctx, jobs, client.InNamespace(stack.Namespace)); err != nil {
+		return fmt.Errorf("listing rufio Jobs: %w", err)
+	}
+
+	for i := range jobs.Items {
+		if ownedBy(jobs.Items[i].OwnerReferences, "TinkerbellMachine", tinkerbellMachine.Name) {
+			if err := b.add(c.Client, stackName, &jobs.Items[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// collectEvents adds the events of all collected objects.
+func (c *Collector) collectEvents(ctx context.Context, b *Bundle, namespace string) error {
+	events := &corev1.EventList{}
+	if err := c.Client.List(ctx, events, client.InNamespace(namespace)); err != nil {
+		return fmt.Errorf("listing events: %w", err)
+	}
+
+	related := &corev1.EventList{}
+
+	for _, event := range events.Items {
+		if b.uids[event.InvolvedObject.UID] {
+			event.ManagedFields = nil
+			related.Items = append(related.Items, event)
+		}
+	}
+
+	sort.SliceStable(related.Items, func(i, j int) bool {
+		return related.Items[i].LastTimestamp.Before(&related.Items[j].LastTimestamp)
+	})
+
+	data, err := yaml.Marshal(related)
+	if err != nil {
+		return fmt.Errorf("marshaling events: %w", err)
+	}
+
+	return b.addFile(IndexEntry{
+		Path:      path.Join("events", namespace+".yaml"),
+		Kind:      "EventList",
+		Namespace: namespace,
+	}, data)
+}
+
+// collectLogs adds the logs of all manager pod containers.
+func (c *Collector) collectLogs(ctx context.Context, b *Bundle, opts Options) error {
+	if c.PodLogs == nil || opts.ManagerNamespace == "" {
+		return nil
+	}
+
+	selector, err := labels.Parse(opts.ManagerSelector)
+	if err != nil {
+		return fmt.Errorf("parsing manager selector: %w", err)
+	}
+
+	pods := &corev1.PodList{}
+	if err := c.Client.List(ctx, pods, client.InNamespace(opts.ManagerNamespace),
+		client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return fmt.Errorf("listing manager pods: %w", err)
+	}
+
+	for _, pod := range pods.Items {
+		for _, container := range pod.Spec.Containers {
+			logs, err := c.PodLogs(ctx, pod.Namespace, pod.Name, container.Name)
+			if err != nil {
+				logs = []byte(fmt.Sprintf("unable to read logs: %v\n", err))
+			}
+
+			if err := b.addFile(IndexEntry{
+				Path:      path.Join("logs", pod.Namespace, pod.Name, container.Name+".log"),
+				Kind:      "Log",
+				Namespace: pod.Namespace,
+				Name:      pod.Name + "/" + container.Name,
+			}, logs); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// get adds the object with the given key to the bundle. Objects which don't exist are skipped.
+func (c *Collector) get(ctx context.Context, b *Bundle, key client.ObjectKey, obj client.Object) error {
+	return c.getFrom(ctx, b, c.Client, "", key, obj)
+}
+
+// getFrom adds the object read with the given client, which may be the client of the Tinkerbell stack
+// of the named failure domain.
+func (c *Collector) getFrom(ctx context.Context, b *Bundle, reader client.Reader, stack string, key client.ObjectKey,
+	obj client.Object,
+) error {
+	if err := reader.Get(ctx, key, obj); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+
+		return fmt.Errorf("getting %T %s: %w", obj, key, err)
+	}
+
+	return b.add(c.Client, stack, obj)
+}
+
+func ownedBy(refs []metav1.OwnerReference, kind, name string) bool {
+	for _, ref := range refs {
+		if ref.Kind == kind && ref.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// add redacts and serializes the object into the bundle. Objects of a remote Tinkerbell stack are
+// stored below stacks/<failure domain>. Objects already collected are skipped.
+func (b *Bundle) add(c client.Client, stack string, obj client.Object) error {
+	if obj.GetUID() != "" && b.uids[obj.GetUID()] {
+		return nil
+	}
+
+	gvk, err := apiutil.GVKForObject(obj, c.Scheme())
+	if err != nil {
+		return fmt.Errorf("getting kind of %T: %w", obj, err)
+	}
+
+	obj = obj.DeepCopyObject().(client.Object) //nolint:forcetypeassert
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+	obj.SetManagedFields(nil)
+	redact(obj)
+
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("marshaling %s %s: %w", gvk.Kind, obj.GetName(), err)
+	}
+
+	group := gvk.Group
+	if group == "" {
+		group = coreGroup
+	}
+
+	dir := "resources"
+	if stack != "" {
+		dir = path.Join("stacks", stack, dir)
+	}
+
+	if err := b.addFile(IndexEntry{
+		Path:      path.Join(dir, group, gvk.Kind, obj.GetNamespace(), obj.GetName()+".yaml"),
+		Group:     gvk.Group,
+		Kind:      gvk.Kind,
+		Stack:     stack,
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+	}, data); err != nil {
+		return err
+	}
+
+	if obj.GetUID() != "" {
+		b.uids[obj.GetUID()] = true
+	}
+
+	return nil
+}
+
+// addFile adds a file to the bundle, refusing to overwrite a file already added.
+func (b *Bundle) addFile(entry IndexEntry, data []byte) error {
+	if _, ok := b.files[entry.Path]; ok {
+		return fmt.Errorf("%w: %s", ErrDuplicatePath, entry.Path)
+	}
+
+	b.Index.Entries = append(b.Index.Entries, entry)
+	b.files[entry.Path] = data
+
+	return nil
+}
+
+// redact removes sensitive values from the object.
+func redact(obj client.Object) {
+	// The last applied configuration repeats the values redacted below.
+	if _, ok := obj.GetAnnotations()[corev1.LastAppliedConfigAnnotation]; ok {
+		annotations := obj.GetAnnotations()
+		annotations[corev1.LastAppliedConfigAnnotation] = Redacted
+		obj.SetAnnotations(annotations)
+	}
+
+	switch o := obj.(type) {
+	case *corev1.Secret:
+		for k := range o.Data {
+			o.Data[k] = []byte(Redacted)
+		}
+
+		for k := range o.StringData {
+			o.StringData[k] = Redacted
+		}
+
+		for k := range o.Annotations {
+			o.Annotations[k] = Redacted
+		}
+	case *tinkv1.Hardware:
+		if o.Spec.UserData != nil && *o.Spec.UserData != "" {
+			redacted := Redacted
+			o.Spec.UserData = &redacted
+		}
+
+		if o.Spec.Metadata != nil && o.Spec.Metadata.Instance != nil && o.Spec.Metadata.Instance.Userdata != "" {
+			o.Spec.Metadata.Instance.Userdata = Redacted
+		}
+	case *tinkv1.Template:
+		if _, ok := o.Labels[controllers.TemplateSecretsLabel]; ok && o.Spec.Data != nil {
+			redacted := Redacted
+			o.Spec.Data = &redacted
+		}
+	case *tinkv1.Workflow:
+		// Secret values may end up in any field of the rendered tasks, not only in their environment.
+		if _, ok := o.Labels[controllers.TemplateSecretsLabel]; ok {
+			o.Status.Tasks = nil
+		}
+	}
+}
+
+// Write writes the bundle as a gzipped tarball, starting with the index.
+func (b *Bundle) Write(w io.Writer) error {
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	index, err := json.MarshalIndent(b.Index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling index: %w", err)
+	}
+
+	if err := writeFile(tarWriter, IndexFileName, index, b.Index.CreatedAt); err != nil {
+		return err
+	}
+
+	for _, entry := range b.Index.Entries {
+		if err := writeFile(tarWriter, entry.Path, b.files[entry.Path], b.Index.CreatedAt); err != nil {
+			return err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return fmt.Errorf("closing tarball: %w", err)
+	}
+
+	if err := gzipWriter.Close(); err != nil {
+		return fmt.Errorf("closing gzip stream: %w", err)
+	}
+
+	return nil
+}
+
+func writeFile(w *tar.Writer, name string, data []byte, modTime time.Time) error {
+	if err := w.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o600, //nolint:gomnd
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}); err != nil {
+		return fmt.Errorf("writing header of %s: %w", name, err)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+
+	return nil
+}
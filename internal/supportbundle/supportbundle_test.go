@@ -0,0 +1,348 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supportbundle_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	rufiov1 "github.com/tinkerbell/rufio/api/v1alpha1"
+	tinkv1 "github.com/tinkerbell/tink/pkg/apis/core/v1alpha1"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/controllers"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/internal/supportbundle"
+)
+
+const (
+	namespace   = "default"
+	clusterName = "myCluster"
+)
+
+func objects() []runtime.Object {
+	clusterLabels := map[string]string{clusterv1.ClusterLabelName: clusterName}
+
+	return []runtime.Object{
+		&clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Name: clusterName, Namespace: namespace}},
+		&infrastructurev1.TinkerbellCluster{ObjectMeta: metav1.ObjectMeta{Name: clusterName, Namespace: namespace}},
+		&clusterv1.Machine{
+			ObjectMeta: metav1.ObjectMeta{Name: "machine-0", Namespace: namespace, Labels: clusterLabels},
+			Spec: clusterv1.MachineSpec{
+				ClusterName: clusterName,
+				Bootstrap:   clusterv1.Bootstrap{DataSecretName: pointer.String("machine-0")},
+			},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "machine-0",
+				Namespace:   namespace,
+				Annotations: map[string]string{corev1.LastAppliedConfigAnnotation: `{"data":{"value":"I2Nsb3VkLWNvbmZpZw=="}}`},
+			},
+			Data: map[string][]byte{"value": []byte("#cloud-config")},
+		},
+		&infrastructurev1.TinkerbellMachine{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "tinkerbellmachine-0",
+				Namespace: namespace,
+				Labels:    clusterLabels,
+				UID:       "tinkerbellmachine-0-uid",
+				OwnerReferences: []metav1.OwnerReference{
+					{APIVersion: clusterv1.GroupVersion.String(), Kind: "Machine", Name: "machine-0"},
+				},
+			},
+			Spec: infrastructurev1.TinkerbellMachineSpec{HardwareName: "hardware-0"},
+		},
+		&tinkv1.Hardware{
+			ObjectMeta: metav1.ObjectMeta{Name: "hardware-0", Namespace: namespace},
+			Spec: tinkv1.HardwareSpec{
+				UserData: pointer.String("#cloud-config\npassword: secret"),
+				BMCRef:   &corev1.TypedLocalObjectReference{Kind: "Machine", Name: "bmc-0"},
+				Metadata: &tinkv1.HardwareMetadata{
+					Instance: &tinkv1.MetadataInstance{Userdata: "#cloud-config\npassword: instance-secret"},
+				},
+			},
+		},
+		&tinkv1.Hardware{ObjectMeta: metav1.ObjectMeta{Name: "unrelated", Namespace: namespace}},
+		&tinkv1.Template{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "tinkerbellmachine-0",
+				Namespace: namespace,
+				Labels:    map[string]string{controllers.TemplateSecretsLabel: "true"},
+			},
+			Spec: tinkv1.TemplateSpec{Data: pointer.String("TOKEN: portal-token")},
+		},
+		&tinkv1.Workflow{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "tinkerbellmachine-0",
+				Namespace: namespace,
+				Labels:    map[string]string{controllers.TemplateSecretsLabel: "true"},
+			},
+			Status: tinkv1.WorkflowStatus{Tasks: []tinkv1.Task{{
+				Name: "provision",
+				Actions: []tinkv1.Action{{
+					Name:        "firmware",
+					Environment: map[string]string{"TOKEN": "portal-token"},
+					Command:     []string{"update", "--token", "portal-token"},
+				}},
+			}}},
+		},
+		&rufiov1.Machine{ObjectMeta: metav1.ObjectMeta{Name: "bmc-0", Namespace: namespace}},
+		&rufiov1.Job{ObjectMeta: metav1.ObjectMeta{
+			Name:      "tinkerbellmachine-0-provision",
+			Namespace: namespace,
+			OwnerReferences: []metav1.OwnerReference{
+				{APIVersion: infrastructurev1.GroupVersion.String(), Kind: "TinkerbellMachine", Name: "tinkerbellmachine-0"},
+			},
+		}},
+		&rufiov1.Job{ObjectMeta: metav1.ObjectMeta{
+			Name:      "tinkerbellmachine-1-provision",
+			Namespace: namespace,
+			OwnerReferences: []metav1.OwnerReference{
+				{APIVersion: infrastructurev1.GroupVersion.String(), Kind: "TinkerbellMachine", Name: "tinkerbellmachine-1"},
+			},
+		}},
+		&corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: "event-0", Namespace: namespace},
+			InvolvedObject: corev1.ObjectReference{UID: "tinkerbellmachine-0-uid"},
+			Message:        "related event",
+		},
+		&corev1.Event{
+			ObjectMeta: metav1.ObjectMeta{Name: "event-1", Namespace: namespace},
+			Message:    "unrelated event",
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "capt-controller-manager-0",
+				Namespace: "capt-system",
+				Labels:    map[string]string{"control-plane": "controller-manager"},
+			},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "manager"}}},
+		},
+	}
+}
+
+func newScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	g := NewWithT(t)
+
+	scheme := runtime.NewScheme()
+	g.Expect(corev1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(clusterv1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(infrastructurev1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(tinkv1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(rufiov1.AddToScheme(scheme)).To(Succeed())
+
+	return scheme
+}
+
+func readBundle(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	g := NewWithT(t)
+
+	gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	tarReader := tar.NewReader(gzipReader)
+	files := map[string]string{}
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		g.Expect(err).NotTo(HaveOccurred())
+
+		content, err := io.ReadAll(tarReader)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		files[header.Name] = string(content)
+	}
+
+	return files
+}
+
+func Test_Collect(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	collector := &supportbundle.Collector{
+		Client: fake.NewClientBuilder().WithScheme(newScheme(t)).WithRuntimeObjects(objects()...).Build(),
+		PodLogs: func(_ context.Context, namespace, pod, container string) ([]byte, error) {
+			return []byte("logs of " + namespace + "/" + pod + "/" + container), nil
+		},
+	}
+
+	bundle, err := collector.Collect(context.Background(), supportbundle.Options{
+		Namespace:        namespace,
+		ClusterName:      clusterName,
+		ManagerNamespace: "capt-system",
+		ManagerSelector:  "control-plane=controller-manager",
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	out := &bytes.Buffer{}
+	g.Expect(bundle.Write(out)).To(Succeed())
+
+	files := readBundle(t, out.Bytes())
+
+	index := &supportbundle.Index{}
+	g.Expect(json.Unmarshal([]byte(files[supportbundle.IndexFileName]), index)).To(Succeed())
+
+	paths := []string{}
+	for _, entry := range index.Entries {
+		paths = append(paths, entry.Path)
+		g.Expect(files).To(HaveKey(entry.Path), "Indexed file should be in the bundle")
+	}
+
+	g.Expect(paths).To(ConsistOf(
+		"resources/cluster.x-k8s.io/Cluster/default/myCluster.yaml",
+		"resources/infrastructure.cluster.x-k8s.io/TinkerbellCluster/default/myCluster.yaml",
+		"resources/infrastructure.cluster.x-k8s.io/TinkerbellMachine/default/tinkerbellmachine-0.yaml",
+		"resources/tinkerbell.org/Template/default/tinkerbellmachine-0.yaml",
+		"resources/tinkerbell.org/Workflow/default/tinkerbellmachine-0.yaml",
+		"resources/tinkerbell.org/Hardware/default/hardware-0.yaml",
+		"resources/bmc.tinkerbell.org/Machine/default/bmc-0.yaml",
+		"resources/bmc.tinkerbell.org/Job/default/tinkerbellmachine-0-provision.yaml",
+		"resources/cluster.x-k8s.io/Machine/default/machine-0.yaml",
+		"resources/core/Secret/default/machine-0.yaml",
+		"events/default.yaml",
+		"logs/capt-system/capt-controller-manager-0/manager.log",
+	))
+
+	t.Run("redacts_secrets", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		g.Expect(files["resources/core/Secret/default/machine-0.yaml"]).NotTo(ContainSubstring("Y2xvdWQtY29uZmln"))
+		g.Expect(files["resources/core/Secret/default/machine-0.yaml"]).To(ContainSubstring("value:"))
+		g.Expect(files["resources/core/Secret/default/machine-0.yaml"]).NotTo(ContainSubstring("I2Nsb3VkLWNvbmZpZw"))
+	})
+
+	t.Run("redacts_user_data", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		hardware := files["resources/tinkerbell.org/Hardware/default/hardware-0.yaml"]
+		g.Expect(hardware).NotTo(ContainSubstring("password"))
+		g.Expect(hardware).To(ContainSubstring("userData: " + supportbundle.Redacted))
+		g.Expect(hardware).To(ContainSubstring("userdata: " + supportbundle.Redacted))
+	})
+
+	t.Run("redacts_templates_holding_secrets", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		workflow := files["resources/tinkerbell.org/Workflow/default/tinkerbellmachine-0.yaml"]
+		g.Expect(files["resources/tinkerbell.org/Template/default/tinkerbellmachine-0.yaml"]).NotTo(
+			ContainSubstring("portal-token"))
+		g.Expect(workflow).NotTo(ContainSubstring("portal-token"))
+		g.Expect(workflow).NotTo(ContainSubstring("tasks:"))
+	})
+
+	t.Run("includes_only_related_events", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		g.Expect(files["events/default.yaml"]).To(ContainSubstring("related event"))
+		g.Expect(files["events/default.yaml"]).NotTo(ContainSubstring("unrelated event"))
+	})
+
+	t.Run("includes_manager_logs", func(t *testing.T) {
+		t.Parallel()
+		g := NewWithT(t)
+
+		g.Expect(files["logs/capt-system/capt-controller-manager-0/manager.log"]).To(
+			Equal("logs of capt-system/capt-controller-manager-0/manager"))
+	})
+}
+
+func Test_Collect_stores_objects_of_remote_stacks_apart(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	failureDomain := &infrastructurev1.TinkerbellFailureDomain{
+		Name:                "rack-1",
+		KubeconfigSecretRef: &corev1.LocalObjectReference{Name: "rack-1-kubeconfig"},
+	}
+
+	remoteMachine := &infrastructurev1.TinkerbellMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "tinkerbellmachine-1",
+			Namespace: namespace,
+			Labels:    map[string]string{clusterv1.ClusterLabelName: clusterName},
+		},
+		Spec:   infrastructurev1.TinkerbellMachineSpec{HardwareName: "hardware-0"},
+		Status: infrastructurev1.TinkerbellMachineStatus{FailureDomain: failureDomain},
+	}
+
+	// The Hardware of the remote stack has the same name as the one of the management cluster.
+	stackClient := fake.NewClientBuilder().WithScheme(newScheme(t)).WithRuntimeObjects(
+		&tinkv1.Hardware{ObjectMeta: metav1.ObjectMeta{Name: "hardware-0", Namespace: namespace, UID: "remote-uid"}},
+	).Build()
+
+	collector := &supportbundle.Collector{
+		Client: fake.NewClientBuilder().WithScheme(newScheme(t)).WithRuntimeObjects(append(objects(),
+			remoteMachine,
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "rack-1-kubeconfig", Namespace: namespace},
+				Data:       map[string][]byte{"value": []byte("kubeconfig")},
+			},
+		)...).Build(),
+		StackClientGetter: func([]byte) (client.Client, error) {
+			return stackClient, nil
+		},
+	}
+
+	bundle, err := collector.Collect(context.Background(), supportbundle.Options{
+		Namespace:   namespace,
+		ClusterName: clusterName,
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	paths := []string{}
+	for _, entry := range bundle.Index.Entries {
+		paths = append(paths, entry.Path)
+	}
+
+	g.Expect(paths).To(ContainElements(
+		"resources/tinkerbell.org/Hardware/default/hardware-0.yaml",
+		"stacks/rack-1/resources/tinkerbell.org/Hardware/default/hardware-0.yaml",
+	))
+}
+
+func Test_Collect_requires_a_target(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	_, err := (&supportbundle.Collector{}).Collect(context.Background(), supportbundle.Options{Namespace: namespace})
+	g.Expect(err).To(MatchError(supportbundle.ErrNoTarget))
+}
@@ -20,7 +20,10 @@ package templates
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"regexp"
+	"strings"
 	"text/template"
 
 	"github.com/pkg/errors"
@@ -32,6 +35,23 @@ var (
 
 	// ErrMissingImageURL is the error returned when the WorfklowTemplate ImageURL is not specified.
 	ErrMissingImageURL = fmt.Errorf("imageURL can't be empty")
+
+	// deviceEnvironment matches action environment variables used by Tinkerbell actions to select
+	// the disk or partition they write to.
+	deviceEnvironment = regexp.MustCompile(
+		`(?m)^\s*(?:DEST_DISK|DEST_PARTITION|BLOCK_DEVICE|DISK|DEVICE)\s*:\s*["']?([^"'\s]+)`)
+
+	// secretCall matches calls of the secret template function, e.g. {{ secret "registry" "token" }},
+	// including the double quotes around a quoted call.
+	secretCall = regexp.MustCompile(`"?{{-?\s*secret\s+"([^"]+)"\s+"([^"]+)"\s*-?}}"?`)
+
+	// partitionSuffix matches the partition part of a device name, e.g. 1 in /dev/sda1 or p1 in /dev/nvme0n1p1.
+	partitionSuffix = regexp.MustCompile(`^p?\d+$`)
+)
+
+const (
+	defaultPreservedDiskFilesystemType = "auto"
+	defaultPreservedDiskMountOptions   = "defaults,nofail"
 )
 
 // WorkflowTemplate is a helper struct for rendering CAPT Template data.
@@ -42,6 +62,20 @@ type WorkflowTemplate struct {
 	DestDisk           string
 	DestPartition      string
 	DeviceTemplateName string
+	PreservedDisks     []PreservedDisk
+
+	// MetadataCABundle holds the PEM encoded CA certificates the https metadata service is
+	// verified with. When set, they are added to the trust store and the cloud-init ca_certs
+	// configuration of the machine.
+	MetadataCABundle string
+}
+
+// PreservedDisk is a data filesystem which is mounted again after the OS has been written.
+type PreservedDisk struct {
+	FilesystemUUID string
+	MountPoint     string
+	FilesystemType string
+	MountOptions   string
 }
 
 // Render renders workflow template for a given machine including user-data.
@@ -58,7 +92,17 @@ func (wt *WorkflowTemplate) Render() (string, error) {
 		wt.DeviceTemplateName = "{{.device_1}}"
 	}
 
-	tpl, err := template.New("template").Parse(workflowTemplate)
+	for i := range wt.PreservedDisks {
+		if wt.PreservedDisks[i].FilesystemType == "" {
+			wt.PreservedDisks[i].FilesystemType = defaultPreservedDiskFilesystemType
+		}
+
+		if wt.PreservedDisks[i].MountOptions == "" {
+			wt.PreservedDisks[i].MountOptions = defaultPreservedDiskMountOptions
+		}
+	}
+
+	tpl, err := template.New("template").Funcs(template.FuncMap{"indent": indent}).Parse(workflowTemplate)
 	if err != nil {
 		return "", errors.Wrap(err, "unable to parse template")
 	}
@@ -73,6 +117,87 @@ func (wt *WorkflowTemplate) Render() (string, error) {
 	return buf.String(), nil
 }
 
+// indent indents all lines of the text by the given number of spaces, for embedding it in a YAML
+// block scalar.
+func indent(spaces int, text string) string {
+	padding := strings.Repeat(" ", spaces)
+
+	return padding + strings.ReplaceAll(strings.TrimRight(text, "\n"), "\n", "\n"+padding)
+}
+
+// WritesToDevice reports whether any action in the given template data targets the given disk
+// device or one of its partitions.
+func WritesToDevice(data, device string) bool {
+	for _, match := range deviceEnvironment.FindAllStringSubmatch(data, -1) {
+		target := match[1]
+		if target == device {
+			return true
+		}
+
+		if strings.HasPrefix(target, device) && partitionSuffix.MatchString(strings.TrimPrefix(target, device)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SecretReference identifies a value of a Secret referenced by a template.
+type SecretReference struct {
+	Name string
+	Key  string
+}
+
+// SecretReferences returns the Secret values referenced by the template data through the secret
+// function, in order of first use.
+func SecretReferences(data string) []SecretReference {
+	refs := []SecretReference{}
+	seen := map[SecretReference]bool{}
+
+	for _, match := range secretCall.FindAllStringSubmatch(data, -1) {
+		ref := SecretReference{Name: match[1], Key: match[2]}
+		if !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+
+	return refs
+}
+
+// ResolveSecrets replaces the calls of the secret function in the template data with the values
+// returned by lookup, as double-quoted YAML scalars, so values holding newlines, quotes or YAML
+// syntax can't change the structure of the template. A call must therefore be a whole YAML value.
+// Other template actions are left untouched, as they are rendered by Tinkerbell when the workflow
+// is created.
+func ResolveSecrets(data string, lookup func(ref SecretReference) (string, error)) (string, error) {
+	values := map[SecretReference]string{}
+
+	for _, ref := range SecretReferences(data) {
+		value, err := lookup(ref)
+		if err != nil {
+			return "", err
+		}
+
+		values[ref] = value
+	}
+
+	return secretCall.ReplaceAllStringFunc(data, func(call string) string {
+		match := secretCall.FindStringSubmatch(call)
+
+		return quoteYAML(values[SecretReference{Name: match[1], Key: match[2]}])
+	}), nil
+}
+
+// quoteYAML returns value as a double-quoted YAML scalar. JSON strings are valid YAML scalars. The
+// braces are escaped too, so Tinkerbell does not render template actions held by the value.
+func quoteYAML(value string) string {
+	// Marshaling a string can't fail.
+	quoted, _ := json.Marshal(value)
+
+	return strings.ReplaceAll(string(quoted), "{", `\u007b`)
+}
+
 const (
 	workflowTemplate = `
 version: "0.1"
@@ -118,6 +243,12 @@ tasks:
             manage_etc_hosts: localhost
             warnings:
               dsid_missing_source: off
+{{- if .MetadataCABundle }}
+            ca_certs:
+              trusted:
+                - |
+{{ indent 20 .MetadataCABundle }}
+{{- end }}
       - name: "add-tink-cloud-init-ds-config"
         image: writefile:v1.0.0
         timeout: 90
@@ -131,6 +262,48 @@ tasks:
           DIRMODE: 0700
           CONTENTS: |
             datasource: Ec2
+{{- if .MetadataCABundle }}
+      - name: "add-tink-metadata-ca"
+        image: writefile:v1.0.0
+        timeout: 90
+        environment:
+          DEST_DISK: {{.DestPartition}}
+          FS_TYPE: ext4
+          DEST_PATH: /usr/local/share/ca-certificates/tinkerbell-metadata.crt
+          UID: 0
+          GID: 0
+          MODE: 0644
+          DIRMODE: 0755
+          CONTENTS: |
+{{ indent 12 .MetadataCABundle }}
+      - name: "update-ca-certificates"
+        image: cexec:v1.0.0
+        timeout: 90
+        environment:
+          BLOCK_DEVICE: {{.DestPartition}}
+          FS_TYPE: ext4
+          CHROOT: "y"
+          DEFAULT_INTERPRETER: "/bin/sh -c"
+          CMD_LINE: "update-ca-certificates"
+{{- end }}
+{{- if .PreservedDisks }}
+      - name: "add-preserved-disks-mounts"
+        image: writefile:v1.0.0
+        timeout: 90
+        environment:
+          DEST_DISK: {{.DestPartition}}
+          FS_TYPE: ext4
+          DEST_PATH: /etc/cloud/cloud.cfg.d/20_preserved_disks.cfg
+          UID: 0
+          GID: 0
+          MODE: 0600
+          DIRMODE: 0700
+          CONTENTS: |
+            mounts:
+{{- range .PreservedDisks }}
+              - ["UUID={{.FilesystemUUID}}", "{{.MountPoint}}", "{{.FilesystemType}}", "{{.MountOptions}}", "0", "2"]
+{{- end }}
+{{- end }}
       - name: "kexec-image"
         image: kexec:v1.0.0
         timeout: 90
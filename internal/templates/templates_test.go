@@ -17,6 +17,7 @@ limitations under the License.
 package templates_test
 
 import (
+	"fmt"
 	"testing"
 
 	. "github.com/onsi/gomega"
@@ -35,6 +36,52 @@ func validWorkflowTemplate() *templates.WorkflowTemplate {
 	}
 }
 
+const testCABundle = `-----BEGIN CERTIFICATE-----
+MIIBdzCCAR2gAwIBAgIUTinkerbellTestCA
+-----END CERTIFICATE-----
+`
+
+// renderedAction is an action of a rendered template.
+type renderedAction struct {
+	Name        string            `json:"name"`
+	Environment map[string]string `json:"environment"`
+}
+
+// renderedActions returns the actions of the rendered template in order.
+func renderedActions(t *testing.T, renderResult string) []renderedAction {
+	t.Helper()
+	g := NewWithT(t)
+
+	rendered := struct {
+		Tasks []struct {
+			Actions []renderedAction `json:"actions"`
+		} `json:"tasks"`
+	}{}
+	g.Expect(yaml.Unmarshal([]byte(renderResult), &rendered)).To(Succeed())
+
+	actions := []renderedAction{}
+	for _, task := range rendered.Tasks {
+		actions = append(actions, task.Actions...)
+	}
+
+	return actions
+}
+
+// actionContents returns the CONTENTS environment of the actions of the rendered template by action name.
+func actionContents(t *testing.T, renderResult string) map[string]string {
+	t.Helper()
+
+	contents := map[string]string{}
+
+	for _, action := range renderedActions(t, renderResult) {
+		if value, ok := action.Environment["CONTENTS"]; ok {
+			contents[action.Name] = value
+		}
+	}
+
+	return contents
+}
+
 //nolint:funlen
 func Test_Cloud_config_template(t *testing.T) {
 	t.Parallel()
@@ -65,6 +112,74 @@ func Test_Cloud_config_template(t *testing.T) {
 			mutateF: func(wt *templates.WorkflowTemplate) {},
 		},
 
+		"renders_mounts_for_preserved_disks": {
+			mutateF: func(wt *templates.WorkflowTemplate) {
+				wt.PreservedDisks = []templates.PreservedDisk{
+					{
+						FilesystemUUID: "5b6c2a8e-3f1d-4a4e-9d0e-0c6f3c1a2b7d",
+						MountPoint:     "/var/lib/data",
+					},
+				}
+			},
+			validateF: func(t *testing.T, wt *templates.WorkflowTemplate, renderResult string) { //nolint:thelper
+				g := NewWithT(t)
+				x := &map[string]interface{}{}
+
+				g.Expect(yaml.Unmarshal([]byte(renderResult), x)).To(Succeed())
+				g.Expect(renderResult).To(ContainSubstring(
+					`- ["UUID=5b6c2a8e-3f1d-4a4e-9d0e-0c6f3c1a2b7d", "/var/lib/data", "auto", "defaults,nofail", "0", "2"]`))
+			},
+		},
+
+		"renders_metadata_ca_bundle": {
+			mutateF: func(wt *templates.WorkflowTemplate) {
+				wt.MetadataURL = "https://10.10.10.10:50061"
+				wt.MetadataCABundle = testCABundle
+			},
+			validateF: func(t *testing.T, wt *templates.WorkflowTemplate, renderResult string) { //nolint:thelper
+				g := NewWithT(t)
+
+				contents := actionContents(t, renderResult)
+				g.Expect(contents).To(HaveKeyWithValue("add-tink-metadata-ca", testCABundle))
+
+				// The CA is added to the trust store of the OS once written.
+				var update *renderedAction
+
+				written := false
+				actions := renderedActions(t, renderResult)
+
+				for i := range actions {
+					switch actions[i].Name {
+					case "add-tink-metadata-ca":
+						written = true
+					case "update-ca-certificates":
+						g.Expect(written).To(BeTrue(), "Expected the CA to be written first")
+						update = &actions[i]
+					}
+				}
+
+				g.Expect(update).NotTo(BeNil())
+				g.Expect(update.Environment).To(HaveKeyWithValue("BLOCK_DEVICE", wt.DestPartition))
+				g.Expect(update.Environment).To(HaveKeyWithValue("CHROOT", "y"))
+				g.Expect(update.Environment).To(HaveKeyWithValue("CMD_LINE", "update-ca-certificates"))
+
+				cloudConfig := map[string]interface{}{}
+				g.Expect(yaml.Unmarshal([]byte(contents["add-tink-cloud-init-config"]), &cloudConfig)).To(Succeed())
+				g.Expect(cloudConfig).To(HaveKeyWithValue("ca_certs",
+					map[string]interface{}{"trusted": []interface{}{testCABundle}}))
+			},
+		},
+
+		"renders_no_metadata_ca_without_bundle": {
+			validateF: func(t *testing.T, wt *templates.WorkflowTemplate, renderResult string) { //nolint:thelper
+				g := NewWithT(t)
+
+				g.Expect(actionContents(t, renderResult)).NotTo(HaveKey("add-tink-metadata-ca"))
+				g.Expect(renderResult).NotTo(ContainSubstring("update-ca-certificates"))
+				g.Expect(renderResult).NotTo(ContainSubstring("ca_certs"))
+			},
+		},
+
 		"rendered_output_should_be_valid_YAML": {
 			validateF: func(t *testing.T, wt *templates.WorkflowTemplate, renderResult string) { //nolint:thelper
 				g := NewWithT(t)
@@ -108,3 +223,110 @@ func Test_Cloud_config_template(t *testing.T) {
 		})
 	}
 }
+
+func Test_Writes_to_device(t *testing.T) {
+	t.Parallel()
+
+	data := `actions:
+  - name: "stream-image"
+    environment:
+      DEST_DISK: /dev/nvme0n1
+  - name: "write-file"
+    environment:
+      DEST_DISK: "/dev/sda2"`
+
+	cases := map[string]struct {
+		device string
+		writes bool
+	}{
+		"matches_whole_disk":         {device: "/dev/nvme0n1", writes: true},
+		"matches_partition_of_disk":  {device: "/dev/sda", writes: true},
+		"ignores_other_disks":        {device: "/dev/sdb", writes: false},
+		"ignores_disks_with_prefix":  {device: "/dev/nvme0", writes: false},
+		"ignores_unreferenced_disks": {device: "/dev/nvme1n1", writes: false},
+	}
+
+	for name, c := range cases {
+		c := c
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			g := NewWithT(t)
+
+			g.Expect(templates.WritesToDevice(data, c.device)).To(Equal(c.writes))
+		})
+	}
+}
+
+func Test_Resolve_secrets(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	data := `actions:
+  - name: "login"
+    worker: "{{.device_1}}"
+    environment:
+      USERNAME: {{ secret "registry" "username" }}
+      PASSWORD: {{secret "registry" "password"}}
+  - name: "firmware"
+    environment:
+      TOKEN: "{{- secret "firmware-portal" "token" -}}"
+      AGAIN: {{ secret "registry" "username" }}`
+
+	g.Expect(templates.SecretReferences(data)).To(Equal([]templates.SecretReference{
+		{Name: "registry", Key: "username"},
+		{Name: "registry", Key: "password"},
+		{Name: "firmware-portal", Key: "token"},
+	}))
+
+	resolved, err := templates.ResolveSecrets(data, func(ref templates.SecretReference) (string, error) {
+		return ref.Name + "." + ref.Key, nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(resolved).To(Equal(`actions:
+  - name: "login"
+    worker: "{{.device_1}}"
+    environment:
+      USERNAME: "registry.username"
+      PASSWORD: "registry.password"
+  - name: "firmware"
+    environment:
+      TOKEN: "firmware-portal.token"
+      AGAIN: "registry.username"`))
+
+	errLookup := fmt.Errorf("secret not found")
+
+	_, err = templates.ResolveSecrets(data, func(ref templates.SecretReference) (string, error) {
+		return "", errLookup
+	})
+	g.Expect(err).To(MatchError(errLookup))
+}
+
+func Test_ResolveSecrets_quotes_values(t *testing.T) {
+	t.Parallel()
+	g := NewWithT(t)
+
+	data := `environment:
+  CERTIFICATE: {{ secret "firmware-portal" "certificate" }}
+  TOKEN: "{{ secret "firmware-portal" "token" }}"`
+
+	values := map[string]string{
+		"certificate": "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+		"token":       `"quoted": {{ .injected }} # not a comment`,
+	}
+
+	resolved, err := templates.ResolveSecrets(data, func(ref templates.SecretReference) (string, error) {
+		return values[ref.Key], nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(resolved).NotTo(ContainSubstring("{{"), "Expected no template action to be left for Tinkerbell")
+
+	parsed := struct {
+		Environment map[string]string `json:"environment"`
+	}{}
+	g.Expect(yaml.Unmarshal([]byte(resolved), &parsed)).To(Succeed())
+	g.Expect(parsed.Environment).To(Equal(map[string]string{
+		"CERTIFICATE": values["certificate"],
+		"TOKEN":       values["token"],
+	}))
+}
@@ -16,6 +16,7 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
@@ -24,6 +25,7 @@ import (
 	"time"
 
 	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	cgrecord "k8s.io/client-go/tools/record"
@@ -31,6 +33,7 @@ import (
 	"k8s.io/klog/v2"
 	"k8s.io/klog/v2/klogr"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	runtimeserver "sigs.k8s.io/cluster-api/exp/runtime/server"
 	"sigs.k8s.io/cluster-api/util/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
@@ -40,6 +43,8 @@ import (
 
 	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
 	"github.com/tinkerbell/cluster-api-provider-tinkerbell/controllers"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/internal/imagecache"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/internal/inventoryapi"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -82,6 +87,29 @@ var (
 	leaderElectionLeaseDuration   time.Duration
 	leaderElectionRenewDeadline   time.Duration
 	leaderElectionRetryPeriod     time.Duration
+	hardwareFaultNodeConditions   []string
+	hardwareFaultNodeLabels       []string
+	bmcHealthPollInterval         time.Duration
+	bmcRedfishPort                int
+	imageCacheAddr                string
+	imageCacheDir                 string
+	imageCacheMaxSize             string
+	imageCacheURL                 string
+	imageCacheRequireChecksum     bool
+	imageCacheAllowedHosts        []string
+	imageCacheDownloadTimeout     time.Duration
+	inventoryAPIAddr              string
+	inventoryAPITokenFile         string
+	inventoryAPICertFile          string
+	inventoryAPIKeyFile           string
+	inventoryAPIInsecure          bool
+	usageAccountingInterval       time.Duration
+	hardwareClassLabel            string
+	legacyHardwareOwnerLabels     []string
+	legacyHardwareOwnedStates     []string
+	hardwareOwnershipMigration    time.Duration
+	manageBMCMachines             bool
+	runtimeExtensionPort          int
 )
 
 func initFlags(fs *pflag.FlagSet) { //nolint:funlen
@@ -201,6 +229,144 @@ func initFlags(fs *pflag.FlagSet) { //nolint:funlen
 		":9440",
 		"The address the health endpoint binds to.",
 	)
+
+	fs.StringSliceVar(&hardwareFaultNodeConditions,
+		"hardware-fault-node-conditions",
+		nil,
+		"Workload cluster Node condition types which, when True on deletion, quarantine the Node's Hardware instead of releasing it", //nolint:lll
+	)
+
+	fs.StringSliceVar(&hardwareFaultNodeLabels,
+		"hardware-fault-node-labels",
+		nil,
+		"Workload cluster Node label keys which, when present on deletion, quarantine the Node's Hardware instead of releasing it", //nolint:lll
+	)
+
+	fs.DurationVar(&bmcHealthPollInterval,
+		"bmc-health-poll-interval",
+		0,
+		"Interval at which the hardware health of machines is read from their BMC through Redfish. Disabled if 0 (e.g. 5m)",
+	)
+
+	fs.IntVar(&bmcRedfishPort,
+		"bmc-redfish-port",
+		controllers.DefaultRedfishPort,
+		"Port of the Redfish service of the BMCs polled for hardware health",
+	)
+
+	fs.StringVar(&imageCacheAddr,
+		"image-cache-bind-addr",
+		"",
+		"The address the machine image cache binds to. Disabled if empty (e.g. :8081)",
+	)
+
+	fs.StringVar(&imageCacheDir,
+		"image-cache-dir",
+		"/var/cache/capt/images",
+		"Directory the machine image cache stores images in",
+	)
+
+	fs.StringVar(&imageCacheMaxSize,
+		"image-cache-max-size",
+		"50Gi",
+		"Total size of the images kept by the machine image cache, the least recently used images are evicted beyond it",
+	)
+
+	fs.StringVar(&imageCacheURL,
+		"image-cache-url",
+		"",
+		"URL machines reach the image cache at. When set, machine image URLs are rewritten to download through it (e.g. http://10.0.0.5:8081)", //nolint:lll
+	)
+
+	fs.BoolVar(&imageCacheRequireChecksum,
+		"image-cache-require-checksum",
+		true,
+		"Reject images without a SHA-256 checksum file next to them in the registry",
+	)
+
+	fs.StringSliceVar(&imageCacheAllowedHosts,
+		"image-cache-allowed-hosts",
+		nil,
+		"Registry hosts the machine image cache downloads images from, required with --image-cache-bind-addr (e.g. images.example.com)", //nolint:lll
+	)
+
+	fs.DurationVar(&imageCacheDownloadTimeout,
+		"image-cache-download-timeout",
+		time.Hour,
+		"Time after which the machine image cache gives up downloading an image",
+	)
+
+	fs.StringVar(&inventoryAPIAddr,
+		"inventory-api-bind-addr",
+		"",
+		"The address the read-only inventory API binds to. Disabled if empty (e.g. :8082)",
+	)
+
+	fs.StringVar(&inventoryAPITokenFile,
+		"inventory-api-token-file",
+		"",
+		"File holding the bearer token clients of the inventory API authenticate with",
+	)
+
+	fs.StringVar(&inventoryAPICertFile,
+		"inventory-api-tls-cert-file",
+		"",
+		"TLS certificate of the inventory API, required unless --inventory-api-insecure is set",
+	)
+
+	fs.StringVar(&inventoryAPIKeyFile,
+		"inventory-api-tls-key-file",
+		"",
+		"TLS private key of the inventory API",
+	)
+
+	fs.BoolVar(&inventoryAPIInsecure,
+		"inventory-api-insecure",
+		false,
+		"Serve the inventory API over plain HTTP without TLS certificate, sending its bearer token in plain text",
+	)
+
+	fs.DurationVar(&usageAccountingInterval,
+		"usage-accounting-interval",
+		0,
+		"Interval at which the usage of allocated Hardware is accounted in metrics and TinkerbellUsageReports. Disabled if 0 (e.g. 15m)", //nolint:lll
+	)
+
+	fs.StringVar(&hardwareClassLabel,
+		"hardware-class-label",
+		"",
+		"Hardware label Hardware usage is broken down by (e.g. the server model)",
+	)
+
+	fs.StringArrayVar(&legacyHardwareOwnerLabels,
+		"legacy-hardware-owner-label",
+		nil,
+		"Hardware label set by older CAPT releases or other tooling holding the name of the owner, optionally followed by =<namespace label>. Hardware carrying it is adopted by the named TinkerbellMachine or never selected (repeatable)", //nolint:lll
+	)
+
+	fs.StringSliceVar(&legacyHardwareOwnedStates,
+		"legacy-hardware-owned-states",
+		nil,
+		"Hardware metadata states marking Hardware owned by other tooling, which is never selected (e.g. in_use)",
+	)
+
+	fs.DurationVar(&hardwareOwnershipMigration,
+		"hardware-ownership-migration-interval",
+		0,
+		"Interval at which legacy Hardware ownership markers are migrated again after startup. Only migrated at startup if 0 (e.g. 5m)", //nolint:lll
+	)
+
+	fs.BoolVar(&manageBMCMachines,
+		"manage-bmc-machines",
+		false,
+		"Create and update the BMC Machines of Hardware from its v1alpha1.tinkerbell.org/bmc* annotations and set its BMCRef",
+	)
+
+	fs.IntVar(&runtimeExtensionPort,
+		"runtime-extension-port",
+		0,
+		"Port the CAPI Runtime Extension vetoing ClusterClass creates and upgrades is served on, with the certificate in the webhook cert dir. Disabled if 0 (e.g. 9444)", //nolint:lll
+	)
 }
 
 func addHealthChecks(mgr ctrl.Manager) error {
@@ -215,21 +381,213 @@ func addHealthChecks(mgr ctrl.Manager) error {
 	return nil
 }
 
-func setupReconcilers(ctx context.Context, mgr ctrl.Manager) error {
+func setupReconcilers(ctx context.Context, mgr ctrl.Manager) error { //nolint:funlen
+	legacyOwnerships, err := legacyHardwareOwnerships(legacyHardwareOwnerLabels)
+	if err != nil {
+		return fmt.Errorf("unable to parse legacy hardware owner labels:%w", err)
+	}
+
+	var ownershipMigrator *controllers.HardwareOwnershipMigrator
+	if len(legacyOwnerships) > 0 || len(legacyHardwareOwnedStates) > 0 {
+		if ownershipMigrator, err = setupHardwareOwnershipMigration(mgr, legacyOwnerships); err != nil {
+			return fmt.Errorf("unable to setup hardware ownership migration:%w", err)
+		}
+	}
+
+	var usageAccountant *controllers.UsageAccountant
+	if usageAccountingInterval > 0 {
+		usageAccountant = &controllers.UsageAccountant{
+			Client:             mgr.GetClient(),
+			Interval:           usageAccountingInterval,
+			HardwareClassLabel: hardwareClassLabel,
+		}
+
+		if err := usageAccountant.SetupWithManager(mgr); err != nil {
+			return fmt.Errorf("unable to setup usage accountant:%w", err)
+		}
+	}
+
 	if err := (&controllers.TinkerbellClusterReconciler{
-		Client:           mgr.GetClient(),
-		WatchFilterValue: watchFilterValue,
+		Client:                    mgr.GetClient(),
+		WatchFilterValue:          watchFilterValue,
+		HardwareOwnershipMigrator: ownershipMigrator,
 	}).SetupWithManager(ctx, mgr, controller.Options{MaxConcurrentReconciles: tinkerbellClusterConcurrency}); err != nil {
 		return fmt.Errorf("unable to setup TinkerbellCluster controller:%w", err)
 	}
 
 	if err := (&controllers.TinkerbellMachineReconciler{
-		Client:           mgr.GetClient(),
-		WatchFilterValue: watchFilterValue,
+		Client:                    mgr.GetClient(),
+		APIReader:                 mgr.GetAPIReader(),
+		WatchFilterValue:          watchFilterValue,
+		HardwareFaultConditions:   hardwareFaultNodeConditions,
+		HardwareFaultLabels:       hardwareFaultNodeLabels,
+		ImageCacheURL:             imageCacheURL,
+		UsageAccountant:           usageAccountant,
+		HardwareOwnershipMigrator: ownershipMigrator,
 	}).SetupWithManager(ctx, mgr, controller.Options{MaxConcurrentReconciles: tinkerbellMachineConcurrency}); err != nil {
 		return fmt.Errorf("unable to setup TinkerbellMachine controller:%w", err)
 	}
 
+	if err := (&controllers.ScaleDownReconciler{
+		Client:           mgr.GetClient(),
+		WatchFilterValue: watchFilterValue,
+	}).SetupWithManager(ctx, mgr, controller.Options{}); err != nil {
+		return fmt.Errorf("unable to setup scale-down controller:%w", err)
+	}
+
+	if err := (&controllers.TinkerbellFirmwareRolloutReconciler{
+		Client:           mgr.GetClient(),
+		WatchFilterValue: watchFilterValue,
+	}).SetupWithManager(ctx, mgr, controller.Options{}); err != nil {
+		return fmt.Errorf("unable to setup firmware rollout controller:%w", err)
+	}
+
+	if err := (&controllers.HardwareDecommissionReconciler{
+		Client:           mgr.GetClient(),
+		WatchFilterValue: watchFilterValue,
+	}).SetupWithManager(ctx, mgr, controller.Options{}); err != nil {
+		return fmt.Errorf("unable to setup hardware decommission controller:%w", err)
+	}
+
+	if manageBMCMachines {
+		if err := (&controllers.HardwareBMCReconciler{
+			Client:           mgr.GetClient(),
+			WatchFilterValue: watchFilterValue,
+		}).SetupWithManager(ctx, mgr, controller.Options{}); err != nil {
+			return fmt.Errorf("unable to setup hardware BMC controller:%w", err)
+		}
+	}
+
+	if bmcHealthPollInterval > 0 {
+		if err := (&controllers.BMCHealthPoller{
+			Client:           mgr.GetClient(),
+			WatchFilterValue: watchFilterValue,
+			Interval:         bmcHealthPollInterval,
+			RedfishPort:      bmcRedfishPort,
+		}).SetupWithManager(mgr); err != nil {
+			return fmt.Errorf("unable to setup BMC health poller:%w", err)
+		}
+	}
+
+	if imageCacheAddr != "" {
+		if err := setupImageCache(mgr); err != nil {
+			return fmt.Errorf("unable to setup image cache:%w", err)
+		}
+	}
+
+	if inventoryAPIAddr != "" {
+		if err := setupInventoryAPI(mgr); err != nil {
+			return fmt.Errorf("unable to setup inventory API:%w", err)
+		}
+	}
+
+	if runtimeExtensionPort > 0 {
+		if err := (&controllers.RuntimeExtension{
+			Client:           mgr.GetClient(),
+			LegacyOwnerships: legacyOwnerships,
+		}).SetupWithManager(mgr, runtimeserver.Options{Port: runtimeExtensionPort, CertDir: webhookCertDir}); err != nil {
+			return fmt.Errorf("unable to setup runtime extension:%w", err)
+		}
+	}
+
+	return nil
+}
+
+// setupHardwareOwnershipMigration adds the migrator of legacy Hardware ownership markers to the
+// manager. It migrates Hardware on the leader once it's elected, then again every interval if one
+// is set. The reconcilers don't select Hardware before the first migration succeeded.
+//
+//nolint:lll
+func setupHardwareOwnershipMigration(mgr ctrl.Manager, ownerships []controllers.LegacyOwnership) (*controllers.HardwareOwnershipMigrator, error) {
+	migrator := &controllers.HardwareOwnershipMigrator{
+		Client:      mgr.GetClient(),
+		Ownerships:  ownerships,
+		OwnedStates: legacyHardwareOwnedStates,
+		Interval:    hardwareOwnershipMigration,
+	}
+
+	if err := migrator.SetupWithManager(mgr); err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	return migrator, nil
+}
+
+// legacyHardwareOwnerships parses the values of --legacy-hardware-owner-label.
+func legacyHardwareOwnerships(values []string) ([]controllers.LegacyOwnership, error) {
+	ownerships := []controllers.LegacyOwnership{}
+
+	for _, value := range values {
+		ownership, err := controllers.ParseLegacyOwnership(value)
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		ownerships = append(ownerships, ownership)
+	}
+
+	return ownerships, nil
+}
+
+// ErrMissingImageCacheAllowedHosts is returned when the image cache is enabled without allowed hosts.
+var ErrMissingImageCacheAllowedHosts = fmt.Errorf("image cache requires --image-cache-allowed-hosts")
+
+func setupImageCache(mgr ctrl.Manager) error {
+	if len(imageCacheAllowedHosts) == 0 {
+		return ErrMissingImageCacheAllowedHosts
+	}
+
+	maxSize, err := resource.ParseQuantity(imageCacheMaxSize)
+	if err != nil {
+		return fmt.Errorf("parsing image cache max size: %w", err)
+	}
+
+	cache, err := imagecache.New(imagecache.Options{
+		Dir:             imageCacheDir,
+		MaxBytes:        maxSize.Value(),
+		AllowedHosts:    imageCacheAllowedHosts,
+		RequireChecksum: imageCacheRequireChecksum,
+		DownloadTimeout: imageCacheDownloadTimeout,
+	})
+	if err != nil {
+		return fmt.Errorf("creating image cache: %w", err)
+	}
+
+	if err := mgr.Add(&imagecache.Server{Addr: imageCacheAddr, Cache: cache}); err != nil {
+		return fmt.Errorf("adding image cache to manager: %w", err)
+	}
+
+	return nil
+}
+
+// ErrEmptyInventoryAPIToken is returned when the inventory API token file holds no token.
+var ErrEmptyInventoryAPIToken = fmt.Errorf("inventory API token file is empty")
+
+func setupInventoryAPI(mgr ctrl.Manager) error {
+	token, err := os.ReadFile(inventoryAPITokenFile)
+	if err != nil {
+		return fmt.Errorf("reading inventory API token: %w", err)
+	}
+
+	if len(bytes.TrimSpace(token)) == 0 {
+		return ErrEmptyInventoryAPIToken
+	}
+
+	handler := inventoryapi.NewHandler(mgr.GetClient(), controllers.NewCachingStackClientGetter(mgr.GetScheme()),
+		string(bytes.TrimSpace(token)))
+
+	server := &inventoryapi.Server{
+		Addr:     inventoryAPIAddr,
+		Handler:  handler,
+		CertFile: inventoryAPICertFile,
+		KeyFile:  inventoryAPIKeyFile,
+		Insecure: inventoryAPIInsecure,
+	}
+
+	if err := mgr.Add(server); err != nil {
+		return fmt.Errorf("adding inventory API to manager: %w", err)
+	}
+
 	return nil
 }
 
@@ -250,6 +608,24 @@ func setupWebhooks(mgr ctrl.Manager) error {
 }
 
 func main() { //nolint:funlen
+	if len(os.Args) > 1 && os.Args[1] == supportBundleCommand {
+		if err := runSupportBundle(ctrl.SetupSignalHandler(), os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == whatIfCommand {
+		if err := runWhatIf(ctrl.SetupSignalHandler(), os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	initFlags(pflag.CommandLine)
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
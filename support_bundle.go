@@ -0,0 +1,107 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/controllers"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/internal/supportbundle"
+)
+
+const supportBundleCommand = "support-bundle"
+
+// runSupportBundle collects a support bundle for a cluster or machine into a tarball.
+func runSupportBundle(ctx context.Context, args []string) error {
+	var (
+		opts     supportbundle.Options
+		output   string
+		logLines int64
+	)
+
+	fs := pflag.NewFlagSet(supportBundleCommand, pflag.ExitOnError)
+	fs.StringVarP(&opts.Namespace, "namespace", "n", "default", "Namespace of the cluster or machine")
+	fs.StringVar(&opts.ClusterName, "cluster", "", "Name of the CAPI Cluster to collect")
+	fs.StringVar(&opts.MachineName, "machine", "", "Name of a single TinkerbellMachine to collect")
+	fs.StringVar(&opts.ManagerNamespace, "manager-namespace", "capt-system", "Namespace of the CAPT manager pods")
+	fs.StringVar(&opts.ManagerSelector, "manager-selector", "control-plane=controller-manager",
+		"Label selector of the CAPT manager pods")
+	fs.Int64Var(&logLines, "log-lines", 10000, "Number of manager log lines to collect per container") //nolint:gomnd
+	fs.StringVarP(&output, "output", "o",
+		fmt.Sprintf("capt-support-bundle-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z")),
+		"Path of the tarball to write")
+	fs.AddGoFlagSet(flag.CommandLine)
+
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("parsing flags: %w", err)
+	}
+
+	config, err := ctrl.GetConfig()
+	if err != nil {
+		return fmt.Errorf("getting kubeconfig: %w", err)
+	}
+
+	c, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return fmt.Errorf("creating client: %w", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("creating clientset: %w", err)
+	}
+
+	collector := &supportbundle.Collector{
+		Client:            c,
+		StackClientGetter: controllers.NewCachingStackClientGetter(scheme),
+		PodLogs: func(ctx context.Context, namespace, pod, container string) ([]byte, error) {
+			return clientset.CoreV1().Pods(namespace).GetLogs(pod, &corev1.PodLogOptions{ //nolint:wrapcheck
+				Container: container,
+				TailLines: &logLines,
+			}).DoRaw(ctx)
+		},
+	}
+
+	bundle, err := collector.Collect(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("collecting support bundle: %w", err)
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", output, err)
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	if err := bundle.Write(f); err != nil {
+		return fmt.Errorf("writing %s: %w", output, err)
+	}
+
+	fmt.Printf("Support bundle written to %s\n", output) //nolint:forbidigo
+
+	return nil
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2022 The Tinkerbell Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/pflag"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrastructurev1 "github.com/tinkerbell/cluster-api-provider-tinkerbell/api/v1beta1"
+	"github.com/tinkerbell/cluster-api-provider-tinkerbell/controllers"
+)
+
+const whatIfCommand = "what-if"
+
+// ErrInvalidOutputFormat is returned for an unknown what-if output format.
+var ErrInvalidOutputFormat = fmt.Errorf("output format must be text or json")
+
+// ErrNoTinkerbellCluster is returned for a Cluster whose infrastructure isn't a TinkerbellCluster.
+var ErrNoTinkerbellCluster = fmt.Errorf("cluster has no TinkerbellCluster")
+
+// runWhatIf prints the Hardware new machines from a TinkerbellMachineTemplate would be provisioned
+// on, or how many machines there would be no Hardware for.
+func runWhatIf(ctx context.Context, args []string) error {
+	var (
+		namespace         string
+		templateName      string
+		hardwareNamespace string
+		replicas          int
+		output            string
+		legacyOwnerLabels []string
+		clusterName       string
+		replacements      bool
+	)
+
+	fs := pflag.NewFlagSet(whatIfCommand, pflag.ExitOnError)
+	fs.StringVarP(&namespace, "namespace", "n", "default", "Namespace of the TinkerbellMachineTemplate")
+	fs.StringVar(&templateName, "template", "", "Name of the TinkerbellMachineTemplate the machines are created from")
+	fs.StringVar(&hardwareNamespace, "hardware-namespace", "", "Only consider Hardware in this namespace")
+	fs.IntVar(&replicas, "replicas", 1, "Number of machines to simulate")
+	fs.StringVar(&clusterName, "cluster", "",
+		"Cluster in the namespace the machines belong to, whose topology exclusivity and remediation reserve apply")
+	fs.BoolVar(&replacements, "replacements", false,
+		"Simulate replacements of remediated machines, which take Hardware from the remediation reserve first")
+	fs.StringVarP(&output, "output", "o", "text", "Output format, text or json")
+	fs.StringArrayVar(&legacyOwnerLabels, "legacy-hardware-owner-label", nil,
+		"Hardware label of a legacy ownership as given to the controller. Hardware carrying it is not selected (repeatable)")
+	fs.AddGoFlagSet(flag.CommandLine)
+
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("parsing flags: %w", err)
+	}
+
+	if output != "text" && output != "json" {
+		return ErrInvalidOutputFormat
+	}
+
+	legacyOwnerships, err := legacyHardwareOwnerships(legacyOwnerLabels)
+	if err != nil {
+		return err
+	}
+
+	config, err := ctrl.GetConfig()
+	if err != nil {
+		return fmt.Errorf("getting kubeconfig: %w", err)
+	}
+
+	c, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return fmt.Errorf("creating client: %w", err)
+	}
+
+	template := &infrastructurev1.TinkerbellMachineTemplate{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: templateName}, template); err != nil {
+		return fmt.Errorf("getting TinkerbellMachineTemplate: %w", err)
+	}
+
+	selector := &controllers.HardwareSelector{Client: c, LegacyOwnerships: legacyOwnerships}
+	if hardwareNamespace != "" {
+		selector.ListOptions = append(selector.ListOptions, client.InNamespace(hardwareNamespace))
+	}
+
+	if clusterName != "" {
+		if selector.TinkerbellCluster, err = tinkerbellClusterOf(ctx, c, namespace, clusterName); err != nil {
+			return err
+		}
+
+		selector.ClusterName = clusterName
+	}
+
+	simulation, err := controllers.SimulateAllocation(ctx, selector, template, replicas, replacements)
+	if err != nil {
+		return fmt.Errorf("simulating allocation: %w", err)
+	}
+
+	if output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(simulation) //nolint:wrapcheck
+	}
+
+	printSimulation(os.Stdout, simulation)
+
+	return nil
+}
+
+// tinkerbellClusterOf returns the TinkerbellCluster of the Cluster.
+func tinkerbellClusterOf(ctx context.Context, c client.Client, namespace, clusterName string,
+) (*infrastructurev1.TinkerbellCluster, error) {
+	cluster := &clusterv1.Cluster{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: clusterName}, cluster); err != nil {
+		return nil, fmt.Errorf("getting Cluster: %w", err)
+	}
+
+	ref := cluster.Spec.InfrastructureRef
+	if ref == nil || ref.Kind != "TinkerbellCluster" {
+		return nil, fmt.Errorf("%w: %s", ErrNoTinkerbellCluster, clusterName)
+	}
+
+	tinkerbellCluster := &infrastructurev1.TinkerbellCluster{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: ref.Name}, tinkerbellCluster); err != nil {
+		return nil, fmt.Errorf("getting TinkerbellCluster: %w", err)
+	}
+
+	return tinkerbellCluster, nil
+}
+
+func printSimulation(w io.Writer, simulation *controllers.AllocationSimulation) {
+	for i, hardware := range simulation.Selected {
+		fmt.Fprintf(w, "machine %d: %s\n", i+1, hardware)
+	}
+
+	if simulation.Shortfall > 0 {
+		fmt.Fprintf(w, "shortfall: no Hardware available for %d of %d machines\n", simulation.Shortfall, simulation.Requested)
+
+		return
+	}
+
+	fmt.Fprintf(w, "all %d machines can be allocated\n", simulation.Requested)
+}